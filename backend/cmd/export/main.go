@@ -0,0 +1,74 @@
+// Command export writes the history of a symbol to a CSV or Parquet file, the same export served by the
+// /admin/export/{symbol} endpoint.
+//
+//	go run ./cmd/export -symbol AAPL -dataset trades -from 2024-01-02T00:00:00Z -to 2024-01-03T00:00:00Z -format parquet
+package main
+
+import (
+	"context"
+	"flag"
+	"github/wry-0313/exchange/db"
+	"github/wry-0313/exchange/internal/config"
+	"github/wry-0313/exchange/internal/export"
+	"github/wry-0313/exchange/internal/orderbook"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	var (
+		symbol   = flag.String("symbol", "", "symbol to export")
+		dataset  = flag.String("dataset", "", "one of candles, trades, order_events")
+		format   = flag.String("format", "csv", "csv or parquet")
+		interval = flag.String("interval", "", "candle interval, one of 1s, 1m, 5m, 1h, 1d (default 1s)")
+		from     = flag.String("from", "", "start of the range, RFC 3339 or unix seconds")
+		to       = flag.String("to", "", "end of the range, RFC 3339 or unix seconds (default now)")
+		out      = flag.String("out", "", "file to write, - for stdout (default <symbol>_<dataset>_<from>_<to>.<format>)")
+		envFile  = flag.String("env", ".env", "config file")
+	)
+	flag.Parse()
+
+	req, err := export.ParseRequest(*symbol, *dataset, *format, *interval, *from, *to)
+	if err != nil {
+		flag.Usage()
+		log.Fatalf("Invalid export: %v", err)
+	}
+
+	cfg, err := config.Load(*envFile)
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+	db, err := db.New(cfg.DB)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
+	}
+	defer db.DB.Close()
+
+	var w io.Writer = os.Stdout
+	filename := *out
+	if filename == "" {
+		filename = req.Filename()
+	}
+	if filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			log.Fatalf("Could not create %s: %v", filename, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exportService := export.NewService(orderbook.NewRepository(db.DB))
+	if err := exportService.Export(ctx, w, req); err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	if filename != "-" {
+		log.Printf("Exported %s %s to %s", req.Symbol, req.Dataset, filename)
+	}
+}
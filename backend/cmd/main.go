@@ -3,14 +3,22 @@ package main
 import (
 	"context"
 	"github/wry-0313/exchange/db"
+	"github/wry-0313/exchange/internal/admin"
+	"github/wry-0313/exchange/internal/apikey"
 	"github/wry-0313/exchange/internal/auth"
+	"github/wry-0313/exchange/internal/bus"
 	"github/wry-0313/exchange/internal/config"
 	"github/wry-0313/exchange/internal/endpoint"
 	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/export"
+	"github/wry-0313/exchange/internal/funding"
 	"github/wry-0313/exchange/internal/jwt"
+	"github/wry-0313/exchange/internal/mail"
+	"github/wry-0313/exchange/internal/margin"
 	"github/wry-0313/exchange/internal/middleware"
 	"github/wry-0313/exchange/internal/models"
 	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/internal/portfolio"
 	"github/wry-0313/exchange/internal/redis"
 	"github/wry-0313/exchange/internal/user"
 	ws "github/wry-0313/exchange/internal/websocket"
@@ -25,6 +33,8 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 
 	validator := validator.New()
@@ -41,17 +51,19 @@ func main() {
 
 	// Setup server
 	mux := chi.NewRouter()
-	r, exchangeService := setupHandlerAndService(mux, db, validator, cfg)
+	r, exchangeService, portfolioService, marginService, websocket := setupHandlerAndService(mux, db, validator, cfg)
 	server := http.Server{
 		Addr:    cfg.ServerPort,
 		Handler: r,
 	}
 
-	exchangeService.Run(cfg.KafkaBrokers)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	exchangeService.Run(ctx)
+	portfolioService.Run(ctx)
+	marginService.Run(ctx)
+	websocket.Run(ctx)
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -59,16 +71,22 @@ func main() {
 		}
 	}()
 
-	<-stop
-
-	exchangeService.ShutdownConsumers() // First shut down kafka consumers
+	<-ctx.Done()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Graceful shutdown. Intake stops first so that nothing new enters the pipeline while it drains, requests
+	// already waiting on the engine still get their result since the consumers are running until after.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced shutdown: %s", err)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server forced shutdown: %s", err)
 	}
-
+	if err := websocket.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WebSocket forced shutdown: %s", err)
+	}
+	if err := exchangeService.Shutdown(shutdownCtx); err != nil {
+		log.Fatalf("Exchange forced shutdown: %s", err)
+	}
+	log.Println("Shutdown complete")
 }
 
 // setupHandlerAndService sets up all the middleware and API routes for the server. It will also return certain services that require additional instructions.
@@ -77,45 +95,92 @@ func setupHandlerAndService(
 	db *db.DB,
 	v validator.Validate,
 	cfg *config.Config,
-) (chi.Router, exchange.Service) {
+) (chi.Router, exchange.Service, portfolio.Service, margin.Service, *ws.WebSocket) {
 	// Set up middleware
 	r.Use(middleware.Cors())
 
 	// Set up repositories
 	userRepo := user.NewRepository(db.DB)
 	obRepo := orderbook.NewRepository(db.DB)
+	exchangeRepo := exchange.NewRepository(db.DB)
+	authRepo := auth.NewRepository(db.DB)
+	apiKeyRepo := apikey.NewRepository(db.DB)
+	adminRepo := admin.NewRepository(db.DB)
+	fundingRepo := funding.NewRepository(db.DB)
+	portfolioRepo := portfolio.NewRepository(db.DB)
+	marginRepo := margin.NewRepository(db.DB)
+
+	rdb := redis.NewRedis(cfg.Rdb)
 
 	// Set up services
-	jwtService := jwt.NewService(cfg.JwtSecret, cfg.JwtExpiration)
-	authService := auth.NewService(userRepo, jwtService, v)
-	userService := user.NewService(userRepo, v)
+	revocations := auth.NewRevocationList(rdb, time.Duration(cfg.JwtExpiration)*time.Hour)
+	jwtService := jwt.NewService(cfg.JwtSecret, cfg.JwtExpiration, revocations)
+	authService := auth.NewService(userRepo, authRepo, jwtService, revocations, v, cfg.RefreshTokenExpiration)
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Could not create mailer: %v", err)
+	}
+	userService := user.NewService(userRepo, v, mailer, revocations, cfg.AppURL)
+	apiKeyService := apikey.NewService(apiKeyRepo, apikey.NewNonceStore(rdb), v, cfg.APIKeyEncryptionKey)
 
+	if err := orderbook.InitializeLogService("orderbook_log.txt"); err != nil {
+		log.Fatalf("Could not initialize log service: %v", err)
+	}
 	obServices := make(map[string]orderbook.Service)
 
-	rdb := redis.NewRedis(cfg.Rdb)
-	obServices["AAPL"] = orderbook.NewService("AAPL", obRepo, rdb)
-
-	exchangeService := exchange.NewService(userRepo, obServices, v, cfg.KafkaBrokers)
+	obServices["AAPL"] = orderbook.NewService("AAPL", obRepo, rdb, cfg.SnapshotDir, cfg.DeadLetterFile)
 
+	messageBus, err := bus.New(cfg)
+	if err != nil {
+		log.Fatalf("Could not create message bus: %v", err)
+	}
+	exchangeService := exchange.NewService(exchangeRepo, userRepo, obRepo, obServices, v, messageBus, rdb)
+	exportService := export.NewService(obRepo)
+	adminService := admin.NewService(adminRepo, userRepo, exchangeService, revocations, v)
+	fundingService := funding.NewService(fundingRepo, obServices, v)
+	portfolioService := portfolio.NewService(portfolioRepo, obServices, rdb)
+	for _, ob := range obServices {
+		ob.OnFillsPersisted(portfolioService.NotifyFills)
+	}
+	marginService := margin.NewService(marginRepo, portfolioService, obServices, v, rdb, cfg.Margin)
+	if cfg.RequireVerifiedEmail {
+		exchangeService.AddRiskCheck(exchange.NewEmailVerificationCheck(userRepo))
+	}
+	exchangeService.AddRiskCheck(marginService)
 
 	// Set up API
 	userAPI := user.NewAPI(userService, jwtService, v)
 	authAPI := auth.NewAPI(authService, v)
+	apiKeyAPI := apikey.NewAPI(apiKeyService)
+	adminAPI := admin.NewAPI(adminService)
+	fundingAPI := funding.NewAPI(fundingService)
+	portfolioAPI := portfolio.NewAPI(portfolioService)
+	marginAPI := margin.NewAPI(marginService)
 	exchangeAPI := exchange.NewAPI(exchangeService)
-	websocket := ws.NewWebSocket(exchangeService, rdb)
+	exportAPI := export.NewAPI(exportService)
+	websocket := ws.NewWebSocket(exchangeService, rdb, jwtService, cfg.WSAllowedOrigins)
 
 	// Set up auth handler
 	authHandler := middleware.Auth(jwtService)
+	apiKeyHandler := middleware.APIKey(apiKeyService, authHandler)
+	tradeHandler := middleware.Trading()
+	adminHandler := middleware.Admin(cfg.AdminAPIKey, authHandler)
 
 	// Register handlers
-	userAPI.RegisterHandlers(r, authHandler)
-	authAPI.RegisterHandlers(r)
-	exchangeAPI.RegisterHandlers(r, authHandler)
-	websocket.RegisterHandlers(r)
+	userAPI.RegisterHandlers(r, authHandler, apiKeyHandler)
+	authAPI.RegisterHandlers(r, authHandler)
+	apiKeyAPI.RegisterHandlers(r, authHandler)
+	exchangeAPI.RegisterHandlers(r, apiKeyHandler, tradeHandler, adminHandler)
+	adminAPI.RegisterHandlers(r, adminHandler)
+	fundingAPI.RegisterHandlers(r, apiKeyHandler, adminHandler)
+	portfolioAPI.RegisterHandlers(r, apiKeyHandler)
+	marginAPI.RegisterHandlers(r, apiKeyHandler, tradeHandler)
+	exportAPI.RegisterHandlers(r, adminHandler)
+	websocket.RegisterHandlers(r, adminHandler)
 
 	r.Get("/ping", handlePingCheck)
 
-	return r, exchangeService
+	return r, exchangeService, portfolioService, marginService, websocket
 }
 
 func handlePingCheck(w http.ResponseWriter, _ *http.Request) {
@@ -7,45 +7,105 @@ CREATE TABLE IF NOT EXISTS users (
     email VARCHAR(255) UNIQUE,
     password VARCHAR(255),
     cash_balance DECIMAL(10, 2) NOT NULL DEFAULT 100000,
+    role ENUM('trader', 'market_maker', 'admin', 'read_only') NOT NULL DEFAULT 'trader',
+    account_type ENUM('cash', 'margin') NOT NULL DEFAULT 'cash', -- only margin accounts can sell short
+    email_verified_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS stocks (
-    symbol VARCHAR(10) UNIQUE PRIMARY KEY NOT NULL
+    symbol VARCHAR(10) UNIQUE PRIMARY KEY NOT NULL,
+    halted BOOLEAN NOT NULL DEFAULT FALSE -- halted stocks accept no new orders
 );
 
 CREATE TABLE if NOT EXISTS stock_history (
     symbol VARCHAR(10) NOT NULL,
+    bar_interval VARCHAR(3) NOT NULL DEFAULT '1s',
     open DECIMAL(10, 2) NOT NULL,
     high DECIMAL(10, 2) NOT NULL,
     low DECIMAL(10, 2) NOT NULL,
     close DECIMAL(10, 2) NOT NULL,
-    bid_volume DECIMAL(10, 2) NOT NULL,
-    ask_volume DECIMAL(10, 2) NOT NULL,
+    volume DECIMAL(20, 2) NOT NULL DEFAULT 0,
+    trade_count INT NOT NULL DEFAULT 0,
+    bid_volume DECIMAL(20, 2) NOT NULL,
+    ask_volume DECIMAL(20, 2) NOT NULL,
     recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (symbol) REFERENCES stocks(symbol),
-    INDEX idx_stock_time(symbol, recorded_at DESC)
+    UNIQUE KEY uq_stock_interval_time (symbol, bar_interval, recorded_at)
 );
 
 CREATE TABLE if NOT EXISTS orders (
     order_id VARCHAR(26) PRIMARY KEY,
     user_id VARCHAR(26) NOT NULL,
+    client_order_id VARCHAR(64), -- optional ID chosen by the client, unique per user
     symbol VARCHAR(10) NOT NULL,
     order_side ENUM('Buy', 'Sell') NOT NULL,
-    order_status ENUM('Open', 'Filled', 'PartiallyFilled', 'Rejected') NOT NULL,
+    order_status ENUM('Open', 'Filled', 'PartiallyFilled', 'Rejected', 'Cancelled') NOT NULL,
+    reject_reason VARCHAR(255),
     order_type ENUM('Market', 'Limit') NOT NULL,
     filled_at DECIMAL(10, 2),
+    last_filled_at TIMESTAMP(6) NULL,
     total_processed DECIMAL(10, 2) DEFAULT 0,
     volume DECIMAL(10, 2) NOT NULL,
     initial_volume DECIMAL(10, 2) NOT NULL,
     price DECIMAL(10, 2) NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_user_client_order (user_id, client_order_id),
+    INDEX idx_orders_status(order_status, order_id),
+    INDEX idx_orders_user(user_id, order_id),
     FOREIGN KEY (user_id) REFERENCES users(user_id),
     FOREIGN KEY (symbol) REFERENCES stocks(symbol)
 );
 
+-- Every match between two orders, the aggressor is the side of the incoming order
+CREATE TABLE IF NOT EXISTS trades (
+    trade_id VARCHAR(26) PRIMARY KEY,
+    symbol VARCHAR(10) NOT NULL,
+    price DECIMAL(10, 2) NOT NULL,
+    volume DECIMAL(10, 2) NOT NULL,
+    aggressor_side ENUM('Buy', 'Sell') NOT NULL,
+    buy_order_id VARCHAR(26) NOT NULL,
+    sell_order_id VARCHAR(26) NOT NULL,
+    executed_at TIMESTAMP(6) NOT NULL,
+    FOREIGN KEY (symbol) REFERENCES stocks(symbol),
+    INDEX idx_trades_symbol_time(symbol, executed_at, trade_id)
+);
+
+-- Every change to an order: its creation or rejection, each fill and its cancellation
+CREATE TABLE IF NOT EXISTS order_events (
+    event_id VARCHAR(26) PRIMARY KEY,
+    order_id VARCHAR(26) NOT NULL,
+    user_id VARCHAR(26) NOT NULL,
+    symbol VARCHAR(10) NOT NULL,
+    event_type ENUM('Created', 'Rejected', 'Filled', 'Cancelled', 'Amended') NOT NULL,
+    order_side ENUM('Buy', 'Sell') NOT NULL,
+    order_status ENUM('Open', 'Filled', 'PartiallyFilled', 'Rejected', 'Cancelled') NOT NULL,
+    price DECIMAL(10, 2) NOT NULL, -- limit price when created, fill price when filled
+    volume DECIMAL(10, 2) NOT NULL, -- volume left on the order after the event
+    filled_volume DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    occurred_at TIMESTAMP(6) NOT NULL,
+    FOREIGN KEY (symbol) REFERENCES stocks(symbol),
+    INDEX idx_order_events_symbol_time(symbol, occurred_at, event_id),
+    INDEX idx_order_events_order(order_id, occurred_at)
+);
+
+-- Order commands the consumer could not apply, see the admin dead-letter endpoints
+CREATE TABLE IF NOT EXISTS dead_letters (
+    dead_letter_id VARCHAR(26) PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    message_key VARCHAR(255) NOT NULL,
+    message_partition INT NOT NULL,
+    message_offset BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    reason VARCHAR(512) NOT NULL,
+    failed_at TIMESTAMP NOT NULL,
+    replayed_at TIMESTAMP NULL,
+    replay_order_id VARCHAR(26), -- the fresh order ID a replayed order was placed under
+    INDEX idx_dead_letters_failed_at(failed_at DESC)
+);
+
 CREATE TABLE if NOT EXISTS holdings (
     user_id VARCHAR(26) NOT NULL,
     symbol VARCHAR(10) NOT NULL,
@@ -57,6 +117,128 @@ CREATE TABLE if NOT EXISTS holdings (
     FOREIGN KEY (symbol) REFERENCES stocks(symbol)
 );
 
+-- Refresh tokens, by the SHA-256 hash of the token. Each login starts a family, every refresh uses up a token
+-- and adds its replacement, presenting a used token again revokes the whole family.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_id VARCHAR(26) PRIMARY KEY,
+    family_id VARCHAR(26) NOT NULL,
+    user_id VARCHAR(26) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    replaced_by VARCHAR(26),
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    INDEX idx_refresh_tokens_family(family_id)
+);
+
+-- Single-use tokens mailed to users to verify their email address or reset their password, by the SHA-256 hash
+-- of the token.
+CREATE TABLE IF NOT EXISTS verifications (
+    verification_id VARCHAR(26) PRIMARY KEY,
+    user_id VARCHAR(26) NOT NULL,
+    purpose ENUM('email', 'password_reset') NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    INDEX idx_verifications_user(user_id, purpose)
+);
+
+-- API keys for programmatic access. Requests are signed with the secret, so it's stored encrypted rather than
+-- hashed.
+CREATE TABLE IF NOT EXISTS api_keys (
+    key_id VARCHAR(26) PRIMARY KEY,
+    user_id VARCHAR(26) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    secret VARBINARY(128) NOT NULL,
+    scopes SET('read', 'trade', 'withdraw') NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    INDEX idx_api_keys_user(user_id, created_at)
+);
+
+-- Changes admins made to users' cash balances. admin_id is empty when the change was made with the admin key.
+CREATE TABLE IF NOT EXISTS balance_adjustments (
+    adjustment_id VARCHAR(26) PRIMARY KEY,
+    user_id VARCHAR(26) NOT NULL,
+    admin_id VARCHAR(26),
+    amount DECIMAL(10, 2) NOT NULL,
+    balance_after DECIMAL(10, 2) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    INDEX idx_balance_adjustments_user(user_id, created_at)
+);
+
+-- Cash moving into, out of and within the exchange. Withdrawals and internal transfers leave the sender's balance
+-- when requested, deposits are credited once approved.
+CREATE TABLE IF NOT EXISTS transfers (
+    transfer_id VARCHAR(26) PRIMARY KEY,
+    transfer_type ENUM('Deposit', 'Withdrawal', 'Transfer') NOT NULL,
+    transfer_status ENUM('Pending', 'Approved', 'Rejected') NOT NULL,
+    user_id VARCHAR(26) NOT NULL, -- who requested it, the sender of internal transfers
+    counterparty_id VARCHAR(26), -- the recipient of internal transfers
+    amount DECIMAL(10, 2) NOT NULL,
+    note VARCHAR(255) NOT NULL DEFAULT '',
+    reject_reason VARCHAR(255),
+    reviewed_by VARCHAR(26),
+    created_at TIMESTAMP(6) NOT NULL,
+    reviewed_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (counterparty_id) REFERENCES users(user_id),
+    INDEX idx_transfers_user(user_id, transfer_id),
+    INDEX idx_transfers_counterparty(counterparty_id, transfer_id),
+    INDEX idx_transfers_status(transfer_status, transfer_id)
+);
+
+-- Each user's position in a symbol at average cost, updated with the holdings as fills are applied. Unlike holdings
+-- the row is kept once the position is closed so that its realized P&L isn't lost.
+CREATE TABLE IF NOT EXISTS positions (
+    user_id VARCHAR(26) NOT NULL,
+    symbol VARCHAR(10) NOT NULL,
+    volume DECIMAL(10, 2) NOT NULL, -- negative for a short position
+    avg_cost DECIMAL(20, 6) NOT NULL,
+    realized_pnl DECIMAL(20, 6) NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, symbol),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (symbol) REFERENCES stocks(symbol)
+);
+
+-- Each user's equity at the end of a day (UTC), valued at the market prices of the time
+CREATE TABLE IF NOT EXISTS equity_snapshots (
+    user_id VARCHAR(26) NOT NULL,
+    snapshot_date DATE NOT NULL,
+    cash_balance DECIMAL(20, 2) NOT NULL,
+    market_value DECIMAL(20, 2) NOT NULL,
+    equity DECIMAL(20, 2) NOT NULL,
+    realized_pnl DECIMAL(20, 2) NOT NULL,
+    unrealized_pnl DECIMAL(20, 2) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, snapshot_date),
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+-- Shares located for short sales. A locate is good until the end of the day (UTC) it was made, short sales use up
+-- the remaining volume of the user's locates, soonest expiring first.
+CREATE TABLE IF NOT EXISTS locates (
+    locate_id VARCHAR(26) PRIMARY KEY,
+    user_id VARCHAR(26) NOT NULL,
+    symbol VARCHAR(10) NOT NULL,
+    volume DECIMAL(10, 2) NOT NULL,
+    remaining DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (symbol) REFERENCES stocks(symbol),
+    INDEX idx_locates_user(user_id, symbol, expires_at),
+    INDEX idx_locates_symbol(symbol, expires_at)
+);
+
 DELIMITER //
 CREATE PROCEDURE InsertOrUpdateHoldingThenDeleteZeroVolume(
     IN p_user_id VARCHAR(26), 
@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// ErrMsgInternalServer is a message displayed when an unexpected error occurs
+	ErrMsgInternalServer = "Internal server error"
+
+	errMsgInvalidLimit = "limit must be a positive integer"
+
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type API struct {
+	adminService Service
+}
+
+// NewAPI creates a new intance of the API struct.
+func NewAPI(adminService Service) API {
+	return API{
+		adminService: adminService,
+	}
+}
+
+// HandleGetUsers returns a page of users. The next page starts after the last user's ID, passed as ?after=.
+func (api *API) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+	users, err := api.adminService.GetUsers(r.URL.Query().Get("after"), limit)
+	if err != nil {
+		log.Printf("HandleGetUsers: Failed to get users due to internal server error: %v", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, users)
+}
+
+func (api *API) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	u, err := api.adminService.GetUser(chi.URLParam(r, "userID"))
+	if err != nil {
+		writeUserErr(w, "HandleGetUser", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, u)
+}
+
+// HandleUpdateUserRole changes a user's role.
+func (api *API) HandleUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	var input UpdateRoleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if err := api.adminService.UpdateUserRole(r.Context(), chi.URLParam(r, "userID"), input); err != nil {
+		if validator.IsValidationError(err) {
+			endpoint.WriteValidationErr(w, input, err)
+			return
+		}
+		writeUserErr(w, "HandleUpdateUserRole", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: "User role updated"})
+}
+
+// HandleAdjustBalance credits or debits a user's cash balance and returns the recorded adjustment.
+func (api *API) HandleAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	var input AdjustBalanceInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	adminID := middleware.UserIDFromContext(r.Context())
+	adj, err := api.adminService.AdjustBalance(adminID, chi.URLParam(r, "userID"), input)
+	if err != nil {
+		switch {
+		case validator.IsValidationError(err):
+			endpoint.WriteValidationErr(w, input, err)
+		case errors.Is(err, errZeroAmount):
+			endpoint.WriteWithError(w, http.StatusBadRequest, errZeroAmount.Error())
+		case errors.Is(err, ErrInsufficientBalance):
+			endpoint.WriteWithError(w, http.StatusConflict, ErrInsufficientBalance.Error())
+		default:
+			writeUserErr(w, "HandleAdjustBalance", err)
+		}
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, adj)
+}
+
+// HandleGetInstruments returns the ticker of every symbol, including whether trading is halted.
+func (api *API) HandleGetInstruments(w http.ResponseWriter, r *http.Request) {
+	endpoint.WriteWithStatus(w, http.StatusOK, api.adminService.GetInstruments())
+}
+
+// HandleHaltInstrument stops a symbol from accepting new orders.
+func (api *API) HandleHaltInstrument(w http.ResponseWriter, r *http.Request) {
+	api.setTradingHalted(w, r, true)
+}
+
+// HandleResumeInstrument lets a halted symbol accept orders again.
+func (api *API) HandleResumeInstrument(w http.ResponseWriter, r *http.Request) {
+	api.setTradingHalted(w, r, false)
+}
+
+func (api *API) setTradingHalted(w http.ResponseWriter, r *http.Request, halted bool) {
+	symbol := chi.URLParam(r, "symbol")
+	if err := api.adminService.SetTradingHalted(symbol, halted); err != nil {
+		if errors.Is(err, exchange.ErrInvalidSymbol) {
+			endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("setTradingHalted: Failed to set trading status of %s due to internal server error: %v", symbol, err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	msg := "Trading resumed"
+	if halted {
+		msg = "Trading halted"
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: msg})
+}
+
+// HandleGetOpenOrders returns a page of the open orders of every user, optionally of one ?symbol=. The next page
+// starts after the last order's ID, passed as ?after=.
+func (api *API) HandleGetOpenOrders(w http.ResponseWriter, r *http.Request) {
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	orders, err := api.adminService.GetOpenOrders(query.Get("symbol"), query.Get("after"), limit)
+	if err != nil {
+		log.Printf("HandleGetOpenOrders: Failed to get open orders due to internal server error: %v", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, orders)
+}
+
+// parseLimit reads the ?limit= page size, writing a Bad Request response when it is invalid.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := defaultPageLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidLimit)
+			return 0, false
+		}
+		limit = min(n, maxPageLimit)
+	}
+	return limit, true
+}
+
+func writeUserErr(w http.ResponseWriter, handler string, err error) {
+	if errors.Is(err, user.ErrUserNotFound) {
+		endpoint.WriteWithError(w, http.StatusNotFound, user.ErrUserNotFound.Error())
+		return
+	}
+	log.Printf("%s: Failed due to internal server error: %v", handler, err)
+	endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+}
+
+// RegisterHandlers registers the API's request handlers behind adminHandler.
+func (api *API) RegisterHandlers(r chi.Router, adminHandler func(http.Handler) http.Handler) {
+	r.Route("/admin/users", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/", api.HandleGetUsers)
+		r.Get("/{userID}", api.HandleGetUser)
+		r.Put("/{userID}/role", api.HandleUpdateUserRole)
+		r.Post("/{userID}/balance-adjustments", api.HandleAdjustBalance)
+	})
+	r.Route("/admin/instruments", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/", api.HandleGetInstruments)
+		r.Post("/{symbol}/halt", api.HandleHaltInstrument)
+		r.Post("/{symbol}/resume", api.HandleResumeInstrument)
+	})
+	r.With(adminHandler).Get("/admin/orders", api.HandleGetOpenOrders)
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/user"
+
+	"github.com/shopspring/decimal"
+)
+
+var ErrInsufficientBalance = errors.New("Adjustment would make the balance negative")
+
+type Repository interface {
+	// AdjustCashBalance applies an adjustment to the user's cash balance and records it, setting its BalanceAfter.
+	// It returns ErrInsufficientBalance if the balance would go below zero.
+	AdjustCashBalance(adj BalanceAdjustment) (BalanceAdjustment, error)
+	// GetOpenOrders returns up to limit open or partially filled orders ordered by ID, starting after the order
+	// with ID after. An empty symbol returns the orders of every symbol.
+	GetOpenOrders(symbol, after string, limit int) ([]OpenOrder, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func (r *repository) AdjustCashBalance(adj BalanceAdjustment) (BalanceAdjustment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	var balance decimal.Decimal
+	err = tx.QueryRow("SELECT cash_balance FROM users WHERE user_id = ? FOR UPDATE", adj.UserID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return BalanceAdjustment{}, user.ErrUserNotFound
+	}
+	if err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("repository: failed to get user cash balance: %w", err)
+	}
+	adj.BalanceAfter = balance.Add(adj.Amount)
+	if adj.BalanceAfter.IsNegative() {
+		return BalanceAdjustment{}, ErrInsufficientBalance
+	}
+
+	if _, err := tx.Exec("UPDATE users SET cash_balance = ? WHERE user_id = ?", adj.BalanceAfter, adj.UserID); err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("repository: failed to update user cash balance: %w", err)
+	}
+	adminID := sql.NullString{String: adj.AdminID, Valid: adj.AdminID != ""}
+	_, err = tx.Exec("INSERT INTO balance_adjustments (adjustment_id, user_id, admin_id, amount, balance_after, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		adj.ID, adj.UserID, adminID, adj.Amount, adj.BalanceAfter, adj.Reason, adj.CreatedAt)
+	if err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("repository: failed to record balance adjustment: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("repository: failed to commit balance adjustment: %w", err)
+	}
+	return adj, nil
+}
+
+func (r *repository) GetOpenOrders(symbol, after string, limit int) ([]OpenOrder, error) {
+	rows, err := r.db.Query(`SELECT user_id, symbol, order_id, client_order_id, order_side, order_status, order_type, filled_at, last_filled_at, total_processed, volume, initial_volume, price, created_at, updated_at
+		FROM orders WHERE order_status IN ('Open', 'PartiallyFilled') AND (? = '' OR symbol = ?) AND order_id > ? ORDER BY order_id LIMIT ?`,
+		symbol, symbol, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get open orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := []OpenOrder{}
+	for rows.Next() {
+		var o OpenOrder
+		err := rows.Scan(&o.UserID, &o.Symbol, &o.OrderID, &o.ClientOrderID, &o.OrderSide, &o.OrderStatus, &o.OrderType, &o.FilledAt, &o.FilledAtTime, &o.TotalProcessed, &o.Volume, &o.InitialVolume, &o.Price, &o.CreatedAt, &o.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("repository: failed to scan open order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get open orders: %w", err)
+	}
+	return orders, nil
+}
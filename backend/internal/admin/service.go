@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var errZeroAmount = errors.New("Amount must not be zero")
+
+// Service defines the admin service interface, for managing users and the market.
+type Service interface {
+	GetUsers(after string, limit int) ([]models.User, error)
+	GetUser(userID string) (models.User, error)
+	// UpdateUserRole changes a user's role and revokes the tokens issued with the old one, which closes the user's
+	// WebSocket connections. Refreshing a session issues a token with the new role.
+	UpdateUserRole(ctx context.Context, userID string, input UpdateRoleInput) error
+	// AdjustBalance credits or debits a user's cash balance on behalf of adminID, which is empty for the admin key.
+	AdjustBalance(adminID, userID string, input AdjustBalanceInput) (BalanceAdjustment, error)
+	// GetInstruments returns the ticker of every symbol, which includes whether it is halted.
+	GetInstruments() []orderbook.Ticker
+	SetTradingHalted(symbol string, halted bool) error
+	GetOpenOrders(symbol, after string, limit int) ([]OpenOrder, error)
+}
+
+type service struct {
+	repo            Repository
+	userRepo        user.Repository
+	exchangeService exchange.Service
+	revoker         user.SessionRevoker
+	validator       validator.Validate
+}
+
+// NewService creates a new instance of the admin service.
+func NewService(repo Repository, userRepo user.Repository, exchangeService exchange.Service, revoker user.SessionRevoker, validator validator.Validate) Service {
+	return &service{
+		repo:            repo,
+		userRepo:        userRepo,
+		exchangeService: exchangeService,
+		revoker:         revoker,
+		validator:       validator,
+	}
+}
+
+func (s *service) GetUsers(after string, limit int) ([]models.User, error) {
+	users, err := s.userRepo.GetUsers(after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get users: %w", err)
+	}
+	return users, nil
+}
+
+func (s *service) GetUser(userID string) (models.User, error) {
+	u, err := s.userRepo.GetUser(userID)
+	if err != nil {
+		return models.User{}, fmt.Errorf("service: failed to get user: %w", err)
+	}
+	// Hide password
+	u.Password = nil
+	return u, nil
+}
+
+func (s *service) UpdateUserRole(ctx context.Context, userID string, input UpdateRoleInput) error {
+	if err := s.validator.Struct(input); err != nil {
+		return err
+	}
+	if err := s.userRepo.UpdateUserRole(userID, input.Role); err != nil {
+		return fmt.Errorf("service: failed to update user role: %w", err)
+	}
+	log.Printf("Role of user %s changed to %s\n", userID, input.Role)
+	if err := s.revoker.RevokeUser(ctx, userID, time.Now()); err != nil {
+		return fmt.Errorf("service: failed to revoke tokens of the old role: %w", err)
+	}
+	return nil
+}
+
+func (s *service) AdjustBalance(adminID, userID string, input AdjustBalanceInput) (BalanceAdjustment, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return BalanceAdjustment{}, err
+	}
+	amount := input.Amount.Round(2)
+	if amount.IsZero() {
+		return BalanceAdjustment{}, errZeroAmount
+	}
+	adj, err := s.repo.AdjustCashBalance(BalanceAdjustment{
+		ID:        ulid.Make().String(),
+		UserID:    userID,
+		AdminID:   adminID,
+		Amount:    amount,
+		Reason:    input.Reason,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return BalanceAdjustment{}, fmt.Errorf("service: failed to adjust balance: %w", err)
+	}
+	return adj, nil
+}
+
+func (s *service) GetInstruments() []orderbook.Ticker {
+	return s.exchangeService.GetTickers()
+}
+
+func (s *service) SetTradingHalted(symbol string, halted bool) error {
+	return s.exchangeService.SetTradingHalted(symbol, halted)
+}
+
+func (s *service) GetOpenOrders(symbol, after string, limit int) ([]OpenOrder, error) {
+	orders, err := s.repo.GetOpenOrders(symbol, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get open orders: %w", err)
+	}
+	return orders, nil
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"context"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"testing"
+	"time"
+)
+
+// memUsers keeps the roles of users in memory.
+type memUsers struct {
+	user.Repository
+	roles map[string]models.Role
+}
+
+func (r memUsers) UpdateUserRole(userID string, role models.Role) error {
+	r.roles[userID] = role
+	return nil
+}
+
+// memRevoker records when each user's tokens were revoked.
+type memRevoker map[string]time.Time
+
+func (m memRevoker) RevokeUser(ctx context.Context, userID string, issuedBefore time.Time) error {
+	m[userID] = issuedBefore
+	return nil
+}
+
+func TestUpdateUserRoleRevokesTokens(t *testing.T) {
+	users, revoker := memUsers{roles: map[string]models.Role{}}, memRevoker{}
+	s := NewService(nil, users, nil, revoker, validator.New())
+
+	before := time.Now()
+	if err := s.UpdateUserRole(context.Background(), "user-1", UpdateRoleInput{Role: models.RoleReadOnly}); err != nil {
+		t.Fatal(err)
+	}
+	if users.roles["user-1"] != models.RoleReadOnly {
+		t.Fatalf("role = %s, want read_only", users.roles["user-1"])
+	}
+	if at, ok := revoker["user-1"]; !ok || at.Before(before) {
+		t.Fatalf("tokens of the old role were not revoked")
+	}
+}
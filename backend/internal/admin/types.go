@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"github/wry-0313/exchange/internal/models"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// UpdateRoleInput defines the structure for requests to change a user's role.
+type UpdateRoleInput struct {
+	Role models.Role `json:"role" validate:"required,oneof=trader market_maker admin read_only"`
+}
+
+// AdjustBalanceInput defines the structure for requests to credit or debit a user's cash balance. A negative
+// amount debits the balance.
+type AdjustBalanceInput struct {
+	Amount decimal.Decimal `json:"amount"`
+	Reason string          `json:"reason" validate:"required,max=255"`
+}
+
+// BalanceAdjustment is a change an admin made to a user's cash balance.
+type BalanceAdjustment struct {
+	ID           string          `json:"id"`
+	UserID       string          `json:"user_id"`
+	AdminID      string          `json:"admin_id,omitempty"` // empty when made with the admin key
+	Amount       decimal.Decimal `json:"amount"`
+	BalanceAfter decimal.Decimal `json:"balance_after"`
+	Reason       string          `json:"reason"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// OpenOrder is an order of any user that is still open.
+type OpenOrder struct {
+	models.Order
+	UserID string `json:"user_id"`
+}
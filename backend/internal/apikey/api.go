@@ -0,0 +1,96 @@
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// ErrMsgInternalServer is a message displayed when an unexpected error occurs
+	ErrMsgInternalServer = "Internal server error"
+)
+
+type API struct {
+	apiKeyService Service
+}
+
+// NewAPI creates a new intance of the API struct.
+func NewAPI(apiKeyService Service) API {
+	return API{
+		apiKeyService: apiKeyService,
+	}
+}
+
+// HandleCreateKey creates an API key for the user. The response holds the key's secret, which can't be
+// retrieved again.
+func (api *API) HandleCreateKey(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromContext(r.Context())
+
+	var input CreateKeyInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	dto, err := api.apiKeyService.CreateKey(userID, input)
+	if err != nil {
+		switch {
+		case validator.IsValidationError(err):
+			endpoint.WriteValidationErr(w, input, err)
+		case errors.Is(err, errDuplicateScope):
+			endpoint.WriteWithError(w, http.StatusBadRequest, errDuplicateScope.Error())
+		default:
+			log.Printf("HandleCreateKey: Failed to create API key due to internal server error: %v", err)
+			endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		}
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, dto)
+}
+
+// HandleGetKeys lists the user's API keys.
+func (api *API) HandleGetKeys(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromContext(r.Context())
+	keys, err := api.apiKeyService.GetUserKeys(userID)
+	if err != nil {
+		log.Printf("HandleGetKeys: Failed to get API keys due to internal server error: %v", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, keys)
+}
+
+// HandleRevokeKey revokes one of the user's API keys.
+func (api *API) HandleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromContext(r.Context())
+	if err := api.apiKeyService.RevokeKey(userID, chi.URLParam(r, "keyID")); err != nil {
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			endpoint.WriteWithError(w, http.StatusNotFound, ErrKeyNotFound.Error())
+		default:
+			log.Printf("HandleRevokeKey: Failed to revoke API key due to internal server error: %v", err)
+			endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		}
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: "API key revoked"})
+}
+
+// RegisterHandlers registers the API's request handlers. Keys are managed with a login token only, a key can't
+// be used to create or revoke keys.
+func (api *API) RegisterHandlers(r chi.Router, authHandler func(http.Handler) http.Handler) {
+	r.Route("/api-keys", func(r chi.Router) {
+		r.Use(authHandler)
+		r.Post("/", api.HandleCreateKey)
+		r.Get("/", api.HandleGetKeys)
+		r.Delete("/{keyID}", api.HandleRevokeKey)
+	})
+}
@@ -0,0 +1,34 @@
+package apikey
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const usedNonceKeyPrefix = "api_nonce:"
+
+// NonceStore remembers the nonces signed requests used so they can't be replayed.
+type NonceStore interface {
+	// Use records a key's nonce for ttl. It returns false if the nonce was already used.
+	Use(ctx context.Context, keyID, nonce string, ttl time.Duration) (bool, error)
+}
+
+type redisNonceStore struct {
+	rdb *redis.Client
+}
+
+// NewNonceStore creates a NonceStore that keeps nonces in Redis.
+func NewNonceStore(rdb *redis.Client) NonceStore {
+	return &redisNonceStore{rdb: rdb}
+}
+
+func (s *redisNonceStore) Use(ctx context.Context, keyID, nonce string, ttl time.Duration) (bool, error) {
+	ok, err := s.rdb.SetNX(ctx, usedNonceKeyPrefix+keyID+":"+nonce, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("apikey: failed to record nonce: %w", err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,101 @@
+package apikey
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("API key does not exist")
+
+type Repository interface {
+	CreateKey(key storedKey) error
+	// GetKey returns a key along with its user's role.
+	GetKey(keyID string) (storedKey, error)
+	GetUserKeys(userID string) ([]APIKey, error)
+	// RevokeKey revokes a user's key, it returns ErrKeyNotFound if the user has no such active key.
+	RevokeKey(userID, keyID string, revokedAt time.Time) error
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func (r *repository) CreateKey(key storedKey) error {
+	_, err := r.db.Exec(`INSERT INTO api_keys (key_id, user_id, name, secret, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		key.ID, key.UserID, key.Name, key.EncryptedSecret, strings.Join(key.Scopes, ","), key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository: failed to create API key: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetKey(keyID string) (storedKey, error) {
+	var key storedKey
+	var scopes string
+	err := r.db.QueryRow(`SELECT k.key_id, k.user_id, u.role, k.name, k.secret, k.scopes, k.created_at, k.revoked_at
+		FROM api_keys k JOIN users u ON u.user_id = k.user_id WHERE k.key_id = ?`, keyID).
+		Scan(&key.ID, &key.UserID, &key.Role, &key.Name, &key.EncryptedSecret, &scopes, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedKey{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return storedKey{}, fmt.Errorf("repository: failed to get API key: %w", err)
+	}
+	key.Scopes = splitScopes(scopes)
+	return key, nil
+}
+
+func (r *repository) GetUserKeys(userID string) ([]APIKey, error) {
+	rows, err := r.db.Query(`SELECT key_id, user_id, name, scopes, created_at, revoked_at FROM api_keys WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &scopes, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan API key: %w", err)
+		}
+		key.Scopes = splitScopes(scopes)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (r *repository) RevokeKey(userID, keyID string, revokedAt time.Time) error {
+	res, err := r.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE key_id = ? AND user_id = ? AND revoked_at IS NULL`, revokedAt, keyID, userID)
+	if err != nil {
+		return fmt.Errorf("repository: failed to revoke API key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("repository: failed to revoke API key: %w", err)
+	}
+	if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// splitScopes parses a MySQL SET value.
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
@@ -0,0 +1,170 @@
+package apikey
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/pkg/security"
+	"github/wry-0313/exchange/pkg/validator"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	errKeyRevoked     = errors.New("API key was revoked")
+	errBadSignature   = errors.New("signature does not match")
+	errBadTimestamp   = errors.New("timestamp is missing or outside the receive window")
+	errBadNonce       = errors.New("nonce is missing or too long")
+	errNonceUsed      = errors.New("nonce was already used")
+	errDuplicateScope = errors.New("Scopes must not repeat.")
+)
+
+const (
+	// secretBytes is the amount of randomness in an API key secret.
+	secretBytes = 32
+	// recvWindow is how far a signed request's timestamp may be from the server's clock.
+	recvWindow = 30 * time.Second
+	// maxNonceLength bounds the nonces clients may choose.
+	maxNonceLength = 64
+)
+
+// Service defines the API key service interface. It verifies requests for middleware.APIKey.
+type Service interface {
+	middleware.APIKeyVerifier
+	CreateKey(userID string, input CreateKeyInput) (CreateKeyDTO, error)
+	GetUserKeys(userID string) ([]APIKey, error)
+	RevokeKey(userID, keyID string) error
+}
+
+type service struct {
+	repo      Repository
+	nonces    NonceStore
+	validator validator.Validate
+	// encryptionKey encrypts secrets at rest. Unlike passwords they can't be hashed, verifying a signature needs
+	// the secret itself.
+	encryptionKey string
+}
+
+// NewService creates a new instance of the API key service. Secrets are stored encrypted with encryptionKey.
+func NewService(repo Repository, nonces NonceStore, validator validator.Validate, encryptionKey string) Service {
+	return &service{
+		repo:          repo,
+		nonces:        nonces,
+		validator:     validator,
+		encryptionKey: encryptionKey,
+	}
+}
+
+// CreateKey creates an API key for a user. The returned secret can't be retrieved again.
+func (s *service) CreateKey(userID string, input CreateKeyInput) (CreateKeyDTO, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return CreateKeyDTO{}, err
+	}
+	seen := make(map[string]bool, len(input.Scopes))
+	for _, scope := range input.Scopes {
+		if seen[scope] {
+			return CreateKeyDTO{}, errDuplicateScope
+		}
+		seen[scope] = true
+	}
+
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return CreateKeyDTO{}, fmt.Errorf("service: failed to generate API key secret: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	encrypted, err := security.Encrypt(s.encryptionKey, []byte(secret))
+	if err != nil {
+		return CreateKeyDTO{}, fmt.Errorf("service: failed to encrypt API key secret: %w", err)
+	}
+
+	key := APIKey{
+		ID:        ulid.Make().String(),
+		UserID:    userID,
+		Name:      input.Name,
+		Scopes:    input.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateKey(storedKey{APIKey: key, EncryptedSecret: encrypted}); err != nil {
+		return CreateKeyDTO{}, fmt.Errorf("service: failed to create API key: %w", err)
+	}
+	return CreateKeyDTO{APIKey: key, Secret: secret}, nil
+}
+
+// GetUserKeys returns a user's API keys, revoked ones included, without their secrets.
+func (s *service) GetUserKeys(userID string) ([]APIKey, error) {
+	keys, err := s.repo.GetUserKeys(userID)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeKey revokes one of a user's API keys, requests signed with it are rejected from then on.
+func (s *service) RevokeKey(userID, keyID string) error {
+	if err := s.repo.RevokeKey(userID, keyID, time.Now()); err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return ErrKeyNotFound
+		}
+		return fmt.Errorf("service: failed to revoke API key: %w", err)
+	}
+	return nil
+}
+
+// VerifyRequest checks a signed request. The signature is checked before the nonce is recorded, so requests from
+// clients without the secret can't use up nonces.
+func (s *service) VerifyRequest(ctx context.Context, req middleware.SignedRequest) (middleware.APIKeyIdentity, error) {
+	key, err := s.repo.GetKey(req.KeyID)
+	if err != nil {
+		return middleware.APIKeyIdentity{}, err
+	}
+	if key.RevokedAt != nil {
+		return middleware.APIKeyIdentity{}, errKeyRevoked
+	}
+
+	secret, err := security.Decrypt(s.encryptionKey, key.EncryptedSecret)
+	if err != nil {
+		return middleware.APIKeyIdentity{}, fmt.Errorf("service: failed to decrypt API key secret: %w", err)
+	}
+	given, err := hex.DecodeString(req.Signature)
+	if err != nil || !hmac.Equal(given, Sign(secret, req.Payload())) {
+		return middleware.APIKeyIdentity{}, errBadSignature
+	}
+
+	millis, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return middleware.APIKeyIdentity{}, errBadTimestamp
+	}
+	if skew := time.Since(time.UnixMilli(millis)); skew > recvWindow || skew < -recvWindow {
+		return middleware.APIKeyIdentity{}, errBadTimestamp
+	}
+	if req.Nonce == "" || len(req.Nonce) > maxNonceLength {
+		return middleware.APIKeyIdentity{}, errBadNonce
+	}
+	// A nonce only needs remembering while its timestamp is in the window, the window is on both sides of now
+	fresh, err := s.nonces.Use(ctx, key.ID, req.Nonce, 2*recvWindow)
+	if err != nil {
+		return middleware.APIKeyIdentity{}, err
+	}
+	if !fresh {
+		return middleware.APIKeyIdentity{}, errNonceUsed
+	}
+
+	return middleware.APIKeyIdentity{KeyID: key.ID, UserID: key.UserID, Role: key.Role, Scopes: key.Scopes}, nil
+}
+
+// Sign returns the HMAC-SHA256 of payload keyed with an API key secret. Clients send it hex encoded in the
+// X-API-Signature header.
+func Sign(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,142 @@
+package apikey
+
+import (
+	"context"
+	"encoding/hex"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/pkg/validator"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// memRepository is an in-memory Repository.
+type memRepository map[string]storedKey
+
+func (r memRepository) CreateKey(key storedKey) error {
+	r[key.ID] = key
+	return nil
+}
+
+func (r memRepository) GetKey(keyID string) (storedKey, error) {
+	key, ok := r[keyID]
+	if !ok {
+		return storedKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (r memRepository) GetUserKeys(userID string) ([]APIKey, error) {
+	keys := []APIKey{}
+	for _, key := range r {
+		if key.UserID == userID {
+			keys = append(keys, key.APIKey)
+		}
+	}
+	return keys, nil
+}
+
+func (r memRepository) RevokeKey(userID, keyID string, revokedAt time.Time) error {
+	key, ok := r[keyID]
+	if !ok || key.UserID != userID || key.RevokedAt != nil {
+		return ErrKeyNotFound
+	}
+	key.RevokedAt = &revokedAt
+	r[keyID] = key
+	return nil
+}
+
+// memNonces is an in-memory NonceStore that never forgets.
+type memNonces map[string]bool
+
+func (m memNonces) Use(ctx context.Context, keyID, nonce string, ttl time.Duration) (bool, error) {
+	if m[keyID+nonce] {
+		return false, nil
+	}
+	m[keyID+nonce] = true
+	return true, nil
+}
+
+// signedRequest builds a request signed with key at time at.
+func signedRequest(key CreateKeyDTO, method, uri, body, nonce string, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.UnixMilli(), 10)
+	payload := middleware.SignedRequest{Timestamp: timestamp, Nonce: nonce, Method: method, URI: uri, Body: []byte(body)}.Payload()
+	r.Header.Set(middleware.HeaderAPIKey, key.ID)
+	r.Header.Set(middleware.HeaderAPITimestamp, timestamp)
+	r.Header.Set(middleware.HeaderAPINonce, nonce)
+	r.Header.Set(middleware.HeaderAPISignature, hex.EncodeToString(Sign([]byte(key.Secret), payload)))
+	return r
+}
+
+func TestSignedRequests(t *testing.T) {
+	s := NewService(memRepository{}, memNonces{}, validator.New(), "encryption key")
+	readKey, err := s.CreateKey("user1", CreateKeyInput{Name: "reader", Scopes: []string{middleware.ScopeRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeKey, err := s.CreateKey("user1", CreateKeyInput{Name: "bot", Scopes: []string{middleware.ScopeTrade}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtOnly := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	}
+	r := chi.NewRouter()
+	r.Route("/orders", func(r chi.Router) {
+		r.Use(middleware.APIKey(s, jwtOnly))
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			if middleware.UserIDFromContext(r.Context()) != "user1" {
+				t.Error("user ID not set by API key")
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+		r.Get("/", handler)
+		r.With(middleware.RequireScope(middleware.ScopeTrade)).Post("/", handler)
+		r.With(middleware.RequireScope(middleware.ScopeWithdraw)).Post("/withdraw", handler)
+	})
+
+	now := time.Now()
+	signed := signedRequest(tradeKey, "POST", "/orders/?symbol=AAPL", `{"volume":1}`, "n1", now)
+	replayed := signedRequest(tradeKey, "POST", "/orders/?symbol=AAPL", `{"volume":1}`, "n1", now)
+	tampered := signedRequest(tradeKey, "POST", "/orders/", `{"volume":1}`, "n4", now)
+	tampered.Header.Set(middleware.HeaderAPISignature, strings.Repeat("00", 32))
+
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"unsigned falls back", httptest.NewRequest("GET", "/orders/", nil), http.StatusTeapot},
+		{"signed", signed, http.StatusOK},
+		{"replayed", replayed, http.StatusUnauthorized},
+		{"read-only key reads", signedRequest(readKey, "GET", "/orders/", "", "n1", now), http.StatusOK},
+		{"read-only key trades", signedRequest(readKey, "POST", "/orders/", "{}", "n2", now), http.StatusForbidden},
+		{"missing scope", signedRequest(tradeKey, "POST", "/orders/withdraw", "{}", "n2", now), http.StatusForbidden},
+		{"stale", signedRequest(tradeKey, "GET", "/orders/", "", "n3", now.Add(-time.Minute)), http.StatusUnauthorized},
+		{"bad signature", tampered, http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, tc.req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	if err := s.RevokeKey("user1", tradeKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, signedRequest(tradeKey, "GET", "/orders/", "", "n5", now))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
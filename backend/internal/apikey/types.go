@@ -0,0 +1,36 @@
+package apikey
+
+import (
+	"github/wry-0313/exchange/internal/models"
+	"time"
+)
+
+// APIKey is a key a user created for programmatic access. The secret it signs requests with is only returned
+// once, when the key is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"-"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateKeyInput defines the structure for requests to create an API key.
+type CreateKeyInput struct {
+	Name   string   `json:"name" validate:"required,max=64"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=read trade withdraw"`
+}
+
+// CreateKeyDTO defines the structure of a successful create API key response.
+type CreateKeyDTO struct {
+	APIKey
+	Secret string `json:"secret"`
+}
+
+// storedKey is an API key along with its encrypted secret and the role of its user.
+type storedKey struct {
+	APIKey
+	EncryptedSecret []byte
+	Role            models.Role
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/middleware"
 	"github/wry-0313/exchange/pkg/validator"
+	"io"
 	"log"
 	"net/http"
 
@@ -40,7 +42,7 @@ func (api *API) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	token, err := api.authService.Login(input)
+	dto, err := api.authService.Login(input)
 	if err != nil {
 		switch {
 		case errors.Is(err, errBadLogin):
@@ -53,12 +55,63 @@ func (api *API) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	endpoint.WriteWithStatus(w, http.StatusOK, LoginDTO{Token: token})
+	endpoint.WriteWithStatus(w, http.StatusOK, dto)
+}
+
+// HandleRefresh exchanges a refresh token for a new token and refresh token. The presented refresh token can't
+// be used again.
+func (api *API) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var input RefreshInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	dto, err := api.authService.Refresh(input)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidRefreshToken), errors.Is(err, errRefreshTokenReused):
+			endpoint.WriteWithError(w, http.StatusUnauthorized, err.Error())
+		case validator.IsValidationError(err):
+			endpoint.WriteValidationErr(w, input, err)
+		default:
+			log.Printf("HandleRefresh: Failed to refresh token due to internal server error: %v", err)
+			endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		}
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, dto)
+}
+
+// HandleLogout revokes the token the request was made with. The body is optional, a refresh token in it is
+// revoked too.
+func (api *API) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims, ok := middleware.TokenFromContext(ctx)
+	if !ok {
+		endpoint.WriteWithError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	var input LogoutInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if err := api.authService.Logout(ctx, claims, input); err != nil {
+		log.Printf("HandleLogout: Failed to logout user due to internal server error: %v", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // RegisterHandlers registers the API's request handlers.
-func (api *API) RegisterHandlers(r chi.Router) {
+func (api *API) RegisterHandlers(r chi.Router, authHandler func(http.Handler) http.Handler) {
 	r.Route("/auth", func(r chi.Router) {
 		r.Post("/login", api.HandleLogin)
+		r.Post("/refresh", api.HandleRefresh)
+		r.With(authHandler).Post("/logout", api.HandleLogout)
 	})
 }
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("Refresh token does not exist")
+	// ErrRefreshTokenUsed is returned when rotating a token that was used or revoked in the meantime.
+	ErrRefreshTokenUsed = errors.New("Refresh token was already used")
+)
+
+type Repository interface {
+	CreateRefreshToken(token RefreshToken) error
+	GetRefreshTokenByHash(tokenHash string) (RefreshToken, error)
+	// RotateRefreshToken marks token used and replaced by next and stores next, in one transaction. It returns
+	// ErrRefreshTokenUsed when token is no longer usable.
+	RotateRefreshToken(tokenID string, next RefreshToken, usedAt time.Time) error
+	// RevokeRefreshTokenFamily revokes every token of a family that isn't revoked yet.
+	RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func (r *repository) CreateRefreshToken(token RefreshToken) error {
+	return createRefreshToken(r.db, token)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func createRefreshToken(db execer, token RefreshToken) error {
+	_, err := db.Exec(`INSERT INTO refresh_tokens (token_id, family_id, user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		token.ID, token.FamilyID, token.UserID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository: failed to create refresh token: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	var t RefreshToken
+	err := r.db.QueryRow(`SELECT token_id, family_id, user_id, token_hash, expires_at, created_at, used_at, replaced_by, revoked_at FROM refresh_tokens WHERE token_hash = ?`, tokenHash).
+		Scan(&t.ID, &t.FamilyID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &t.CreatedAt, &t.UsedAt, &t.ReplacedBy, &t.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, fmt.Errorf("repository: failed to get refresh token: %w", err)
+	}
+	return t, nil
+}
+
+func (r *repository) RotateRefreshToken(tokenID string, next RefreshToken, usedAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	// The conditions make concurrent refreshes with the same token race on this row, only one of them wins
+	res, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ?, replaced_by = ? WHERE token_id = ? AND used_at IS NULL AND revoked_at IS NULL`, usedAt, next.ID, tokenID)
+	if err != nil {
+		return fmt.Errorf("repository: failed to use refresh token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("repository: failed to use refresh token: %w", err)
+	}
+	if n == 0 {
+		return ErrRefreshTokenUsed
+	}
+	if err := createRefreshToken(tx, next); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("repository: failed to commit refresh token rotation: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error {
+	_, err := r.db.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`, revokedAt, familyID)
+	if err != nil {
+		return fmt.Errorf("repository: failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github/wry-0313/exchange/internal/jwt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	revokedTokenKeyPrefix   = "revoked_token:"
+	revokedSessionKeyPrefix = "revoked_session:"
+	revokedUserKeyPrefix    = "revoked_user:" // holds the Unix time tokens of the user must be issued after
+)
+
+// RevocationList keeps the IDs of access tokens revoked before they expired in Redis. Each entry expires along
+// with its token, so the list only holds tokens that would otherwise still be accepted. Revoking a session or every
+// token of a user is kept for tokenTTL, the lifetime of an access token. Every revocation is announced on
+// jwt.RevocationsChannel.
+type RevocationList struct {
+	rdb      *redis.Client
+	tokenTTL time.Duration
+}
+
+func NewRevocationList(rdb *redis.Client, tokenTTL time.Duration) *RevocationList {
+	return &RevocationList{rdb: rdb, tokenTTL: tokenTTL}
+}
+
+// Revoke adds the token with claims to the list.
+func (l *RevocationList) Revoke(ctx context.Context, claims jwt.Claims) error {
+	ttl := time.Until(claims.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	if err := l.rdb.Set(ctx, revokedTokenKeyPrefix+claims.ID, 1, ttl).Err(); err != nil {
+		return fmt.Errorf("auth: failed to revoke token: %w", err)
+	}
+	return l.publish(ctx, jwt.Revocation{UserID: claims.UserID, TokenID: claims.ID})
+}
+
+// RevokeSession revokes every token of a user issued with the refresh token family sessionID.
+func (l *RevocationList) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	if err := l.rdb.Set(ctx, revokedSessionKeyPrefix+sessionID, 1, l.tokenTTL).Err(); err != nil {
+		return fmt.Errorf("auth: failed to revoke session: %w", err)
+	}
+	return l.publish(ctx, jwt.Revocation{UserID: userID, SessionID: sessionID})
+}
+
+// RevokeUser revokes every token of a user issued before issuedBefore.
+func (l *RevocationList) RevokeUser(ctx context.Context, userID string, issuedBefore time.Time) error {
+	if err := l.rdb.Set(ctx, revokedUserKeyPrefix+userID, issuedBefore.Unix(), l.tokenTTL).Err(); err != nil {
+		return fmt.Errorf("auth: failed to revoke user tokens: %w", err)
+	}
+	return l.publish(ctx, jwt.Revocation{UserID: userID, IssuedBefore: issuedBefore})
+}
+
+func (l *RevocationList) publish(ctx context.Context, rev jwt.Revocation) error {
+	msg, err := json.Marshal(rev)
+	if err != nil {
+		return fmt.Errorf("auth: failed to marshal revocation: %w", err)
+	}
+	if err := l.rdb.Publish(ctx, jwt.RevocationsChannel, msg).Err(); err != nil {
+		return fmt.Errorf("auth: failed to publish revocation: %w", err)
+	}
+	return nil
+}
+
+// IsRevoked implements jwt.Revocations.
+func (l *RevocationList) IsRevoked(ctx context.Context, claims jwt.Claims) (bool, error) {
+	keys := []string{revokedUserKeyPrefix + claims.UserID}
+	if claims.ID != "" {
+		keys = append(keys, revokedTokenKeyPrefix+claims.ID)
+	}
+	if claims.SessionID != "" {
+		keys = append(keys, revokedSessionKeyPrefix+claims.SessionID)
+	}
+	values, err := l.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return false, fmt.Errorf("auth: failed to check token revocation: %w", err)
+	}
+	for _, v := range values[1:] {
+		if v != nil {
+			return true, nil
+		}
+	}
+	if s, ok := values[0].(string); ok {
+		issuedBefore, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("auth: invalid user revocation %q: %w", s, err)
+		}
+		return jwt.Revocation{UserID: claims.UserID, IssuedBefore: time.Unix(issuedBefore, 0)}.Matches(claims), nil
+	}
+	return false, nil
+}
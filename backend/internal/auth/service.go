@@ -1,60 +1,223 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github/wry-0313/exchange/internal/jwt"
 	"github/wry-0313/exchange/internal/user"
 	"github/wry-0313/exchange/pkg/security"
 	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
 var (
 	errBadLogin = errors.New("Incorrect email or password.")
+	// errInvalidRefreshToken is returned for refresh tokens that don't exist, expired or were revoked.
+	errInvalidRefreshToken = errors.New("Invalid or expired refresh token.")
+	// errRefreshTokenReused is returned when a refresh token is presented after it was already exchanged. The
+	// token may have been stolen, so every token of its session is revoked.
+	errRefreshTokenReused = errors.New("Refresh token was already used, please log in again.")
 )
 
+// refreshTokenBytes is the amount of randomness in a refresh token.
+const refreshTokenBytes = 32
+
+// Revoker revokes access tokens before they expire.
+type Revoker interface {
+	Revoke(ctx context.Context, claims jwt.Claims) error
+	// RevokeSession revokes every access token issued with the refresh token family sessionID.
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+}
+
 // Service defines the authentication service interface.
 type Service interface {
-	Login(input LoginInput) (token string, err error)
+	Login(input LoginInput) (LoginDTO, error)
+	// Refresh exchanges a refresh token for a new access token and refresh token.
+	Refresh(input RefreshInput) (LoginDTO, error)
+	// Logout revokes the access token with the given claims, and the session of the refresh token if given.
+	Logout(ctx context.Context, claims jwt.Claims, input LogoutInput) error
 }
 
 type service struct {
 	userRepo   user.Repository
+	repo       Repository
 	jwtService jwt.Service
+	revoker    Revoker
 	validator  validator.Validate
+	// refreshExpiration is how long refresh tokens are valid for.
+	refreshExpiration time.Duration
 }
 
-// NewService creates a new instance of the authentication service.
-func NewService(userRepo user.Repository, jwtService jwt.Service, validator validator.Validate) Service {
+// NewService creates a new instance of the authentication service. Refresh tokens expire after
+// refreshExpiration hours.
+func NewService(userRepo user.Repository, repo Repository, jwtService jwt.Service, revoker Revoker, validator validator.Validate, refreshExpiration int) Service {
 	return &service{
-		userRepo:   userRepo,
-		jwtService: jwtService,
-		validator:  validator,
+		userRepo:          userRepo,
+		repo:              repo,
+		jwtService:        jwtService,
+		revoker:           revoker,
+		validator:         validator,
+		refreshExpiration: time.Duration(refreshExpiration) * time.Hour,
 	}
 }
 
 // Login performs the login process using the provided user credentials.
-// It retrieves the user from the user repository and generates a JWT token.
-// If successful, it returns the generated token.
+// It retrieves the user from the user repository and generates a JWT token and a refresh token.
+// If successful, it returns the generated tokens.
 // If the user cannot be found, it returns ErrBadLogin.
 // If there is any other error, it returns a wrapped error.
-func (s *service) Login(input LoginInput) (token string, err error) {
+func (s *service) Login(input LoginInput) (LoginDTO, error) {
 	if err := s.validator.Struct(input); err != nil {
-		return "", err
+		return LoginDTO{}, err
 	}
-	retrievedUser, err := s.userRepo.GetUserByEmail(input.Email)
+	retrievedUser, err := s.userRepo.GetUserByEmail(user.NormalizeEmail(input.Email))
 	if err != nil {
 		if errors.Is(err, user.ErrUserNotFound) {
-			return "", errBadLogin
+			return LoginDTO{}, errBadLogin
 		}
-		return "", fmt.Errorf("service: failed to get user by email: %w", err)
+		return LoginDTO{}, fmt.Errorf("service: failed to get user by email: %w", err)
 	}
 	if retrievedUser.Password == nil {
-		return "", fmt.Errorf("service: user %s does not have a password", retrievedUser.ID)
+		return LoginDTO{}, fmt.Errorf("service: user %s does not have a password", retrievedUser.ID)
 	}
 
 	if ok := security.CheckPasswordHash(input.Password, *retrievedUser.Password); !ok {
-		return "", errBadLogin
+		return LoginDTO{}, errBadLogin
+	}
+
+	refreshToken, secret, err := s.newRefreshToken(retrievedUser.ID, "", time.Now())
+	if err != nil {
+		return LoginDTO{}, err
+	}
+	if err := s.repo.CreateRefreshToken(refreshToken); err != nil {
+		return LoginDTO{}, fmt.Errorf("service: failed to store refresh token: %w", err)
+	}
+	token, err := s.jwtService.GenerateToken(retrievedUser.ID, retrievedUser.Role, refreshToken.FamilyID)
+	if err != nil {
+		return LoginDTO{}, fmt.Errorf("service: failed to generate token: %w", err)
+	}
+	return LoginDTO{Token: token, RefreshToken: secret, RefreshTokenExpiresAt: refreshToken.ExpiresAt}, nil
+}
+
+// Refresh rotates the given refresh token: it is used up and replaced by a new one, along with a new access
+// token. Presenting a token that was already used revokes its whole family and returns errRefreshTokenReused.
+func (s *service) Refresh(input RefreshInput) (LoginDTO, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return LoginDTO{}, err
+	}
+	current, err := s.repo.GetRefreshTokenByHash(security.HashToken(input.RefreshToken))
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenNotFound) {
+			return LoginDTO{}, errInvalidRefreshToken
+		}
+		return LoginDTO{}, fmt.Errorf("service: failed to get refresh token: %w", err)
+	}
+
+	now := time.Now()
+	if current.RevokedAt != nil || !now.Before(current.ExpiresAt) {
+		return LoginDTO{}, errInvalidRefreshToken
+	}
+	if current.UsedAt != nil {
+		return LoginDTO{}, s.revokeReusedFamily(current, now)
+	}
+
+	// The role is read again so that role changes apply from the next refresh
+	retrievedUser, err := s.userRepo.GetUser(current.UserID)
+	if err != nil {
+		return LoginDTO{}, fmt.Errorf("service: failed to get user: %w", err)
+	}
+
+	next, secret, err := s.newRefreshToken(current.UserID, current.FamilyID, now)
+	if err != nil {
+		return LoginDTO{}, err
+	}
+	if err := s.repo.RotateRefreshToken(current.ID, next, now); err != nil {
+		// Another request used the token between reading and rotating it
+		if errors.Is(err, ErrRefreshTokenUsed) {
+			return LoginDTO{}, s.revokeReusedFamily(current, now)
+		}
+		return LoginDTO{}, fmt.Errorf("service: failed to rotate refresh token: %w", err)
+	}
+
+	token, err := s.jwtService.GenerateToken(retrievedUser.ID, retrievedUser.Role, next.FamilyID)
+	if err != nil {
+		return LoginDTO{}, fmt.Errorf("service: failed to generate token: %w", err)
+	}
+	return LoginDTO{Token: token, RefreshToken: secret, RefreshTokenExpiresAt: next.ExpiresAt}, nil
+}
+
+// revokeReusedFamily revokes the family of a refresh token that was presented again after being used, along with
+// the access tokens issued with it.
+func (s *service) revokeReusedFamily(token RefreshToken, now time.Time) error {
+	log.Printf("Refresh token %s of user %s was reused, revoking family %s", token.ID, token.UserID, token.FamilyID)
+	if err := s.revokeFamily(context.Background(), token, now); err != nil {
+		return err
+	}
+	return errRefreshTokenReused
+}
+
+// revokeFamily revokes a refresh token family and the access tokens issued with it, which closes the WebSocket
+// connections that authenticated with them.
+func (s *service) revokeFamily(ctx context.Context, token RefreshToken, now time.Time) error {
+	if err := s.repo.RevokeRefreshTokenFamily(token.FamilyID, now); err != nil {
+		return fmt.Errorf("service: failed to revoke refresh token family: %w", err)
+	}
+	if err := s.revoker.RevokeSession(ctx, token.UserID, token.FamilyID); err != nil {
+		return fmt.Errorf("service: failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// Logout revokes the access token until it expires. A refresh token that belongs to the same user has its family
+// revoked, unknown refresh tokens are ignored so logging out twice succeeds.
+func (s *service) Logout(ctx context.Context, claims jwt.Claims, input LogoutInput) error {
+	if claims.ID != "" {
+		if err := s.revoker.Revoke(ctx, claims); err != nil {
+			return fmt.Errorf("service: failed to revoke token: %w", err)
+		}
+	}
+	if input.RefreshToken == "" {
+		return nil
+	}
+
+	token, err := s.repo.GetRefreshTokenByHash(security.HashToken(input.RefreshToken))
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenNotFound) {
+			return nil
+		}
+		return fmt.Errorf("service: failed to get refresh token: %w", err)
+	}
+	if token.UserID != claims.UserID {
+		return nil
+	}
+	return s.revokeFamily(ctx, token, time.Now())
+}
+
+// newRefreshToken creates a refresh token for a user along with the secret handed to the client. An empty
+// familyID starts a new family.
+func (s *service) newRefreshToken(userID, familyID string, now time.Time) (RefreshToken, string, error) {
+	b := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return RefreshToken{}, "", fmt.Errorf("service: failed to generate refresh token: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	id := ulid.Make().String()
+	if familyID == "" {
+		familyID = id
 	}
-	return s.jwtService.GenerateToken(retrievedUser.ID)
+	return RefreshToken{
+		ID:        id,
+		FamilyID:  familyID,
+		UserID:    userID,
+		TokenHash: security.HashToken(secret),
+		ExpiresAt: now.Add(s.refreshExpiration),
+		CreatedAt: now,
+	}, secret, nil
 }
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github/wry-0313/exchange/internal/jwt"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"testing"
+	"time"
+)
+
+// memRepository is an in-memory Repository.
+type memRepository struct {
+	tokens map[string]RefreshToken
+}
+
+func (r *memRepository) CreateRefreshToken(token RefreshToken) error {
+	r.tokens[token.ID] = token
+	return nil
+}
+
+func (r *memRepository) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	for _, t := range r.tokens {
+		if t.TokenHash == tokenHash {
+			return t, nil
+		}
+	}
+	return RefreshToken{}, ErrRefreshTokenNotFound
+}
+
+func (r *memRepository) RotateRefreshToken(tokenID string, next RefreshToken, usedAt time.Time) error {
+	t := r.tokens[tokenID]
+	if t.UsedAt != nil || t.RevokedAt != nil {
+		return ErrRefreshTokenUsed
+	}
+	t.UsedAt, t.ReplacedBy = &usedAt, &next.ID
+	r.tokens[tokenID] = t
+	return r.CreateRefreshToken(next)
+}
+
+func (r *memRepository) RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error {
+	for id, t := range r.tokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			t.RevokedAt = &revokedAt
+			r.tokens[id] = t
+		}
+	}
+	return nil
+}
+
+// stubUsers is a user.Repository whose users all exist as traders.
+type stubUsers struct {
+	user.Repository
+}
+
+func (stubUsers) GetUser(userID string) (models.User, error) {
+	return models.User{ID: userID, Role: models.RoleTrader}, nil
+}
+
+// memRevocations is an in-memory Revoker and jwt.Revocations, keyed by token and session ID.
+type memRevocations map[string]bool
+
+func (m memRevocations) Revoke(ctx context.Context, claims jwt.Claims) error {
+	m["token:"+claims.ID] = true
+	return nil
+}
+
+func (m memRevocations) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	m["session:"+sessionID] = true
+	return nil
+}
+
+func (m memRevocations) IsRevoked(ctx context.Context, claims jwt.Claims) (bool, error) {
+	return m["token:"+claims.ID] || (claims.SessionID != "" && m["session:"+claims.SessionID]), nil
+}
+
+func newTestService() (*service, *memRepository, memRevocations) {
+	repo := &memRepository{tokens: map[string]RefreshToken{}}
+	revocations := memRevocations{}
+	jwtService := jwt.NewService("secret", 1, revocations)
+	s := NewService(stubUsers{}, repo, jwtService, revocations, validator.New(), 1).(*service)
+	return s, repo, revocations
+}
+
+// login stores a refresh token for a new session as Login does and returns its secret.
+func login(t *testing.T, s *service, repo *memRepository, userID string) string {
+	t.Helper()
+	token, secret, err := s.newRefreshToken(userID, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.CreateRefreshToken(token)
+	return secret
+}
+
+func TestRefreshRotation(t *testing.T) {
+	s, repo, _ := newTestService()
+	first := login(t, s, repo, "user1")
+
+	dto, err := s.Refresh(RefreshInput{RefreshToken: first})
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if dto.Token == "" || dto.RefreshToken == "" || dto.RefreshToken == first {
+		t.Fatalf("refresh returned %+v, want a new token pair", dto)
+	}
+	userID, err := s.jwtService.VerifyToken(dto.Token)
+	if err != nil || userID != "user1" {
+		t.Fatalf("new token verifies as %q, %v", userID, err)
+	}
+
+	second, err := s.Refresh(RefreshInput{RefreshToken: dto.RefreshToken})
+	if err != nil {
+		t.Fatalf("refresh with rotated token: %v", err)
+	}
+
+	// Reusing the first token revokes the session, including the latest token
+	if _, err := s.Refresh(RefreshInput{RefreshToken: first}); !errors.Is(err, errRefreshTokenReused) {
+		t.Fatalf("reuse: err = %v, want errRefreshTokenReused", err)
+	}
+	if _, err := s.Refresh(RefreshInput{RefreshToken: second.RefreshToken}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("refresh after reuse: err = %v, want errInvalidRefreshToken", err)
+	}
+	if _, err := s.jwtService.VerifyToken(second.Token); !errors.Is(err, jwt.ErrTokenRevoked) {
+		t.Fatalf("access token of the session after reuse: err = %v, want jwt.ErrTokenRevoked", err)
+	}
+
+	if _, err := s.Refresh(RefreshInput{RefreshToken: "unknown"}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("unknown token: err = %v, want errInvalidRefreshToken", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s, repo, _ := newTestService()
+	refresh := login(t, s, repo, "user1")
+	other := login(t, s, repo, "user2")
+	token, _ := s.jwtService.GenerateToken("user1", models.RoleTrader, "")
+	claims, err := s.jwtService.VerifyTokenClaims(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Logout(context.Background(), claims, LogoutInput{RefreshToken: refresh}); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	if _, err := s.jwtService.VerifyToken(token); !errors.Is(err, jwt.ErrTokenRevoked) {
+		t.Errorf("token after logout: err = %v, want jwt.ErrTokenRevoked", err)
+	}
+	if _, err := s.Refresh(RefreshInput{RefreshToken: refresh}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("refresh after logout: err = %v, want errInvalidRefreshToken", err)
+	}
+
+	// Another user's refresh token is left alone
+	if err := s.Logout(context.Background(), claims, LogoutInput{RefreshToken: other}); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	if _, err := s.Refresh(RefreshInput{RefreshToken: other}); err != nil {
+		t.Errorf("other user's refresh: %v", err)
+	}
+}
@@ -1,12 +1,42 @@
 package auth
 
+import "time"
+
 // LoginInput represents the input structure for a login request
 type LoginInput struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
 }
 
-// LoginDTO represents the response structure for a successful login request
+// LoginDTO represents the response structure for a successful login or refresh request. The refresh token can be
+// exchanged for a new pair once, at /auth/refresh.
 type LoginDTO struct {
-	Token string `json:"token"`
-}
\ No newline at end of file
+	Token                 string    `json:"token"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+}
+
+// RefreshInput represents the input structure for a refresh request
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// LogoutInput represents the input structure for a logout request. The refresh token is optional, when given its
+// session is ended too.
+type LogoutInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken is a stored refresh token. Only the SHA-256 hash of the token is kept. Every login starts a family
+// of tokens, each refresh uses up the presented token and adds its replacement to the family.
+type RefreshToken struct {
+	ID         string
+	FamilyID   string
+	UserID     string
+	TokenHash  string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	UsedAt     *time.Time
+	ReplacedBy *string
+	RevokedAt  *time.Time
+}
@@ -0,0 +1,69 @@
+// Package bus carries messages between the API and the order book consumers. It hides the broker behind a small
+// interface so the exchange can run against Kafka in production and an in-process bus locally and in tests.
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github/wry-0313/exchange/internal/config"
+)
+
+const (
+	// NumPartitions is the number of partitions a topic is split into. Messages with the same key always land on
+	// the same partition.
+	NumPartitions = 5
+)
+
+var (
+	ErrClosed = errors.New("bus: closed")
+)
+
+// Message is a single message read from a topic.
+type Message struct {
+	Topic     string
+	Key       string
+	Value     []byte
+	Partition int32
+	Offset    int64
+}
+
+// Handler processes a consumed message. Messages of one partition are handed to the handler one at a time, in
+// the order they were published.
+type Handler func(ctx context.Context, msg Message) error
+
+// Bus is an interface that represents all the capabilities of a message bus.
+type Bus interface {
+	// Publish sends value to topic. Messages with the same key are consumed in the order they were published.
+	Publish(ctx context.Context, topic, key string, value []byte) error
+
+	// Consume delivers the messages of topic to handler until ctx is done. Consumers sharing a group split the
+	// topic's partitions between them and resume where the group left off. A message counts as consumed once the
+	// handler returns, whatever it returns, so handlers deal with their own failures. The exception is a handler
+	// failing once its context is done: the message is left for the group to consume again where the bus keeps
+	// messages across restarts.
+	Consume(ctx context.Context, topic, group string, handler Handler) error
+
+	Close() error
+}
+
+// New creates the bus selected in the config.
+func New(cfg *config.Config) (Bus, error) {
+	switch cfg.MessageBus {
+	case config.MessageBusMemory:
+		return NewMemory(), nil
+	case config.MessageBusKafka, "":
+		return NewKafka(cfg.KafkaBrokers)
+	default:
+		return nil, fmt.Errorf("bus: unknown message bus %q", cfg.MessageBus)
+	}
+}
+
+// partitionFor maps a key to a partition the same way for every bus implementation.
+func partitionFor(key string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int32(h.Sum32() % NumPartitions)
+}
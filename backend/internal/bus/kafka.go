@@ -0,0 +1,177 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+)
+
+// kafka is a bus backed by a Kafka cluster. Topics are created on first use and consumed as part of a consumer
+// group, so offsets survive restarts.
+type kafka struct {
+	brokerList []string
+	producer   sarama.SyncProducer
+}
+
+// NewKafka creates a bus that produces to and consumes from the given brokers.
+func NewKafka(brokerList []string) (Bus, error) {
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	// Hashing the key keeps every key on a single partition
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	producer, err := sarama.NewSyncProducer(brokerList, config)
+	if err != nil {
+		return nil, fmt.Errorf("bus: failed to create producer: %w", err)
+	}
+
+	return &kafka{
+		brokerList: brokerList,
+		producer:   producer,
+	}, nil
+}
+
+func (k *kafka) Publish(ctx context.Context, topic, key string, value []byte) error {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	}
+	// The producer can't be interrupted, so the send is left running when ctx is done first and the message may
+	// still be delivered
+	sent := make(chan error, 1)
+	go func() {
+		_, _, err := k.producer.SendMessage(msg)
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			return fmt.Errorf("bus: failed to send message: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("bus: failed to send message: %w", ctx.Err())
+	}
+}
+
+func (k *kafka) Consume(ctx context.Context, topic, group string, handler Handler) error {
+	if err := k.ensureTopic(topic); err != nil {
+		return err
+	}
+
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	// Only used the first time the group reads a partition, afterwards the committed offset wins. Starting from the
+	// oldest offset means messages published before the group ever ran are not skipped.
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
+
+	consumerGroup, err := sarama.NewConsumerGroup(k.brokerList, group, config)
+	if err != nil {
+		return fmt.Errorf("bus: failed to start consumer group: %w", err)
+	}
+	defer func() {
+		if err := consumerGroup.Close(); err != nil {
+			log.Printf("Failed to close consumer group: %v", err)
+		}
+	}()
+
+	go func() {
+		for err := range consumerGroup.Errors() {
+			log.Println("Error consuming message: ", err)
+		}
+	}()
+
+	h := &consumerGroupHandler{handler: handler}
+	for {
+		// Consume blocks for the lifetime of a group session and returns when the group rebalances, so it is
+		// called again until ctx is done.
+		if err := consumerGroup.Consume(ctx, []string{topic}, h); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return nil
+			}
+			log.Printf("Consumer group error: %v", err)
+		}
+		if ctx.Err() != nil {
+			log.Printf("Shutting down consumer group %s\n", group)
+			return nil
+		}
+	}
+}
+
+// ensureTopic creates topic if it does not exist yet.
+func (k *kafka) ensureTopic(topic string) error {
+	admin, err := sarama.NewClusterAdmin(k.brokerList, sarama.NewConfig())
+	if err != nil {
+		return fmt.Errorf("bus: failed to create cluster admin: %w", err)
+	}
+	defer func() { admin.Close() }()
+
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("bus: failed to list topics: %w", err)
+	}
+	if _, exists := topics[topic]; exists {
+		log.Printf("Topic '%s' already exists. Skipping creation.", topic)
+		return nil
+	}
+	err = admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     NumPartitions,
+		ReplicationFactor: 1,
+	}, false)
+	if err != nil {
+		return fmt.Errorf("bus: failed to create topic: %w", err)
+	}
+	return nil
+}
+
+func (k *kafka) Close() error {
+	return k.producer.Close()
+}
+
+// consumerGroupHandler hands the messages of each claimed partition to the handler in order. One goroutine per
+// partition preserves the order of every key.
+type consumerGroupHandler struct {
+	handler Handler
+}
+
+func (h *consumerGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	log.Printf("Consumer group session started, claims: %v\n", session.Claims())
+	return nil
+}
+
+func (h *consumerGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			err := h.handler(session.Context(), Message{
+				Topic:     msg.Topic,
+				Key:       string(msg.Key),
+				Value:     msg.Value,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+			})
+			if err != nil && session.Context().Err() != nil {
+				// The handler gave up because the session ended, whoever claims the partition next gets the message
+				return nil
+			}
+			// The offset is only marked once the handler returns, so a crash replays the message rather than
+			// losing it. Marked offsets are committed in the background and when the session ends.
+			session.MarkMessage(msg, "")
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
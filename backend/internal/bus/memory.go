@@ -0,0 +1,185 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	memoryPartitionBuffer = 1024
+
+	// memoryDrainTimeout bounds how long a stopped consumer keeps handing buffered messages to its handler, so a
+	// handler retrying a failure can't hold up shutdown.
+	memoryDrainTimeout = 10 * time.Second
+)
+
+// memory is an in-process bus backed by buffered channels, one per topic partition and consumer group. Messages are
+// lost when the process stops, so it is meant for local development and tests.
+type memory struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+	offset int64
+	closed bool
+}
+
+// memoryTopic holds a copy of a topic's partitions for every group consuming it. Messages published before any
+// group consumes the topic are buffered for the first one, the way a new Kafka group starts from the oldest offset.
+type memoryTopic struct {
+	groups  map[string]*memoryGroup
+	backlog []chan Message
+}
+
+// memoryGroup is a group's copy of a topic's partitions. Like in a Kafka group, each partition is consumed by one
+// consumer of the group at a time, the one holding its owner slot.
+type memoryGroup struct {
+	partitions []chan Message
+	owners     []chan struct{}
+}
+
+// NewMemory creates an in-process bus.
+func NewMemory() Bus {
+	return &memory{
+		topics: map[string]*memoryTopic{},
+	}
+}
+
+func newPartitions() []chan Message {
+	ps := make([]chan Message, NumPartitions)
+	for i := range ps {
+		ps[i] = make(chan Message, memoryPartitionBuffer)
+	}
+	return ps
+}
+
+// topic returns topic, creating it the first time it is used. m.mu must be held.
+func (m *memory) topic(name string) (*memoryTopic, error) {
+	if m.closed {
+		return nil, ErrClosed
+	}
+	t, ok := m.topics[name]
+	if !ok {
+		t = &memoryTopic{groups: map[string]*memoryGroup{}, backlog: newPartitions()}
+		m.topics[name] = t
+	}
+	return t, nil
+}
+
+// group returns the partitions of topic kept for group, creating them the first time the group consumes the topic.
+func (m *memory) group(topic, group string) (*memoryGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	g, ok := t.groups[group]
+	if !ok {
+		g = &memoryGroup{owners: make([]chan struct{}, NumPartitions)}
+		if len(t.groups) == 0 {
+			g.partitions, t.backlog = t.backlog, nil
+		} else {
+			g.partitions = newPartitions()
+		}
+		for i := range g.owners {
+			g.owners[i] = make(chan struct{}, 1)
+		}
+		t.groups[group] = g
+	}
+	return g, nil
+}
+
+// Publish hands the message to every group consuming topic.
+func (m *memory) Publish(ctx context.Context, topic, key string, value []byte) error {
+	partition := partitionFor(key)
+
+	m.mu.Lock()
+	t, err := m.topic(topic)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	var queues []chan Message
+	if len(t.groups) == 0 {
+		queues = append(queues, t.backlog[partition])
+	}
+	for _, g := range t.groups {
+		queues = append(queues, g.partitions[partition])
+	}
+	m.offset++
+	msg := Message{Topic: topic, Key: key, Value: value, Partition: partition, Offset: m.offset}
+	m.mu.Unlock()
+
+	for _, q := range queues {
+		select {
+		case q <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Consume delivers every message of topic to group once. Consumers of the same group split its partitions, a
+// partition whose consumer stops is taken over by another consumer of the group still running.
+func (m *memory) Consume(ctx context.Context, topic, group string, handler Handler) error {
+	g, err := m.group(topic, group)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := range g.partitions {
+		wg.Add(1)
+		go func(p chan Message, owner chan struct{}) {
+			defer wg.Done()
+			select {
+			case owner <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-owner }()
+			for {
+				select {
+				case msg := <-p:
+					handler(ctx, msg)
+				case <-ctx.Done():
+					drain(ctx, p, handler)
+					return
+				}
+			}
+		}(g.partitions[i], g.owners[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// drain hands the messages still buffered in p to handler for up to memoryDrainTimeout. Unlike Kafka nothing
+// survives the process, so whatever was published before the consumer stopped is applied rather than lost, unless
+// the handler can't keep up.
+func drain(ctx context.Context, p chan Message, handler Handler) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), memoryDrainTimeout)
+	defer cancel()
+	for {
+		if ctx.Err() != nil {
+			if n := len(p); n > 0 {
+				log.Printf("Dropping %d messages still buffered after draining for %s\n", n, memoryDrainTimeout)
+			}
+			return
+		}
+		select {
+		case msg := <-p:
+			handler(ctx, msg)
+		default:
+			return
+		}
+	}
+}
+
+func (m *memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
@@ -0,0 +1,65 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryDeliversOncePerGroup(t *testing.T) {
+	b := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Published before anyone consumes the topic, it is kept for the first group
+	if err := b.Publish(ctx, "orders", "key", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	var engine, audit atomic.Int32
+	var wg sync.WaitGroup
+	consume := func(group string, count *atomic.Int32) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Consume(ctx, "orders", group, func(context.Context, Message) error {
+				count.Add(1)
+				return nil
+			})
+		}()
+	}
+	groups := func() int {
+		m := b.(*memory)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.topics["orders"].groups)
+	}
+	consume("engine", &engine)
+	consume("engine", &engine)
+	for groups() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// The audit group joins after the first message
+	consume("audit", &audit)
+	for groups() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := b.Publish(ctx, "orders", "key", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for engine.Load() < 2 || audit.Load() < 1 {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if engine.Load() != 2 || audit.Load() != 1 {
+		t.Fatalf("engine group got %d messages and audit group %d, want 2 and 1", engine.Load(), audit.Load())
+	}
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github/wry-0313/exchange/pkg/validator"
 
@@ -20,16 +22,69 @@ const (
 	keyRedisHost = "REDIS_HOST"
 	keyRedisPort = "REDIS_PORT"
 
-	keyEnv             = "ENV"
-	keyServerPort      = "SERVER_PORT"
-	keyJWTSecret       = "JWT_SIGNING_KEY"
-	keyJWTExpiration   = "JWT_EXPIRATION"
-	keyInternalNetwork = "INTERNAL_NETWORK"
+	keyEnv              = "ENV"
+	keyServerPort       = "SERVER_PORT"
+	keyJWTSecret        = "JWT_SIGNING_KEY"
+	keyJWTExpiration    = "JWT_EXPIRATION"
+	keyRefreshTokenExp  = "REFRESH_TOKEN_EXPIRATION"
+	keyAPIKeySecret     = "API_KEY_ENCRYPTION_KEY"
+	keyInternalNetwork  = "INTERNAL_NETWORK"
+	keyAdminAPIKey      = "ADMIN_API_KEY"
+	keySnapshotDir      = "SNAPSHOT_DIR"
+	keyDeadLetterFile   = "PERSISTENCE_DEADLETTER_FILE"
+	keyWSAllowedOrigins = "WS_ALLOWED_ORIGINS"
 
+	keyMarginInitial     = "MARGIN_INITIAL"
+	keyMarginMaintenance = "MARGIN_MAINTENANCE"
+	keyMarginBorrowLimit = "MARGIN_BORROW_LIMIT"
+
+	keyMailDriver      = "MAIL_DRIVER"
+	keyMailFrom        = "MAIL_FROM"
+	keyMailDir         = "MAIL_DIR"
+	keySMTPHost        = "SMTP_HOST"
+	keySMTPPort        = "SMTP_PORT"
+	keySMTPUsername    = "SMTP_USERNAME"
+	keySMTPPassword    = "SMTP_PASSWORD"
+	keyAppURL          = "APP_URL"
+	keyRequireVerified = "REQUIRE_VERIFIED_EMAIL"
+
+	keyMessageBus   = "MESSAGE_BUS"
 	keyKafkaBrokers = "KAFKA_BROKERS"
 
+	defaultSnapshotDir    = "snapshots"
+	defaultDeadLetterFile = "persistence_deadletter.jsonl"
+
+	// defaultRefreshTokenExpiration is 30 days, in hours.
+	defaultRefreshTokenExpiration = 720
+
+	// defaultWSAllowedOrigins is the frontend's development server.
+	defaultWSAllowedOrigins = "http://localhost:3000"
+
+	// The default margin requirements, as fractions of the gross value of a margin account's positions, and the
+	// number of shares of each symbol that can be borrowed for short sales.
+	defaultMarginInitial     = 0.5
+	defaultMarginMaintenance = 0.25
+	defaultMarginBorrowLimit = 100000
+
+	defaultMailFrom = "no-reply@exchange.local"
+	defaultMailDir  = "mail"
+	defaultSMTPPort = "587"
+
+	// defaultAppURL is the frontend's development server, links in emails point to it.
+	defaultAppURL = "http://localhost:3000"
+
 	ProdEnv = "production"
 	DevEnv  = "development"
+
+	// MailDriverSMTP, MailDriverFile and MailDriverMemory are the values MAIL_DRIVER accepts. Emails are written
+	// to files when it is unset.
+	MailDriverSMTP   = "smtp"
+	MailDriverFile   = "file"
+	MailDriverMemory = "memory"
+
+	// MessageBusKafka and MessageBusMemory are the values MESSAGE_BUS accepts. Kafka is used when it is unset.
+	MessageBusKafka  = "kafka"
+	MessageBusMemory = "memory"
 )
 
 type Config struct {
@@ -37,8 +92,26 @@ type Config struct {
 	ServerPort    string
 	JwtSecret     string
 	JwtExpiration int
-	KafkaBrokers  []string
-	Rdb           RedisConfig
+	// RefreshTokenExpiration is how long refresh tokens are valid for, in hours.
+	RefreshTokenExpiration int
+	// APIKeyEncryptionKey encrypts API key secrets at rest. It defaults to the JWT secret, changing it makes
+	// existing API keys unusable.
+	APIKeyEncryptionKey string
+	AdminAPIKey         string // grants access to the admin endpoints besides an admin login, disabled when empty
+	SnapshotDir         string // where order books are saved on shutdown and restored from on startup
+	DeadLetterFile      string // absolute path of the file order book writes the database refuses are appended to
+	// WSAllowedOrigins are the origins browsers may open WebSocket connections from, "*" allows any. Connections
+	// without an Origin header are not from a browser and always allowed.
+	WSAllowedOrigins []string
+	Margin           MarginConfig
+	Mail             MailConfig
+	MessageBus       string
+	KafkaBrokers     []string
+	Rdb              RedisConfig
+	// AppURL is the address of the frontend, which links in emails point to.
+	AppURL string
+	// RequireVerifiedEmail blocks users from placing orders until they verified their email address.
+	RequireVerifiedEmail bool
 }
 
 func Load(file string) (*Config, error) {
@@ -65,6 +138,63 @@ func Load(file string) (*Config, error) {
 		return nil, fmt.Errorf("invalid JWT expiration value: %w", err)
 	}
 
+	refreshTokenExpiration := defaultRefreshTokenExpiration
+	if refreshTokenExpStr := os.Getenv(keyRefreshTokenExp); refreshTokenExpStr != "" {
+		refreshTokenExpiration, err = strconv.Atoi(refreshTokenExpStr)
+		if err != nil || refreshTokenExpiration <= 0 {
+			return nil, fmt.Errorf("invalid refresh token expiration value: %q", refreshTokenExpStr)
+		}
+	}
+
+	apiKeyEncryptionKey := os.Getenv(keyAPIKeySecret)
+	if apiKeyEncryptionKey == "" {
+		apiKeyEncryptionKey = jwtSecret
+	}
+
+	snapshotDir := os.Getenv(keySnapshotDir)
+	if snapshotDir == "" {
+		snapshotDir = defaultSnapshotDir
+	}
+
+	deadLetterFile := os.Getenv(keyDeadLetterFile)
+	if deadLetterFile == "" {
+		deadLetterFile = defaultDeadLetterFile
+	}
+	// Resolved now, so the file doesn't move with the working directory
+	deadLetterFile, err = filepath.Abs(deadLetterFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", keyDeadLetterFile, err)
+	}
+
+	wsAllowedOrigins := os.Getenv(keyWSAllowedOrigins)
+	if wsAllowedOrigins == "" {
+		wsAllowedOrigins = defaultWSAllowedOrigins
+	}
+
+	marginConfig, err := getMarginConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	mailConfig, err := getMailConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	appURL := os.Getenv(keyAppURL)
+	if appURL == "" {
+		appURL = defaultAppURL
+	}
+
+	requireVerifiedEmail := false
+	if s := os.Getenv(keyRequireVerified); s != "" {
+		requireVerifiedEmail, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %q", keyRequireVerified, s)
+		}
+	}
+
+	messageBus := os.Getenv(keyMessageBus)
 	broker := os.Getenv(keyKafkaBrokers)
 	KafkaBrokers := []string{broker}
 
@@ -74,15 +204,120 @@ func Load(file string) (*Config, error) {
 	}
 
 	return &Config{
-		DB:            databaseConfig,
-		ServerPort:    serverPort,
-		JwtSecret:     jwtSecret,
-		JwtExpiration: jwtExpiration,
-		KafkaBrokers:  KafkaBrokers,
-		Rdb:           rdbConfig,
+		DB:                     databaseConfig,
+		ServerPort:             serverPort,
+		JwtSecret:              jwtSecret,
+		JwtExpiration:          jwtExpiration,
+		RefreshTokenExpiration: refreshTokenExpiration,
+		APIKeyEncryptionKey:    apiKeyEncryptionKey,
+		AdminAPIKey:            os.Getenv(keyAdminAPIKey),
+		SnapshotDir:            snapshotDir,
+		DeadLetterFile:         deadLetterFile,
+		WSAllowedOrigins:       splitList(wsAllowedOrigins),
+		Margin:                 marginConfig,
+		Mail:                   mailConfig,
+		AppURL:                 strings.TrimSuffix(appURL, "/"),
+		RequireVerifiedEmail:   requireVerifiedEmail,
+		MessageBus:             messageBus,
+		KafkaBrokers:           KafkaBrokers,
+		Rdb:                    rdbConfig,
 	}, nil
 }
 
+// splitList splits a comma separated env var, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// MarginConfig holds the requirements of margin accounts. Initial is the fraction of the gross value of its
+// positions an account's equity must cover to open more, Maintenance the fraction below which it is liquidated.
+type MarginConfig struct {
+	Initial     float64
+	Maintenance float64
+	// BorrowLimit is the number of shares of each symbol that can be out on loan to short sellers at once.
+	BorrowLimit float64
+}
+
+func getMarginConfig() (MarginConfig, error) {
+	cfg := MarginConfig{
+		Initial:     defaultMarginInitial,
+		Maintenance: defaultMarginMaintenance,
+		BorrowLimit: defaultMarginBorrowLimit,
+	}
+	for key, value := range map[string]*float64{
+		keyMarginInitial:     &cfg.Initial,
+		keyMarginMaintenance: &cfg.Maintenance,
+		keyMarginBorrowLimit: &cfg.BorrowLimit,
+	} {
+		if s := os.Getenv(key); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return MarginConfig{}, fmt.Errorf("invalid %s value: %q", key, s)
+			}
+			*value = f
+		}
+	}
+	if cfg.Maintenance <= 0 || cfg.Maintenance > cfg.Initial || cfg.Initial > 1 {
+		return MarginConfig{}, fmt.Errorf("margin requirements must satisfy 0 < %s <= %s <= 1", keyMarginMaintenance, keyMarginInitial)
+	}
+	if cfg.BorrowLimit < 0 {
+		return MarginConfig{}, fmt.Errorf("invalid %s value: %v", keyMarginBorrowLimit, cfg.BorrowLimit)
+	}
+	return cfg, nil
+}
+
+// MailConfig selects how emails are sent. The SMTP settings are only used by the SMTP driver, Dir only by the
+// file driver.
+type MailConfig struct {
+	Driver       string
+	From         string
+	Dir          string // where the file driver writes emails
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+func getMailConfig() (MailConfig, error) {
+	cfg := MailConfig{
+		Driver:       os.Getenv(keyMailDriver),
+		From:         os.Getenv(keyMailFrom),
+		Dir:          os.Getenv(keyMailDir),
+		SMTPHost:     os.Getenv(keySMTPHost),
+		SMTPPort:     os.Getenv(keySMTPPort),
+		SMTPUsername: os.Getenv(keySMTPUsername),
+		SMTPPassword: os.Getenv(keySMTPPassword),
+	}
+	if cfg.Driver == "" {
+		cfg.Driver = MailDriverFile
+	}
+	if cfg.From == "" {
+		cfg.From = defaultMailFrom
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = defaultMailDir
+	}
+	if cfg.SMTPPort == "" {
+		cfg.SMTPPort = defaultSMTPPort
+	}
+	switch cfg.Driver {
+	case MailDriverSMTP:
+		if cfg.SMTPHost == "" {
+			return MailConfig{}, fmt.Errorf("%s is required by the %s mail driver", keySMTPHost, MailDriverSMTP)
+		}
+	case MailDriverFile, MailDriverMemory:
+	default:
+		return MailConfig{}, fmt.Errorf("invalid %s value: %q", keyMailDriver, cfg.Driver)
+	}
+	return cfg, nil
+}
+
 // RedisConfig represents the config for connecting to Redis PubSub
 type RedisConfig struct {
 	Host string `validate:"required"`
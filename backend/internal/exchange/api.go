@@ -1,21 +1,50 @@
 package exchange
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github/wry-0313/exchange/internal/endpoint"
 	"github/wry-0313/exchange/internal/middleware"
-	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
 	"github/wry-0313/exchange/pkg/validator"
+	"strconv"
+	"strings"
+	"time"
 
 	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/oklog/ulid/v2"
 )
 
 const (
 	ErrMsgInternalServer = "Internal server error"
+
+	errMsgInvalidTimeout = "timeout_ms must be a positive integer"
+
+	errMsgInvalidLimit    = "limit must be a positive integer"
+	errMsgInvalidTime     = "from and to must be RFC 3339 timestamps or unix seconds"
+	errMsgInvalidInterval = "interval must be one of 1s, 1m, 5m, 1h, 1d"
+	errMsgInvalidSymbol   = "Unknown symbol"
+
+	errMsgInvalidSide      = "side must be buy or sell"
+	errMsgInvalidStatus    = "status must be one of Open, Filled, PartiallyFilled, Rejected or Cancelled"
+	errMsgInvalidOrderType = "type must be market or limit"
+	errMsgInvalidCursor    = "before must be an order ID"
+
+	defaultAckTimeout = 5 * time.Second
+	maxAckTimeout     = 30 * time.Second
+
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 500
+
+	defaultCandleLimit = 25
+	maxCandleLimit     = 1000
+
+	defaultOrderLimit = 50
+	maxOrderLimit     = 500
 )
 
 type API struct {
@@ -45,34 +74,386 @@ func (api *API) HandlePlaceOrder(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 
-	if err := api.exchangeService.PlaceOrder(input); err != nil {
+	wait, timeout, ok := parseWait(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ack, err := api.exchangeService.PlaceOrder(ctx, input, wait)
+	if err != nil {
 		switch {
 		case validator.IsValidationError(err):
 			endpoint.WriteValidationErr(w, input, err)
 		case errors.Is(err, ErrInvalidSymbol):
 			endpoint.WriteWithError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrTradingHalted):
+			endpoint.WriteWithError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, ErrOrderRejected):
+			endpoint.WriteWithError(w, http.StatusUnprocessableEntity, err.Error())
 		default:
+			log.Printf("handler: failed to place order: %v\n", err)
 			endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
 		}
 		return
 	}
-	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: "Order placed"})
+
+	writeAck(w, ack)
+}
+
+// HandleGetClientOrder returns an order by the client order ID the user placed it with.
+func (api *API) HandleGetClientOrder(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromContext(r.Context())
+	clientOrderID := chi.URLParam(r, "clientOrderID")
+
+	ack, err := api.exchangeService.GetClientOrder(userID, clientOrderID)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("handler: failed to get client order: %v\n", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, ack)
+}
+
+// HandleGetUserOrders returns the user's orders newest first, filtered by ?symbol=, ?side=, ?status=, ?type= and
+// the time they were created within [?from=, ?to=). The next page starts before the last order's ID, passed as
+// ?before=.
+func (api *API) HandleGetUserOrders(w http.ResponseWriter, r *http.Request) {
+	api.getUserOrders(w, r, false)
+}
+
+// HandleGetOpenOrders is HandleGetUserOrders limited to the open and partially filled orders.
+func (api *API) HandleGetOpenOrders(w http.ResponseWriter, r *http.Request) {
+	api.getUserOrders(w, r, true)
+}
+
+func (api *API) getUserOrders(w http.ResponseWriter, r *http.Request, openOnly bool) {
+	filter, ok := parseOrderFilter(w, r)
+	if !ok {
+		return
+	}
+	filter.OpenOnly = openOnly
+
+	orders, err := api.exchangeService.GetUserOrders(middleware.UserIDFromContext(r.Context()), filter)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSymbol) {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidSymbol)
+			return
+		}
+		log.Printf("handler: failed to get user orders: %v\n", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, orders)
 }
 
+// parseOrderFilter reads the query of an order history request, writing the error response when it's invalid.
+// Sides, statuses and types are matched regardless of case.
+func parseOrderFilter(w http.ResponseWriter, r *http.Request) (orderbook.OrderFilter, bool) {
+	query := r.URL.Query()
+	filter := orderbook.OrderFilter{Symbol: query.Get("symbol"), Before: query.Get("before"), Limit: defaultOrderLimit}
+
+	var ok bool
+	if filter.Side, ok = oneOf(query.Get("side"), "Buy", "Sell"); !ok {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidSide)
+		return filter, false
+	}
+	if filter.Status, ok = oneOf(query.Get("status"), "Open", "Filled", "PartiallyFilled", "Rejected", "Cancelled"); !ok {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidStatus)
+		return filter, false
+	}
+	if filter.Type, ok = oneOf(query.Get("type"), "Market", "Limit"); !ok {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidOrderType)
+		return filter, false
+	}
+	if filter.Before != "" {
+		if _, err := ulid.ParseStrict(filter.Before); err != nil {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidCursor)
+			return filter, false
+		}
+	}
+
+	var err error
+	if filter.From, err = parseTime(query.Get("from")); err != nil {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidTime)
+		return filter, false
+	}
+	if filter.To, err = parseTime(query.Get("to")); err != nil {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidTime)
+		return filter, false
+	}
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidLimit)
+			return filter, false
+		}
+		filter.Limit = min(n, maxOrderLimit)
+	}
+	return filter, true
+}
+
+// oneOf returns the value of values that equals v regardless of case. An empty v is valid and returned as is.
+func oneOf(v string, values ...string) (string, bool) {
+	if v == "" {
+		return "", true
+	}
+	for _, value := range values {
+		if strings.EqualFold(v, value) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// HandleGetUserOrder returns an order of the user with its fills.
+func (api *API) HandleGetUserOrder(w http.ResponseWriter, r *http.Request) {
+	order, err := api.exchangeService.GetUserOrder(middleware.UserIDFromContext(r.Context()), chi.URLParam(r, "orderID"))
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("handler: failed to get order: %v\n", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, order)
+}
+
+// HandleCancelClientOrder cancels an order by the client order ID the user placed it with. Like placing an order
+// it accepts ?wait=true to respond with the engine's result.
+func (api *API) HandleCancelClientOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := middleware.UserIDFromContext(ctx)
+	clientOrderID := chi.URLParam(r, "clientOrderID")
+
+	wait, timeout, ok := parseWait(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ack, err := api.exchangeService.CancelClientOrder(ctx, userID, clientOrderID, wait)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("handler: failed to cancel client order: %v\n", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	writeAck(w, ack)
+}
+
+// HandleAmendClientOrder reduces the volume of an order by the client order ID the user placed it with. Like
+// placing an order it accepts ?wait=true to respond with the engine's result.
+func (api *API) HandleAmendClientOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := middleware.UserIDFromContext(ctx)
+	clientOrderID := chi.URLParam(r, "clientOrderID")
+
+	var input AmendOrderInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+
+	wait, timeout, ok := parseWait(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ack, err := api.exchangeService.AmendClientOrder(ctx, userID, clientOrderID, input.Volume, wait)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, ErrInvalidVolume):
+			endpoint.WriteWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			log.Printf("handler: failed to amend client order: %v\n", err)
+			endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		}
+		return
+	}
+	writeAck(w, ack)
+}
+
+// HandleGetDeadLetters lists the most recent dead-lettered messages, up to ?limit.
+func (api *API) HandleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDeadLetterLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidLimit)
+			return
+		}
+		limit = min(n, maxDeadLetterLimit)
+	}
+
+	deadLetters, err := api.exchangeService.GetDeadLetters(limit)
+	if err != nil {
+		log.Printf("handler: failed to get dead letters: %v\n", err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, deadLetters)
+}
+
+func (api *API) HandleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl, err := api.exchangeService.GetDeadLetter(chi.URLParam(r, "deadLetterID"))
+	if err != nil {
+		writeDeadLetterErr(w, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, dl)
+}
+
+// HandleReplayDeadLetter publishes a dead-lettered message to its original topic again.
+func (api *API) HandleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl, err := api.exchangeService.ReplayDeadLetter(r.Context(), chi.URLParam(r, "deadLetterID"))
+	if err != nil {
+		writeDeadLetterErr(w, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusAccepted, dl)
+}
+
+func writeDeadLetterErr(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		endpoint.WriteWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	log.Printf("handler: dead letter request failed: %v\n", err)
+	endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+}
+
+// parseWait reads the ?wait and ?timeout_ms query parameters. With ?wait=true the response carries the engine's
+// result instead of only the order ID. It writes the error response and returns false when they are invalid.
+func parseWait(w http.ResponseWriter, r *http.Request) (wait bool, timeout time.Duration, ok bool) {
+	wait = r.URL.Query().Get("wait") == "true"
+	timeout = defaultAckTimeout
+	if t := r.URL.Query().Get("timeout_ms"); t != "" {
+		ms, err := strconv.Atoi(t)
+		if err != nil || ms <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidTimeout)
+			return false, 0, false
+		}
+		timeout = min(time.Duration(ms)*time.Millisecond, maxAckTimeout)
+	}
+	return wait, timeout, true
+}
+
+// writeAck responds with 202 while the engine has not processed the command yet and 422 when it rejected it.
+func writeAck(w http.ResponseWriter, ack OrderAck) {
+	switch ack.Status {
+	case AckStatusAccepted, AckStatusPending:
+		endpoint.WriteWithStatus(w, http.StatusAccepted, ack)
+	case orderbook.Rejected.String():
+		endpoint.WriteWithStatus(w, http.StatusUnprocessableEntity, ack)
+	default:
+		endpoint.WriteWithStatus(w, http.StatusOK, ack)
+	}
+}
+
+// HandleGetPriceData returns the candles of a symbol. ?interval selects the candle interval (default 1s), ?from and
+// ?to bound the candle start times and ?limit caps the number of candles, keeping the most recent ones.
 func (api *API) HandleGetPriceData(w http.ResponseWriter, r *http.Request) {
 	symbol := chi.URLParam(r, "symbol") // Extract the dynamic parameter
 	defer r.Body.Close()
 
-	priceData, err := api.exchangeService.GetSymbolMarketPriceHistory(symbol)
+	query := r.URL.Query()
+	interval := orderbook.BaseInterval
+	if i := query.Get("interval"); i != "" {
+		var err error
+		if interval, err = orderbook.ParseInterval(i); err != nil {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidInterval)
+			return
+		}
+	}
+	from, err := parseTime(query.Get("from"))
+	if err != nil {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidTime)
+		return
+	}
+	to, err := parseTime(query.Get("to"))
+	if err != nil {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidTime)
+		return
+	}
+	limit := defaultCandleLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidLimit)
+			return
+		}
+		limit = min(n, maxCandleLimit)
+	}
+
+	priceData, err := api.exchangeService.GetSymbolMarketPriceHistory(symbol, interval, from, to, limit)
 	if err != nil {
+		if errors.Is(err, ErrInvalidSymbol) {
+			endpoint.WriteWithError(w, http.StatusNotFound, errMsgInvalidSymbol)
+			return
+		}
 		log.Printf("handler: failed to get price history: %v\n", err)
 		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
 		return
-	}	
+	}
 
 	endpoint.WriteWithStatus(w, http.StatusOK, priceData)
 }
 
+// parseTime parses an RFC 3339 timestamp or unix seconds. An empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (api *API) HandleGetTicker(w http.ResponseWriter, r *http.Request) {
+	ticker, err := api.exchangeService.GetTicker(chi.URLParam(r, "symbol"))
+	if err != nil {
+		endpoint.WriteWithError(w, http.StatusNotFound, errMsgInvalidSymbol)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, ticker)
+}
+
+func (api *API) HandleGetTickers(w http.ResponseWriter, r *http.Request) {
+	endpoint.WriteWithStatus(w, http.StatusOK, api.exchangeService.GetTickers())
+}
+
+// HandleGetL3Snapshot returns the orders resting on a symbol's book, the starting point for the L3 feed.
+func (api *API) HandleGetL3Snapshot(w http.ResponseWriter, r *http.Request) {
+	book, err := api.exchangeService.GetL3Snapshot(chi.URLParam(r, "symbol"))
+	if err != nil {
+		endpoint.WriteWithError(w, http.StatusNotFound, errMsgInvalidSymbol)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, book)
+}
+
+func (api *API) HandleGetPersistenceStats(w http.ResponseWriter, r *http.Request) {
+	endpoint.WriteWithStatus(w, http.StatusOK, api.exchangeService.PersistenceStats())
+}
+
 // func (api *API) HandleStreamMarketPrice(w http.ResponseWriter, r *http.Request) {
 // 	// Unmarshal params
 // 	var params StreamPriceParams
@@ -114,15 +495,36 @@ func (api *API) HandleGetPriceData(w http.ResponseWriter, r *http.Request) {
 // 	}
 // }
 
-// RegisterHandlers is a function that registers all the handlers for the user endpoints
-func (api *API) RegisterHandlers(r chi.Router, authHandler func(http.Handler) http.Handler) {
+// RegisterHandlers is a function that registers all the handlers for the user endpoints. The /orders routes are
+// behind apiKeyHandler, which accepts both login tokens and requests signed with an API key, and the routes that
+// change orders are also behind tradeHandler.
+func (api *API) RegisterHandlers(r chi.Router, apiKeyHandler, tradeHandler, adminHandler func(http.Handler) http.Handler) {
 	r.Route("/price-history", func(r chi.Router) {
 		r.Get("/{symbol}", api.HandleGetPriceData)
 	})
+	r.Get("/ticker/{symbol}", api.HandleGetTicker)
+	r.Get("/tickers", api.HandleGetTickers)
+	r.Get("/l3/{symbol}", api.HandleGetL3Snapshot)
+	r.Get("/stats/persistence", api.HandleGetPersistenceStats)
 	r.Route("/orders", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
-			r.Use(authHandler)
-			r.Post("/", api.HandlePlaceOrder)
+			r.Use(apiKeyHandler)
+			r.With(tradeHandler).Post("/", api.HandlePlaceOrder)
+			r.Get("/{orderID}", api.HandleGetUserOrder)
+			r.Get("/client/{clientOrderID}", api.HandleGetClientOrder)
+			r.With(tradeHandler).Delete("/client/{clientOrderID}", api.HandleCancelClientOrder)
+			r.With(tradeHandler).Patch("/client/{clientOrderID}", api.HandleAmendClientOrder)
 		})
 	})
+	r.Route("/users/me/orders", func(r chi.Router) {
+		r.Use(apiKeyHandler)
+		r.Get("/", api.HandleGetUserOrders)
+		r.Get("/open", api.HandleGetOpenOrders)
+	})
+	r.Route("/admin/dead-letters", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/", api.HandleGetDeadLetters)
+		r.Get("/{deadLetterID}", api.HandleGetDeadLetter)
+		r.Post("/{deadLetterID}/replay", api.HandleReplayDeadLetter)
+	})
 }
@@ -0,0 +1,119 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// clientOrderTTL is how long an order stays in the index once the engine has applied it. Its writes are
+	// persisted well before then, later lookups find it in the database.
+	clientOrderTTL = 10 * time.Minute
+	// clientOrderSweepInterval is how often reserving an order also evicts the expired ones.
+	clientOrderSweepInterval = time.Minute
+)
+
+// clientOrder is what the exchange remembers about an order placed with a client order ID.
+type clientOrder struct {
+	orderID   string
+	symbol    string
+	applied   bool      // set once the engine has processed the order
+	ack       OrderAck  // the engine's latest result, valid once applied
+	appliedAt time.Time // when ack was last updated
+}
+
+// clientOrders indexes orders by user and client order ID so that a retried submission, or a redelivered message,
+// is answered with the original order instead of creating a new one. The database is the source of truth across
+// restarts, the index covers the window before an order has been persisted and evicts orders clientOrderTTL after
+// they were applied.
+type clientOrders struct {
+	mu        sync.Mutex
+	orders    map[string]*clientOrder
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newClientOrders() *clientOrders {
+	return &clientOrders{
+		orders: map[string]*clientOrder{},
+		now:    time.Now,
+	}
+}
+
+// latestAck returns the engine's latest result, or an accepted ack while the order is still queued.
+func (o clientOrder) latestAck(clientOrderID string) OrderAck {
+	if !o.applied {
+		return OrderAck{OrderID: o.orderID, ClientOrderID: clientOrderID, Status: AckStatusAccepted}
+	}
+	return o.ack
+}
+
+// duplicateAck is the response to a submission that reused the client order ID of o.
+func (o clientOrder) duplicateAck(clientOrderID string) OrderAck {
+	ack := o.latestAck(clientOrderID)
+	ack.Duplicate = true
+	return ack
+}
+
+func clientOrderKey(userID, clientOrderID string) string {
+	return userID + "/" + clientOrderID
+}
+
+func (c *clientOrders) get(key string) (clientOrder, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok := c.orders[key]
+	if !ok {
+		return clientOrder{}, false
+	}
+	return *o, true
+}
+
+// reserve records o under key unless the key is already taken, in which case the existing order is returned.
+func (c *clientOrders) reserve(key string, o clientOrder) (existing clientOrder, reserved bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastSweep) >= clientOrderSweepInterval {
+		c.evictExpired(now)
+	}
+	if e, ok := c.orders[key]; ok {
+		return *e, false
+	}
+	if o.applied {
+		o.appliedAt = now
+	}
+	c.orders[key] = &o
+	return o, true
+}
+
+// evictExpired removes the orders applied more than clientOrderTTL ago. Orders the engine hasn't applied yet stay,
+// the database doesn't know them.
+func (c *clientOrders) evictExpired(now time.Time) {
+	c.lastSweep = now
+	for key, o := range c.orders {
+		if o.applied && now.Sub(o.appliedAt) >= clientOrderTTL {
+			delete(c.orders, key)
+		}
+	}
+}
+
+// release frees a key reserved for orderID, used when the order never made it onto the bus.
+func (c *clientOrders) release(key, orderID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if o, ok := c.orders[key]; ok && o.orderID == orderID {
+		delete(c.orders, key)
+	}
+}
+
+// update stores the engine's latest result for the order held under key.
+func (c *clientOrders) update(key string, ack OrderAck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if o, ok := c.orders[key]; ok && o.orderID == ack.OrderID {
+		o.applied = true
+		o.ack = ack
+		o.appliedAt = c.now()
+	}
+}
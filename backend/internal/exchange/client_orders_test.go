@@ -0,0 +1,28 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientOrdersEvictAppliedOrders(t *testing.T) {
+	now := time.Now()
+	c := newClientOrders()
+	c.now = func() time.Time { return now }
+
+	c.reserve("user/applied", clientOrder{orderID: "1"})
+	c.update("user/applied", OrderAck{OrderID: "1", Status: "Filled"})
+	c.reserve("user/queued", clientOrder{orderID: "2"})
+
+	now = now.Add(clientOrderTTL)
+	c.reserve("user/new", clientOrder{orderID: "3"})
+	if _, ok := c.get("user/applied"); ok {
+		t.Error("an order applied clientOrderTTL ago is still indexed")
+	}
+	if _, ok := c.get("user/queued"); !ok {
+		t.Error("an order the engine hasn't applied was evicted")
+	}
+	if _, ok := c.get("user/new"); !ok {
+		t.Error("the reserved order is missing")
+	}
+}
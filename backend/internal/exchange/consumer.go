@@ -0,0 +1,178 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github/wry-0313/exchange/internal/bus"
+	"github/wry-0313/exchange/internal/orderbook"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	deadLetterTopic = "orders.deadletter"
+
+	// ordersConsumerGroup is the group the order book consumers commit their offsets under. A restarted exchange
+	// resumes from the last committed offset of each partition.
+	ordersConsumerGroup     = "orderbook"
+	deadLetterConsumerGroup = "deadletters"
+
+	// A dead letter that can't be published or stored is retried with a linear backoff up to deadLetterMaxBackoff
+	// until it succeeds or the consumer stops.
+	deadLetterRetryBackoff = 100 * time.Millisecond
+	deadLetterMaxBackoff   = 5 * time.Second
+)
+
+// consumeOrders applies the orders published to the orders topic until ctx is cancelled. Messages that cannot be
+// applied are sent to the dead-letter topic.
+func (s *service) consumeOrders(ctx context.Context) {
+	err := s.bus.Consume(ctx, ordersTopic, ordersConsumerGroup, func(ctx context.Context, msg bus.Message) error {
+		if err := s.handleOrderMessage(ctx, msg); err != nil {
+			return s.deadLetter(ctx, msg, err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to consume orders: %v", err)
+	}
+}
+
+// consumeDeadLetters stores the messages published to the dead-letter topic so they can be inspected and replayed.
+func (s *service) consumeDeadLetters(ctx context.Context) {
+	err := s.bus.Consume(ctx, deadLetterTopic, deadLetterConsumerGroup, s.storeDeadLetter)
+	if err != nil {
+		log.Fatalf("Failed to consume dead letters: %v", err)
+	}
+}
+
+// storeDeadLetter stores a dead letter, retrying until the repository accepts it. It only gives up once ctx is
+// done, returning the error so the bus leaves the message to be delivered again.
+func (s *service) storeDeadLetter(ctx context.Context, msg bus.Message) error {
+	var dl DeadLetter
+	if err := json.Unmarshal(msg.Value, &dl); err != nil {
+		log.Printf("Failed to deserialize dead letter: %v, message: %s\n", err, msg.Value)
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.repo.CreateDeadLetter(dl)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to store dead letter %s (attempt %d): %v\n", dl.ID, attempt, err)
+		if !waitToRetry(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// waitToRetry waits before the next attempt of a dead letter operation. It returns false once ctx is done.
+func waitToRetry(ctx context.Context, attempt int) bool {
+	select {
+	case <-time.After(min(time.Duration(attempt)*deadLetterRetryBackoff, deadLetterMaxBackoff)):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleOrderMessage applies a single command. Since commands are keyed by symbol, every partition is owned by a
+// fixed set of order books and the bus applies each symbol's commands in the order they were placed. It returns an
+// error when the message should be dead-lettered.
+func (s *service) handleOrderMessage(ctx context.Context, msg bus.Message) error {
+	var cmd orderCommand
+	if err := json.Unmarshal(msg.Value, &cmd); err != nil {
+		return fmt.Errorf("failed to deserialize order: %w", err)
+	}
+
+	if cmd.Cancel != nil {
+		res, err := s.processCancel(*cmd.Cancel)
+		ack := buildOrderAck(PlaceOrderInput{OrderID: cmd.Cancel.OrderID, ClientOrderID: cmd.Cancel.ClientOrderID}, res, err)
+		if err == nil {
+			s.clientOrders.update(clientOrderKey(cmd.Cancel.UserID, cmd.Cancel.ClientOrderID), ack)
+		}
+		s.reply(cmd.Cancel.CorrelationID, ack)
+		if errors.Is(err, orderbook.ErrOrderNotExists) {
+			// The order was filled or cancelled before the cancellation arrived, which is not a failure
+			return nil
+		}
+		return err
+	}
+
+	if cmd.Amend != nil {
+		res, err := s.processAmend(*cmd.Amend)
+		ack := buildOrderAck(PlaceOrderInput{OrderID: cmd.Amend.OrderID, ClientOrderID: cmd.Amend.ClientOrderID}, res, err)
+		if err == nil {
+			s.clientOrders.update(clientOrderKey(cmd.Amend.UserID, cmd.Amend.ClientOrderID), ack)
+		}
+		s.reply(cmd.Amend.CorrelationID, ack)
+		if errors.Is(err, orderbook.ErrOrderNotExists) || errors.Is(err, orderbook.ErrInvalidAmendment) {
+			// The order left the book or is already smaller, the caller gets the rejection and nothing is lost
+			return nil
+		}
+		return err
+	}
+
+	order := cmd.PlaceOrderInput
+	ack, ok, err := s.claimClientOrder(order)
+	if !ok && err == nil {
+		log.Printf("Skipping duplicate client order %s of user %s\n", order.ClientOrderID, order.UserID)
+		orderDone(s.riskChecks, order, false)
+		s.reply(order.CorrelationID, ack)
+		return nil
+	}
+	// An order whose client order ID can't be checked is recorded as rejected, so the user learns it wasn't
+	// placed, and dead-lettered
+	res, err := s.processOrder(order, err)
+	orderDone(s.riskChecks, order, err == nil)
+	ack = buildOrderAck(order, res, err)
+	if order.ClientOrderID != "" {
+		s.clientOrders.update(clientOrderKey(order.UserID, order.ClientOrderID), ack)
+	}
+	s.reply(order.CorrelationID, ack)
+	if err != nil {
+		s.notifyUser(order.UserID, EventOrderRejected, ack)
+	}
+	if errors.Is(err, orderbook.ErrTradingHalted) {
+		// The symbol was halted after the order was accepted, it is rejected like any order arriving during the halt
+		return nil
+	}
+	return err
+}
+
+// deadLetter publishes a message that could not be applied to the dead-letter topic along with the reason,
+// retrying until the bus accepts it. It only gives up once ctx is done or the bus is closed, returning the error so
+// the bus leaves the message to be delivered again.
+func (s *service) deadLetter(ctx context.Context, msg bus.Message, cause error) error {
+	log.Printf("Dead-lettering message at partition %d offset %d: %v\n", msg.Partition, msg.Offset, cause)
+
+	dl := DeadLetter{
+		ID:        ulid.Make().String(),
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Payload:   string(msg.Value),
+		Reason:    cause.Error(),
+		FailedAt:  time.Now(),
+	}
+	dlJSON, err := json.Marshal(dl)
+	if err != nil {
+		log.Printf("Failed to serialize dead letter: %v, message: %s\n", err, msg.Value)
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.bus.Publish(ctx, deadLetterTopic, msg.Key, dlJSON)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to publish dead letter (attempt %d): %v, message: %s\n", attempt, err, msg.Value)
+		if errors.Is(err, bus.ErrClosed) || !waitToRetry(ctx, attempt) {
+			return err
+		}
+	}
+}
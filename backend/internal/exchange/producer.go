@@ -1,20 +0,0 @@
-package exchange
-
-import (
-	"github.com/IBM/sarama"
-)
-
-// newProducer creates a new Kafka producer.
-func newProducer(brokerList []string) (sarama.SyncProducer, error) {
-	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Return.Successes = true
-
-	producer, err := sarama.NewSyncProducer(brokerList, config)
-	if err != nil {
-		return nil, err
-	}
-
-	return producer, nil
-}
-
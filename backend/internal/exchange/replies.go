@@ -0,0 +1,42 @@
+package exchange
+
+import "sync"
+
+// replies routes the engine's result for an order back to the request waiting on it, matched by correlation ID.
+// Results for requests that are not waiting, or stopped waiting, are dropped.
+type replies struct {
+	mu      sync.Mutex
+	pending map[string]chan OrderAck
+}
+
+func newReplies() *replies {
+	return &replies{
+		pending: map[string]chan OrderAck{},
+	}
+}
+
+// register returns the channel the result for correlationID will be delivered on. The caller must call cancel
+// once it stops waiting.
+func (r *replies) register(correlationID string) <-chan OrderAck {
+	ch := make(chan OrderAck, 1)
+	r.mu.Lock()
+	r.pending[correlationID] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+func (r *replies) cancel(correlationID string) {
+	r.mu.Lock()
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+}
+
+func (r *replies) deliver(correlationID string, ack OrderAck) {
+	r.mu.Lock()
+	ch, ok := r.pending[correlationID]
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+	if ok {
+		ch <- ack // buffered, never blocks
+	}
+}
@@ -0,0 +1,105 @@
+package exchange
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("Dead letter not found")
+)
+
+type Repository interface {
+	CreateDeadLetter(dl DeadLetter) error
+	GetDeadLetters(limit int) ([]DeadLetter, error)
+	GetDeadLetter(id string) (DeadLetter, error)
+	MarkDeadLetterReplayed(id, replayOrderID string, replayedAt time.Time) error
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+// CreateDeadLetter stores a dead letter. Storing the same dead letter twice, as happens when the dead-letter topic
+// redelivers a message, is a no-op.
+func (r *repository) CreateDeadLetter(dl DeadLetter) error {
+	_, err := r.db.Exec(`INSERT IGNORE INTO dead_letters (dead_letter_id, topic, message_key, message_partition, message_offset, payload, reason, failed_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, dl.ID, dl.Topic, dl.Key, dl.Partition, dl.Offset, dl.Payload, dl.Reason, dl.FailedAt)
+	if err != nil {
+		return fmt.Errorf("repository: failed to create dead letter: %w", err)
+	}
+	return nil
+}
+
+// GetDeadLetters returns the most recent dead letters first.
+func (r *repository) GetDeadLetters(limit int) ([]DeadLetter, error) {
+	rows, err := r.db.Query(`SELECT dead_letter_id, topic, message_key, message_partition, message_offset, payload, reason, failed_at, replayed_at, replay_order_id
+	FROM dead_letters ORDER BY failed_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters := []DeadLetter{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: error iterating dead letters: %w", err)
+	}
+	return deadLetters, nil
+}
+
+func (r *repository) GetDeadLetter(id string) (DeadLetter, error) {
+	row := r.db.QueryRow(`SELECT dead_letter_id, topic, message_key, message_partition, message_offset, payload, reason, failed_at, replayed_at, replay_order_id
+	FROM dead_letters WHERE dead_letter_id = ?`, id)
+	dl, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return dl, err
+}
+
+// MarkDeadLetterReplayed records when a dead letter was replayed and, for orders, the order ID it was replayed under.
+func (r *repository) MarkDeadLetterReplayed(id, replayOrderID string, replayedAt time.Time) error {
+	replayOrder := sql.NullString{String: replayOrderID, Valid: replayOrderID != ""}
+	_, err := r.db.Exec(`UPDATE dead_letters SET replayed_at = ?, replay_order_id = ? WHERE dead_letter_id = ?`, replayedAt, replayOrder, id)
+	if err != nil {
+		return fmt.Errorf("repository: failed to mark dead letter replayed: %w", err)
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDeadLetter(row scanner) (DeadLetter, error) {
+	var dl DeadLetter
+	var replayedAt sql.NullTime
+	var replayOrderID sql.NullString
+	err := row.Scan(&dl.ID, &dl.Topic, &dl.Key, &dl.Partition, &dl.Offset, &dl.Payload, &dl.Reason, &dl.FailedAt, &replayedAt, &replayOrderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DeadLetter{}, err
+		}
+		return DeadLetter{}, fmt.Errorf("repository: failed to scan dead letter: %w", err)
+	}
+	if replayedAt.Valid {
+		dl.ReplayedAt = &replayedAt.Time
+	}
+	dl.ReplayOrderID = replayOrderID.String
+	return dl, nil
+}
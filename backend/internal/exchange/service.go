@@ -1,68 +1,137 @@
 package exchange
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github/wry-0313/exchange/internal/bus"
 	"github/wry-0313/exchange/internal/models"
 	"github/wry-0313/exchange/internal/orderbook"
 	"github/wry-0313/exchange/internal/user"
 	"github/wry-0313/exchange/pkg/validator"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/IBM/sarama"
 	"github.com/oklog/ulid/v2"
+	"github.com/redis/go-redis/v9"
 	"github.com/shopspring/decimal"
 )
 
 const (
-	kafkaTopic    = "orders"
-	NumPartitions = 5
+	ordersTopic = "orders"
 )
 
 var (
 	ErrInvalidSymbol = errors.New("Symbol not found")
+	ErrOrderNotFound = errors.New("Order not found")
+	ErrInvalidVolume = errors.New("Volume must be positive")
+	ErrTradingHalted = errors.New("Trading is halted for this symbol")
+	// ErrOrderRejected is wrapped by the errors of a RiskCheck, their message tells the user why.
+	ErrOrderRejected = errors.New("Order rejected")
+
+	// errClientOrderUnchecked rejects an order whose client order ID could not be checked for duplicates.
+	errClientOrderUnchecked = errors.New("Client order ID could not be checked, the order was not placed")
 )
 
+// RiskCheck checks an order before it is queued for the engine, see Service.AddRiskCheck. A rejected order is
+// reported with an error wrapping ErrOrderRejected.
+type RiskCheck interface {
+	CheckOrder(input PlaceOrderInput) error
+	// OrderDone is called for an order that passed CheckOrder once it is known whether it reached the book:
+	// accepted is false when a later check rejected it, it could not be published or the engine rejected it.
+	OrderDone(input PlaceOrderInput, accepted bool)
+}
+
 type Service interface {
-	PlaceOrder(input PlaceOrderInput) error
+	// PlaceOrder assigns the order an ID and queues it for the engine. When wait is set it blocks until the engine
+	// has processed the order or ctx is done, whichever comes first.
+	PlaceOrder(ctx context.Context, input PlaceOrderInput, wait bool) (OrderAck, error)
+	// GetClientOrder returns the latest known state of the order a user placed with clientOrderID.
+	GetClientOrder(userID, clientOrderID string) (OrderAck, error)
+	// CancelClientOrder queues the cancellation of the order a user placed with clientOrderID, waiting for the
+	// engine like PlaceOrder does.
+	CancelClientOrder(ctx context.Context, userID, clientOrderID string, wait bool) (OrderAck, error)
+	// AmendClientOrder queues the reduction of the order a user placed with clientOrderID to volume, waiting for
+	// the engine like PlaceOrder does. The order keeps its place in the queue.
+	AmendClientOrder(ctx context.Context, userID, clientOrderID string, volume float64, wait bool) (OrderAck, error)
+	// GetUserOrders returns the user's orders matching filter, newest first. Orders show up once the engine's
+	// writes are persisted.
+	GetUserOrders(userID string, filter orderbook.OrderFilter) ([]models.Order, error)
+	// GetUserOrder returns an order of the user with its fills.
+	GetUserOrder(userID, orderID string) (OrderDetails, error)
 
-	Run(brokerList []string)
-	ShutdownConsumers()
-	GetSymbolMarketPriceHistory(symbol string) ([]models.StockPriceHistory, error)
+	// Run starts the consumers and the order books' background work. ctx only bounds the startup, the work keeps
+	// running until Shutdown.
+	Run(ctx context.Context)
+	// Shutdown stops the consumers once the message being applied is done, then stops the order books, snapshots
+	// them and flushes their pending writes. It gives up when ctx is done.
+	Shutdown(ctx context.Context) error
+	GetSymbolMarketPriceHistory(symbol string, interval orderbook.Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error)
+	GetTicker(symbol string) (orderbook.Ticker, error)
+	GetTickers() []orderbook.Ticker
+	// HasSymbol reports whether symbol is listed on the exchange.
+	HasSymbol(symbol string) bool
+	GetL3Snapshot(symbol string) (orderbook.L3Book, error)
+	PersistenceStats() []orderbook.WriterStats
+	// SetTradingHalted halts or resumes trading on a symbol, see orderbook.Service.SetHalted.
+	SetTradingHalted(symbol string, halted bool) error
+	// AddRiskCheck makes PlaceOrder check orders with check once they are validated, after the checks added
+	// before it. It must be called before orders are placed.
+	AddRiskCheck(check RiskCheck)
+
+	// GetDeadLetters returns the most recent messages the consumer could not apply.
+	GetDeadLetters(limit int) ([]DeadLetter, error)
+	GetDeadLetter(id string) (DeadLetter, error)
+	// ReplayDeadLetter publishes a dead-lettered message to its original topic again. A replayed order is placed
+	// under a fresh order ID, which the dead letter links to.
+	ReplayDeadLetter(ctx context.Context, id string) (DeadLetter, error)
 }
 
 type service struct {
-	validator  validator.Validate
-	obServices map[string]orderbook.Service
-	producer   sarama.SyncProducer
-	Shutdown   chan struct{}
-	userRepo   user.Repository
+	validator    validator.Validate
+	obServices   map[string]orderbook.Service
+	bus          bus.Bus
+	repo         Repository
+	userRepo     user.Repository
+	obRepo       orderbook.Repository
+	rdb          *redis.Client
+	replies      *replies
+	clientOrders *clientOrders
+	riskChecks   []RiskCheck
+
+	cancelConsumers context.CancelFunc
+	consumersWg     sync.WaitGroup
+	stopBooks       context.CancelFunc // stops the order books' simulations and tickers
 }
 
-func NewService(userRepo user.Repository, obServices map[string]orderbook.Service, validator validator.Validate, brokerList []string) Service {
-	producer, err := newProducer(brokerList)
-	if err != nil {
-		log.Fatalf("Could not create producer: %v", err)
-	}
+func NewService(repo Repository, userRepo user.Repository, obRepo orderbook.Repository, obServices map[string]orderbook.Service, validator validator.Validate, b bus.Bus, rdb *redis.Client) Service {
 	return &service{
-		validator:  validator,
-		obServices: obServices,
-		producer:   producer,
-		Shutdown:   make(chan struct{}),
-		userRepo:   userRepo,
+		validator:    validator,
+		obServices:   obServices,
+		bus:          b,
+		repo:         repo,
+		userRepo:     userRepo,
+		obRepo:       obRepo,
+		rdb:          rdb,
+		replies:      newReplies(),
+		clientOrders: newClientOrders(),
+		// replaced by Run once the consumers and books start
+		cancelConsumers: func() {},
+		stopBooks:       func() {},
 	}
 }
 
-func (s *service) Run(brokerList []string) {
+func (s *service) Run(ctx context.Context) {
 	marketSimulationUlid := ulid.Make()
 	email := "market@gmail.com"
 	err := s.userRepo.CreateUser(models.User{
 		ID:    marketSimulationUlid.String(),
 		Name:  "Market Simulation",
 		Email: &email,
+		Role:  models.RoleMarketMaker,
 	})
 
 	if err != nil {
@@ -78,171 +147,570 @@ func (s *service) Run(brokerList []string) {
 		}
 	}
 
-	go s.startConsumers(brokerList)
+	s.startConsumers()
+	booksCtx, stopBooks := context.WithCancel(context.Background())
+	s.stopBooks = stopBooks
 	for _, ob := range s.obServices {
 		log.Printf("Starting market price history persistance for %v\n", ob.Symbol())
-		ob.SimulateMarketFluctuations(marketSimulationUlid)
-		time.Sleep(4 * time.Second)
-		ob.Run()
+		ob.SimulateMarketFluctuations(booksCtx, marketSimulationUlid)
+		select {
+		case <-time.After(4 * time.Second):
+		case <-ctx.Done():
+			log.Printf("Startup interrupted: %v\n", ctx.Err())
+			return
+		}
+		ob.Run(booksCtx)
 	}
 }
 
-func (s *service) GetSymbolMarketPriceHistory(symbol string) ([]models.StockPriceHistory, error) {
+// startConsumers starts applying orders and storing dead letters from the bus in the background until Shutdown is
+// called.
+func (s *service) startConsumers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelConsumers = cancel
+	s.consumersWg.Add(2)
+	go func() {
+		defer s.consumersWg.Done()
+		s.consumeOrders(ctx)
+	}()
+	go func() {
+		defer s.consumersWg.Done()
+		s.consumeDeadLetters(ctx)
+	}()
+}
+
+// GetSymbolMarketPriceHistory returns the candles of a symbol, see orderbook.Service.GetCandles.
+func (s *service) GetSymbolMarketPriceHistory(symbol string, interval orderbook.Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error) {
 	ob, ok := s.obServices[symbol]
 	if !ok {
 		return nil, ErrInvalidSymbol
 	}
-	return ob.GetMarketPriceHistory()
+	return ob.GetCandles(interval, from, to, limit)
 }
 
-func (s *service) PlaceOrder(input PlaceOrderInput) error {
+func (s *service) GetTicker(symbol string) (orderbook.Ticker, error) {
+	ob, ok := s.obServices[symbol]
+	if !ok {
+		return orderbook.Ticker{}, ErrInvalidSymbol
+	}
+	return ob.Ticker(), nil
+}
+
+func (s *service) HasSymbol(symbol string) bool {
+	_, ok := s.obServices[symbol]
+	return ok
+}
+
+// GetL3Snapshot returns every order resting on a symbol's book, see the L3 feed.
+func (s *service) GetL3Snapshot(symbol string) (orderbook.L3Book, error) {
+	ob, ok := s.obServices[symbol]
+	if !ok {
+		return orderbook.L3Book{}, ErrInvalidSymbol
+	}
+	return ob.L3Snapshot(), nil
+}
+
+// GetTickers returns the ticker of every symbol, ordered by symbol.
+func (s *service) GetTickers() []orderbook.Ticker {
+	tickers := make([]orderbook.Ticker, 0, len(s.obServices))
+	for _, ob := range s.obServices {
+		tickers = append(tickers, ob.Ticker())
+	}
+	sort.Slice(tickers, func(i, j int) bool { return tickers[i].Symbol < tickers[j].Symbol })
+	return tickers
+}
+
+// PersistenceStats returns the persistence queue metrics of every order book.
+func (s *service) PersistenceStats() []orderbook.WriterStats {
+	stats := make([]orderbook.WriterStats, 0, len(s.obServices))
+	for _, ob := range s.obServices {
+		stats = append(stats, ob.PersistenceStats())
+	}
+	return stats
+}
+
+func (s *service) SetTradingHalted(symbol string, halted bool) error {
+	ob, ok := s.obServices[symbol]
+	if !ok {
+		return ErrInvalidSymbol
+	}
+	if err := ob.SetHalted(halted); err != nil {
+		return fmt.Errorf("service: failed to set trading status: %w", err)
+	}
+	return nil
+}
+
+func (s *service) AddRiskCheck(check RiskCheck) {
+	s.riskChecks = append(s.riskChecks, check)
+}
+
+func (s *service) PlaceOrder(ctx context.Context, input PlaceOrderInput, wait bool) (OrderAck, error) {
 	if err := s.validator.Struct(input); err != nil {
-		return fmt.Errorf("service: validation error: %w", err)
+		return OrderAck{}, fmt.Errorf("service: validation error: %w", err)
 	}
 
 	// Check the validity of the input symbol
-	_, ok := s.obServices[input.Symbol]
+	ob, ok := s.obServices[input.Symbol]
 	if !ok {
-		return ErrInvalidSymbol
+		return OrderAck{}, ErrInvalidSymbol
+	}
+	if ob.Halted() {
+		return OrderAck{}, ErrTradingHalted
+	}
+
+	input.OrderID = ulid.Make().String()
+	input.CorrelationID = ulid.Make().String()
+
+	if input.ClientOrderID != "" {
+		existing, found, err := s.findClientOrder(input.UserID, input.ClientOrderID)
+		if err != nil {
+			return OrderAck{}, err
+		}
+		if found {
+			return existing.duplicateAck(input.ClientOrderID), nil
+		}
+		key := clientOrderKey(input.UserID, input.ClientOrderID)
+		if existing, reserved := s.clientOrders.reserve(key, clientOrder{orderID: input.OrderID, symbol: input.Symbol}); !reserved {
+			return existing.duplicateAck(input.ClientOrderID), nil
+		}
+	}
+
+	for i, check := range s.riskChecks {
+		if err := check.CheckOrder(input); err != nil {
+			if input.ClientOrderID != "" {
+				s.clientOrders.release(clientOrderKey(input.UserID, input.ClientOrderID), input.OrderID)
+			}
+			orderDone(s.riskChecks[:i], input, false)
+			return OrderAck{}, err
+		}
 	}
 
 	inputJSON, err := json.Marshal(input)
 	if err != nil {
-		return fmt.Errorf("Failed to serialize order to JSON: %w", err)
+		orderDone(s.riskChecks, input, false)
+		return OrderAck{}, fmt.Errorf("Failed to serialize order to JSON: %w", err)
 	}
 
-	// Produce the serialized Order object to Kafka
-	msg := &sarama.ProducerMessage{
-		Topic: kafkaTopic,
-		Value: sarama.ByteEncoder(inputJSON),
+	accepted := OrderAck{OrderID: input.OrderID, ClientOrderID: input.ClientOrderID, Status: AckStatusAccepted}
+	ack, err := s.publish(ctx, input.Symbol, input.CorrelationID, inputJSON, wait, accepted)
+	if err != nil {
+		// The order never reached the bus, so a retry with the same client order ID must be able to place it
+		if input.ClientOrderID != "" {
+			s.clientOrders.release(clientOrderKey(input.UserID, input.ClientOrderID), input.OrderID)
+		}
+		orderDone(s.riskChecks, input, false)
 	}
+	return ack, err
+}
+
+// orderDone tells checks whether an order they passed reached the book, see RiskCheck.OrderDone.
+func orderDone(checks []RiskCheck, input PlaceOrderInput, accepted bool) {
+	for _, check := range checks {
+		check.OrderDone(input, accepted)
+	}
+}
+
+func (s *service) GetClientOrder(userID, clientOrderID string) (OrderAck, error) {
+	// The database is checked first since it also reflects fills the order received after it was placed
+	order, err := s.obRepo.GetOrderByClientOrderID(userID, clientOrderID)
+	if err == nil {
+		return ackFromOrder(order), nil
+	}
+	if !errors.Is(err, orderbook.ErrOrderNotExists) {
+		return OrderAck{}, fmt.Errorf("service: failed to get client order: %w", err)
+	}
+
+	// Not persisted yet
+	o, ok := s.clientOrders.get(clientOrderKey(userID, clientOrderID))
+	if !ok {
+		return OrderAck{}, ErrOrderNotFound
+	}
+	return o.latestAck(clientOrderID), nil
+}
 
-	_, _, err = s.producer.SendMessage(msg)
+func (s *service) CancelClientOrder(ctx context.Context, userID, clientOrderID string, wait bool) (OrderAck, error) {
+	o, found, err := s.findClientOrder(userID, clientOrderID)
 	if err != nil {
-		return fmt.Errorf("Failed to send message: %w", err)
+		return OrderAck{}, err
+	}
+	if !found {
+		return OrderAck{}, ErrOrderNotFound
 	}
 
-	return nil
+	cmd := orderCommand{Cancel: &cancelOrderCommand{
+		OrderID:       o.orderID,
+		UserID:        userID,
+		ClientOrderID: clientOrderID,
+		Symbol:        o.symbol,
+		CorrelationID: ulid.Make().String(),
+	}}
+	cmdJSON, err := json.Marshal(cmd)
+	if err != nil {
+		return OrderAck{}, fmt.Errorf("Failed to serialize cancel to JSON: %w", err)
+	}
+
+	accepted := OrderAck{OrderID: o.orderID, ClientOrderID: clientOrderID, Status: AckStatusAccepted}
+	return s.publish(ctx, o.symbol, cmd.Cancel.CorrelationID, cmdJSON, wait, accepted)
 }
 
-func (s *service) startConsumers(brokerList []string) {
-	config := sarama.NewConfig()
-	admin, err := sarama.NewClusterAdmin(brokerList, config)
+func (s *service) AmendClientOrder(ctx context.Context, userID, clientOrderID string, volume float64, wait bool) (OrderAck, error) {
+	if volume <= 0 {
+		return OrderAck{}, ErrInvalidVolume
+	}
+	o, found, err := s.findClientOrder(userID, clientOrderID)
 	if err != nil {
-		log.Fatal("Error while creating cluster admin: ", err.Error())
+		return OrderAck{}, err
 	}
-	defer func() { admin.Close() }()
-	topics, err := admin.ListTopics()
+	if !found {
+		return OrderAck{}, ErrOrderNotFound
+	}
+
+	cmd := orderCommand{Amend: &amendOrderCommand{
+		OrderID:       o.orderID,
+		UserID:        userID,
+		ClientOrderID: clientOrderID,
+		Symbol:        o.symbol,
+		Volume:        volume,
+		CorrelationID: ulid.Make().String(),
+	}}
+	cmdJSON, err := json.Marshal(cmd)
 	if err != nil {
-		log.Fatal("Error listing topics: ", err.Error())
+		return OrderAck{}, fmt.Errorf("Failed to serialize amendment to JSON: %w", err)
 	}
 
-	if _, exists := topics[kafkaTopic]; !exists {
-		err = admin.CreateTopic(kafkaTopic, &sarama.TopicDetail{
-			NumPartitions:     NumPartitions,
-			ReplicationFactor: 1,
-		}, false)
-		if err != nil {
-			log.Fatal("Error while creating topic: ", err.Error())
-		}
-	} else {
-		log.Printf("Topic '%s' already exists. Skipping creation.", kafkaTopic)
+	accepted := OrderAck{OrderID: o.orderID, ClientOrderID: clientOrderID, Status: AckStatusAccepted}
+	return s.publish(ctx, o.symbol, cmd.Amend.CorrelationID, cmdJSON, wait, accepted)
+}
+
+// publish sends a command to the orders topic. Without wait it returns accepted right away, otherwise it waits for
+// the engine's reply until ctx is done.
+func (s *service) publish(ctx context.Context, symbol, correlationID string, payload []byte, wait bool, accepted OrderAck) (OrderAck, error) {
+	var reply <-chan OrderAck
+	if wait {
+		// Register before producing so a fast consumer cannot reply before anyone listens
+		reply = s.replies.register(correlationID)
+		defer s.replies.cancel(correlationID)
+	}
+
+	// Keying by symbol sends every command for a symbol to the same partition, so they are consumed in the order
+	// they were accepted.
+	if err := s.bus.Publish(ctx, ordersTopic, symbol, payload); err != nil {
+		return OrderAck{}, fmt.Errorf("Failed to send message: %w", err)
 	}
 
-	config.Consumer.Return.Errors = true
-	consumer, err := sarama.NewConsumer(brokerList, config)
+	if !wait {
+		return accepted, nil
+	}
+	select {
+	case ack := <-reply:
+		return ack, nil
+	case <-ctx.Done():
+		accepted.Status = AckStatusPending
+		return accepted, nil
+	}
+}
+
+// findClientOrder looks up the order a user placed with clientOrderID, first in memory and then in the database.
+// Orders only found in the database are added to the index so that later lookups stay in memory.
+func (s *service) findClientOrder(userID, clientOrderID string) (clientOrder, bool, error) {
+	key := clientOrderKey(userID, clientOrderID)
+	if o, ok := s.clientOrders.get(key); ok {
+		return o, true, nil
+	}
+
+	order, err := s.obRepo.GetOrderByClientOrderID(userID, clientOrderID)
+	if errors.Is(err, orderbook.ErrOrderNotExists) {
+		return clientOrder{}, false, nil
+	}
 	if err != nil {
-		log.Fatal("Failed to start consumer:", err)
+		return clientOrder{}, false, fmt.Errorf("service: failed to look up client order: %w", err)
 	}
+	o, _ := s.clientOrders.reserve(key, clientOrder{
+		orderID: order.OrderID,
+		symbol:  order.Symbol,
+		applied: true,
+		ack:     ackFromOrder(order),
+	})
+	return o, true, nil
+}
 
-	var wg sync.WaitGroup
+// claimClientOrder decides whether a consumed order may be applied. It returns false with the ack to reply with
+// when the client order ID already belongs to an order the engine has seen, which covers both a redelivered
+// message and a second order that slipped past the check in PlaceOrder. It returns errClientOrderUnchecked when
+// the client order ID can't be looked up.
+func (s *service) claimClientOrder(order PlaceOrderInput) (OrderAck, bool, error) {
+	if order.ClientOrderID == "" {
+		return OrderAck{}, true, nil
+	}
 
-	partitionList, err := consumer.Partitions(kafkaTopic)
+	existing, found, err := s.findClientOrder(order.UserID, order.ClientOrderID)
 	if err != nil {
-		log.Fatal("Failed to get the list of partitions:", err)
+		log.Printf("Failed to check client order %s of user %s: %v\n", order.ClientOrderID, order.UserID, err)
+		return OrderAck{}, false, errClientOrderUnchecked
+	}
+	if !found {
+		key := clientOrderKey(order.UserID, order.ClientOrderID)
+		var reserved bool
+		if existing, reserved = s.clientOrders.reserve(key, clientOrder{orderID: order.OrderID, symbol: order.Symbol}); reserved {
+			return OrderAck{}, true, nil
+		}
+	}
+	if existing.orderID != order.OrderID || existing.applied {
+		return existing.duplicateAck(order.ClientOrderID), false, nil
 	}
+	return OrderAck{}, true, nil
+}
 
-	for _, partition := range partitionList {
+// processOrder applies a consumed order to the order book that owns its symbol, or rejects it with reject when
+// set. An order that cannot be submitted is recorded as rejected, unless it has no valid user or symbol to be
+// stored under.
+func (s *service) processOrder(order PlaceOrderInput, reject error) (orderbook.OrderResult, error) {
+	req := orderbook.OrderRequest{ClientOrderID: order.ClientOrderID}
+	var err error
+	if req.UserID, err = ulid.Parse(order.UserID); err != nil {
+		return orderbook.OrderResult{}, fmt.Errorf("failed to parse ULID: %w", err)
+	}
+	service := s.obServices[order.Symbol]
+	if service == nil {
+		return orderbook.OrderResult{}, fmt.Errorf("%w: %s", ErrInvalidSymbol, order.Symbol)
+	}
+	log.Printf("Consumer processing: %v\n", order)
+	req.Volume = decimal.NewFromFloat(order.Volume).Round(2)
+	if order.OrderType == "limit" {
+		req.Price = decimal.NewFromFloat(order.Price).Round(2)
+	}
 
-		pc, err := consumer.ConsumePartition(kafkaTopic, partition, sarama.OffsetNewest)
-		if err != nil {
-			log.Fatalf("Failed to start consumer for partition %d: %s", partition, err)
+	cause := reject
+	if req.OrderID, err = ulid.Parse(order.OrderID); err != nil {
+		// The rejection is recorded under a fresh order ID
+		req.OrderID = ulid.ULID{}
+		if cause == nil {
+			cause = fmt.Errorf("failed to parse order ID: %w", err)
 		}
+	}
+	if req.Side, err = orderbook.SideFromString(order.OrderSide); err != nil && cause == nil {
+		cause = fmt.Errorf("failed to parse side: %w", err)
+	}
+	switch order.OrderType {
+	case "limit":
+		req.Type = orderbook.Limit
+	case "market":
+		req.Type = orderbook.Market
+	default:
+		if cause == nil {
+			cause = errors.New("invalid order type")
+		}
+	}
+	if cause != nil {
+		return service.RejectOrder(req, cause), cause
+	}
+	return service.SubmitOrder(req)
+}
 
-		go func(pc sarama.PartitionConsumer) {
-			<-s.Shutdown
-			log.Printf("Shutting down partition consumer %d\n", partition)
-			pc.AsyncClose()
-		}(pc)
+// processCancel applies a consumed cancellation to the order book that owns the order.
+func (s *service) processCancel(cmd cancelOrderCommand) (orderbook.OrderResult, error) {
+	orderID, err := ulid.Parse(cmd.OrderID)
+	if err != nil {
+		return orderbook.OrderResult{}, fmt.Errorf("failed to parse order ID: %w", err)
+	}
+	userID, err := ulid.Parse(cmd.UserID)
+	if err != nil {
+		return orderbook.OrderResult{}, fmt.Errorf("failed to parse ULID: %w", err)
+	}
+	service := s.obServices[cmd.Symbol]
+	if service == nil {
+		return orderbook.OrderResult{}, fmt.Errorf("%w: %s", ErrInvalidSymbol, cmd.Symbol)
+	}
+	return service.CancelOrder(orderID, userID)
+}
 
-		go s.consume(pc, &wg, 0)
+// processAmend applies a consumed amendment to the order book that owns the order.
+func (s *service) processAmend(cmd amendOrderCommand) (orderbook.OrderResult, error) {
+	orderID, err := ulid.Parse(cmd.OrderID)
+	if err != nil {
+		return orderbook.OrderResult{}, fmt.Errorf("failed to parse order ID: %w", err)
 	}
+	userID, err := ulid.Parse(cmd.UserID)
+	if err != nil {
+		return orderbook.OrderResult{}, fmt.Errorf("failed to parse ULID: %w", err)
+	}
+	service := s.obServices[cmd.Symbol]
+	if service == nil {
+		return orderbook.OrderResult{}, fmt.Errorf("%w: %s", ErrInvalidSymbol, cmd.Symbol)
+	}
+	return service.AmendOrder(orderID, userID, decimal.NewFromFloat(cmd.Volume).Round(2))
+}
 
-	wg.Wait()
+// reply hands the outcome of a consumed command to the request waiting for it, if any.
+func (s *service) reply(correlationID string, ack OrderAck) {
+	if correlationID == "" {
+		return
+	}
+	s.replies.deliver(correlationID, ack)
 }
 
-func (s *service) consume(pc sarama.PartitionConsumer, wg *sync.WaitGroup, index int) {
-	defer wg.Done()
-	for {
-		select {
-		case msg, ok := <-pc.Messages():
-			if !ok {
-				log.Println("Error consuming message")
-				continue
-			}
-			var order PlaceOrderInput
-			err := json.Unmarshal(msg.Value, &order)
-			if err != nil {
-				log.Println("Failed to deserialize order:", err)
-				continue
-			}
-			userID, error := ulid.Parse(order.UserID)
-			if error != nil {
-				log.Println("Failed to parse ULID:", error)
-				continue
-			}
-			side, error := orderbook.SideFromString(order.OrderSide)
-			if error != nil {
-				log.Println("Failed to parse side:", error)
-				continue
-			}
-			log.Printf("Consumer processing: %v\n", order)
-			switch order.OrderType {
-			case "limit":
-				service := s.obServices[order.Symbol]
-				if service == nil {
-					log.Printf("Invalid symbol: %s\n", order.Symbol)
-					continue
-				}
-				_, err := service.PlaceLimitOrder(side, userID, decimal.NewFromFloat(order.Volume).Round(2), decimal.NewFromFloat(order.Price).Round(2))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			case "market":
-				service := s.obServices[order.Symbol]
-				if service == nil {
-					log.Printf("Invalid symbol: %s\n", order.Symbol)
-					continue
-				}
-				_, err := service.PlaceMarketOrder(side, userID, decimal.NewFromFloat(order.Volume).Round(2))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			default:
-				log.Println("Invalid order type")
-			}
-		case err := <-pc.Errors():
-			log.Println("Error consuming message: ", err)
-		case <-s.Shutdown:
-			log.Printf("Shutting down partition consumer %d\n", index)
-			return
+func buildOrderAck(order PlaceOrderInput, res orderbook.OrderResult, err error) OrderAck {
+	if err != nil {
+		orderID := order.OrderID
+		if res.OrderID != (ulid.ULID{}) {
+			// Rejections of malformed order IDs are recorded under a fresh one
+			orderID = res.OrderID.String()
+		}
+		return OrderAck{
+			OrderID:       orderID,
+			ClientOrderID: order.ClientOrderID,
+			Status:        orderbook.Rejected.String(),
+			RejectReason:  err.Error(),
+		}
+	}
+	ack := OrderAck{
+		OrderID:         res.OrderID.String(),
+		ClientOrderID:   order.ClientOrderID,
+		Status:          res.Status.String(),
+		RemainingVolume: &res.RemainingVolume,
+	}
+	for _, f := range res.Fills {
+		ack.Fills = append(ack.Fills, FillDTO{Price: f.Price.InexactFloat64(), Volume: f.Volume.InexactFloat64()})
+	}
+	return ack
+}
+
+// ackFromOrder describes a persisted order. Fills are not stored individually so the ack carries none.
+func ackFromOrder(order models.Order) OrderAck {
+	remaining := decimal.NewFromFloat(order.Volume)
+	ack := OrderAck{
+		OrderID:         order.OrderID,
+		Status:          order.OrderStatus,
+		RemainingVolume: &remaining,
+	}
+	if order.ClientOrderID != nil {
+		ack.ClientOrderID = *order.ClientOrderID
+	}
+	return ack
+}
+
+func (s *service) GetUserOrders(userID string, filter orderbook.OrderFilter) ([]models.Order, error) {
+	if filter.Symbol != "" {
+		if _, ok := s.obServices[filter.Symbol]; !ok {
+			return nil, ErrInvalidSymbol
 		}
 	}
+	orders, err := s.obRepo.GetUserOrders(userID, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get user orders: %w", err)
+	}
+	return orders, nil
+}
+
+func (s *service) GetUserOrder(userID, orderID string) (OrderDetails, error) {
+	order, err := s.obRepo.GetUserOrder(userID, orderID)
+	if errors.Is(err, orderbook.ErrOrderNotExists) {
+		return OrderDetails{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return OrderDetails{}, fmt.Errorf("service: failed to get order: %w", err)
+	}
+	fills, err := s.obRepo.GetOrderFills(orderID)
+	if err != nil {
+		return OrderDetails{}, fmt.Errorf("service: failed to get order fills: %w", err)
+	}
+	return OrderDetails{Order: order, Fills: fills}, nil
 }
 
-func (s *service) ShutdownConsumers() {
-	log.Println("Shutting down consumers called")
-	close(s.Shutdown)
+func (s *service) GetDeadLetters(limit int) ([]DeadLetter, error) {
+	return s.repo.GetDeadLetters(limit)
+}
+
+func (s *service) GetDeadLetter(id string) (DeadLetter, error) {
+	return s.repo.GetDeadLetter(id)
+}
+
+func (s *service) ReplayDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	dl, err := s.repo.GetDeadLetter(id)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	payload, replayOrderID := replayPayload(dl)
+	if err := s.bus.Publish(ctx, dl.Topic, dl.Key, payload); err != nil {
+		return DeadLetter{}, fmt.Errorf("Failed to replay dead letter: %w", err)
+	}
+	replayedAt := time.Now()
+	if err := s.repo.MarkDeadLetterReplayed(dl.ID, replayOrderID, replayedAt); err != nil {
+		return DeadLetter{}, err
+	}
+	dl.ReplayedAt = &replayedAt
+	dl.ReplayOrderID = replayOrderID
+	return dl, nil
+}
+
+// replayPayload returns the message to publish when replaying a dead letter. The original order was recorded as
+// rejected under its ID, so a placed order gets a fresh one, and nobody waits for the reply anymore. Other
+// messages are replayed unchanged and return no order ID.
+func replayPayload(dl DeadLetter) ([]byte, string) {
+	var cmd orderCommand
+	if dl.Topic != ordersTopic || json.Unmarshal([]byte(dl.Payload), &cmd) != nil || cmd.Cancel != nil || cmd.Amend != nil {
+		return []byte(dl.Payload), ""
+	}
+	cmd.OrderID = ulid.Make().String()
+	cmd.CorrelationID = ""
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return []byte(dl.Payload), ""
+	}
+	return payload, cmd.OrderID
+}
+
+// UserChannel is the Redis channel events for a single user are published on.
+func UserChannel(userID string) string {
+	return "user." + userID
+}
+
+// NotifyUser publishes an event on the user's channel, which their authenticated WebSocket connections forward.
+func NotifyUser(rdb *redis.Client, userID, event string, result any) error {
+	msg, err := json.Marshal(UserNotification{Event: event, Success: true, Result: result})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s notification: %w", event, err)
+	}
+	if err := rdb.Publish(context.Background(), UserChannel(userID), msg).Err(); err != nil {
+		return fmt.Errorf("failed to publish %s notification: %w", event, err)
+	}
+	return nil
+}
+
+func (s *service) notifyUser(userID, event string, result any) {
+	if s.rdb == nil || userID == "" {
+		return
+	}
+	if err := NotifyUser(s.rdb, userID, event, result); err != nil {
+		log.Printf("Service: failed to notify user %s: %v", userID, err)
+	}
+}
+
+func (s *service) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down exchange")
+	s.stopBooks()
+
+	// The consumers return once the message they are applying is done, so no order is left half matched
+	s.cancelConsumers()
+	consumersDone := make(chan struct{})
+	go func() {
+		s.consumersWg.Wait()
+		close(consumersDone)
+	}()
+	select {
+	case <-consumersDone:
+	case <-ctx.Done():
+		return fmt.Errorf("service: consumers did not stop: %w", ctx.Err())
+	}
+
+	var errs []error
+	for _, ob := range s.obServices {
+		if err := ob.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.bus.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("service: failed to close bus: %w", err))
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,803 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github/wry-0313/exchange/internal/bus"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+// nopOrderbookRepository discards every write so the order books run without a database.
+type nopOrderbookRepository struct{}
+
+func (nopOrderbookRepository) CreateStock(stock models.Stock) error { return nil }
+func (nopOrderbookRepository) GetStock(symbol string) (models.Stock, error) {
+	return models.Stock{Symbol: symbol}, nil
+}
+func (nopOrderbookRepository) SetStockHalted(symbol string, halted bool) error { return nil }
+func (nopOrderbookRepository) PersistBatch(batch orderbook.PersistBatch) error { return nil }
+func (nopOrderbookRepository) GetOrderByClientOrderID(userID, clientOrderID string) (models.Order, error) {
+	return models.Order{}, orderbook.ErrOrderNotExists
+}
+func (nopOrderbookRepository) GetUserOrder(userID, orderID string) (models.Order, error) {
+	return models.Order{}, orderbook.ErrOrderNotExists
+}
+func (nopOrderbookRepository) GetUserOrders(userID string, filter orderbook.OrderFilter) ([]models.Order, error) {
+	return nil, nil
+}
+func (nopOrderbookRepository) GetOrderFills(orderID string) ([]models.OrderFill, error) {
+	return nil, nil
+}
+func (nopOrderbookRepository) CreateOrUpdateCandles(symbol string, candles []models.StockPriceHistory) error {
+	return nil
+}
+func (nopOrderbookRepository) GetCandles(symbol string, interval orderbook.Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error) {
+	return nil, nil
+}
+func (nopOrderbookRepository) GetCandlePage(symbol string, interval orderbook.Interval, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.StockPriceHistory, error) {
+	return nil, nil
+}
+func (nopOrderbookRepository) GetTradePage(symbol string, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.Trade, error) {
+	return nil, nil
+}
+func (nopOrderbookRepository) GetOrderEventPage(symbol string, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.OrderEvent, error) {
+	return nil, nil
+}
+
+// nopUserRepository satisfies user.Repository, the flow under test never reads users.
+type nopUserRepository struct{}
+
+func (nopUserRepository) CreateUser(user models.User) error          { return nil }
+func (nopUserRepository) GetUser(userID string) (models.User, error) { return models.User{}, nil }
+func (nopUserRepository) GetUserByEmail(email string) (models.User, error) {
+	return models.User{}, nil
+}
+func (nopUserRepository) GetUserPrivateInfo(userID string) (user.UserPrivateInfo, error) {
+	return user.UserPrivateInfo{}, errors.New("not implemented")
+}
+func (nopUserRepository) UpdateUserName(userID, name string) error                { return nil }
+func (nopUserRepository) GetUsers(after string, limit int) ([]models.User, error) { return nil, nil }
+func (nopUserRepository) UpdateUserRole(userID string, role models.Role) error    { return nil }
+func (nopUserRepository) CreateVerification(v user.Verification) error            { return nil }
+func (nopUserRepository) VerifyEmail(tokenHash string, now time.Time) (string, error) {
+	return "", nil
+}
+func (nopUserRepository) ResetPassword(tokenHash, passwordHash string, now time.Time) (string, error) {
+	return "", nil
+}
+
+// memoryRepository keeps dead letters in memory.
+type memoryRepository struct {
+	mu          sync.Mutex
+	deadLetters []DeadLetter
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{}
+}
+
+func (r *memoryRepository) CreateDeadLetter(dl DeadLetter) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadLetters = append(r.deadLetters, dl)
+	return nil
+}
+
+func (r *memoryRepository) GetDeadLetters(limit int) ([]DeadLetter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]DeadLetter(nil), r.deadLetters[:min(limit, len(r.deadLetters))]...), nil
+}
+
+func (r *memoryRepository) GetDeadLetter(id string) (DeadLetter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dl := range r.deadLetters {
+		if dl.ID == id {
+			return dl, nil
+		}
+	}
+	return DeadLetter{}, ErrDeadLetterNotFound
+}
+
+func (r *memoryRepository) MarkDeadLetterReplayed(id, replayOrderID string, replayedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.deadLetters {
+		if r.deadLetters[i].ID == id {
+			r.deadLetters[i].ReplayedAt = &replayedAt
+			r.deadLetters[i].ReplayOrderID = replayOrderID
+		}
+	}
+	return nil
+}
+
+func newTestService(t *testing.T) *service {
+	t.Helper()
+	obServices := map[string]orderbook.Service{
+		"TEST": orderbook.NewService("TEST", nopOrderbookRepository{}, nil, "", ""),
+	}
+	s := NewService(newMemoryRepository(), nopUserRepository{}, nopOrderbookRepository{}, obServices, validator.New(), bus.NewMemory(), nil).(*service)
+	s.startConsumers()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return s
+}
+
+func placeAndWait(t *testing.T, s *service, input PlaceOrderInput) OrderAck {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ack, err := s.PlaceOrder(ctx, input, true)
+	if err != nil {
+		t.Fatalf("PlaceOrder: %v", err)
+	}
+	return ack
+}
+
+func TestPlaceOrderThroughMemoryBus(t *testing.T) {
+	s := newTestService(t)
+	seller, buyer := ulid.Make().String(), ulid.Make().String()
+
+	ack := placeAndWait(t, s, PlaceOrderInput{
+		UserID: seller, OrderType: "limit", OrderSide: "sell", Price: 100, Volume: 10, Symbol: "TEST",
+	})
+	if ack.Status != orderbook.Open.String() {
+		t.Fatalf("resting sell: expected status %s, got %s (%s)", orderbook.Open, ack.Status, ack.RejectReason)
+	}
+	if ack.OrderID == "" {
+		t.Fatal("expected an order ID")
+	}
+
+	ack = placeAndWait(t, s, PlaceOrderInput{
+		UserID: buyer, OrderType: "market", OrderSide: "buy", Volume: 4, Symbol: "TEST",
+	})
+	if ack.Status != orderbook.Filled.String() {
+		t.Fatalf("market buy: expected status %s, got %s (%s)", orderbook.Filled, ack.Status, ack.RejectReason)
+	}
+	if len(ack.Fills) != 1 || ack.Fills[0].Price != 100 || ack.Fills[0].Volume != 4 {
+		t.Fatalf("market buy: unexpected fills %+v", ack.Fills)
+	}
+}
+
+func TestPlaceOrderWithoutWaiting(t *testing.T) {
+	s := newTestService(t)
+
+	ack, err := s.PlaceOrder(context.Background(), PlaceOrderInput{
+		UserID: ulid.Make().String(), OrderType: "limit", OrderSide: "buy", Price: 50, Volume: 1, Symbol: "TEST",
+	}, false)
+	if err != nil {
+		t.Fatalf("PlaceOrder: %v", err)
+	}
+	if ack.Status != AckStatusAccepted {
+		t.Fatalf("expected status %s, got %s", AckStatusAccepted, ack.Status)
+	}
+}
+
+func TestPlaceOrderUnknownSymbol(t *testing.T) {
+	s := newTestService(t)
+
+	_, err := s.PlaceOrder(context.Background(), PlaceOrderInput{
+		UserID: ulid.Make().String(), OrderType: "market", OrderSide: "buy", Volume: 1, Symbol: "NOPE",
+	}, false)
+	if !errors.Is(err, ErrInvalidSymbol) {
+		t.Fatalf("expected ErrInvalidSymbol, got %v", err)
+	}
+}
+
+func TestPlaceOrderRejectsOutOfRangeValues(t *testing.T) {
+	s := newTestService(t)
+
+	for _, input := range []PlaceOrderInput{
+		{UserID: ulid.Make().String(), OrderType: "market", OrderSide: "buy", Volume: 1e20, Symbol: "TEST"},
+		{UserID: ulid.Make().String(), OrderType: "limit", OrderSide: "buy", Price: 1e20, Volume: 1, Symbol: "TEST"},
+	} {
+		if _, err := s.PlaceOrder(context.Background(), input, false); !validator.IsValidationError(err) {
+			t.Errorf("price %g volume %g: err = %v, want a validation error", input.Price, input.Volume, err)
+		}
+	}
+}
+
+func TestClientOrderIDIsIdempotent(t *testing.T) {
+	s := newTestService(t)
+	userID := ulid.Make().String()
+	input := PlaceOrderInput{
+		UserID: userID, OrderType: "limit", OrderSide: "buy", Price: 90, Volume: 5, Symbol: "TEST", ClientOrderID: "retry-1",
+	}
+
+	first := placeAndWait(t, s, input)
+	if first.Duplicate || first.ClientOrderID != "retry-1" {
+		t.Fatalf("first submission: unexpected ack %+v", first)
+	}
+
+	second := placeAndWait(t, s, input)
+	if !second.Duplicate {
+		t.Fatal("second submission: expected a duplicate")
+	}
+	if second.OrderID != first.OrderID || second.Status != first.Status {
+		t.Fatalf("second submission: expected the original order %+v, got %+v", first, second)
+	}
+
+	// A redelivered message must not place the order a second time either
+	dup, ok, err := s.claimClientOrder(PlaceOrderInput{UserID: userID, OrderID: first.OrderID, ClientOrderID: "retry-1", Symbol: "TEST"})
+	if ok || err != nil || !dup.Duplicate {
+		t.Fatalf("redelivery: expected a duplicate, got %+v", dup)
+	}
+}
+
+func TestCancelClientOrder(t *testing.T) {
+	s := newTestService(t)
+	userID := ulid.Make().String()
+
+	placeAndWait(t, s, PlaceOrderInput{
+		UserID: userID, OrderType: "limit", OrderSide: "sell", Price: 110, Volume: 3, Symbol: "TEST", ClientOrderID: "c-1",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ack, err := s.CancelClientOrder(ctx, userID, "c-1", true)
+	if err != nil {
+		t.Fatalf("CancelClientOrder: %v", err)
+	}
+	if ack.Status != orderbook.Cancelled.String() {
+		t.Fatalf("expected status %s, got %s (%s)", orderbook.Cancelled, ack.Status, ack.RejectReason)
+	}
+
+	got, err := s.GetClientOrder(userID, "c-1")
+	if err != nil {
+		t.Fatalf("GetClientOrder: %v", err)
+	}
+	if got.Status != orderbook.Cancelled.String() {
+		t.Fatalf("expected status %s, got %s", orderbook.Cancelled, got.Status)
+	}
+
+	ack, err = s.CancelClientOrder(ctx, userID, "c-1", true)
+	if err != nil {
+		t.Fatalf("CancelClientOrder: %v", err)
+	}
+	if ack.Status != orderbook.Rejected.String() {
+		t.Fatalf("cancelling twice: expected status %s, got %s", orderbook.Rejected, ack.Status)
+	}
+
+	if _, err := s.CancelClientOrder(ctx, ulid.Make().String(), "c-1", false); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("other user: expected ErrOrderNotFound, got %v", err)
+	}
+}
+
+func TestAmendClientOrder(t *testing.T) {
+	s := newTestService(t)
+	userID := ulid.Make().String()
+
+	placeAndWait(t, s, PlaceOrderInput{
+		UserID: userID, OrderType: "limit", OrderSide: "sell", Price: 110, Volume: 3, Symbol: "TEST", ClientOrderID: "c-1",
+	})
+	placeAndWait(t, s, PlaceOrderInput{
+		UserID: userID, OrderType: "limit", OrderSide: "sell", Price: 110, Volume: 1, Symbol: "TEST", ClientOrderID: "c-2",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ack, err := s.AmendClientOrder(ctx, userID, "c-1", 1, true)
+	if err != nil {
+		t.Fatalf("AmendClientOrder: %v", err)
+	}
+	if ack.Status != orderbook.Open.String() || !ack.RemainingVolume.Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("expected an open order with 1 left, got %+v (%s)", ack, ack.RejectReason)
+	}
+
+	// The amended order keeps its priority and the L3 feed reports the new size in place
+	book, err := s.GetL3Snapshot("TEST")
+	if err != nil {
+		t.Fatalf("GetL3Snapshot: %v", err)
+	}
+	want := []orderbook.L3Order{{OrderID: 1, Price: 110, Size: 1}, {OrderID: 2, Price: 110, Size: 1}}
+	if book.Sequence != 3 || len(book.Asks) != 2 || book.Asks[0] != want[0] || book.Asks[1] != want[1] {
+		t.Fatalf("expected sequence 3 and asks %+v, got %+v", want, book)
+	}
+
+	ack, err = s.AmendClientOrder(ctx, userID, "c-1", 2, true)
+	if err != nil {
+		t.Fatalf("AmendClientOrder: %v", err)
+	}
+	if ack.Status != orderbook.Rejected.String() {
+		t.Fatalf("increasing the volume: expected status %s, got %s", orderbook.Rejected, ack.Status)
+	}
+
+	if _, err := s.AmendClientOrder(ctx, userID, "c-1", 0, true); !errors.Is(err, ErrInvalidVolume) {
+		t.Fatalf("zero volume: expected ErrInvalidVolume, got %v", err)
+	}
+	if _, err := s.AmendClientOrder(ctx, ulid.Make().String(), "c-1", 1, false); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("other user: expected ErrOrderNotFound, got %v", err)
+	}
+}
+
+// waitForDeadLetters polls until n dead letters were stored.
+func waitForDeadLetters(t *testing.T, s *service, n int) []DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dls, err := s.GetDeadLetters(100)
+		if err != nil {
+			t.Fatalf("GetDeadLetters: %v", err)
+		}
+		if len(dls) >= n {
+			return dls
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d dead letters, got %d", n, len(dls))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailedOrdersAreDeadLettered(t *testing.T) {
+	s := newTestService(t)
+
+	// Malformed JSON never reaches the engine
+	if err := s.bus.Publish(context.Background(), ordersTopic, "TEST", []byte("{not json")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// An order the engine rejects is reported to the waiting caller and dead-lettered as well
+	ack := placeAndWait(t, s, PlaceOrderInput{
+		UserID: "not-a-ulid", OrderType: "market", OrderSide: "buy", Volume: 1, Symbol: "TEST",
+	})
+	if ack.Status != orderbook.Rejected.String() || ack.RejectReason == "" {
+		t.Fatalf("expected a rejection with a reason, got %+v", ack)
+	}
+
+	dls := waitForDeadLetters(t, s, 2)
+	for _, dl := range dls {
+		if dl.Topic != ordersTopic || dl.Key != "TEST" || dl.Reason == "" || dl.Payload == "" {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+	}
+}
+
+// unavailableRepository fails to store the first failures dead letters, like a database that is briefly down.
+type unavailableRepository struct {
+	*memoryRepository
+	failures int
+}
+
+func (r *unavailableRepository) CreateDeadLetter(dl DeadLetter) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("connection refused")
+	}
+	return r.memoryRepository.CreateDeadLetter(dl)
+}
+
+func TestStoreDeadLetterRetries(t *testing.T) {
+	repo := &unavailableRepository{memoryRepository: newMemoryRepository(), failures: 2}
+	s := &service{repo: repo}
+	msg := bus.Message{Topic: deadLetterTopic, Value: []byte(`{"id":"dl-1"}`)}
+
+	if err := s.storeDeadLetter(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if dls, _ := repo.GetDeadLetters(10); len(dls) != 1 || dls[0].ID != "dl-1" {
+		t.Fatalf("got %+v, want the dead letter stored once the repository recovered", dls)
+	}
+
+	// A consumer that stops gives up, so the message is delivered again rather than marked consumed
+	repo.failures = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.storeDeadLetter(ctx, msg); err == nil {
+		t.Fatal("storing while the repository is down and the consumer stopped succeeded")
+	}
+}
+
+// unavailableBus refuses the first failures publishes, like a broker that is briefly unreachable.
+type unavailableBus struct {
+	bus.Bus
+	failures  int
+	published int
+}
+
+func (b *unavailableBus) Publish(ctx context.Context, topic, key string, value []byte) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("broker unreachable")
+	}
+	b.published++
+	return nil
+}
+
+func TestDeadLetterRetriesPublish(t *testing.T) {
+	b := &unavailableBus{failures: 2}
+	s := &service{bus: b}
+	msg := bus.Message{Topic: ordersTopic, Key: "TEST", Value: []byte("{not json")}
+
+	if err := s.deadLetter(context.Background(), msg, errors.New("bad order")); err != nil || b.published != 1 {
+		t.Fatalf("got %v with %d published, want the dead letter published once the broker recovered", err, b.published)
+	}
+
+	// A consumer that stops gives up, so the order isn't marked consumed without a dead letter
+	b.failures = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.deadLetter(ctx, msg, errors.New("bad order")); err == nil {
+		t.Fatal("dead-lettering while the broker is down and the consumer stopped succeeded")
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	s := newTestService(t)
+
+	if err := s.bus.Publish(context.Background(), ordersTopic, "TEST", []byte("{not json")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	dl := waitForDeadLetters(t, s, 1)[0]
+
+	replayed, err := s.ReplayDeadLetter(context.Background(), dl.ID)
+	if err != nil {
+		t.Fatalf("ReplayDeadLetter: %v", err)
+	}
+	if replayed.ReplayedAt == nil {
+		t.Fatal("expected the dead letter to be marked replayed")
+	}
+
+	// Still malformed, so the replay fails again and comes back as a new dead letter
+	waitForDeadLetters(t, s, 2)
+
+	if _, err := s.ReplayDeadLetter(context.Background(), "missing"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("expected ErrDeadLetterNotFound, got %v", err)
+	}
+}
+
+// recordingOrderbookRepository keeps the orders the books persist.
+type recordingOrderbookRepository struct {
+	nopOrderbookRepository
+	mu     sync.Mutex
+	orders []orderbook.OrderRecord
+}
+
+func (r *recordingOrderbookRepository) PersistBatch(batch orderbook.PersistBatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.orders = append(r.orders, batch.Orders...)
+	return nil
+}
+
+func (r *recordingOrderbookRepository) waitForOrders(t *testing.T, n int) []orderbook.OrderRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		orders := append([]orderbook.OrderRecord(nil), r.orders...)
+		r.mu.Unlock()
+		if len(orders) >= n {
+			return orders
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d persisted orders, got %d", n, len(orders))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unreachableClientOrders fails every client order lookup, like a database that is down.
+type unreachableClientOrders struct {
+	recordingOrderbookRepository
+}
+
+func (r *unreachableClientOrders) GetOrderByClientOrderID(userID, clientOrderID string) (models.Order, error) {
+	return models.Order{}, errors.New("connection refused")
+}
+
+func TestUncheckedClientOrderIsRejected(t *testing.T) {
+	obRepo := &unreachableClientOrders{}
+	obServices := map[string]orderbook.Service{"TEST": orderbook.NewService("TEST", obRepo, nil, "", "")}
+	s := NewService(newMemoryRepository(), nopUserRepository{}, obRepo, obServices, validator.New(), bus.NewMemory(), nil).(*service)
+	s.startConsumers()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	// The order passed PlaceOrder's check before the database went away, so it reaches the consumer
+	orderID := ulid.Make().String()
+	cmd, err := json.Marshal(orderCommand{PlaceOrderInput: PlaceOrderInput{
+		OrderID: orderID, UserID: ulid.Make().String(), OrderType: "market", OrderSide: "buy", Volume: 1, Symbol: "TEST", ClientOrderID: "c-1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bus.Publish(context.Background(), ordersTopic, "TEST", cmd); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	orders := obRepo.waitForOrders(t, 1)
+	if orders[0].OrderID.String() != orderID || orders[0].Status != orderbook.Rejected || orders[0].RejectReason != errClientOrderUnchecked.Error() {
+		t.Fatalf("expected order %s to be recorded as rejected, got %+v", orderID, orders[0])
+	}
+	if dl := waitForDeadLetters(t, s, 1)[0]; dl.Reason != errClientOrderUnchecked.Error() {
+		t.Fatalf("dead letter reason = %q", dl.Reason)
+	}
+}
+
+func TestReplayedOrderIsRejectedUnderFreshID(t *testing.T) {
+	obRepo := &recordingOrderbookRepository{}
+	obServices := map[string]orderbook.Service{"TEST": orderbook.NewService("TEST", obRepo, nil, "", "")}
+	s := NewService(newMemoryRepository(), nopUserRepository{}, obRepo, obServices, validator.New(), bus.NewMemory(), nil).(*service)
+	s.startConsumers()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	// A side the engine doesn't know fails before the order reaches the book, it is still recorded as rejected
+	orderID := ulid.Make().String()
+	cmd, err := json.Marshal(orderCommand{PlaceOrderInput: PlaceOrderInput{
+		OrderID: orderID, UserID: ulid.Make().String(), OrderType: "market", OrderSide: "short", Volume: 1, Symbol: "TEST",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bus.Publish(context.Background(), ordersTopic, "TEST", cmd); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	orders := obRepo.waitForOrders(t, 1)
+	if orders[0].OrderID.String() != orderID || orders[0].Status != orderbook.Rejected || orders[0].RejectReason == "" {
+		t.Fatalf("expected order %s to be recorded as rejected, got %+v", orderID, orders[0])
+	}
+
+	dl := waitForDeadLetters(t, s, 1)[0]
+	replayed, err := s.ReplayDeadLetter(context.Background(), dl.ID)
+	if err != nil {
+		t.Fatalf("ReplayDeadLetter: %v", err)
+	}
+	if replayed.ReplayOrderID == "" || replayed.ReplayOrderID == orderID {
+		t.Fatalf("expected the replay to get a fresh order ID, got %q", replayed.ReplayOrderID)
+	}
+	orders = obRepo.waitForOrders(t, 2)
+	if orders[1].OrderID.String() != replayed.ReplayOrderID {
+		t.Fatalf("expected the replay to be recorded as %s, got %s", replayed.ReplayOrderID, orders[1].OrderID)
+	}
+}
+
+func TestShutdownSnapshotsBooks(t *testing.T) {
+	dir := t.TempDir()
+	obServices := map[string]orderbook.Service{
+		"SNAP": orderbook.NewService("SNAP", nopOrderbookRepository{}, nil, dir, ""),
+	}
+	s := NewService(newMemoryRepository(), nopUserRepository{}, nopOrderbookRepository{}, obServices, validator.New(), bus.NewMemory(), nil).(*service)
+	s.startConsumers()
+
+	userID := ulid.Make().String()
+	for _, input := range []PlaceOrderInput{
+		{UserID: userID, OrderType: "limit", OrderSide: "buy", Price: 99, Volume: 2, Symbol: "SNAP"},
+		{UserID: userID, OrderType: "limit", OrderSide: "buy", Price: 98, Volume: 3, Symbol: "SNAP"},
+		{UserID: userID, OrderType: "limit", OrderSide: "sell", Price: 101, Volume: 4, Symbol: "SNAP"},
+	} {
+		// Not waiting, the shutdown has to drain whatever is still queued
+		if _, err := s.PlaceOrder(context.Background(), input, false); err != nil {
+			t.Fatalf("PlaceOrder: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	before := obServices["SNAP"].Snapshot()
+	if len(before.Orders) != 3 {
+		t.Fatalf("expected 3 resting orders after draining, got %d", len(before.Orders))
+	}
+
+	restored := orderbook.NewService("SNAP", nopOrderbookRepository{}, nil, dir, "").Snapshot()
+	if len(restored.Orders) != len(before.Orders) {
+		t.Fatalf("expected %d restored orders, got %d", len(before.Orders), len(restored.Orders))
+	}
+	for i := range before.Orders {
+		if !restored.Orders[i].CreatedAt.Equal(before.Orders[i].CreatedAt) {
+			t.Fatalf("order %d: expected created at %v, got %v", i, before.Orders[i].CreatedAt, restored.Orders[i].CreatedAt)
+		}
+		restored.Orders[i].CreatedAt = before.Orders[i].CreatedAt
+		if restored.Orders[i] != before.Orders[i] {
+			t.Fatalf("order %d: expected %+v, got %+v", i, before.Orders[i], restored.Orders[i])
+		}
+	}
+}
+
+// candleRepository keeps the candles an order book persists.
+type candleRepository struct {
+	nopOrderbookRepository
+	mu      sync.Mutex
+	candles []models.StockPriceHistory
+}
+
+func (r *candleRepository) CreateOrUpdateCandles(symbol string, candles []models.StockPriceHistory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.candles = append(r.candles, candles...)
+	return nil
+}
+
+func TestCandlesAreBuiltFromTrades(t *testing.T) {
+	repo := &candleRepository{}
+	ob := orderbook.NewService("CNDL", repo, nil, "", "")
+	userID := ulid.Make()
+	for _, req := range []orderbook.OrderRequest{
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(2)},
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(103), Volume: decimal.NewFromInt(2)},
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Market, Volume: decimal.NewFromInt(3)},
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Market, Volume: decimal.NewFromInt(5)},
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)},
+	} {
+		if _, err := ob.SubmitOrder(req); err != nil {
+			t.Fatalf("SubmitOrder: %v", err)
+		}
+	}
+
+	// Stopping Run stores the candle that is still open
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ob.Run(ctx)
+	if err := ob.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// The trades may straddle a second boundary, merge the candles like the repository would
+	if len(repo.candles) == 0 {
+		t.Fatal("expected candles to be persisted")
+	}
+	var volume, buyVolume, sellVolume float64
+	var trades int
+	for _, c := range repo.candles {
+		if c.Interval != string(orderbook.BaseInterval) {
+			t.Fatalf("expected %s candles, got %s", orderbook.BaseInterval, c.Interval)
+		}
+		volume += c.Volume
+		buyVolume += c.BidVolume
+		sellVolume += c.AskVolume
+		trades += c.TradeCount
+	}
+	// 2 @ 101 and 1 @ 103 bought by the market buy, then 1 @ 100 bought by the limit buy that met the resting market
+	// sell, every trade was initiated by a buyer
+	if volume != 4 || buyVolume != 4 || sellVolume != 0 || trades != 3 {
+		t.Fatalf("expected volume 4 bought over 3 trades, got %v (%v buy, %v sell) over %d trades", volume, buyVolume, sellVolume, trades)
+	}
+	first, last := repo.candles[0], repo.candles[len(repo.candles)-1]
+	if !first.Open.Equal(decimal.NewFromInt(101)) || !last.Close.Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("expected open 101 and close 100, got %v and %v", first.Open, last.Close)
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, i := range orderbook.Intervals {
+		if got, err := orderbook.ParseInterval(string(i)); err != nil || got != i {
+			t.Fatalf("ParseInterval(%q) = %q, %v", i, got, err)
+		}
+	}
+	if _, err := orderbook.ParseInterval("2m"); !errors.Is(err, orderbook.ErrInvalidInterval) {
+		t.Fatalf("expected ErrInvalidInterval, got %v", err)
+	}
+}
+
+func TestTickerFromTrades(t *testing.T) {
+	ob := orderbook.NewService("TICK", nopOrderbookRepository{}, nil, "", "")
+	t.Cleanup(func() { ob.Shutdown(context.Background()) })
+	userID := ulid.Make()
+	for _, req := range []orderbook.OrderRequest{
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)},
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(110), Volume: decimal.NewFromInt(3)},
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Market, Volume: decimal.NewFromInt(2)},
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(105), Volume: decimal.NewFromInt(1)},
+	} {
+		if _, err := ob.SubmitOrder(req); err != nil {
+			t.Fatalf("SubmitOrder: %v", err)
+		}
+	}
+
+	s := NewService(newMemoryRepository(), nopUserRepository{}, nopOrderbookRepository{}, map[string]orderbook.Service{"TICK": ob}, validator.New(), bus.NewMemory(), nil)
+	ticker, err := s.GetTicker("TICK")
+	if err != nil {
+		t.Fatalf("GetTicker: %v", err)
+	}
+	// 1 @ 100 then 1 @ 110 by the market buy, leaving 2 @ 110 against the 1 @ 105 bid
+	want := orderbook.Ticker{
+		Symbol:           "TICK",
+		LastPrice:        110,
+		LastSize:         1,
+		BestBid:          105,
+		BestAsk:          110,
+		Spread:           5,
+		Open24h:          100,
+		High24h:          110,
+		Low24h:           100,
+		Change24h:        10,
+		ChangePercent24h: 10,
+		Volume24h:        2,
+		QuoteVolume24h:   210,
+		TradeCount24h:    2,
+		VWAP24h:          105,
+	}
+	ticker.LastTradeAt = time.Time{}
+	if ticker != want {
+		t.Fatalf("expected %+v, got %+v", want, ticker)
+	}
+
+	if _, err := s.GetTicker("NONE"); !errors.Is(err, ErrInvalidSymbol) {
+		t.Fatalf("expected ErrInvalidSymbol, got %v", err)
+	}
+	if tickers := s.GetTickers(); len(tickers) != 1 || tickers[0].Symbol != "TICK" {
+		t.Fatalf("expected the TICK ticker, got %+v", tickers)
+	}
+}
+
+func TestL3Snapshot(t *testing.T) {
+	ob := orderbook.NewService("LTHR", nopOrderbookRepository{}, nil, "", "")
+	t.Cleanup(func() { ob.Shutdown(context.Background()) })
+	userID := ulid.Make()
+	for _, req := range []orderbook.OrderRequest{
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(101), Volume: decimal.NewFromInt(2)}, // add 1
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(102), Volume: decimal.NewFromInt(1)}, // add 2
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(100), Volume: decimal.NewFromInt(1)},  // add 3
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Market, Volume: decimal.NewFromInt(3)},                                 // execute and delete 1 and 2
+		{Side: orderbook.Sell, UserID: userID, Type: orderbook.Limit, Price: decimal.NewFromInt(105), Volume: decimal.NewFromInt(5)}, // add 4
+		{Side: orderbook.Buy, UserID: userID, Type: orderbook.Market, Volume: decimal.NewFromInt(2)},                                 // execute 4
+	} {
+		if _, err := ob.SubmitOrder(req); err != nil {
+			t.Fatalf("SubmitOrder: %v", err)
+		}
+	}
+
+	book := ob.L3Snapshot()
+	want := orderbook.L3Book{
+		Symbol:   "LTHR",
+		Sequence: 9,
+		Bids:     []orderbook.L3Order{{OrderID: 3, Price: 100, Size: 1}},
+		Asks:     []orderbook.L3Order{{OrderID: 4, Price: 105, Size: 3}},
+	}
+	if book.Symbol != want.Symbol || book.Sequence != want.Sequence || len(book.Bids) != 1 || len(book.Asks) != 1 ||
+		book.Bids[0] != want.Bids[0] || book.Asks[0] != want.Asks[0] {
+		t.Fatalf("expected %+v, got %+v", want, book)
+	}
+}
+
+func TestParseOrderFilter(t *testing.T) {
+	for query, want := range map[string]int{
+		"?side=BUY&status=partiallyfilled&type=limit&limit=10000": http.StatusOK,
+		"?side=short":     http.StatusBadRequest,
+		"?status=Pending": http.StatusBadRequest,
+		"?before=123":     http.StatusBadRequest,
+		"?from=yesterday": http.StatusBadRequest,
+		"?limit=0":        http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		filter, ok := parseOrderFilter(w, httptest.NewRequest(http.MethodGet, "/users/me/orders"+query, nil))
+		if ok != (want == http.StatusOK) || (!ok && w.Code != want) {
+			t.Errorf("%s: ok = %v with status %d, want %d", query, ok, w.Code, want)
+		}
+		if ok && (filter.Side != "Buy" || filter.Status != "PartiallyFilled" || filter.Type != "Limit" || filter.Limit != maxOrderLimit) {
+			t.Errorf("%s: filter = %+v, want canonical values and the limit capped", query, filter)
+		}
+	}
+}
@@ -1,10 +1,117 @@
 package exchange
 
+import (
+	"github/wry-0313/exchange/internal/models"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
 type PlaceOrderInput struct {
 	UserID    string  `json:"user_id" validate:"omitempty"`
 	OrderType string  `json:"order_type" validate:"required,oneof=market limit"`
 	OrderSide string  `json:"order_side" validate:"required,oneof=buy sell"`
-	Price     float64 `json:"price" validate:"required_if=OrderType limit"`
-	Volume    float64 `json:"volume" validate:"required"`
+	Price     float64 `json:"price" validate:"required_if=OrderType limit,lt=100000000"`
+	Volume    float64 `json:"volume" validate:"required,lt=100000000"`
 	Symbol    string  `json:"symbol" validate:"required"`
+
+	// ClientOrderID is an optional ID chosen by the client, unique per user. Submitting an order with a client
+	// order ID that was already used returns the original order instead of placing a new one.
+	ClientOrderID string `json:"client_order_id" validate:"omitempty,max=64"`
+
+	// Set by the service before the order is produced, any value sent by the client is overwritten.
+	OrderID       string `json:"order_id" validate:"omitempty"`
+	CorrelationID string `json:"correlation_id" validate:"omitempty"`
+}
+
+const (
+	// AckStatusAccepted means the order was queued and the caller did not wait for the engine.
+	AckStatusAccepted = "Accepted"
+	// AckStatusPending means the caller waited but the engine did not respond before the timeout.
+	AckStatusPending = "Pending"
+)
+
+// OrderAck is the response to a placed order. Status is one of the order statuses once the engine has processed
+// the order, or AckStatusAccepted / AckStatusPending before that.
+type OrderAck struct {
+	OrderID         string           `json:"order_id"`
+	ClientOrderID   string           `json:"client_order_id,omitempty"`
+	Duplicate       bool             `json:"duplicate,omitempty"` // the client order ID was already used, the ack describes that order
+	Status          string           `json:"status"`
+	RejectReason    string           `json:"reject_reason,omitempty"`
+	RemainingVolume *decimal.Decimal `json:"remaining_volume,omitempty"`
+	Fills           []FillDTO        `json:"fills,omitempty"`
+}
+
+// OrderDetails is an order with every fill it received.
+type OrderDetails struct {
+	models.Order
+	Fills []models.OrderFill `json:"fills"`
+}
+
+// FillDTO is a fill the order received while it was being matched.
+type FillDTO struct {
+	Price  float64 `json:"price"`
+	Volume float64 `json:"volume"`
+}
+
+// cancelOrderCommand asks the engine to cancel a resting order.
+type cancelOrderCommand struct {
+	OrderID       string `json:"order_id"`
+	UserID        string `json:"user_id"`
+	ClientOrderID string `json:"client_order_id"`
+	Symbol        string `json:"symbol"`
+	CorrelationID string `json:"correlation_id"`
+}
+
+// amendOrderCommand asks the engine to reduce the volume of a resting order.
+type amendOrderCommand struct {
+	OrderID       string  `json:"order_id"`
+	UserID        string  `json:"user_id"`
+	ClientOrderID string  `json:"client_order_id"`
+	Symbol        string  `json:"symbol"`
+	Volume        float64 `json:"volume"`
+	CorrelationID string  `json:"correlation_id"`
+}
+
+// AmendOrderInput is the body of an amendment, the volume the order is reduced to.
+type AmendOrderInput struct {
+	Volume float64 `json:"volume"`
+}
+
+// orderCommand is a message on the orders topic. Orders are published as a bare PlaceOrderInput, a cancellation
+// sets Cancel and an amendment sets Amend instead.
+type orderCommand struct {
+	PlaceOrderInput
+	Cancel *cancelOrderCommand `json:"cancel,omitempty"`
+	Amend  *amendOrderCommand  `json:"amend,omitempty"`
+}
+
+// DeadLetter is a message the consumer could not apply, kept with the reason it failed so it can be inspected and
+// replayed.
+type DeadLetter struct {
+	ID         string     `json:"id"`
+	Topic      string     `json:"topic"`
+	Key        string     `json:"key"`
+	Partition  int32      `json:"partition"`
+	Offset     int64      `json:"offset"`
+	Payload    string     `json:"payload"`
+	Reason     string     `json:"reason"`
+	FailedAt   time.Time  `json:"failed_at"`
+	ReplayedAt *time.Time `json:"replayed_at,omitempty"`
+
+	// ReplayOrderID is the order ID a replayed order was placed under.
+	ReplayOrderID string `json:"replay_order_id,omitempty"`
+}
+
+const (
+	// EventOrderRejected is published on a user's channel when the engine rejects one of their orders.
+	EventOrderRejected = "exchange.order_rejected"
+)
+
+// UserNotification is the message published on a user's Redis channel.
+type UserNotification struct {
+	Event   string `json:"event"`
+	Success bool   `json:"success"`
+	Result  any    `json:"result,omitempty"`
 }
@@ -0,0 +1,43 @@
+package exchange
+
+import (
+	"fmt"
+	"github/wry-0313/exchange/internal/user"
+	"sync"
+)
+
+// ErrEmailNotVerified rejects the orders of users who haven't verified their email address yet.
+var ErrEmailNotVerified = fmt.Errorf("%w: Verify your email address before trading", ErrOrderRejected)
+
+type emailVerificationCheck struct {
+	userRepo user.Repository
+
+	// Users whose email is verified. An email stays verified, so only users who haven't verified it yet are
+	// looked up for every order.
+	verified sync.Map
+}
+
+// NewEmailVerificationCheck creates a RiskCheck that rejects the orders of users who haven't verified their email
+// address, see Service.AddRiskCheck.
+func NewEmailVerificationCheck(userRepo user.Repository) RiskCheck {
+	return &emailVerificationCheck{
+		userRepo: userRepo,
+	}
+}
+
+func (c *emailVerificationCheck) CheckOrder(input PlaceOrderInput) error {
+	if _, ok := c.verified.Load(input.UserID); ok {
+		return nil
+	}
+	u, err := c.userRepo.GetUser(input.UserID)
+	if err != nil {
+		return fmt.Errorf("service: failed getting user: %w", err)
+	}
+	if !u.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	c.verified.Store(input.UserID, struct{}{})
+	return nil
+}
+
+func (c *emailVerificationCheck) OrderDone(PlaceOrderInput, bool) {}
@@ -0,0 +1,36 @@
+package exchange
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/models"
+	"testing"
+)
+
+// countingUsers counts the lookups of users, only "verified" has verified their email.
+type countingUsers struct {
+	nopUserRepository
+	lookups int
+}
+
+func (r *countingUsers) GetUser(userID string) (models.User, error) {
+	r.lookups++
+	return models.User{ID: userID, EmailVerified: userID == "verified"}, nil
+}
+
+func TestEmailVerificationCheckRemembersVerifiedUsers(t *testing.T) {
+	users := &countingUsers{}
+	check := NewEmailVerificationCheck(users)
+
+	for i := 0; i < 3; i++ {
+		if err := check.CheckOrder(PlaceOrderInput{UserID: "verified"}); err != nil {
+			t.Fatalf("verified user: %v", err)
+		}
+		if err := check.CheckOrder(PlaceOrderInput{UserID: "unverified"}); !errors.Is(err, ErrEmailNotVerified) {
+			t.Fatalf("unverified user: got %v, want ErrEmailNotVerified", err)
+		}
+	}
+	// The verified user is looked up once, the unverified one for every order since they may verify any time
+	if users.lookups != 4 {
+		t.Fatalf("got %d lookups, want 4", users.lookups)
+	}
+}
@@ -0,0 +1,68 @@
+package export
+
+import (
+	"fmt"
+	"github/wry-0313/exchange/internal/endpoint"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const errMsgInternalServer = "Internal server error"
+
+type API struct {
+	exportService Service
+}
+
+func NewAPI(exportService Service) *API {
+	return &API{
+		exportService: exportService,
+	}
+}
+
+// HandleExport streams the history of a symbol as a file download. The dataset is selected with ?dataset, the range
+// with ?from and ?to, the file format with ?format and the candle interval with ?interval.
+func (api *API) HandleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req, err := ParseRequest(chi.URLParam(r, "symbol"), query.Get("dataset"), query.Get("format"), query.Get("interval"), query.Get("from"), query.Get("to"))
+	if err != nil {
+		endpoint.WriteWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The status is sent with the first chunk, an error after that can only abort the response
+	ew := &exportWriter{ResponseWriter: w, req: req}
+	if err := api.exportService.Export(r.Context(), ew, req); err != nil {
+		log.Printf("handler: failed to export %s %s: %v\n", req.Symbol, req.Dataset, err)
+		if !ew.started {
+			endpoint.WriteWithError(w, http.StatusInternalServerError, errMsgInternalServer)
+			return
+		}
+		panic(http.ErrAbortHandler) // the client sees a truncated response instead of a complete looking file
+	}
+}
+
+// exportWriter sets the download headers once the export writes its first bytes.
+type exportWriter struct {
+	http.ResponseWriter
+	req     Request
+	started bool
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.Header().Set("Content-Type", w.req.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", w.req.Filename()))
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (api *API) RegisterHandlers(r chi.Router, adminHandler func(http.Handler) http.Handler) {
+	r.Route("/admin/export", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/{symbol}", api.HandleExport)
+	})
+}
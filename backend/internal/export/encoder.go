@@ -0,0 +1,124 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// encoder writes rows of one of the row types in a file format. Each call to write is one chunk of the export and
+// is flushed to the underlying writer before returning, so that memory use is bounded by the chunk size.
+type encoder[T any] interface {
+	write(rows []T) error
+	close() error
+}
+
+func newEncoder[T any](w io.Writer, format Format) encoder[T] {
+	if format == FormatParquet {
+		return &parquetEncoder[T]{w: parquet.NewGenericWriter[T](w, parquet.Compression(&parquet.Snappy))}
+	}
+	return &csvEncoder[T]{w: csv.NewWriter(w)}
+}
+
+// parquetEncoder writes each chunk as a row group.
+type parquetEncoder[T any] struct {
+	w *parquet.GenericWriter[T]
+}
+
+func (e *parquetEncoder[T]) write(rows []T) error {
+	if _, err := e.w.Write(rows); err != nil {
+		return fmt.Errorf("export: failed to write parquet rows: %w", err)
+	}
+	if err := e.w.Flush(); err != nil {
+		return fmt.Errorf("export: failed to flush parquet row group: %w", err)
+	}
+	return nil
+}
+
+// close writes the parquet footer, the file is not readable without it.
+func (e *parquetEncoder[T]) close() error {
+	if err := e.w.Close(); err != nil {
+		return fmt.Errorf("export: failed to close parquet writer: %w", err)
+	}
+	return nil
+}
+
+// csvEncoder writes a header row of the column names followed by one record per row.
+type csvEncoder[T any] struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (e *csvEncoder[T]) write(rows []T) error {
+	if !e.wroteHeader {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		record := make([]string, v.NumField())
+		for i := range record {
+			record[i] = formatValue(v.Field(i))
+		}
+		if err := e.w.Write(record); err != nil {
+			return fmt.Errorf("export: failed to write csv record: %w", err)
+		}
+	}
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		return fmt.Errorf("export: failed to flush csv records: %w", err)
+	}
+	return nil
+}
+
+func (e *csvEncoder[T]) writeHeader() error {
+	e.wroteHeader = true
+	var row T
+	if err := e.w.Write(columns(reflect.TypeOf(row))); err != nil {
+		return fmt.Errorf("export: failed to write csv header: %w", err)
+	}
+	return nil
+}
+
+// close writes the header of an export without rows.
+func (e *csvEncoder[T]) close() error {
+	if !e.wroteHeader {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+		e.w.Flush()
+	}
+	return e.w.Error()
+}
+
+// columns returns the column names of a row type.
+func columns(t reflect.Type) []string {
+	names := make([]string, t.NumField())
+	for i := range names {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("parquet"), ",")
+		names[i] = name
+	}
+	return names
+}
+
+func formatValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case string:
+		return x
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,143 @@
+package export
+
+import (
+	"context"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+	"io"
+)
+
+// pageSize is the number of rows read from the database and written at a time.
+const pageSize = 5000
+
+type Service interface {
+	// Export writes the history selected by req to w, reading it in chunks so that the whole range is never held in
+	// memory. If an error is returned part of the export may already have been written.
+	Export(ctx context.Context, w io.Writer, req Request) error
+}
+
+type service struct {
+	obRepo orderbook.Repository
+}
+
+func NewService(obRepo orderbook.Repository) Service {
+	return &service{
+		obRepo: obRepo,
+	}
+}
+
+func (s *service) Export(ctx context.Context, w io.Writer, req Request) error {
+	switch req.Dataset {
+	case DatasetCandles:
+		return writePages(ctx, w, req.Format, func(after orderbook.PageCursor) ([]candleRow, orderbook.PageCursor, error) {
+			candles, err := s.obRepo.GetCandlePage(req.Symbol, req.Interval, req.From, req.To, after, pageSize)
+			if err != nil || len(candles) == 0 {
+				return nil, after, err
+			}
+			rows := make([]candleRow, len(candles))
+			for i, c := range candles {
+				rows[i] = newCandleRow(req.Symbol, c)
+			}
+			return rows, orderbook.PageCursor{At: candles[len(candles)-1].RecordedAt}, nil
+		})
+	case DatasetTrades:
+		return writePages(ctx, w, req.Format, func(after orderbook.PageCursor) ([]tradeRow, orderbook.PageCursor, error) {
+			trades, err := s.obRepo.GetTradePage(req.Symbol, req.From, req.To, after, pageSize)
+			if err != nil || len(trades) == 0 {
+				return nil, after, err
+			}
+			rows := make([]tradeRow, len(trades))
+			for i, t := range trades {
+				rows[i] = newTradeRow(t)
+			}
+			last := trades[len(trades)-1]
+			return rows, orderbook.PageCursor{At: last.ExecutedAt, ID: last.TradeID}, nil
+		})
+	case DatasetOrderEvents:
+		return writePages(ctx, w, req.Format, func(after orderbook.PageCursor) ([]orderEventRow, orderbook.PageCursor, error) {
+			events, err := s.obRepo.GetOrderEventPage(req.Symbol, req.From, req.To, after, pageSize)
+			if err != nil || len(events) == 0 {
+				return nil, after, err
+			}
+			rows := make([]orderEventRow, len(events))
+			for i, e := range events {
+				rows[i] = newOrderEventRow(e)
+			}
+			last := events[len(events)-1]
+			return rows, orderbook.PageCursor{At: last.OccurredAt, ID: last.EventID}, nil
+		})
+	default:
+		return ErrInvalidDataset
+	}
+}
+
+// writePages encodes the pages returned by next until a page comes back short. next is given the cursor of the
+// last row of the previous page.
+func writePages[T any](ctx context.Context, w io.Writer, format Format, next func(after orderbook.PageCursor) ([]T, orderbook.PageCursor, error)) error {
+	enc := newEncoder[T](w, format)
+	var after orderbook.PageCursor
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, cursor, err := next(after)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			if err := enc.write(rows); err != nil {
+				return err
+			}
+		}
+		if len(rows) < pageSize {
+			break
+		}
+		after = cursor
+	}
+	return enc.close()
+}
+
+func newCandleRow(symbol string, c models.StockPriceHistory) candleRow {
+	return candleRow{
+		Symbol:     symbol,
+		Interval:   c.Interval,
+		Start:      c.RecordedAt,
+		Open:       c.Open.InexactFloat64(),
+		High:       c.High.InexactFloat64(),
+		Low:        c.Low.InexactFloat64(),
+		Close:      c.Close.InexactFloat64(),
+		Volume:     c.Volume,
+		TradeCount: int64(c.TradeCount),
+		BuyVolume:  c.BidVolume,
+		SellVolume: c.AskVolume,
+	}
+}
+
+func newTradeRow(t models.Trade) tradeRow {
+	return tradeRow{
+		TradeID:       t.TradeID,
+		Symbol:        t.Symbol,
+		Price:         t.Price.InexactFloat64(),
+		Volume:        t.Volume.InexactFloat64(),
+		AggressorSide: t.AggressorSide,
+		BuyOrderID:    t.BuyOrderID,
+		SellOrderID:   t.SellOrderID,
+		ExecutedAt:    t.ExecutedAt,
+	}
+}
+
+func newOrderEventRow(e models.OrderEvent) orderEventRow {
+	return orderEventRow{
+		EventID:      e.EventID,
+		OrderID:      e.OrderID,
+		UserID:       e.UserID,
+		Symbol:       e.Symbol,
+		EventType:    e.EventType,
+		OrderSide:    e.OrderSide,
+		OrderStatus:  e.OrderStatus,
+		Price:        e.Price.InexactFloat64(),
+		Volume:       e.Volume.InexactFloat64(),
+		FilledVolume: e.FilledVolume.InexactFloat64(),
+		OccurredAt:   e.OccurredAt,
+	}
+}
@@ -0,0 +1,139 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"testing"
+	"time"
+
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/shopspring/decimal"
+)
+
+// tradeRepository serves trades from memory, paging them like the database does.
+type tradeRepository struct {
+	orderbook.Repository // only the trade page query is used
+	trades               []models.Trade
+	pages                int
+}
+
+func (r *tradeRepository) GetTradePage(symbol string, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.Trade, error) {
+	r.pages++
+	page := []models.Trade{}
+	for _, t := range r.trades {
+		if t.ExecutedAt.Before(from) || !t.ExecutedAt.Before(to) {
+			continue
+		}
+		if !after.At.IsZero() && (t.ExecutedAt.Before(after.At) || t.ExecutedAt.Equal(after.At) && t.TradeID <= after.ID) {
+			continue
+		}
+		if len(page) == limit {
+			break
+		}
+		page = append(page, t)
+	}
+	return page, nil
+}
+
+func newTradeRepository(n int, start time.Time) *tradeRepository {
+	r := &tradeRepository{}
+	for i := 0; i < n; i++ {
+		r.trades = append(r.trades, models.Trade{
+			TradeID:       fmt.Sprintf("%08d", i),
+			Symbol:        "AAPL",
+			Price:         decimal.NewFromFloat(100.25),
+			Volume:        decimal.NewFromInt(int64(i%7 + 1)),
+			AggressorSide: "Buy",
+			BuyOrderID:    "buy",
+			SellOrderID:   "sell",
+			ExecutedAt:    start.Add(time.Duration(i/3) * time.Millisecond), // several trades share a time
+		})
+	}
+	return r
+}
+
+func TestExportTradesCSVInPages(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	repo := newTradeRepository(pageSize+10, start)
+	req, err := ParseRequest("AAPL", "trades", "csv", "", "2024-01-02T00:00:00Z", "2024-01-03T00:00:00Z")
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewService(repo).Export(context.Background(), &buf, req); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading csv: %v", err)
+	}
+	if len(records) != len(repo.trades)+1 {
+		t.Fatalf("expected a header and %d records, got %d rows", len(repo.trades), len(records))
+	}
+	if records[0][0] != "trade_id" || records[0][len(records[0])-1] != "executed_at" {
+		t.Fatalf("unexpected header %v", records[0])
+	}
+	for i, record := range records[1:] {
+		if record[0] != repo.trades[i].TradeID {
+			t.Fatalf("record %d: expected trade %s, got %s", i, repo.trades[i].TradeID, record[0])
+		}
+	}
+	if records[1][2] != "100.25" || records[1][7] != "2024-01-02T00:00:00Z" {
+		t.Fatalf("unexpected record %v", records[1])
+	}
+	if repo.pages != 2 {
+		t.Fatalf("expected 2 pages, got %d", repo.pages)
+	}
+}
+
+func TestExportTradesParquet(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	repo := newTradeRepository(25, start)
+	req, err := ParseRequest("AAPL", "trades", "parquet", "", "2024-01-02T00:00:00Z", "2024-01-03T00:00:00Z")
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewService(repo).Export(context.Background(), &buf, req); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	rows, err := parquet.Read[tradeRow](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading parquet: %v", err)
+	}
+	if len(rows) != len(repo.trades) {
+		t.Fatalf("expected %d rows, got %d", len(repo.trades), len(rows))
+	}
+	if want := newTradeRow(repo.trades[24]); !rows[24].ExecutedAt.Equal(want.ExecutedAt) || rows[24].TradeID != want.TradeID || rows[24].Volume != want.Volume {
+		t.Fatalf("expected %+v, got %+v", want, rows[24])
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	for _, tc := range []struct {
+		dataset, format, interval, from, to string
+		err                                 error
+	}{
+		{"trades", "", "", "1704153600", "", nil},
+		{"candles", "parquet", "1h", "2024-01-02T00:00:00Z", "2024-01-03T00:00:00Z", nil},
+		{"orders", "", "", "1704153600", "", ErrInvalidDataset},
+		{"trades", "json", "", "1704153600", "", ErrInvalidFormat},
+		{"candles", "", "2m", "1704153600", "", orderbook.ErrInvalidInterval},
+		{"trades", "", "", "", "", ErrInvalidTimeRange},
+		{"trades", "", "", "yesterday", "", ErrInvalidTime},
+		{"trades", "", "", "1704153600", "1704153600", ErrInvalidTimeRange},
+	} {
+		if _, err := ParseRequest("AAPL", tc.dataset, tc.format, tc.interval, tc.from, tc.to); err != tc.err {
+			t.Errorf("ParseRequest(%q, %q, %q, %q, %q): expected %v, got %v", tc.dataset, tc.format, tc.interval, tc.from, tc.to, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/orderbook"
+	"strconv"
+	"time"
+)
+
+// Dataset is a kind of history that can be exported.
+type Dataset string
+
+const (
+	DatasetCandles     Dataset = "candles"
+	DatasetTrades      Dataset = "trades"
+	DatasetOrderEvents Dataset = "order_events"
+)
+
+// Format is the file format an export is written in.
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatParquet Format = "parquet"
+)
+
+var (
+	ErrInvalidDataset   = errors.New("export: dataset must be one of candles, trades, order_events")
+	ErrInvalidFormat    = errors.New("export: format must be csv or parquet")
+	ErrInvalidTime      = errors.New("export: from and to must be RFC 3339 timestamps or unix seconds")
+	ErrInvalidTimeRange = errors.New("export: from is required and must be before to")
+	ErrMissingSymbol    = errors.New("export: symbol is required")
+)
+
+// Request selects the history to export: a dataset of one symbol within [From, To). Interval only applies to
+// candles.
+type Request struct {
+	Symbol   string
+	Dataset  Dataset
+	Format   Format
+	Interval orderbook.Interval
+	From     time.Time
+	To       time.Time
+}
+
+// ParseRequest builds a request from its string form, as given on the command line or in a query string. Format
+// defaults to csv, interval to the base interval and to to now.
+func ParseRequest(symbol, dataset, format, interval, from, to string) (Request, error) {
+	req := Request{
+		Symbol:   symbol,
+		Dataset:  Dataset(dataset),
+		Format:   FormatCSV,
+		Interval: orderbook.BaseInterval,
+		To:       time.Now(),
+	}
+	if symbol == "" {
+		return Request{}, ErrMissingSymbol
+	}
+	switch req.Dataset {
+	case DatasetCandles, DatasetTrades, DatasetOrderEvents:
+	default:
+		return Request{}, ErrInvalidDataset
+	}
+	if format != "" {
+		req.Format = Format(format)
+		if req.Format != FormatCSV && req.Format != FormatParquet {
+			return Request{}, ErrInvalidFormat
+		}
+	}
+	if interval != "" {
+		var err error
+		if req.Interval, err = orderbook.ParseInterval(interval); err != nil {
+			return Request{}, err
+		}
+	}
+
+	var err error
+	if req.From, err = parseTime(from); err != nil {
+		return Request{}, err
+	}
+	if to != "" {
+		if req.To, err = parseTime(to); err != nil {
+			return Request{}, err
+		}
+	}
+	if req.From.IsZero() || !req.From.Before(req.To) {
+		return Request{}, ErrInvalidTimeRange
+	}
+	return req, nil
+}
+
+// Filename is the name the export is saved under by default.
+func (r Request) Filename() string {
+	return fmt.Sprintf("%s_%s_%d_%d.%s", r.Symbol, r.Dataset, r.From.Unix(), r.To.Unix(), r.Format)
+}
+
+// ContentType is the media type of the export.
+func (r Request) ContentType() string {
+	if r.Format == FormatParquet {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// parseTime parses an RFC 3339 timestamp or unix seconds. An empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, ErrInvalidTime
+	}
+	return t, nil
+}
+
+// The row types are the exported columns of each dataset. Column names come from the parquet tags and are shared
+// by both formats.
+
+type candleRow struct {
+	Symbol     string    `parquet:"symbol,dict"`
+	Interval   string    `parquet:"interval,dict"`
+	Start      time.Time `parquet:"start"`
+	Open       float64   `parquet:"open"`
+	High       float64   `parquet:"high"`
+	Low        float64   `parquet:"low"`
+	Close      float64   `parquet:"close"`
+	Volume     float64   `parquet:"volume"`
+	TradeCount int64     `parquet:"trade_count"`
+	BuyVolume  float64   `parquet:"buy_volume"`  // volume of trades initiated by a buyer
+	SellVolume float64   `parquet:"sell_volume"` // volume of trades initiated by a seller
+}
+
+type tradeRow struct {
+	TradeID       string    `parquet:"trade_id"`
+	Symbol        string    `parquet:"symbol,dict"`
+	Price         float64   `parquet:"price"`
+	Volume        float64   `parquet:"volume"`
+	AggressorSide string    `parquet:"aggressor_side,dict"`
+	BuyOrderID    string    `parquet:"buy_order_id"`
+	SellOrderID   string    `parquet:"sell_order_id"`
+	ExecutedAt    time.Time `parquet:"executed_at"`
+}
+
+type orderEventRow struct {
+	EventID      string    `parquet:"event_id"`
+	OrderID      string    `parquet:"order_id"`
+	UserID       string    `parquet:"user_id"`
+	Symbol       string    `parquet:"symbol,dict"`
+	EventType    string    `parquet:"event_type,dict"`
+	OrderSide    string    `parquet:"order_side,dict"`
+	OrderStatus  string    `parquet:"order_status,dict"`
+	Price        float64   `parquet:"price"`
+	Volume       float64   `parquet:"volume"`
+	FilledVolume float64   `parquet:"filled_volume"`
+	OccurredAt   time.Time `parquet:"occurred_at"`
+}
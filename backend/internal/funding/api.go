@@ -0,0 +1,262 @@
+package funding
+
+import (
+	"encoding/json"
+	"errors"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// ErrMsgInternalServer is a message displayed when an unexpected error occurs
+	ErrMsgInternalServer = "Internal server error"
+
+	errMsgInvalidLimit  = "limit must be a positive integer"
+	errMsgInvalidType   = "type must be one of Deposit, Withdrawal or Transfer"
+	errMsgInvalidStatus = "status must be one of Pending, Approved or Rejected"
+
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+type API struct {
+	fundingService Service
+}
+
+// NewAPI creates a new intance of the API struct.
+func NewAPI(fundingService Service) API {
+	return API{
+		fundingService: fundingService,
+	}
+}
+
+// HandleGetBalance returns the user's cash, the part reserved by open orders and the part available to withdraw.
+func (api *API) HandleGetBalance(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromContext(r.Context())
+	b, err := api.fundingService.GetBalance(userID)
+	if err != nil {
+		writeErr(w, "HandleGetBalance", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, b)
+}
+
+// HandleRequestDeposit creates a deposit request, which credits the balance once an admin approves it.
+func (api *API) HandleRequestDeposit(w http.ResponseWriter, r *http.Request) {
+	var input AmountInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	t, err := api.fundingService.RequestDeposit(middleware.UserIDFromContext(r.Context()), input)
+	if err != nil {
+		writeInputErr(w, "HandleRequestDeposit", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, t)
+}
+
+// HandleRequestWithdrawal creates a withdrawal request. The amount leaves the balance right away and comes back
+// if an admin rejects the request.
+func (api *API) HandleRequestWithdrawal(w http.ResponseWriter, r *http.Request) {
+	var input AmountInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	t, err := api.fundingService.RequestWithdrawal(middleware.UserIDFromContext(r.Context()), input)
+	if err != nil {
+		writeInputErr(w, "HandleRequestWithdrawal", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, t)
+}
+
+// HandleTransferFunds moves cash from the user to another user.
+func (api *API) HandleTransferFunds(w http.ResponseWriter, r *http.Request) {
+	var input TransferInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	t, err := api.fundingService.TransferFunds(middleware.UserIDFromContext(r.Context()), input)
+	if err != nil {
+		writeInputErr(w, "HandleTransferFunds", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, t)
+}
+
+// HandleGetTransfers returns the user's transfers newest first, optionally filtered by ?type= and ?status=. The
+// next page starts before the last transfer's ID, passed as ?before=.
+func (api *API) HandleGetTransfers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := TransferFilter{Type: TransferType(query.Get("type")), Status: TransferStatus(query.Get("status")), Before: query.Get("before")}
+	switch filter.Type {
+	case "", TypeDeposit, TypeWithdrawal, TypeTransfer:
+	default:
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidType)
+		return
+	}
+	if !validStatus(filter.Status) {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidStatus)
+		return
+	}
+	var ok bool
+	if filter.Limit, ok = parseLimit(w, r); !ok {
+		return
+	}
+
+	transfers, err := api.fundingService.GetUserTransfers(middleware.UserIDFromContext(r.Context()), filter)
+	if err != nil {
+		writeErr(w, "HandleGetTransfers", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, transfers)
+}
+
+func (api *API) HandleGetTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := api.fundingService.GetUserTransfer(middleware.UserIDFromContext(r.Context()), chi.URLParam(r, "transferID"))
+	if err != nil {
+		writeErr(w, "HandleGetTransfer", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, t)
+}
+
+// HandleAdminGetTransfers returns the transfers of every user oldest first, optionally only those with ?status=,
+// such as the pending ones awaiting review. The next page starts after the last transfer's ID, passed as ?after=.
+func (api *API) HandleAdminGetTransfers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := TransferStatus(query.Get("status"))
+	if !validStatus(status) {
+		endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidStatus)
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+	transfers, err := api.fundingService.GetTransfers(status, query.Get("after"), limit)
+	if err != nil {
+		writeErr(w, "HandleAdminGetTransfers", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, transfers)
+}
+
+func (api *API) HandleApproveTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := api.fundingService.ApproveTransfer(middleware.UserIDFromContext(r.Context()), chi.URLParam(r, "transferID"))
+	if err != nil {
+		writeErr(w, "HandleApproveTransfer", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, t)
+}
+
+func (api *API) HandleRejectTransfer(w http.ResponseWriter, r *http.Request) {
+	var input RejectInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	t, err := api.fundingService.RejectTransfer(middleware.UserIDFromContext(r.Context()), chi.URLParam(r, "transferID"), input)
+	if err != nil {
+		writeInputErr(w, "HandleRejectTransfer", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, t)
+}
+
+func validStatus(status TransferStatus) bool {
+	switch status {
+	case "", StatusPending, StatusApproved, StatusRejected:
+		return true
+	}
+	return false
+}
+
+// parseLimit reads the ?limit= page size, writing a Bad Request response when it is invalid.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := defaultPageLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidLimit)
+			return 0, false
+		}
+		limit = min(n, maxPageLimit)
+	}
+	return limit, true
+}
+
+// writeInputErr writes the response for an error of a request with a body, see writeErr.
+func writeInputErr(w http.ResponseWriter, handler string, input any, err error) {
+	if validator.IsValidationError(err) {
+		endpoint.WriteValidationErr(w, input, err)
+		return
+	}
+	writeErr(w, handler, err)
+}
+
+func writeErr(w http.ResponseWriter, handler string, err error) {
+	// Client errors are written with their own message, without the wrapping the layers below added
+	for _, e := range []struct {
+		err    error
+		status int
+	}{
+		{errInvalidAmount, http.StatusBadRequest},
+		{errSelfTransfer, http.StatusBadRequest},
+		{ErrInsufficientFunds, http.StatusConflict},
+		{ErrTransferNotPending, http.StatusConflict},
+		{ErrTransferNotFound, http.StatusNotFound},
+		{ErrRecipientNotFound, http.StatusNotFound},
+		{user.ErrUserNotFound, http.StatusNotFound},
+	} {
+		if errors.Is(err, e.err) {
+			endpoint.WriteWithError(w, e.status, e.err.Error())
+			return
+		}
+	}
+	log.Printf("%s: Failed due to internal server error: %v", handler, err)
+	endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+}
+
+// RegisterHandlers registers the API's request handlers. The /users/me routes are behind apiKeyHandler, moving
+// funds with an API key requires ScopeWithdraw and taking them out of the account a trading role. The review routes
+// are behind adminHandler.
+func (api *API) RegisterHandlers(r chi.Router, apiKeyHandler, adminHandler func(http.Handler) http.Handler) {
+	r.With(apiKeyHandler).Get("/users/me/balance", api.HandleGetBalance)
+	r.Route("/users/me/transfers", func(r chi.Router) {
+		r.Use(apiKeyHandler)
+		r.Get("/", api.HandleGetTransfers)
+		r.Get("/{transferID}", api.HandleGetTransfer)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(middleware.ScopeWithdraw))
+			r.Post("/deposits", api.HandleRequestDeposit)
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireRole(models.TradingRoles...))
+				r.Post("/withdrawals", api.HandleRequestWithdrawal)
+				r.Post("/internal", api.HandleTransferFunds)
+			})
+		})
+	})
+	r.Route("/admin/transfers", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/", api.HandleAdminGetTransfers)
+		r.Post("/{transferID}/approve", api.HandleApproveTransfer)
+		r.Post("/{transferID}/reject", api.HandleRejectTransfer)
+	})
+}
@@ -0,0 +1,279 @@
+package funding
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/user"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrTransferNotFound   = errors.New("Transfer does not exist")
+	ErrTransferNotPending = errors.New("Transfer was already reviewed")
+	ErrInsufficientFunds  = errors.New("Insufficient available balance")
+	ErrRecipientNotFound  = errors.New("Recipient does not exist")
+)
+
+type Repository interface {
+	GetCashBalance(userID string) (decimal.Decimal, error)
+	// CreateDeposit records a pending deposit, the balance only changes once it is approved.
+	CreateDeposit(t Transfer) error
+	// CreateWithdrawal takes the amount from the user's balance and records a pending withdrawal. It returns
+	// ErrInsufficientFunds if the amount exceeds the balance less reserved.
+	CreateWithdrawal(t Transfer, reserved decimal.Decimal) error
+	// CreateInternalTransfer moves the amount from the user to the counterparty and records the transfer. It
+	// returns ErrInsufficientFunds if the amount exceeds the sender's balance less reserved.
+	CreateInternalTransfer(t Transfer, reserved decimal.Decimal) error
+	// ReviewTransfer approves or rejects a pending deposit or withdrawal, crediting an approved deposit and
+	// refunding a rejected withdrawal. It returns ErrTransferNotPending if the transfer was already reviewed.
+	ReviewTransfer(transferID string, approve bool, reviewedBy, reason string, at time.Time) (Transfer, error)
+	GetTransfer(transferID string) (Transfer, error)
+	// GetUserTransfers returns the transfers a user sent or received, newest first.
+	GetUserTransfers(userID string, filter TransferFilter) ([]Transfer, error)
+	// GetTransfers returns up to limit transfers of every user with status, oldest first, starting after the
+	// transfer with ID after. An empty status returns every transfer.
+	GetTransfers(status TransferStatus, after string, limit int) ([]Transfer, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+const transferColumns = `transfer_id, transfer_type, transfer_status, user_id, counterparty_id, amount, note, reject_reason, reviewed_by, created_at, reviewed_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTransfer(row scanner) (Transfer, error) {
+	var t Transfer
+	err := row.Scan(&t.ID, &t.Type, &t.Status, &t.UserID, &t.CounterpartyID, &t.Amount, &t.Note, &t.RejectReason, &t.ReviewedBy, &t.CreatedAt, &t.ReviewedAt)
+	return t, err
+}
+
+func (r *repository) GetCashBalance(userID string) (decimal.Decimal, error) {
+	var cash decimal.Decimal
+	err := r.db.QueryRow("SELECT cash_balance FROM users WHERE user_id = ?", userID).Scan(&cash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decimal.Zero, user.ErrUserNotFound
+	}
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("repository: failed to get cash balance: %w", err)
+	}
+	return cash, nil
+}
+
+func (r *repository) CreateDeposit(t Transfer) error {
+	return insertTransfer(r.db, t)
+}
+
+func (r *repository) CreateWithdrawal(t Transfer, reserved decimal.Decimal) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		if err := debit(tx, t.UserID, t.Amount, reserved); err != nil {
+			return err
+		}
+		return insertTransfer(tx, t)
+	})
+}
+
+func (r *repository) CreateInternalTransfer(t Transfer, reserved decimal.Decimal) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		// Both rows are locked in one statement, in primary key order, so opposite transfers can't deadlock
+		rows, err := tx.Query("SELECT user_id FROM users WHERE user_id IN (?, ?) ORDER BY user_id FOR UPDATE", t.UserID, *t.CounterpartyID)
+		if err != nil {
+			return fmt.Errorf("repository: failed to lock users: %w", err)
+		}
+		found := 0
+		for rows.Next() {
+			found++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("repository: failed to lock users: %w", err)
+		}
+		if found < 2 {
+			return ErrRecipientNotFound
+		}
+
+		if err := debit(tx, t.UserID, t.Amount, reserved); err != nil {
+			return err
+		}
+		if err := credit(tx, *t.CounterpartyID, t.Amount); err != nil {
+			return err
+		}
+		return insertTransfer(tx, t)
+	})
+}
+
+func (r *repository) ReviewTransfer(transferID string, approve bool, reviewedBy, reason string, at time.Time) (Transfer, error) {
+	var t Transfer
+	err := r.inTx(func(tx *sql.Tx) error {
+		var err error
+		t, err = scanTransfer(tx.QueryRow("SELECT "+transferColumns+" FROM transfers WHERE transfer_id = ? FOR UPDATE", transferID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTransferNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("repository: failed to get transfer: %w", err)
+		}
+		if t.Status != StatusPending {
+			return ErrTransferNotPending
+		}
+
+		t.Status, t.ReviewedAt = StatusRejected, &at
+		if approve {
+			t.Status = StatusApproved
+		} else {
+			t.RejectReason = &reason
+		}
+		if reviewedBy != "" {
+			t.ReviewedBy = &reviewedBy
+		}
+		switch {
+		case approve && t.Type == TypeDeposit:
+			err = credit(tx, t.UserID, t.Amount)
+		case !approve && t.Type == TypeWithdrawal:
+			err = credit(tx, t.UserID, t.Amount)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE transfers SET transfer_status = ?, reject_reason = ?, reviewed_by = ?, reviewed_at = ? WHERE transfer_id = ?",
+			t.Status, t.RejectReason, t.ReviewedBy, t.ReviewedAt, t.ID)
+		if err != nil {
+			return fmt.Errorf("repository: failed to update transfer: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Transfer{}, err
+	}
+	return t, nil
+}
+
+func (r *repository) GetTransfer(transferID string) (Transfer, error) {
+	t, err := scanTransfer(r.db.QueryRow("SELECT "+transferColumns+" FROM transfers WHERE transfer_id = ?", transferID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Transfer{}, ErrTransferNotFound
+	}
+	if err != nil {
+		return Transfer{}, fmt.Errorf("repository: failed to get transfer: %w", err)
+	}
+	return t, nil
+}
+
+func (r *repository) GetUserTransfers(userID string, filter TransferFilter) ([]Transfer, error) {
+	var sb strings.Builder
+	sb.WriteString("SELECT " + transferColumns + " FROM transfers WHERE (user_id = ? OR counterparty_id = ?)")
+	args := []any{userID, userID}
+	if filter.Type != "" {
+		sb.WriteString(" AND transfer_type = ?")
+		args = append(args, filter.Type)
+	}
+	if filter.Status != "" {
+		sb.WriteString(" AND transfer_status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Before != "" {
+		sb.WriteString(" AND transfer_id < ?")
+		args = append(args, filter.Before)
+	}
+	sb.WriteString(" ORDER BY transfer_id DESC LIMIT ?")
+	args = append(args, filter.Limit)
+	return r.queryTransfers(sb.String(), args...)
+}
+
+func (r *repository) GetTransfers(status TransferStatus, after string, limit int) ([]Transfer, error) {
+	return r.queryTransfers("SELECT "+transferColumns+" FROM transfers WHERE (? = '' OR transfer_status = ?) AND transfer_id > ? ORDER BY transfer_id LIMIT ?",
+		status, status, after, limit)
+}
+
+func (r *repository) queryTransfers(query string, args ...any) ([]Transfer, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get transfers: %w", err)
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository: failed to scan transfer: %w", err)
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get transfers: %w", err)
+	}
+	return transfers, nil
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.
+func (r *repository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("repository: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertTransfer(db execer, t Transfer) error {
+	_, err := db.Exec("INSERT INTO transfers ("+transferColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.Type, t.Status, t.UserID, t.CounterpartyID, t.Amount, t.Note, t.RejectReason, t.ReviewedBy, t.CreatedAt, t.ReviewedAt)
+	if err != nil {
+		return fmt.Errorf("repository: failed to create transfer: %w", err)
+	}
+	return nil
+}
+
+// debit takes amount from a user's balance, locking the user's row. It returns ErrInsufficientFunds if the amount
+// exceeds the balance left after keeping reserved for the user's open orders.
+func debit(tx *sql.Tx, userID string, amount, reserved decimal.Decimal) error {
+	var cash decimal.Decimal
+	err := tx.QueryRow("SELECT cash_balance FROM users WHERE user_id = ? FOR UPDATE", userID).Scan(&cash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user.ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("repository: failed to get cash balance: %w", err)
+	}
+	if cash.Sub(reserved).LessThan(amount) {
+		return ErrInsufficientFunds
+	}
+	if _, err := tx.Exec("UPDATE users SET cash_balance = cash_balance - ? WHERE user_id = ?", amount, userID); err != nil {
+		return fmt.Errorf("repository: failed to debit cash balance: %w", err)
+	}
+	return nil
+}
+
+func credit(tx *sql.Tx, userID string, amount decimal.Decimal) error {
+	if _, err := tx.Exec("UPDATE users SET cash_balance = cash_balance + ? WHERE user_id = ?", amount, userID); err != nil {
+		return fmt.Errorf("repository: failed to credit cash balance: %w", err)
+	}
+	return nil
+}
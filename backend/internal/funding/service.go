@@ -0,0 +1,180 @@
+package funding
+
+import (
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/pkg/validator"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	errInvalidAmount = errors.New("Amount must be positive and below 100,000,000 with at most 2 decimals")
+	errSelfTransfer  = errors.New("Cannot transfer to yourself")
+)
+
+// maxAmount bounds a single transfer, balances are stored as DECIMAL(10, 2).
+var maxAmount = decimal.NewFromInt(100_000_000)
+
+// Service defines the funding service interface.
+type Service interface {
+	GetBalance(userID string) (Balance, error)
+	RequestDeposit(userID string, input AmountInput) (Transfer, error)
+	RequestWithdrawal(userID string, input AmountInput) (Transfer, error)
+	TransferFunds(userID string, input TransferInput) (Transfer, error)
+	GetUserTransfers(userID string, filter TransferFilter) ([]Transfer, error)
+	// GetUserTransfer returns a transfer the user sent or received, others are reported as ErrTransferNotFound.
+	GetUserTransfer(userID, transferID string) (Transfer, error)
+
+	// GetTransfers, ApproveTransfer and RejectTransfer are for admins. reviewedBy is the admin's user ID, empty
+	// for the admin key.
+	GetTransfers(status TransferStatus, after string, limit int) ([]Transfer, error)
+	ApproveTransfer(reviewedBy, transferID string) (Transfer, error)
+	RejectTransfer(reviewedBy, transferID string, input RejectInput) (Transfer, error)
+}
+
+type service struct {
+	repo       Repository
+	obServices map[string]orderbook.Service
+	validator  validator.Validate
+}
+
+// NewService creates a new instance of the funding service. Open orders and fills are reserved as the order books
+// see them, so an order is reserved from the moment the engine accepts it until its fills are persisted.
+func NewService(repo Repository, obServices map[string]orderbook.Service, validator validator.Validate) Service {
+	return &service{
+		repo:       repo,
+		obServices: obServices,
+		validator:  validator,
+	}
+}
+
+func (s *service) GetBalance(userID string) (Balance, error) {
+	reserved := s.reserved(userID)
+	cash, err := s.repo.GetCashBalance(userID)
+	if err != nil {
+		return Balance{}, fmt.Errorf("service: failed to get balance: %w", err)
+	}
+	return Balance{Cash: cash, Reserved: reserved, Available: cash.Sub(reserved)}, nil
+}
+
+// reserved returns the cash the user's buy orders and unpersisted buy fills are going to take from their balance,
+// see orderbook.Service.CommittedBuyValue. It must be read before the balance it is taken from, so that a fill
+// being persisted is reserved twice rather than not at all.
+func (s *service) reserved(userID string) decimal.Decimal {
+	id, err := ulid.Parse(userID)
+	if err != nil {
+		return decimal.Zero
+	}
+	amount := decimal.Zero
+	for _, ob := range s.obServices {
+		amount = amount.Add(ob.CommittedBuyValue(id))
+	}
+	return amount
+}
+
+func (s *service) RequestDeposit(userID string, input AmountInput) (Transfer, error) {
+	t, err := s.newTransfer(TypeDeposit, userID, input.Amount, input.Note, input)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if err := s.repo.CreateDeposit(t); err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to create deposit: %w", err)
+	}
+	return t, nil
+}
+
+func (s *service) RequestWithdrawal(userID string, input AmountInput) (Transfer, error) {
+	t, err := s.newTransfer(TypeWithdrawal, userID, input.Amount, input.Note, input)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if err := s.repo.CreateWithdrawal(t, s.reserved(userID)); err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to create withdrawal: %w", err)
+	}
+	return t, nil
+}
+
+func (s *service) TransferFunds(userID string, input TransferInput) (Transfer, error) {
+	t, err := s.newTransfer(TypeTransfer, userID, input.Amount, input.Note, input)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if input.ToUserID == userID {
+		return Transfer{}, errSelfTransfer
+	}
+	t.Status = StatusApproved
+	t.CounterpartyID = &input.ToUserID
+	if err := s.repo.CreateInternalTransfer(t, s.reserved(userID)); err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to transfer funds: %w", err)
+	}
+	return t, nil
+}
+
+// newTransfer validates a request and builds the pending transfer it asks for.
+func (s *service) newTransfer(typ TransferType, userID string, amount decimal.Decimal, note string, input any) (Transfer, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return Transfer{}, err
+	}
+	if !amount.IsPositive() || !amount.LessThan(maxAmount) || !amount.Equal(amount.Round(2)) {
+		return Transfer{}, errInvalidAmount
+	}
+	return Transfer{
+		ID:        ulid.Make().String(),
+		Type:      typ,
+		Status:    StatusPending,
+		UserID:    userID,
+		Amount:    amount,
+		Note:      note,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (s *service) GetUserTransfers(userID string, filter TransferFilter) ([]Transfer, error) {
+	transfers, err := s.repo.GetUserTransfers(userID, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get transfers: %w", err)
+	}
+	return transfers, nil
+}
+
+func (s *service) GetUserTransfer(userID, transferID string) (Transfer, error) {
+	t, err := s.repo.GetTransfer(transferID)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to get transfer: %w", err)
+	}
+	if t.UserID != userID && (t.CounterpartyID == nil || *t.CounterpartyID != userID) {
+		return Transfer{}, ErrTransferNotFound
+	}
+	return t, nil
+}
+
+func (s *service) GetTransfers(status TransferStatus, after string, limit int) ([]Transfer, error) {
+	transfers, err := s.repo.GetTransfers(status, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("service: failed to get transfers: %w", err)
+	}
+	return transfers, nil
+}
+
+func (s *service) ApproveTransfer(reviewedBy, transferID string) (Transfer, error) {
+	t, err := s.repo.ReviewTransfer(transferID, true, reviewedBy, "", time.Now())
+	if err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to approve transfer: %w", err)
+	}
+	return t, nil
+}
+
+func (s *service) RejectTransfer(reviewedBy, transferID string, input RejectInput) (Transfer, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return Transfer{}, err
+	}
+	t, err := s.repo.ReviewTransfer(transferID, false, reviewedBy, input.Reason, time.Now())
+	if err != nil {
+		return Transfer{}, fmt.Errorf("service: failed to reject transfer: %w", err)
+	}
+	return t, nil
+}
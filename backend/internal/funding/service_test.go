@@ -0,0 +1,124 @@
+package funding
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/pkg/validator"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+// memRepository keeps transfers and a single cash balance in memory.
+type memRepository struct {
+	Repository
+	transfers map[string]Transfer
+	cash      decimal.Decimal
+}
+
+func (r *memRepository) GetCashBalance(string) (decimal.Decimal, error) {
+	return r.cash, nil
+}
+
+func (r *memRepository) CreateWithdrawal(t Transfer, reserved decimal.Decimal) error {
+	if r.cash.Sub(reserved).LessThan(t.Amount) {
+		return ErrInsufficientFunds
+	}
+	r.cash = r.cash.Sub(t.Amount)
+	r.transfers[t.ID] = t
+	return nil
+}
+
+func (r *memRepository) CreateDeposit(t Transfer) error {
+	r.transfers[t.ID] = t
+	return nil
+}
+
+func (r *memRepository) CreateInternalTransfer(t Transfer, _ decimal.Decimal) error {
+	r.transfers[t.ID] = t
+	return nil
+}
+
+func (r *memRepository) GetTransfer(transferID string) (Transfer, error) {
+	t, ok := r.transfers[transferID]
+	if !ok {
+		return Transfer{}, ErrTransferNotFound
+	}
+	return t, nil
+}
+
+func TestTransferRequests(t *testing.T) {
+	s := NewService(&memRepository{transfers: map[string]Transfer{}}, nil, validator.New())
+
+	for _, amount := range []string{"0", "-5", "0.001", "100000000"} {
+		if _, err := s.RequestDeposit("user1", AmountInput{Amount: decimal.RequireFromString(amount)}); !errors.Is(err, errInvalidAmount) {
+			t.Errorf("deposit of %s: err = %v, want errInvalidAmount", amount, err)
+		}
+	}
+	deposit, err := s.RequestDeposit("user1", AmountInput{Amount: decimal.RequireFromString("250.50")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.Type != TypeDeposit || deposit.Status != StatusPending {
+		t.Errorf("deposit is %s %s, want a pending deposit", deposit.Status, deposit.Type)
+	}
+
+	if _, err := s.TransferFunds("user1", TransferInput{ToUserID: "user1", Amount: decimal.NewFromInt(1)}); !errors.Is(err, errSelfTransfer) {
+		t.Errorf("transfer to self: err = %v, want errSelfTransfer", err)
+	}
+	transfer, err := s.TransferFunds("user1", TransferInput{ToUserID: "user2", Amount: decimal.NewFromInt(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Status != StatusApproved {
+		t.Errorf("internal transfer is %s, want approved", transfer.Status)
+	}
+
+	// Transfers are visible to their sender and recipient only
+	for userID, visible := range map[string]bool{"user1": true, "user2": true, "user3": false} {
+		_, err := s.GetUserTransfer(userID, transfer.ID)
+		if visible != (err == nil) || (!visible && !errors.Is(err, ErrTransferNotFound)) {
+			t.Errorf("transfer for %s: err = %v, visible %v", userID, err, visible)
+		}
+	}
+	if _, err := s.GetUserTransfer("user2", deposit.ID); !errors.Is(err, ErrTransferNotFound) {
+		t.Errorf("another user's deposit: err = %v, want ErrTransferNotFound", err)
+	}
+}
+
+// openBuys is an order book holding buys of a single user.
+type openBuys struct {
+	orderbook.Service
+	userID ulid.ULID
+	value  decimal.Decimal
+}
+
+func (b openBuys) CommittedBuyValue(userID ulid.ULID) decimal.Decimal {
+	if userID != b.userID {
+		return decimal.Zero
+	}
+	return b.value
+}
+
+func TestWithdrawalKeepsOpenOrdersReserved(t *testing.T) {
+	userID := ulid.Make()
+	repo := &memRepository{transfers: map[string]Transfer{}, cash: decimal.NewFromInt(1000)}
+	// The buy rests on the book but may not be persisted yet
+	books := map[string]orderbook.Service{"AAPL": openBuys{userID: userID, value: decimal.NewFromInt(700)}}
+	s := NewService(repo, books, validator.New())
+
+	b, err := s.GetBalance(userID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Reserved.Equal(decimal.NewFromInt(700)) || !b.Available.Equal(decimal.NewFromInt(300)) {
+		t.Fatalf("got %s reserved and %s available, want 700 and 300", b.Reserved, b.Available)
+	}
+	if _, err := s.RequestWithdrawal(userID.String(), AmountInput{Amount: decimal.NewFromInt(301)}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("withdrawing into the reserved cash: err = %v, want ErrInsufficientFunds", err)
+	}
+	if _, err := s.RequestWithdrawal(userID.String(), AmountInput{Amount: decimal.NewFromInt(300)}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package funding
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// TransferType is the kind of a transfer.
+type TransferType string
+
+const (
+	TypeDeposit    TransferType = "Deposit"
+	TypeWithdrawal TransferType = "Withdrawal"
+	TypeTransfer   TransferType = "Transfer" // between two users of the exchange
+)
+
+// TransferStatus is the state of a transfer. Deposits and withdrawals are pending until an admin reviews them,
+// internal transfers are approved when made.
+type TransferStatus string
+
+const (
+	StatusPending  TransferStatus = "Pending"
+	StatusApproved TransferStatus = "Approved"
+	StatusRejected TransferStatus = "Rejected"
+)
+
+// Transfer is a movement of cash into, out of or within the exchange. Withdrawals and internal transfers take the
+// cash from the user's balance when requested, a rejected withdrawal gives it back. Deposits add to the balance
+// once approved.
+type Transfer struct {
+	ID             string          `json:"id"`
+	Type           TransferType    `json:"type"`
+	Status         TransferStatus  `json:"status"`
+	UserID         string          `json:"user_id"`                   // who requested it, the sender of internal transfers
+	CounterpartyID *string         `json:"counterparty_id,omitempty"` // the recipient of internal transfers
+	Amount         decimal.Decimal `json:"amount"`
+	Note           string          `json:"note,omitempty"`
+	RejectReason   *string         `json:"reject_reason,omitempty"`
+	ReviewedBy     *string         `json:"reviewed_by,omitempty"` // the admin who reviewed it, empty for the admin key
+	CreatedAt      time.Time       `json:"created_at"`
+	ReviewedAt     *time.Time      `json:"reviewed_at,omitempty"`
+}
+
+// Balance is a user's cash. Reserved is the value of their open limit buy orders, which can't be withdrawn or
+// transferred.
+type Balance struct {
+	Cash      decimal.Decimal `json:"cash"`
+	Reserved  decimal.Decimal `json:"reserved"`
+	Available decimal.Decimal `json:"available"`
+}
+
+// AmountInput defines the structure for deposit and withdrawal requests.
+type AmountInput struct {
+	Amount decimal.Decimal `json:"amount"`
+	Note   string          `json:"note" validate:"max=255"`
+}
+
+// TransferInput defines the structure for requests to transfer cash to another user.
+type TransferInput struct {
+	ToUserID string          `json:"to_user_id" validate:"required"`
+	Amount   decimal.Decimal `json:"amount"`
+	Note     string          `json:"note" validate:"max=255"`
+}
+
+// RejectInput defines the structure for requests to reject a transfer.
+type RejectInput struct {
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+// TransferFilter narrows down a user's transfer history. Zero fields don't filter. Transfers are listed newest
+// first, Before is the ID of the last transfer of the previous page.
+type TransferFilter struct {
+	Type   TransferType
+	Status TransferStatus
+	Before string
+	Limit  int
+}
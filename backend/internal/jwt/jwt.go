@@ -1,45 +1,87 @@
 package jwt
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github/wry-0313/exchange/internal/models"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/oklog/ulid/v2"
 )
 
+var ErrTokenRevoked = errors.New("Token has been revoked")
+
 // signiture = sign(encode(header (include metadata and algo used for signiture)) + encode(payload (include claims)))
 
 // JWT tokens will have a unique identitfier jti (JWT ID) which will ensure that even if claims are the same the tokens will be distinc values
 
 // Service is an interface that represents all the capabilities for the JWT service.
 type Service interface {
-	GenerateToken(userID string) (string, error)
+	// GenerateToken issues a token for the session sessionID, the refresh token family the token belongs to. It is
+	// empty for tokens issued without a refresh token.
+	GenerateToken(userID string, role models.Role, sessionID string) (string, error)
 	VerifyToken(token string) (string, error)
+	// VerifyTokenClaims is VerifyToken for callers that also need to know when the token expires, such as
+	// long-lived WebSocket sessions.
+	VerifyTokenClaims(token string) (Claims, error)
+}
+
+// Claims are the verified contents of a token.
+type Claims struct {
+	ID        string // the token's jti, empty for tokens issued before tokens had one
+	UserID    string
+	Role      models.Role // RoleTrader for tokens issued before tokens had a role
+	SessionID string      // the refresh token family the token was issued with, empty if it was issued without one
+	IssuedAt  time.Time   // zero for tokens issued before tokens had an iat
+	ExpiresAt time.Time
+}
+
+// Revocations reports tokens that were revoked before they expired, such as on logout.
+type Revocations interface {
+	IsRevoked(ctx context.Context, claims Claims) (bool, error)
 }
 
 type service struct {
-	jwtSecret  string
-	expiration int
+	jwtSecret   string
+	expiration  int
+	revocations Revocations
 }
 
 // NewService creates a service with a provided JWT secret string and expiration (hourly) number. It implements
-// the JWT Service interface.
-func NewService(jwtSecret string, expiration int) *service {
-	return &service{jwtSecret, expiration}
+// the JWT Service interface. Tokens found in revocations fail verification, revocations may be nil.
+func NewService(jwtSecret string, expiration int, revocations Revocations) *service {
+	return &service{jwtSecret, expiration, revocations}
 }
 
-// GenerateToken takes a user ID and
-func (s *service) GenerateToken(userID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// GenerateToken takes a user ID, role and session ID and returns a signed token carrying them.
+func (s *service) GenerateToken(userID string, role models.Role, sessionID string) (string, error) {
+	claims := jwt.MapClaims{
+		"jti":    ulid.Make().String(),
 		"userID": userID,
+		"role":   string(role),
+		"iat":    time.Now().Unix(),
 		"exp":    time.Now().Add(time.Duration(s.expiration) * time.Hour).Unix(),
-	})
+	}
+	if sessionID != "" {
+		claims["sid"] = sessionID
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(s.jwtSecret))
 }
 
 // VerifyToken parses and validates a jwt token. It returns the userID if the token is valid.
 func (s *service) VerifyToken(tokenString string) (string, error) {
+	claims, err := s.VerifyTokenClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.UserID, nil
+}
+
+// VerifyTokenClaims parses and validates a jwt token. It returns the userID, role and expiry if the token is valid.
+func (s *service) VerifyTokenClaims(tokenString string) (Claims, error) {
 	// By having an anonymous function, we can customize the key provision and key validation steps and achieve separation of concerns
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -49,20 +91,43 @@ func (s *service) VerifyToken(tokenString string) (string, error) {
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("Issue parsing token: %w", err)
+		return Claims{}, fmt.Errorf("Issue parsing token: %w", err)
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		userID := claims["userID"]
 		userIDStr, ok := userID.(string)
 		if !ok {
-			return "", fmt.Errorf("Issue parsing userID: %w", err)
+			return Claims{}, fmt.Errorf("Issue parsing userID: %w", err)
 		}
 		if userIDStr == "" {
-			return "", fmt.Errorf("User id not set: %w", err)
+			return Claims{}, fmt.Errorf("User id not set: %w", err)
+		}
+		exp, err := claims.GetExpirationTime()
+		if err != nil || exp == nil {
+			return Claims{}, errors.New("Token has no expiration")
 		}
-		return userIDStr, nil
+		tokenID, _ := claims["jti"].(string)
+		role := models.RoleTrader
+		if roleStr, _ := claims["role"].(string); roleStr != "" {
+			role = models.Role(roleStr)
+		}
+		sessionID, _ := claims["sid"].(string)
+		verified := Claims{ID: tokenID, UserID: userIDStr, Role: role, SessionID: sessionID, ExpiresAt: exp.Time}
+		if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+			verified.IssuedAt = iat.Time
+		}
+		if s.revocations != nil {
+			revoked, err := s.revocations.IsRevoked(context.Background(), verified)
+			if err != nil {
+				return Claims{}, fmt.Errorf("Issue checking token revocation: %w", err)
+			}
+			if revoked {
+				return Claims{}, ErrTokenRevoked
+			}
+		}
+		return verified, nil
 	}
-	return "", errors.New("Invalid token")
+	return Claims{}, errors.New("Invalid token")
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,32 @@
+package jwt
+
+import "time"
+
+// RevocationsChannel is the Redis channel revocations are announced on, so that connections which authenticated
+// with a revoked token can be closed.
+const RevocationsChannel = "jwt.revocations"
+
+// Revocation announces that tokens of UserID were revoked: the token TokenID when set, such as on logout, every
+// token of the session SessionID when set, such as when its refresh token is reused, and otherwise every token
+// issued before IssuedBefore, such as when their password is reset.
+type Revocation struct {
+	UserID       string    `json:"user_id"`
+	TokenID      string    `json:"token_id,omitempty"`
+	SessionID    string    `json:"session_id,omitempty"`
+	IssuedBefore time.Time `json:"issued_before"`
+}
+
+// Matches reports whether the token with claims is revoked. Issue times have a resolution of a second, a token
+// issued within the second of the revocation is kept so that logging in right after it works.
+func (r Revocation) Matches(claims Claims) bool {
+	switch {
+	case claims.UserID != r.UserID:
+		return false
+	case r.TokenID != "":
+		return claims.ID == r.TokenID
+	case r.SessionID != "":
+		return claims.SessionID == r.SessionID
+	default:
+		return claims.IssuedAt.Unix() < r.IssuedBefore.Unix()
+	}
+}
@@ -0,0 +1,38 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFile creates a mailer that writes each email to an .eml file in dir instead of sending it, for local
+// development.
+func NewFile(dir, from string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mail: failed to create mail directory: %w", err)
+	}
+	return &fileMailer{
+		dir:  dir,
+		from: from,
+	}, nil
+}
+
+func (m *fileMailer) Send(_ context.Context, msg Message) error {
+	path := filepath.Join(m.dir, ulid.Make().String()+".eml")
+	if err := os.WriteFile(path, encode(m.from, msg, time.Now()), 0o600); err != nil {
+		return fmt.Errorf("mail: failed to write email: %w", err)
+	}
+	log.Printf("Mail: wrote %q to %s", msg.Subject, path)
+	return nil
+}
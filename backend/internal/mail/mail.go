@@ -0,0 +1,61 @@
+// Package mail sends the emails of the exchange, such as email verifications and password resets. Emails go out
+// over SMTP in production, locally they are written to files or kept in memory.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github/wry-0313/exchange/internal/config"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer is an interface that represents all the capabilities of a mailer.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New creates the mailer selected in the config.
+func New(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case config.MailDriverSMTP:
+		return NewSMTP(cfg), nil
+	case config.MailDriverFile, "":
+		return NewFile(cfg.Dir, cfg.From)
+	case config.MailDriverMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("mail: unknown mail driver %q", cfg.Driver)
+	}
+}
+
+// encode formats msg as an RFC 5322 message from the sender from.
+func encode(from string, msg Message, date time.Time) []byte {
+	var b bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", msg.Subject},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `text/plain; charset="utf-8"`},
+	} {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], headerValue(h[1]))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// headerValue drops line breaks from a header value, they would let the value add headers of its own.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"github/wry-0313/exchange/internal/config"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth // nil when the server takes mail without authentication
+}
+
+// NewSMTP creates a mailer that sends emails through an SMTP server, authenticating with PLAIN when a username is
+// configured. The connection is upgraded with STARTTLS when the server supports it.
+func NewSMTP(cfg config.MailConfig) Mailer {
+	m := &smtpMailer{
+		addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		from: cfg.From,
+	}
+	if cfg.SMTPUsername != "" {
+		m.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return m
+}
+
+// Send ignores ctx, net/smtp can't be cancelled.
+func (m *smtpMailer) Send(_ context.Context, msg Message) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, encode(m.from, msg, time.Now())); err != nil {
+		return fmt.Errorf("mail: failed to send email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package margin
+
+import (
+	"encoding/json"
+	"errors"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/user"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrMsgInternalServer is a message displayed when an unexpected error occurs
+const ErrMsgInternalServer = "Internal server error"
+
+type API struct {
+	marginService Service
+}
+
+// NewAPI creates a new intance of the API struct.
+func NewAPI(marginService Service) API {
+	return API{
+		marginService: marginService,
+	}
+}
+
+// HandleGetAccount returns the user's equity and margin requirements at the current market prices.
+func (api *API) HandleGetAccount(w http.ResponseWriter, r *http.Request) {
+	a, err := api.marginService.GetAccount(middleware.UserIDFromContext(r.Context()))
+	if err != nil {
+		writeErr(w, "HandleGetAccount", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, a)
+}
+
+// HandleSetAccountType switches the user between a cash and a margin account.
+func (api *API) HandleSetAccountType(w http.ResponseWriter, r *http.Request) {
+	var input SetAccountTypeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	a, err := api.marginService.SetAccountType(middleware.UserIDFromContext(r.Context()), input)
+	if err != nil {
+		writeInputErr(w, "HandleSetAccountType", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, a)
+}
+
+// HandleRequestLocate locates shares the user can sell short until the end of the day.
+func (api *API) HandleRequestLocate(w http.ResponseWriter, r *http.Request) {
+	var input LocateInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	l, err := api.marginService.RequestLocate(middleware.UserIDFromContext(r.Context()), input)
+	if err != nil {
+		writeInputErr(w, "HandleRequestLocate", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusCreated, l)
+}
+
+// HandleGetBorrows returns the user's short positions and the locates they can still sell short against.
+func (api *API) HandleGetBorrows(w http.ResponseWriter, r *http.Request) {
+	b, err := api.marginService.GetBorrows(middleware.UserIDFromContext(r.Context()))
+	if err != nil {
+		writeErr(w, "HandleGetBorrows", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, b)
+}
+
+// writeInputErr writes the response for an error of a request with a body, see writeErr.
+func writeInputErr(w http.ResponseWriter, handler string, input any, err error) {
+	if validator.IsValidationError(err) {
+		endpoint.WriteValidationErr(w, input, err)
+		return
+	}
+	writeErr(w, handler, err)
+}
+
+func writeErr(w http.ResponseWriter, handler string, err error) {
+	// Client errors are written with their own message, without the wrapping the layers below added
+	for _, e := range []struct {
+		err    error
+		status int
+	}{
+		{errInvalidVolume, http.StatusBadRequest},
+		{exchange.ErrInvalidSymbol, http.StatusBadRequest},
+		{ErrNotMarginAccount, http.StatusConflict},
+		{ErrOpenShortPositions, http.StatusConflict},
+		{ErrLocateUnavailable, http.StatusConflict},
+		{user.ErrUserNotFound, http.StatusNotFound},
+	} {
+		if errors.Is(err, e.err) {
+			endpoint.WriteWithError(w, e.status, e.err.Error())
+			return
+		}
+	}
+	log.Printf("%s: Failed due to internal server error: %v", handler, err)
+	endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+}
+
+// RegisterHandlers registers the API's request handlers, which are behind apiKeyHandler. Changing the account
+// type and locating shares are also behind tradeHandler.
+func (api *API) RegisterHandlers(r chi.Router, apiKeyHandler, tradeHandler func(http.Handler) http.Handler) {
+	r.Route("/users/me/margin", func(r chi.Router) {
+		r.Use(apiKeyHandler)
+		r.Get("/", api.HandleGetAccount)
+		r.Get("/borrows", api.HandleGetBorrows)
+		r.With(tradeHandler).Put("/type", api.HandleSetAccountType)
+		r.With(tradeHandler).Post("/locates", api.HandleRequestLocate)
+	})
+}
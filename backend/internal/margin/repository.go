@@ -0,0 +1,254 @@
+package margin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/user"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrLocateUnavailable = errors.New("Not enough shares are available to borrow")
+	ErrNoLocate          = fmt.Errorf("%w: Shares must be located before selling short", exchange.ErrOrderRejected)
+)
+
+type Repository interface {
+	GetAccountType(userID string) (AccountType, error)
+	SetAccountType(userID string, accountType AccountType) error
+	// GetMarginUserIDs returns the users of margin accounts that hold a position.
+	GetMarginUserIDs() ([]string, error)
+
+	// GetHolding returns the volume the user holds of a symbol, negative for a short position.
+	GetHolding(userID, symbol string) (decimal.Decimal, error)
+	// GetShorts returns the user's short positions ordered by symbol.
+	GetShorts(userID string) ([]Borrow, error)
+
+	// CreateLocate stores a locate unless the shares already out on loan or located of its symbol would exceed
+	// borrowLimit, ErrLocateUnavailable.
+	CreateLocate(l Locate, borrowLimit decimal.Decimal) error
+	// UseLocates takes volume from the user's locates of a symbol that are good at now, soonest expiring first, and
+	// returns the volume taken by locate ID. It returns ErrNoLocate, using none, when they don't cover the volume.
+	UseLocates(userID, symbol string, volume decimal.Decimal, now time.Time) (map[string]decimal.Decimal, error)
+	// ReturnLocates gives back volume UseLocates took, by locate ID.
+	ReturnLocates(used map[string]decimal.Decimal) error
+	// GetLocates returns the user's locates that are good at now and not used up, soonest expiring first.
+	GetLocates(userID string, now time.Time) ([]Locate, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func (r *repository) GetAccountType(userID string) (AccountType, error) {
+	var accountType AccountType
+	err := r.db.QueryRow("SELECT account_type FROM users WHERE user_id = ?", userID).Scan(&accountType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", user.ErrUserNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("repository: failed to get account type: %w", err)
+	}
+	return accountType, nil
+}
+
+func (r *repository) SetAccountType(userID string, accountType AccountType) error {
+	if _, err := r.db.Exec("UPDATE users SET account_type = ? WHERE user_id = ?", accountType, userID); err != nil {
+		return fmt.Errorf("repository: failed to set account type: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetMarginUserIDs() ([]string, error) {
+	rows, err := r.db.Query(`SELECT DISTINCT u.user_id FROM users u JOIN holdings h ON h.user_id = u.user_id
+	WHERE u.account_type = ? ORDER BY u.user_id`, AccountMargin)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get margin accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan margin account: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get margin accounts: %w", err)
+	}
+	return userIDs, nil
+}
+
+func (r *repository) GetHolding(userID, symbol string) (decimal.Decimal, error) {
+	var volume decimal.Decimal
+	err := r.db.QueryRow("SELECT volume FROM holdings WHERE user_id = ? AND symbol = ?", userID, symbol).Scan(&volume)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decimal.Zero, nil
+	}
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("repository: failed to get holding: %w", err)
+	}
+	return volume, nil
+}
+
+func (r *repository) GetShorts(userID string) ([]Borrow, error) {
+	rows, err := r.db.Query("SELECT symbol, -volume FROM holdings WHERE user_id = ? AND volume < 0 ORDER BY symbol", userID)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get short positions: %w", err)
+	}
+	defer rows.Close()
+
+	borrows := []Borrow{}
+	for rows.Next() {
+		var b Borrow
+		if err := rows.Scan(&b.Symbol, &b.Volume); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan short position: %w", err)
+		}
+		borrows = append(borrows, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get short positions: %w", err)
+	}
+	return borrows, nil
+}
+
+func (r *repository) CreateLocate(l Locate, borrowLimit decimal.Decimal) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		// Locking the stock serializes the locates of a symbol, so they can't exceed the limit together
+		var symbol string
+		err := tx.QueryRow("SELECT symbol FROM stocks WHERE symbol = ? FOR UPDATE", l.Symbol).Scan(&symbol)
+		if errors.Is(err, sql.ErrNoRows) {
+			return exchange.ErrInvalidSymbol
+		}
+		if err != nil {
+			return fmt.Errorf("repository: failed to lock stock: %w", err)
+		}
+
+		var borrowed, located decimal.Decimal
+		if err := tx.QueryRow("SELECT COALESCE(-SUM(volume), 0) FROM holdings WHERE symbol = ? AND volume < 0", l.Symbol).Scan(&borrowed); err != nil {
+			return fmt.Errorf("repository: failed to get borrowed volume: %w", err)
+		}
+		if err := tx.QueryRow("SELECT COALESCE(SUM(remaining), 0) FROM locates WHERE symbol = ? AND expires_at > ?", l.Symbol, l.CreatedAt).Scan(&located); err != nil {
+			return fmt.Errorf("repository: failed to get located volume: %w", err)
+		}
+		if borrowed.Add(located).Add(l.Volume).GreaterThan(borrowLimit) {
+			return ErrLocateUnavailable
+		}
+
+		_, err = tx.Exec("INSERT INTO locates (locate_id, user_id, symbol, volume, remaining, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			l.ID, l.UserID, l.Symbol, l.Volume, l.Remaining, l.CreatedAt, l.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("repository: failed to create locate: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *repository) UseLocates(userID, symbol string, volume decimal.Decimal, now time.Time) (map[string]decimal.Decimal, error) {
+	used := map[string]decimal.Decimal{}
+	err := r.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT locate_id, remaining FROM locates WHERE user_id = ? AND symbol = ? AND expires_at > ? AND remaining > 0
+		ORDER BY expires_at, locate_id FOR UPDATE`, userID, symbol, now)
+		if err != nil {
+			return fmt.Errorf("repository: failed to get locates: %w", err)
+		}
+		type locate struct {
+			id        string
+			remaining decimal.Decimal
+		}
+		var locates []locate
+		for rows.Next() {
+			var l locate
+			if err := rows.Scan(&l.id, &l.remaining); err != nil {
+				rows.Close()
+				return fmt.Errorf("repository: failed to scan locate: %w", err)
+			}
+			locates = append(locates, l)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("repository: failed to get locates: %w", err)
+		}
+
+		left := volume
+		for _, l := range locates {
+			if left.IsZero() {
+				break
+			}
+			take := decimal.Min(left, l.remaining)
+			if _, err := tx.Exec("UPDATE locates SET remaining = remaining - ? WHERE locate_id = ?", take, l.id); err != nil {
+				return fmt.Errorf("repository: failed to use locate: %w", err)
+			}
+			used[l.id] = take
+			left = left.Sub(take)
+		}
+		if left.IsPositive() {
+			return ErrNoLocate
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+func (r *repository) ReturnLocates(used map[string]decimal.Decimal) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		for id, volume := range used {
+			if _, err := tx.Exec("UPDATE locates SET remaining = remaining + ? WHERE locate_id = ?", volume, id); err != nil {
+				return fmt.Errorf("repository: failed to return locate: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *repository) GetLocates(userID string, now time.Time) ([]Locate, error) {
+	rows, err := r.db.Query(`SELECT locate_id, user_id, symbol, volume, remaining, created_at, expires_at FROM locates
+	WHERE user_id = ? AND expires_at > ? AND remaining > 0 ORDER BY expires_at, locate_id`, userID, now)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get locates: %w", err)
+	}
+	defer rows.Close()
+
+	locates := []Locate{}
+	for rows.Next() {
+		var l Locate
+		if err := rows.Scan(&l.ID, &l.UserID, &l.Symbol, &l.Volume, &l.Remaining, &l.CreatedAt, &l.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan locate: %w", err)
+		}
+		locates = append(locates, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get locates: %w", err)
+	}
+	return locates, nil
+}
+
+func (r *repository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("repository: failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,480 @@
+package margin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/config"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/internal/portfolio"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrShortSellingNotAllowed = fmt.Errorf("%w: Cash accounts can only sell shares they hold", exchange.ErrOrderRejected)
+	ErrInsufficientMargin     = fmt.Errorf("%w: Insufficient margin for this order", exchange.ErrOrderRejected)
+	ErrNoMarketPrice          = fmt.Errorf("%w: The symbol has not traded yet, use a limit order", exchange.ErrOrderRejected)
+	ErrOpenShortPositions     = errors.New("Short positions must be closed before switching to a cash account")
+	ErrNotMarginAccount       = errors.New("Only margin accounts can locate shares")
+
+	errInvalidVolume = errors.New("Volume must be positive with at most 2 decimals")
+)
+
+const (
+	// checkInterval is how often margin accounts are checked against the maintenance requirement.
+	checkInterval = time.Second
+
+	// liquidationCooldown is how long an account isn't liquidated again after its last liquidation, so the orders
+	// submitted can fill and be persisted before the account is valued again.
+	liquidationCooldown = 5 * time.Second
+
+	// pendingSellTimeout is how long a sell that passed CheckOrder counts as on its way to the book when OrderDone
+	// is never called for it, e.g. because the process that consumed it isn't this one.
+	pendingSellTimeout = time.Minute
+
+	// volumePlaces and pricePlaces are the precision orders are placed at.
+	volumePlaces = 2
+	pricePlaces  = 2
+)
+
+// Service defines the margin service interface.
+type Service interface {
+	// GetAccount values the user's account and compares it to the margin requirements.
+	GetAccount(userID string) (Account, error)
+	// SetAccountType switches the user between a cash and a margin account. Switching to cash is refused with
+	// ErrOpenShortPositions while the user is short.
+	SetAccountType(userID string, input SetAccountTypeInput) (Account, error)
+	// RequestLocate locates shares the user can sell short until the end of the day (UTC).
+	RequestLocate(userID string, input LocateInput) (Locate, error)
+	GetBorrows(userID string) (Borrows, error)
+
+	// CheckOrder implements exchange.RiskCheck. Cash accounts can't sell more than they hold, margin accounts can
+	// sell short against their locates as long as the order keeps them above the initial requirement.
+	CheckOrder(input exchange.PlaceOrderInput) error
+	// OrderDone implements exchange.RiskCheck. The locates a sell used are given back when it never reached the
+	// book.
+	OrderDone(input exchange.PlaceOrderInput, accepted bool)
+	// Run checks the margin accounts in the background until ctx is done. Accounts below the maintenance
+	// requirement are sent a margin call and liquidated back to the initial requirement.
+	Run(ctx context.Context)
+}
+
+type service struct {
+	repo             Repository
+	portfolioService portfolio.Service
+	obServices       map[string]orderbook.Service
+	validator        validator.Validate
+	rdb              *redis.Client
+
+	initial     decimal.Decimal
+	maintenance decimal.Decimal
+	borrowLimit decimal.Decimal
+
+	// Sells that passed CheckOrder by order ID, until OrderDone reports the engine applied them
+	pendingMu sync.Mutex
+	pending   map[string]pendingSell
+	userLocks map[string]*sync.Mutex
+}
+
+// pendingSell is a sell on its way to the book and the locates it used.
+type pendingSell struct {
+	userID    string
+	symbol    string
+	volume    decimal.Decimal
+	locates   map[string]decimal.Decimal
+	checkedAt time.Time
+}
+
+// NewService creates a new instance of the margin service.
+func NewService(
+	repo Repository,
+	portfolioService portfolio.Service,
+	obServices map[string]orderbook.Service,
+	validator validator.Validate,
+	rdb *redis.Client,
+	cfg config.MarginConfig,
+) Service {
+	return &service{
+		repo:             repo,
+		portfolioService: portfolioService,
+		obServices:       obServices,
+		validator:        validator,
+		rdb:              rdb,
+		initial:          decimal.NewFromFloat(cfg.Initial),
+		maintenance:      decimal.NewFromFloat(cfg.Maintenance),
+		borrowLimit:      decimal.NewFromFloat(cfg.BorrowLimit),
+		pending:          map[string]pendingSell{},
+		userLocks:        map[string]*sync.Mutex{},
+	}
+}
+
+func (s *service) GetAccount(userID string) (Account, error) {
+	a, _, err := s.account(userID)
+	return a, err
+}
+
+// account values the user's account, returning the portfolio it was valued from.
+func (s *service) account(userID string) (Account, portfolio.Portfolio, error) {
+	accountType, err := s.repo.GetAccountType(userID)
+	if err != nil {
+		return Account{}, portfolio.Portfolio{}, fmt.Errorf("service: failed getting account type: %w", err)
+	}
+	p, err := s.portfolioService.GetPortfolio(userID)
+	if err != nil {
+		return Account{}, portfolio.Portfolio{}, err
+	}
+	return s.evaluate(userID, accountType, p), p, nil
+}
+
+// evaluate computes the account of a portfolio.
+func (s *service) evaluate(userID string, accountType AccountType, p portfolio.Portfolio) Account {
+	a := Account{
+		UserID:      userID,
+		Type:        accountType,
+		Status:      StatusHealthy,
+		CashBalance: p.CashBalance,
+		Equity:      p.Equity,
+	}
+	for _, pos := range p.Positions {
+		if pos.MarketValue.IsNegative() {
+			a.ShortValue = a.ShortValue.Sub(pos.MarketValue)
+		} else {
+			a.LongValue = a.LongValue.Add(pos.MarketValue)
+		}
+	}
+	a.GrossValue = a.LongValue.Add(a.ShortValue)
+
+	if accountType != AccountMargin {
+		a.ExcessEquity = a.CashBalance
+		a.BuyingPower = a.CashBalance
+		return a
+	}
+	a.InitialRequirement = a.GrossValue.Mul(s.initial).Round(pricePlaces)
+	a.MaintenanceRequirement = a.GrossValue.Mul(s.maintenance).Round(pricePlaces)
+	a.ExcessEquity = a.Equity.Sub(a.InitialRequirement)
+	a.BuyingPower = decimal.Max(decimal.Zero, a.ExcessEquity.Div(s.initial).Round(pricePlaces))
+	switch {
+	case a.GrossValue.IsPositive() && a.Equity.LessThan(a.MaintenanceRequirement):
+		a.Status = StatusMarginCall
+	case a.Equity.LessThan(a.InitialRequirement):
+		a.Status = StatusRestricted
+	}
+	return a
+}
+
+func (s *service) SetAccountType(userID string, input SetAccountTypeInput) (Account, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return Account{}, fmt.Errorf("service: validation error: %w", err)
+	}
+	if input.Type == AccountCash {
+		shorts, err := s.repo.GetShorts(userID)
+		if err != nil {
+			return Account{}, fmt.Errorf("service: failed getting short positions: %w", err)
+		}
+		if len(shorts) > 0 {
+			return Account{}, ErrOpenShortPositions
+		}
+	}
+	if err := s.repo.SetAccountType(userID, input.Type); err != nil {
+		return Account{}, fmt.Errorf("service: failed setting account type: %w", err)
+	}
+	return s.GetAccount(userID)
+}
+
+func (s *service) RequestLocate(userID string, input LocateInput) (Locate, error) {
+	if err := s.validator.Struct(input); err != nil {
+		return Locate{}, fmt.Errorf("service: validation error: %w", err)
+	}
+	if !input.Volume.IsPositive() || !input.Volume.Equal(input.Volume.Round(volumePlaces)) {
+		return Locate{}, errInvalidVolume
+	}
+	accountType, err := s.repo.GetAccountType(userID)
+	if err != nil {
+		return Locate{}, fmt.Errorf("service: failed getting account type: %w", err)
+	}
+	if accountType != AccountMargin {
+		return Locate{}, ErrNotMarginAccount
+	}
+
+	now := time.Now().UTC()
+	l := Locate{
+		ID:        ulid.Make().String(),
+		UserID:    userID,
+		Symbol:    input.Symbol,
+		Volume:    input.Volume,
+		Remaining: input.Volume,
+		CreatedAt: now,
+		ExpiresAt: now.Truncate(24 * time.Hour).Add(24 * time.Hour),
+	}
+	if err := s.repo.CreateLocate(l, s.borrowLimit); err != nil {
+		return Locate{}, fmt.Errorf("service: failed creating locate: %w", err)
+	}
+	return l, nil
+}
+
+func (s *service) GetBorrows(userID string) (Borrows, error) {
+	shorts, err := s.repo.GetShorts(userID)
+	if err != nil {
+		return Borrows{}, fmt.Errorf("service: failed getting short positions: %w", err)
+	}
+	locates, err := s.repo.GetLocates(userID, time.Now().UTC())
+	if err != nil {
+		return Borrows{}, fmt.Errorf("service: failed getting locates: %w", err)
+	}
+	return Borrows{Borrows: shorts, Locates: locates}, nil
+}
+
+func (s *service) CheckOrder(input exchange.PlaceOrderInput) error {
+	ob, ok := s.obServices[input.Symbol]
+	if !ok {
+		return exchange.ErrInvalidSymbol
+	}
+	userID, err := ulid.Parse(input.UserID)
+	if err != nil {
+		return fmt.Errorf("service: failed to parse user ID: %w", err)
+	}
+
+	// A user's orders are checked one at a time, so a sell is pending before the next order is checked
+	unlock := s.lockUser(input.UserID)
+	defer unlock()
+
+	accountType, err := s.repo.GetAccountType(input.UserID)
+	if err != nil {
+		return fmt.Errorf("service: failed getting account type: %w", err)
+	}
+	// A sell moves from pending to the book to the database, and is read in that order, so one moving along is
+	// counted twice rather than missed
+	pendingSells := s.pendingSellVolume(input.UserID, input.Symbol)
+	committedSells := ob.CommittedSellVolume(userID)
+	held, err := s.repo.GetHolding(input.UserID, input.Symbol)
+	if err != nil {
+		return fmt.Errorf("service: failed getting holding: %w", err)
+	}
+	volume := decimal.NewFromFloat(input.Volume).Round(volumePlaces)
+
+	// The part of a sell the shares held and not already being sold don't cover is a short sale
+	short := decimal.Zero
+	if input.OrderSide == "sell" {
+		sellable := decimal.Max(decimal.Zero, held.Sub(committedSells).Sub(pendingSells))
+		short = decimal.Max(decimal.Zero, volume.Sub(sellable))
+	}
+	if accountType != AccountMargin && short.IsPositive() {
+		return ErrShortSellingNotAllowed
+	}
+
+	// Only the volume that opens or grows a position adds to the requirements, buying back a short doesn't
+	added := short
+	if input.OrderSide == "buy" {
+		added = decimal.Max(decimal.Zero, volume.Sub(decimal.Max(decimal.Zero, held.Neg())))
+	}
+	if accountType == AccountMargin && added.IsPositive() {
+		price, err := s.orderPrice(input)
+		if err != nil {
+			return err
+		}
+		a, _, err := s.account(input.UserID)
+		if err != nil {
+			return err
+		}
+		required := a.GrossValue.Add(added.Mul(price)).Mul(s.initial)
+		if a.Equity.LessThan(required) {
+			return ErrInsufficientMargin
+		}
+	}
+
+	if input.OrderSide != "sell" {
+		return nil
+	}
+	var locates map[string]decimal.Decimal
+	if short.IsPositive() {
+		if locates, err = s.repo.UseLocates(input.UserID, input.Symbol, short, time.Now().UTC()); err != nil {
+			if errors.Is(err, ErrNoLocate) {
+				return ErrNoLocate
+			}
+			return fmt.Errorf("service: failed using locates: %w", err)
+		}
+	}
+	s.pendingMu.Lock()
+	s.pending[input.OrderID] = pendingSell{
+		userID:    input.UserID,
+		symbol:    input.Symbol,
+		volume:    volume,
+		locates:   locates,
+		checkedAt: time.Now(),
+	}
+	s.pendingMu.Unlock()
+	return nil
+}
+
+func (s *service) OrderDone(input exchange.PlaceOrderInput, accepted bool) {
+	s.pendingMu.Lock()
+	sell, ok := s.pending[input.OrderID]
+	delete(s.pending, input.OrderID)
+	s.pendingMu.Unlock()
+	if !ok || accepted || len(sell.locates) == 0 {
+		return
+	}
+	if err := s.repo.ReturnLocates(sell.locates); err != nil {
+		log.Printf("Service: failed to return locates of order %s: %v", input.OrderID, err)
+	}
+}
+
+// lockUser locks the checks of a user's orders, returning the function that unlocks them.
+func (s *service) lockUser(userID string) func() {
+	s.pendingMu.Lock()
+	mu, ok := s.userLocks[userID]
+	if !ok {
+		mu = &sync.Mutex{}
+		s.userLocks[userID] = mu
+	}
+	s.pendingMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// pendingSellVolume returns the volume of the user's sells of a symbol on their way to the book. Sells that have
+// been pending for longer than pendingSellTimeout are dropped.
+func (s *service) pendingSellVolume(userID, symbol string) decimal.Decimal {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	volume := decimal.Zero
+	for orderID, sell := range s.pending {
+		if time.Since(sell.checkedAt) > pendingSellTimeout {
+			delete(s.pending, orderID)
+			continue
+		}
+		if sell.userID == userID && sell.symbol == symbol {
+			volume = volume.Add(sell.volume)
+		}
+	}
+	return volume
+}
+
+// orderPrice returns the price an order is valued at, its limit price or the symbol's market price.
+func (s *service) orderPrice(input exchange.PlaceOrderInput) (decimal.Decimal, error) {
+	if input.OrderType == "limit" {
+		return decimal.NewFromFloat(input.Price).Round(pricePlaces), nil
+	}
+	ob, ok := s.obServices[input.Symbol]
+	if !ok {
+		return decimal.Decimal{}, exchange.ErrInvalidSymbol
+	}
+	price := ob.MarketPrice()
+	if price.Sign() <= 0 {
+		return decimal.Decimal{}, ErrNoMarketPrice
+	}
+	return price.Decimal(), nil
+}
+
+func (s *service) Run(ctx context.Context) {
+	go s.checkAccounts(ctx)
+}
+
+func (s *service) checkAccounts(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	called := map[string]bool{}            // users sent a margin call since they were last above maintenance
+	liquidatedAt := map[string]time.Time{} // users' last liquidation
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		userIDs, err := s.repo.GetMarginUserIDs()
+		if err != nil {
+			log.Printf("Service: failed to get margin accounts: %v", err)
+			continue
+		}
+		for _, userID := range userIDs {
+			a, p, err := s.account(userID)
+			if err != nil {
+				log.Printf("Service: failed to value margin account of user %s: %v", userID, err)
+				continue
+			}
+			if a.Status != StatusMarginCall {
+				delete(called, userID)
+				continue
+			}
+			if !called[userID] {
+				called[userID] = true
+				s.notify(userID, EventMarginCall, a)
+			}
+			if time.Since(liquidatedAt[userID]) < liquidationCooldown {
+				continue
+			}
+			liquidatedAt[userID] = time.Now()
+			s.liquidate(a, p)
+		}
+	}
+}
+
+// liquidate closes the largest positions first with market orders until the gross value of the account is one
+// its equity meets the initial requirement of. An account without equity is closed out entirely.
+func (s *service) liquidate(a Account, p portfolio.Portfolio) {
+	target := decimal.Zero
+	if a.Equity.IsPositive() {
+		target = a.Equity.Div(s.initial)
+	}
+	excess := a.GrossValue.Sub(target)
+
+	positions := slices.Clone(p.Positions)
+	slices.SortFunc(positions, func(a, b portfolio.Position) int {
+		return b.MarketValue.Abs().Cmp(a.MarketValue.Abs())
+	})
+	userID, err := ulid.Parse(a.UserID)
+	if err != nil {
+		log.Printf("Service: failed to parse user ID %s: %v", a.UserID, err)
+		return
+	}
+	for _, pos := range positions {
+		if !excess.IsPositive() {
+			return
+		}
+		ob, ok := s.obServices[pos.Symbol]
+		if !ok || !pos.MarketPrice.IsPositive() {
+			continue
+		}
+		value := decimal.Min(excess, pos.MarketValue.Abs())
+		volume := decimal.Min(value.Div(pos.MarketPrice).RoundCeil(volumePlaces), pos.Volume.Abs())
+		side := orderbook.Sell
+		if pos.Volume.IsNegative() {
+			side = orderbook.Buy
+		}
+
+		res, err := ob.SubmitOrder(orderbook.OrderRequest{UserID: userID, Side: side, Type: orderbook.Market, Volume: volume})
+		if err != nil {
+			log.Printf("Service: failed to liquidate %s of user %s: %v", pos.Symbol, a.UserID, err)
+			continue
+		}
+		log.Printf("Service: liquidating %s %s of user %s, order %s", volume, pos.Symbol, a.UserID, res.OrderID)
+		s.notify(a.UserID, EventLiquidation, Liquidation{
+			OrderID: res.OrderID.String(),
+			Symbol:  pos.Symbol,
+			Side:    side.String(),
+			Volume:  volume,
+			Status:  res.Status.String(),
+		})
+		excess = excess.Sub(volume.Mul(pos.MarketPrice))
+	}
+}
+
+func (s *service) notify(userID, event string, result any) {
+	if s.rdb == nil {
+		return
+	}
+	if err := exchange.NotifyUser(s.rdb, userID, event, result); err != nil {
+		log.Printf("Service: failed to notify user %s: %v", userID, err)
+	}
+}
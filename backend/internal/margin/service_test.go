@@ -0,0 +1,176 @@
+package margin
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/config"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/internal/portfolio"
+	"github/wry-0313/exchange/pkg/validator"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+var d = decimal.RequireFromString
+
+type memRepository struct {
+	Repository
+	accountType AccountType
+	holding     decimal.Decimal
+	located     decimal.Decimal
+}
+
+func (r *memRepository) GetAccountType(string) (AccountType, error) {
+	return r.accountType, nil
+}
+
+func (r *memRepository) GetHolding(string, string) (decimal.Decimal, error) {
+	return r.holding, nil
+}
+
+func (r *memRepository) UseLocates(_, _ string, volume decimal.Decimal, _ time.Time) (map[string]decimal.Decimal, error) {
+	if volume.GreaterThan(r.located) {
+		return nil, ErrNoLocate
+	}
+	r.located = r.located.Sub(volume)
+	return map[string]decimal.Decimal{"locate": volume}, nil
+}
+
+func (r *memRepository) ReturnLocates(used map[string]decimal.Decimal) error {
+	for _, volume := range used {
+		r.located = r.located.Add(volume)
+	}
+	return nil
+}
+
+// sellingBook is an order book on which the user is already selling some volume.
+type sellingBook struct {
+	orderbook.Service
+	committed decimal.Decimal
+}
+
+func (b sellingBook) CommittedSellVolume(ulid.ULID) decimal.Decimal {
+	return b.committed
+}
+
+// fixedPortfolio is a portfolio service that always returns the same portfolio.
+type fixedPortfolio struct {
+	portfolio.Service
+	p portfolio.Portfolio
+}
+
+func (f fixedPortfolio) GetPortfolio(string) (portfolio.Portfolio, error) {
+	return f.p, nil
+}
+
+func newTestService(repo *memRepository, book sellingBook, p portfolio.Portfolio) *service {
+	cfg := config.MarginConfig{Initial: 0.5, Maintenance: 0.25, BorrowLimit: 1000}
+	books := map[string]orderbook.Service{"AAPL": book}
+	return NewService(repo, fixedPortfolio{p: p}, books, validator.New(), nil, cfg).(*service)
+}
+
+func TestEvaluate(t *testing.T) {
+	s := newTestService(&memRepository{}, sellingBook{}, portfolio.Portfolio{})
+	tests := []struct {
+		name   string
+		equity string
+		want   Status
+	}{
+		{"healthy", "1000", StatusHealthy},
+		{"below initial", "399", StatusRestricted},
+		{"below maintenance", "199", StatusMarginCall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := portfolio.Portfolio{
+				Equity: d(tt.equity),
+				Positions: []portfolio.Position{
+					{Symbol: "AAPL", MarketValue: d("500")},
+					{Symbol: "MSFT", MarketValue: d("-300")},
+				},
+			}
+			a := s.evaluate("user1", AccountMargin, p)
+			if !a.GrossValue.Equal(d("800")) || !a.InitialRequirement.Equal(d("400")) || !a.MaintenanceRequirement.Equal(d("200")) {
+				t.Fatalf("got gross %v, requirements %v and %v, want 800, 400 and 200", a.GrossValue, a.InitialRequirement, a.MaintenanceRequirement)
+			}
+			if a.Status != tt.want {
+				t.Errorf("got status %s, want %s", a.Status, tt.want)
+			}
+		})
+	}
+}
+
+var testUserID = ulid.Make().String()
+
+func sell(volume, price float64) exchange.PlaceOrderInput {
+	return exchange.PlaceOrderInput{OrderID: ulid.Make().String(), UserID: testUserID, OrderType: "limit", OrderSide: "sell", Symbol: "AAPL", Volume: volume, Price: price}
+}
+
+func TestCheckOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		repo    memRepository
+		selling string
+		equity  string
+		input   exchange.PlaceOrderInput
+		wantErr error
+	}{
+		{"cash sells holding", memRepository{accountType: AccountCash, holding: d("10")}, "0", "1000", sell(10, 100), nil},
+		{"cash sells short", memRepository{accountType: AccountCash, holding: d("10")}, "5", "1000", sell(10, 100), ErrShortSellingNotAllowed},
+		{"margin short without locate", memRepository{accountType: AccountMargin}, "0", "1000", sell(5, 100), ErrNoLocate},
+		{"margin short with locate", memRepository{accountType: AccountMargin, located: d("5")}, "0", "1000", sell(5, 100), nil},
+		{"margin short over requirement", memRepository{accountType: AccountMargin, located: d("50")}, "0", "1000", sell(50, 100), ErrInsufficientMargin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := portfolio.Portfolio{Equity: d(tt.equity), CashBalance: d(tt.equity)}
+			s := newTestService(&tt.repo, sellingBook{committed: d(tt.selling)}, p)
+			err := s.CheckOrder(tt.input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, exchange.ErrOrderRejected) {
+				t.Errorf("error %v does not wrap ErrOrderRejected", err)
+			}
+		})
+	}
+}
+
+func TestSellsOnTheirWayToTheBookAreCounted(t *testing.T) {
+	repo := &memRepository{accountType: AccountCash, holding: d("10")}
+	s := newTestService(repo, sellingBook{committed: decimal.Zero}, portfolio.Portfolio{Equity: d("1000")})
+
+	// Neither sell is on the book yet when the second one is checked
+	first := sell(6, 100)
+	if err := s.CheckOrder(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckOrder(sell(6, 100)); !errors.Is(err, ErrShortSellingNotAllowed) {
+		t.Fatalf("got error %v, want ErrShortSellingNotAllowed", err)
+	}
+	// Once the engine rejects the first one its volume can be sold again
+	s.OrderDone(first, false)
+	if err := s.CheckOrder(sell(6, 100)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocatesAreReturnedWhenTheOrderIsNotPlaced(t *testing.T) {
+	repo := &memRepository{accountType: AccountMargin, located: d("10")}
+	s := newTestService(repo, sellingBook{committed: decimal.Zero}, portfolio.Portfolio{Equity: d("1000")})
+
+	rejected, placed := sell(4, 100), sell(5, 100)
+	for _, input := range []exchange.PlaceOrderInput{rejected, placed} {
+		if err := s.CheckOrder(input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.OrderDone(rejected, false)
+	s.OrderDone(placed, true)
+	if !repo.located.Equal(d("5")) {
+		t.Fatalf("got %s located, want the 4 of the rejected order back", repo.located)
+	}
+}
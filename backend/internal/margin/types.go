@@ -0,0 +1,97 @@
+package margin
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// EventMarginCall is published on a user's channel with their Account when its equity falls below the
+	// maintenance requirement.
+	EventMarginCall = "exchange.margin_call"
+	// EventLiquidation is published on a user's channel with a Liquidation for each order the liquidation engine
+	// submits for them.
+	EventLiquidation = "exchange.liquidation"
+)
+
+// AccountType decides whether a user can sell short. Cash accounts can only sell what they hold.
+type AccountType string
+
+const (
+	AccountCash   AccountType = "cash"
+	AccountMargin AccountType = "margin"
+)
+
+// Status is the state of an account compared to its margin requirements.
+type Status string
+
+const (
+	StatusHealthy Status = "Healthy"
+	// StatusRestricted accounts are below the initial requirement, they can only reduce their positions.
+	StatusRestricted Status = "Restricted"
+	// StatusMarginCall accounts are below the maintenance requirement and are being liquidated.
+	StatusMarginCall Status = "MarginCall"
+)
+
+// Account is a user's equity and margin requirements, with positions valued at the live market prices. The
+// requirements are fractions of the gross value of the positions, long and short alike. Cash accounts have no
+// requirements and are always healthy.
+type Account struct {
+	UserID                 string          `json:"user_id"`
+	Type                   AccountType     `json:"type"`
+	Status                 Status          `json:"status"`
+	CashBalance            decimal.Decimal `json:"cash_balance"`
+	LongValue              decimal.Decimal `json:"long_value"`
+	ShortValue             decimal.Decimal `json:"short_value"`
+	GrossValue             decimal.Decimal `json:"gross_value"`
+	Equity                 decimal.Decimal `json:"equity"`
+	InitialRequirement     decimal.Decimal `json:"initial_requirement"`
+	MaintenanceRequirement decimal.Decimal `json:"maintenance_requirement"`
+	ExcessEquity           decimal.Decimal `json:"excess_equity"` // equity above the initial requirement
+	BuyingPower            decimal.Decimal `json:"buying_power"`  // the gross value the excess equity can open
+}
+
+// Locate is a number of shares located for short sales, good until ExpiresAt. Remaining is the part short sales
+// haven't used up yet.
+type Locate struct {
+	ID        string          `json:"id"`
+	UserID    string          `json:"user_id"`
+	Symbol    string          `json:"symbol"`
+	Volume    decimal.Decimal `json:"volume"`
+	Remaining decimal.Decimal `json:"remaining"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// Borrow is a short position, the shares the user borrowed to sell.
+type Borrow struct {
+	Symbol string          `json:"symbol"`
+	Volume decimal.Decimal `json:"volume"`
+}
+
+// Borrows lists a user's short positions and the locates they can still sell short against.
+type Borrows struct {
+	Borrows []Borrow `json:"borrows"`
+	Locates []Locate `json:"locates"`
+}
+
+// Liquidation is an order the liquidation engine submitted to bring an account back above its requirements.
+type Liquidation struct {
+	OrderID string          `json:"order_id"`
+	Symbol  string          `json:"symbol"`
+	Side    string          `json:"side"`
+	Volume  decimal.Decimal `json:"volume"`
+	Status  string          `json:"status"`
+}
+
+// SetAccountTypeInput defines the structure for requests to change the account type.
+type SetAccountTypeInput struct {
+	Type AccountType `json:"type" validate:"required,oneof=cash margin"`
+}
+
+// LocateInput defines the structure for requests to locate shares for short sales.
+type LocateInput struct {
+	Symbol string          `json:"symbol" validate:"required"`
+	Volume decimal.Decimal `json:"volume"`
+}
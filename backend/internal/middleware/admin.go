@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/models"
+	"net/http"
+)
+
+const (
+	headerAdminKey = "X-Admin-Key"
+
+	errMsgAdminOnly = "Admin access required."
+)
+
+// AdminKey creates a middleware function that only lets through requests carrying the admin API key in the
+// X-Admin-Key header. When no key is configured every request is rejected.
+func AdminKey(key string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := r.Header.Get(headerAdminKey)
+			if key == "" || subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+				endpoint.WriteWithError(w, http.StatusForbidden, errMsgAdminOnly)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Admin creates a middleware function for the admin endpoints. Requests carrying the X-Admin-Key header are
+// checked like AdminKey does, the rest must pass authHandler as a user with the admin role. The admin key is how
+// the first admin is appointed.
+func Admin(key string, authHandler func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		keyHandler := AdminKey(key)(next)
+		roleHandler := authHandler(RequireRole(models.RoleAdmin)(next))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(headerAdminKey) != "" {
+				keyHandler.ServeHTTP(w, r)
+				return
+			}
+			roleHandler.ServeHTTP(w, r)
+		})
+	}
+}
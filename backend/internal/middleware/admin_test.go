@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"github/wry-0313/exchange/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	// fakeAuth authenticates every request as a user with the role in the X-Role header
+	fakeAuth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := withRole(withUser(r.Context(), "user1"), models.Role(r.Header.Get("X-Role")))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := Admin("secret", fakeAuth)(ok)
+
+	for _, tc := range []struct {
+		name, key, role string
+		want            int
+	}{
+		{"admin key", "secret", "", http.StatusOK},
+		{"wrong admin key", "wrong", string(models.RoleAdmin), http.StatusForbidden},
+		{"admin role", "", string(models.RoleAdmin), http.StatusOK},
+		{"trader role", "", string(models.RoleTrader), http.StatusForbidden},
+		{"no role", "", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/admin/users", nil)
+		if tc.key != "" {
+			r.Header.Set(headerAdminKey, tc.key)
+		}
+		r.Header.Set("X-Role", tc.role)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	if got := RoleFromContext(context.Background()); got != "" {
+		t.Errorf("role of an unauthenticated context = %q, want none", got)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"github/wry-0313/exchange/internal/endpoint"
 	"github/wry-0313/exchange/internal/jwt"
+	"github/wry-0313/exchange/internal/models"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -13,14 +15,17 @@ type userID int
 
 const (
 	keyUserID userID = -1
+	keyToken  userID = -2
+	keyRole   userID = -4
 
-	errMsgMissingToken = "Missing bearer token."
-	errMsgInvalidToken = "Token is invalid."
+	errMsgMissingToken  = "Missing bearer token."
+	errMsgInvalidToken  = "Token is invalid."
+	errMsgForbiddenRole = "Your role does not allow this action."
 )
 
 // Auth creates a middleware function that retrieves a bearer token and validates the token.
-// The middleware sets the userID in the jwt payload into the request context. If the token is
-// invalid, it will write an Unauthorized response.
+// The middleware sets the userID and role in the jwt payload and the token's claims into the request context. If the
+// token is invalid or was revoked, it will write an Unauthorized response.
 func Auth(jwtService jwt.Service) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -34,13 +39,14 @@ func Auth(jwtService jwt.Service) func(next http.Handler) http.Handler {
 			}
 
 			token := strings.TrimPrefix(authHeader, "Bearer ")
-			userID, err := jwtService.VerifyToken(token)
+			claims, err := jwtService.VerifyTokenClaims(token)
 			if err != nil {
 				log.Printf("handler: issue verifying jwt token: %v\n", err)
 				endpoint.WriteWithError(w, http.StatusUnauthorized, errMsgInvalidToken)
 				return
 			}
-			r = r.WithContext(withUser(ctx, userID))
+			ctx = context.WithValue(ctx, keyToken, claims)
+			r = r.WithContext(withRole(withUser(ctx, claims.UserID), claims.Role))
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -54,6 +60,37 @@ func UserIDFromContext(ctx context.Context) string {
 	return ""
 }
 
+// TokenFromContext returns the claims of the token a request was authenticated with.
+func TokenFromContext(ctx context.Context) (jwt.Claims, bool) {
+	claims, ok := ctx.Value(keyToken).(jwt.Claims)
+	return claims, ok
+}
+
+// RequireRole creates a middleware function that only lets through requests of users with one of roles. It must
+// run after a middleware that authenticates the user.
+func RequireRole(roles ...models.Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(roles, RoleFromContext(r.Context())) {
+				endpoint.WriteWithError(w, http.StatusForbidden, errMsgForbiddenRole)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RoleFromContext returns the role of the user a request was authenticated as, or an empty role.
+func RoleFromContext(ctx context.Context) models.Role {
+	role, _ := ctx.Value(keyRole).(models.Role)
+	return role
+}
+
+// withRole adds the user's role to a context object and returns that context
+func withRole(ctx context.Context, role models.Role) context.Context {
+	return context.WithValue(ctx, keyRole, role)
+}
+
 // withUser adds the userID to a context object and returns that context
 func withUser(ctx context.Context, userID string) context.Context {
 	return context.WithValue(ctx, keyUserID, userID)
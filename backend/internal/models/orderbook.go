@@ -9,13 +9,18 @@ import (
 type Stock struct {
 	ID     int    `json:"id"`
 	Symbol string `json:"symbol"`
+	Halted bool   `json:"halted"` // halted stocks accept no new orders, resting orders can still be cancelled
 }
 
+// StockPriceHistory is an OHLCV candle built from the trades of a symbol. RecordedAt is the start of the candle.
 type StockPriceHistory struct {
 	PriceData
-	BidVolume  float64 `json:"bid_volume"`
-	AskVolume  float64 `json:"ask_volume"`
-	RecordedAt time.Time   `json:"recorded_at"`
+	Interval   string    `json:"interval"`
+	Volume     float64   `json:"volume"`
+	TradeCount int       `json:"trade_count"`
+	BidVolume  float64   `json:"bid_volume"` // volume of trades initiated by a buyer
+	AskVolume  float64   `json:"ask_volume"` // volume of trades initiated by a seller
+	RecordedAt time.Time `json:"recorded_at"`
 }
 
 type PriceData struct {
@@ -37,15 +42,53 @@ type Holding struct {
 }
 
 type Order struct {
-	Symbol         string    `json:"symbol"`
-	OrderID        string    `json:"order_id"`
-	OrderSide      string    `json:"order_side"`
-	OrderStatus    string    `json:"order_status"`
-	OrderType      string    `json:"order_type"`
-	FilledAt       *float64   `json:"filled_at"`
-	FilledAtTime   time.Time `json:"filled_at_time"`
-	TotalProcessed float64   `json:"total_processed"`
-	Volume         float64   `json:"volume"`
-	InitialVolume  float64   `json:"initial_volume"`
-	Price          float64   `json:"price"`
+	Symbol         string     `json:"symbol"`
+	OrderID        string     `json:"order_id"`
+	ClientOrderID  *string    `json:"client_order_id,omitempty"`
+	OrderSide      string     `json:"order_side"`
+	OrderStatus    string     `json:"order_status"`
+	OrderType      string     `json:"order_type"`
+	FilledAt       *float64   `json:"filled_at"`      // price of the last fill
+	FilledAtTime   *time.Time `json:"filled_at_time"` // time of the last fill
+	TotalProcessed float64    `json:"total_processed"`
+	Volume         float64    `json:"volume"`
+	InitialVolume  float64    `json:"initial_volume"`
+	Price          float64    `json:"price"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// OrderFill is a fill an order received, at the price of the order it matched.
+type OrderFill struct {
+	EventID  string          `json:"event_id"`
+	Price    decimal.Decimal `json:"price"`
+	Volume   decimal.Decimal `json:"volume"`
+	FilledAt time.Time       `json:"filled_at"`
+}
+
+// Trade is a match between two orders. AggressorSide is the side of the order that arrived last.
+type Trade struct {
+	TradeID       string          `json:"trade_id"`
+	Symbol        string          `json:"symbol"`
+	Price         decimal.Decimal `json:"price"`
+	Volume        decimal.Decimal `json:"volume"`
+	AggressorSide string          `json:"aggressor_side"`
+	BuyOrderID    string          `json:"buy_order_id"`
+	SellOrderID   string          `json:"sell_order_id"`
+	ExecutedAt    time.Time       `json:"executed_at"`
+}
+
+// OrderEvent is a change to an order: its creation or rejection, a fill, an amendment or its cancellation.
+type OrderEvent struct {
+	EventID      string          `json:"event_id"`
+	OrderID      string          `json:"order_id"`
+	UserID       string          `json:"user_id"`
+	Symbol       string          `json:"symbol"`
+	EventType    string          `json:"event_type"`
+	OrderSide    string          `json:"order_side"`
+	OrderStatus  string          `json:"order_status"`
+	Price        decimal.Decimal `json:"price"`  // limit price when created, fill price when filled
+	Volume       decimal.Decimal `json:"volume"` // volume left on the order after the event
+	FilledVolume decimal.Decimal `json:"filled_volume"`
+	OccurredAt   time.Time       `json:"occurred_at"`
 }
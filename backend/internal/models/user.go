@@ -1,7 +1,32 @@
 package models
+
+import "slices"
+
+// Role decides what a user may do. Roles are carried in the user's tokens, so a change applies from the next login
+// or token refresh.
+type Role string
+
+const (
+	RoleTrader      Role = "trader"
+	RoleMarketMaker Role = "market_maker"
+	RoleAdmin       Role = "admin"
+	RoleReadOnly    Role = "read_only" // may view the market and their account but not trade
+)
+
+// TradingRoles are the roles that may place, cancel and amend orders.
+var TradingRoles = []Role{RoleTrader, RoleMarketMaker, RoleAdmin}
+
+// CanTrade reports whether users with the role may place, cancel and amend orders.
+func (r Role) CanTrade() bool {
+	return slices.Contains(TradingRoles, r)
+}
+
 type User struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Email       *string   `json:"email"`
-	Password    *string   `json:"password,omitempty"`
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Email    *string `json:"email"`
+	Password *string `json:"password,omitempty"`
+	Role     Role    `json:"role"`
+	// EmailVerified is set once the user followed the link mailed to them, or reset their password through one.
+	EmailVerified bool `json:"is_verified"`
 }
@@ -0,0 +1,164 @@
+package orderbook
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/fixed"
+	"sync"
+	"time"
+)
+
+// Interval is the period a candle covers.
+type Interval string
+
+const (
+	Interval1s Interval = "1s"
+	Interval1m Interval = "1m"
+	Interval5m Interval = "5m"
+	Interval1h Interval = "1h"
+	Interval1d Interval = "1d"
+
+	// BaseInterval is the interval candles are built at from trades, the larger intervals are rolled up from it.
+	BaseInterval = Interval1s
+)
+
+var (
+	ErrInvalidInterval = errors.New("orderbook: invalid candle interval")
+
+	// Intervals lists every interval candles are stored at, smallest first.
+	Intervals = []Interval{Interval1s, Interval1m, Interval5m, Interval1h, Interval1d}
+
+	intervalDurations = map[Interval]time.Duration{
+		Interval1s: time.Second,
+		Interval1m: time.Minute,
+		Interval5m: 5 * time.Minute,
+		Interval1h: time.Hour,
+		Interval1d: 24 * time.Hour,
+	}
+)
+
+// ParseInterval returns the interval named s.
+func ParseInterval(s string) (Interval, error) {
+	if _, ok := intervalDurations[Interval(s)]; !ok {
+		return "", ErrInvalidInterval
+	}
+	return Interval(s), nil
+}
+
+// Duration returns the period the interval covers.
+func (i Interval) Duration() time.Duration {
+	return intervalDurations[i]
+}
+
+// Start returns the start of the candle t falls in. Candles are aligned to UTC, so daily candles start at midnight
+// UTC.
+func (i Interval) Start(t time.Time) time.Time {
+	return t.UTC().Truncate(i.Duration())
+}
+
+// candle is an OHLCV bar being built from trades.
+type candle struct {
+	start      time.Time
+	open       fixed.Num
+	high       fixed.Num
+	low        fixed.Num
+	close      fixed.Num
+	volume     fixed.Num
+	buyVolume  fixed.Num // volume of trades where the buyer was the aggressor
+	sellVolume fixed.Num // volume of trades where the seller was the aggressor
+	trades     int
+}
+
+func (c *candle) add(price, volume fixed.Num, aggressor Side) {
+	if c.trades == 0 {
+		c.open, c.high, c.low = price, price, price
+	}
+	c.high = max(c.high, price)
+	c.low = min(c.low, price)
+	c.close = price
+	c.volume += volume
+	if aggressor == Buy {
+		c.buyVolume += volume
+	} else {
+		c.sellVolume += volume
+	}
+	c.trades++
+}
+
+func (c *candle) model(interval Interval) models.StockPriceHistory {
+	return models.StockPriceHistory{
+		PriceData: models.PriceData{
+			Open:  c.open.Decimal(),
+			High:  c.high.Decimal(),
+			Low:   c.low.Decimal(),
+			Close: c.close.Decimal(),
+		},
+		Interval:   string(interval),
+		Volume:     c.volume.Float64(),
+		TradeCount: c.trades,
+		BidVolume:  c.buyVolume.Float64(),
+		AskVolume:  c.sellVolume.Float64(),
+		RecordedAt: c.start,
+	}
+}
+
+// candles builds base interval candles from the book's trades. A candle is closed by the first trade or tick after
+// its period ends and then waits in closed until it is persisted.
+type candles struct {
+	mu      sync.Mutex
+	current *candle // nil until the first trade of the period
+	closed  []models.StockPriceHistory
+}
+
+// record adds the fills an aggressor received to the current candle.
+func (c *candles) record(aggressor Side, fills []fill, at time.Time) {
+	if len(fills) == 0 {
+		return
+	}
+	start := BaseInterval.Start(at)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollLocked(start)
+	if c.current == nil {
+		c.current = &candle{start: start}
+	}
+	for _, f := range fills {
+		c.current.add(f.price, f.volume, aggressor)
+	}
+}
+
+// tick closes the current candle once now is past its period. It returns the candles closed since the last tick
+// and the candle still open, if there were trades in the current period.
+func (c *candles) tick(now time.Time) (closed []models.StockPriceHistory, open *models.StockPriceHistory) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollLocked(BaseInterval.Start(now))
+	closed, c.closed = c.closed, nil
+	if c.current != nil {
+		m := c.current.model(BaseInterval)
+		open = &m
+	}
+	return closed, open
+}
+
+// flush closes the current candle even if its period has not ended, used on shutdown. Trades in the same period
+// after a restart are merged into the stored candle.
+func (c *candles) flush() []models.StockPriceHistory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		c.closed = append(c.closed, c.current.model(BaseInterval))
+		c.current = nil
+	}
+	closed := c.closed
+	c.closed = nil
+	return closed
+}
+
+func (c *candles) rollLocked(start time.Time) {
+	if c.current != nil && start.After(c.current.start) {
+		c.closed = append(c.closed, c.current.model(BaseInterval))
+		c.current = nil
+	}
+}
@@ -3,10 +3,13 @@ package orderbook
 import "errors"
 
 var (
-	ErrInvalidVolume   = errors.New("orderbook: invalid order volume")
-	ErrInvalidClientID = errors.New("orderbook: invalid client ID")
-	ErrInvalidPrice    = errors.New("orderbook: invalid order price")
-	ErrInvalidSide     = errors.New("orderbook: invalid order side")
-	ErrOrderExists     = errors.New("orderbook: order already exists")
-	ErrOrderNotExists  = errors.New("orderbook: order does not exist")
+	ErrInvalidVolume    = errors.New("orderbook: invalid order volume")
+	ErrInvalidClientID  = errors.New("orderbook: invalid client ID")
+	ErrInvalidPrice     = errors.New("orderbook: invalid order price")
+	ErrInvalidSide      = errors.New("orderbook: invalid order side")
+	ErrInvalidOrderType = errors.New("orderbook: invalid order type")
+	ErrOrderExists      = errors.New("orderbook: order already exists")
+	ErrOrderNotExists   = errors.New("orderbook: order does not exist")
+	ErrInvalidAmendment = errors.New("orderbook: amended volume must be positive and below the remaining volume")
+	ErrTradingHalted    = errors.New("orderbook: trading is halted")
 )
@@ -0,0 +1,55 @@
+package orderbook
+
+import (
+	"github/wry-0313/exchange/pkg/fixed"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+// OrderRequest describes an order to submit to the book.
+type OrderRequest struct {
+	OrderID       ulid.ULID // generated by the book when left empty
+	UserID        ulid.ULID
+	ClientOrderID string // optional, unique per user
+	Side          Side
+	Type          OrderType
+	Price         decimal.Decimal // ignored for market orders
+	Volume        decimal.Decimal
+}
+
+// Fill is a single match an order received.
+type Fill struct {
+	Price  decimal.Decimal `json:"price"`
+	Volume decimal.Decimal `json:"volume"`
+}
+
+// OrderResult reports the state an order was left in once the book finished matching it.
+type OrderResult struct {
+	OrderID         ulid.ULID
+	Status          OrderStatus
+	RemainingVolume decimal.Decimal
+	Fills           []Fill
+}
+
+// fill is the engine's fixed-point form of Fill.
+type fill struct {
+	price  fixed.Num
+	volume fixed.Num
+}
+
+// result builds the result for o. It must be called before o is released.
+func (o *Order) result(fills []fill) OrderResult {
+	res := OrderResult{
+		OrderID:         o.orderID,
+		Status:          o.status,
+		RemainingVolume: o.Volume().Decimal(),
+	}
+	if len(fills) > 0 {
+		res.Fills = make([]Fill, len(fills))
+		for i, f := range fills {
+			res.Fills[i] = Fill{Price: f.price.Decimal(), Volume: f.volume.Decimal()}
+		}
+	}
+	return res
+}
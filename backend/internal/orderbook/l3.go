@@ -0,0 +1,203 @@
+package orderbook
+
+import (
+	"context"
+	"encoding/json"
+	"github/wry-0313/exchange/pkg/fixed"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EventStreamL3 = "exchange.stream_l3"
+
+	// L3 event types
+	L3Add     = "add"     // an order was added to the book
+	L3Modify  = "modify"  // an order's size was changed in place, keeping its priority
+	L3Delete  = "delete"  // an order left the book, either cancelled or fully executed
+	L3Execute = "execute" // an order on the book traded, Size is what is left of it
+
+	l3QueueSize    = 8192
+	l3MaxBatchSize = 256
+)
+
+// L3Event is a change to one order resting on the book. Events are numbered per symbol without gaps, a client that
+// sees a gap has missed events and must fetch a new snapshot.
+type L3Event struct {
+	Sequence     uint64  `json:"sequence"`
+	Type         string  `json:"type"`
+	OrderID      uint64  `json:"order_id"` // anonymized, stays the same while the order rests on the book
+	Side         string  `json:"side"`
+	Price        float64 `json:"price"`
+	Size         float64 `json:"size"`
+	ExecutedSize float64 `json:"executed_size,omitempty"`
+	Timestamp    int64   `json:"timestamp"` // unix nanoseconds
+}
+
+// L3Order is an order resting on the book as listed in an L3 snapshot.
+type L3Order struct {
+	OrderID uint64  `json:"order_id"`
+	Price   float64 `json:"price"`
+	Size    float64 `json:"size"`
+}
+
+// L3Book is every order resting on the book, bids from the best price down and asks from the best price up, in time
+// priority within a price level. Events with a sequence after Sequence apply on top of it.
+type L3Book struct {
+	Symbol   string    `json:"symbol"`
+	Sequence uint64    `json:"sequence"`
+	Bids     []L3Order `json:"bids"`
+	Asks     []L3Order `json:"asks"`
+}
+
+type L3PubMsg struct {
+	RedisPubMsgBase
+	Result []L3Event `json:"result,omitempty"`
+}
+
+// L3Channel is the Redis channel a symbol's L3 events are published on.
+func L3Channel(symbol string) string {
+	return symbol + ".l3"
+}
+
+// l3Feed numbers the book's order events and publishes them in batches from a background goroutine, so the engine
+// never waits on Redis. When the queue is full events are dropped and counted, subscribers see the gap in the
+// sequence numbers.
+type l3Feed struct {
+	symbol string
+	rdb    *redis.Client
+
+	mu          sync.Mutex
+	sequence    uint64
+	lastOrderID uint64
+	closed      bool
+
+	events  chan L3Event
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+func newL3Feed(symbol string, rdb *redis.Client) *l3Feed {
+	f := &l3Feed{
+		symbol: symbol,
+		rdb:    rdb,
+		events: make(chan L3Event, l3QueueSize),
+		done:   make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// add assigns o its anonymized ID and reports it joining the book.
+func (f *l3Feed) add(o *Order) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastOrderID++
+	o.bookID = f.lastOrderID
+	f.emitLocked(L3Add, o, fixed.Zero)
+}
+
+func (f *l3Feed) emit(eventType string, o *Order, executed fixed.Num) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.emitLocked(eventType, o, executed)
+}
+
+func (f *l3Feed) emitLocked(eventType string, o *Order, executed fixed.Num) {
+	f.sequence++
+	if f.closed {
+		return
+	}
+	e := L3Event{
+		Sequence:     f.sequence,
+		Type:         eventType,
+		OrderID:      o.bookID,
+		Side:         o.side.String(),
+		Price:        o.price.Float64(),
+		Size:         o.Volume().Float64(),
+		ExecutedSize: executed.Float64(),
+		Timestamp:    time.Now().UnixNano(),
+	}
+	select {
+	case f.events <- e:
+	default:
+		f.dropped.Add(1)
+	}
+}
+
+// currentSequence returns the sequence number of the last event.
+func (f *l3Feed) currentSequence() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sequence
+}
+
+func (f *l3Feed) run() {
+	defer close(f.done)
+	batch := make([]L3Event, 0, l3MaxBatchSize)
+	for e := range f.events {
+		batch = append(batch[:0], e)
+	drain:
+		for len(batch) < l3MaxBatchSize {
+			select {
+			case e, ok := <-f.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		f.publish(batch)
+	}
+}
+
+func (f *l3Feed) publish(batch []L3Event) {
+	if f.rdb == nil {
+		return
+	}
+	msg, err := json.Marshal(L3PubMsg{
+		RedisPubMsgBase: RedisPubMsgBase{Event: EventStreamL3, Success: true},
+		Result:          batch,
+	})
+	if err != nil {
+		log.Printf("Service: failed to marshal L3 events of %s: %v", f.symbol, err)
+		return
+	}
+	if err := f.rdb.Publish(context.Background(), L3Channel(f.symbol), msg).Err(); err != nil {
+		log.Printf("Service: failed to publish L3 events of %s: %v", f.symbol, err)
+	}
+}
+
+// close publishes the queued events and stops the feed.
+func (f *l3Feed) close() {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.events)
+	}
+	f.mu.Unlock()
+	<-f.done
+}
+
+// L3Snapshot returns every order resting on the book along with the sequence number it reflects.
+func (s *service) L3Snapshot() L3Book {
+	book := L3Book{Symbol: s.symbol, Bids: []L3Order{}, Asks: []L3Order{}}
+
+	// Events are only emitted while the book is locked for writing, so the sequence matches the orders read here
+	s.sortedOrdersMu.RLock()
+	defer s.sortedOrdersMu.RUnlock()
+	book.Sequence = s.l3.currentSequence()
+	s.bids.each(true, func(o *Order) { book.Bids = append(book.Bids, o.l3Order()) })
+	s.asks.each(false, func(o *Order) { book.Asks = append(book.Asks, o.l3Order()) })
+	return book
+}
+
+func (o *Order) l3Order() L3Order {
+	return L3Order{OrderID: o.bookID, Price: o.price.Float64(), Size: o.Volume().Float64()}
+}
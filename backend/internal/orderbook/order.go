@@ -4,49 +4,125 @@ import (
 	// "encoding/json"
 	// "log"
 	"fmt"
-	"github/wry-0313/exchange/internal/models"
-	"log"
+	"github/wry-0313/exchange/pkg/fixed"
 	"sync"
 	"time"
 
 	"github.com/oklog/ulid/v2"
-	"github.com/shopspring/decimal"
 )
 
+// chicago is the location order and candle timestamps are recorded in. Loading it once avoids reading the zoneinfo
+// database for every order.
+var chicago = loadLocation("America/Chicago")
+
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// orderPool recycles orders once the book no longer references them.
+var orderPool = sync.Pool{
+	New: func() any { return new(Order) },
+}
+
 type Order struct {
 	side      Side
 	orderID   ulid.ULID
 	userID    ulid.ULID
+	clientID  string // client_order_id the user submitted the order with, empty when none
 	orderType OrderType
 	status    OrderStatus
-	price     decimal.Decimal
-	volume    decimal.Decimal
+	price     fixed.Num
+	volume    fixed.Num
 	// totalProcessed decimal.Decimal
 	createdAt time.Time
 	volumeMu  sync.RWMutex
+	bookID    uint64 // anonymized ID published in the L3 feed, zero while the order is not resting on the book
 }
 
-func (s *service) NewOrder(side Side, userID ulid.ULID, orderType OrderType, price, volume decimal.Decimal, partialAllowed bool) *Order {
-	loc, _ := time.LoadLocation("America/Chicago")
-	o := &Order{
-		side:      side,
-		orderID:   ulid.Make(),
-		userID:    userID,
-		orderType: orderType,
-		status:    Open,
-		price:     price,
-		volume:    volume,
-		createdAt: time.Now().In(loc),
-	}
-	go func() {
-		err := s.obRepo.CreateOrder(o, s.symbol)
-		if err != nil {
-			log.Fatalf("service: failed to create order: %v", err)
-		}
-	}()
+// OrderRecord is a copy of an order's fields at a point in time. It is handed to the repository so that
+// persistence never reads an order that may already have been recycled.
+type OrderRecord struct {
+	OrderID       ulid.ULID
+	UserID        ulid.ULID
+	ClientOrderID string
+	Side          Side
+	OrderType     OrderType
+	Status        OrderStatus
+	RejectReason  string // only set for rejected orders
+	Price         fixed.Num
+	Volume        fixed.Num
+	CreatedAt     time.Time
+}
+
+func (s *service) NewOrder(side Side, userID ulid.ULID, orderType OrderType, price, volume fixed.Num, partialAllowed bool) *Order {
+	return s.newOrder(ulid.Make(), "", side, userID, orderType, price, volume)
+}
+
+func (s *service) newOrder(orderID ulid.ULID, clientID string, side Side, userID ulid.ULID, orderType OrderType, price, volume fixed.Num) *Order {
+	o := orderPool.Get().(*Order)
+	o.side = side
+	o.orderID = orderID
+	o.userID = userID
+	o.clientID = clientID
+	o.orderType = orderType
+	o.status = Open
+	o.price = price
+	o.volume = volume
+	o.createdAt = time.Now().In(chicago)
+	o.bookID = 0
+
+	s.writer.createOrder(o.record())
 	return o
 }
 
+// restoreOrder rebuilds an order from a snapshot record without persisting it again.
+func restoreOrder(r OrderRecord) *Order {
+	o := orderPool.Get().(*Order)
+	o.side = r.Side
+	o.orderID = r.OrderID
+	o.userID = r.UserID
+	o.clientID = r.ClientOrderID
+	o.orderType = r.OrderType
+	o.status = r.Status
+	o.price = r.Price
+	o.volume = r.Volume
+	o.createdAt = r.CreatedAt.In(chicago)
+	o.bookID = 0
+	return o
+}
+
+// releaseOrder hands o back to the pool. It must only be called once the order is filled and no price level,
+// market order list or active order entry refers to it.
+func releaseOrder(o *Order) {
+	o.orderID = ulid.ULID{}
+	o.userID = ulid.ULID{}
+	o.clientID = ""
+	o.price = fixed.Zero
+	o.volume = fixed.Zero
+	o.createdAt = time.Time{}
+	o.bookID = 0
+	orderPool.Put(o)
+}
+
+// record returns a snapshot of o for persistence.
+func (o *Order) record() OrderRecord {
+	return OrderRecord{
+		OrderID:       o.orderID,
+		UserID:        o.userID,
+		ClientOrderID: o.clientID,
+		Side:          o.side,
+		OrderType:     o.orderType,
+		Status:        o.status,
+		Price:         o.price,
+		Volume:        o.Volume(),
+		CreatedAt:     o.createdAt,
+	}
+}
+
 // ID returns orderID field copy
 func (o *Order) OrderID() ulid.ULID {
 	return o.orderID
@@ -68,14 +144,14 @@ func (o *Order) Side() Side {
 }
 
 // volume returns volume field copy
-func (o *Order) Volume() decimal.Decimal {
+func (o *Order) Volume() fixed.Num {
 	o.volumeMu.RLock()
 	defer o.volumeMu.RUnlock()
 	return o.volume
 }
 
 // Price returns price field copy
-func (o *Order) Price() decimal.Decimal {
+func (o *Order) Price() fixed.Num {
 	return o.price
 }
 
@@ -87,49 +163,86 @@ func (o *Order) UserID() ulid.ULID {
 	return o.userID
 }
 
-func (s *service) fillOrder(o *Order, filledVolume, filledAt decimal.Decimal) {
+func (s *service) fillOrder(o *Order, filledVolume, filledAt fixed.Num) {
 	// log.Printf("service: order %s filled with volume %s at price %s\n", o.shortOrderID(), filledVolume, filledAt)
+	s.writer.addPending(o.userID, o.side, filledVolume, filledAt)
 	o.volumeMu.Lock()
-	newVolume := o.volume.Sub(filledVolume)
+	newVolume := o.volume - filledVolume
 	o.volume = newVolume
 	o.volumeMu.Unlock()
-	if newVolume.IsZero() {
+	if newVolume == fixed.Zero {
 		o.status = Filled
 	} else {
 		o.status = PartiallyFilled
 	}
-	go func() {
-		processedValue := filledVolume.Mul(filledAt).Round(2)
-		err := s.obRepo.UpdateOrder(o, o.status, newVolume, processedValue, filledAt)
-		if err != nil {
-			log.Fatalf("service: failed to update order: %v", err)
-		}
-		var holdingChange models.HoldingChange
-		if o.Side() == Buy { // order wants to buy stock so we need to add new holding to user and subtract user balance
-			holdingChange = models.HoldingChange{
-				UserID:       o.UserID().String(),
-				Symbol:       s.symbol,
-				VolumeChange: filledVolume,
-			}
-			processedValue = processedValue.Neg()
-		} else {
-			holdingChange = models.HoldingChange{
-				UserID:       o.UserID().String(),
-				Symbol:       s.symbol,
-				VolumeChange: filledVolume.Neg(),
-			}
-		}
-		err = s.obRepo.CreateOrUpdateHolding(holdingChange)
-		if err != nil {
-			log.Fatalf("service: failed to create or update holding: %v", err)
-		}
-		err = s.obRepo.UpdateUserBalance(o.UserID().String(), processedValue)
-		if err != nil {
-			log.Fatalf("service: failed to update user balance: %v", err)
-		}
-	}()	
+
+	s.writer.fill(FillRecord{
+		OrderID:      o.orderID,
+		UserID:       o.userID,
+		Side:         o.side,
+		Status:       o.status,
+		Volume:       newVolume,
+		FilledVolume: filledVolume,
+		FilledAt:     filledAt,
+		At:           eventTime(),
+	})
+
+	if o.bookID != 0 {
+		s.l3.emit(L3Execute, o, filledVolume)
+	}
+}
+
+// cancelOrder marks o as cancelled and records the cancellation. The remaining volume is left on the order so it
+// shows how much was never filled.
+func (s *service) cancelOrder(o *Order) {
+	o.status = Cancelled
+	s.writer.fill(FillRecord{
+		OrderID:  o.orderID,
+		UserID:   o.userID,
+		Side:     o.side,
+		Status:   o.status,
+		Volume:   o.Volume(),
+		FilledAt: fixed.Zero,
+		At:       eventTime(),
+	})
+}
+
+// amendOrder records the reduced volume of an amended order.
+func (s *service) amendOrder(o *Order) {
+	s.writer.fill(FillRecord{
+		OrderID:  o.orderID,
+		UserID:   o.userID,
+		Side:     o.side,
+		Status:   o.status,
+		Volume:   o.Volume(),
+		FilledAt: fixed.Zero,
+		Amended:  true,
+		At:       eventTime(),
+	})
+}
+
+// recordTrade records a match of volume at price between the incoming order and a resting order.
+func (s *service) recordTrade(incoming, resting *Order, price, volume fixed.Num) {
+	buy, sell := incoming, resting
+	if incoming.side == Sell {
+		buy, sell = resting, incoming
+	}
+	s.writer.trade(TradeRecord{
+		TradeID:     ulid.Make(),
+		Price:       price,
+		Volume:      volume,
+		Aggressor:   incoming.side,
+		BuyOrderID:  buy.orderID,
+		SellOrderID: sell.orderID,
+		ExecutedAt:  eventTime(),
+	})
 }
 
+// eventTime is the time recorded for a fill or trade. It is truncated to the precision the database stores, so that
+// a time read back compares equal to the one written.
+func eventTime() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
 
 func (o *Order) CreatedAt() time.Time {
 	return o.createdAt
@@ -3,29 +3,30 @@ package orderbook
 import (
 	"fmt"
 	list "github/wry-0313/exchange/pkg/dsa/linkedlist"
+	"github/wry-0313/exchange/pkg/fixed"
 	"strings"
 	"sync"
-
 	// "sync"
-
-	"github.com/shopspring/decimal"
 )
 
+// nodePool is shared by every order queue and market order list so that resting an order does not allocate a node.
+var nodePool = list.NewNodePool[*Order]()
+
 // OrderQueue stores a queue of orders in a doubly linked list at a certain price level
 type OrderQueue struct {
-	volume   decimal.Decimal    // volume can be changed so we need a mutex
+	volume   fixed.Num          // volume can be changed so we need a mutex
 	volumeMu sync.RWMutex       // protect volume
-	price    decimal.Decimal    // price level cannot be changed once initialized
+	price    fixed.Num          // price level cannot be changed once initialized
 	orders   *list.List[*Order] // limit orders
 	ordersMu sync.RWMutex       // protect orders
 }
 
 // NewOrderQueue initializes a order queue of type orderbook.Order at a given price level. Defaults to zero total volume
-func NewOrderQueue(price decimal.Decimal) *OrderQueue {
+func NewOrderQueue(price fixed.Num) *OrderQueue {
 	return &OrderQueue{
 		price:  price,
-		volume: decimal.Zero,
-		orders: list.New[*Order](),
+		volume: fixed.Zero,
+		orders: list.NewWithPool(nodePool),
 	}
 }
 
@@ -35,7 +36,7 @@ func (oq *OrderQueue) Len() int {
 	return oq.orders.Len()
 }
 
-func (oq *OrderQueue) Price() decimal.Decimal {
+func (oq *OrderQueue) Price() fixed.Num {
 	return oq.price
 }
 
@@ -53,13 +54,13 @@ func (oq *OrderQueue) Head() *list.Node[*Order] {
 // 	return oq.orders.Back()
 // }
 
-func (oq *OrderQueue) Volume() decimal.Decimal {
+func (oq *OrderQueue) Volume() fixed.Num {
 	oq.volumeMu.RLock()
 	defer oq.volumeMu.RUnlock()
 	return oq.volume
 }
 
-func (oq *OrderQueue) SetVolume(volume decimal.Decimal) decimal.Decimal {
+func (oq *OrderQueue) SetVolume(volume fixed.Num) fixed.Num {
 	oq.volumeMu.Lock()
 	oq.volume = volume
 	oq.volumeMu.Unlock()
@@ -68,7 +69,7 @@ func (oq *OrderQueue) SetVolume(volume decimal.Decimal) decimal.Decimal {
 
 func (oq *OrderQueue) Append(o *Order) *list.Node[*Order] {
 	oq.volumeMu.Lock()
-	oq.volume = oq.volume.Add(o.Volume())
+	oq.volume += o.Volume()
 	oq.volumeMu.Unlock()
 	oq.ordersMu.Lock()
 	defer oq.ordersMu.Unlock()
@@ -77,7 +78,7 @@ func (oq *OrderQueue) Append(o *Order) *list.Node[*Order] {
 
 func (oq *OrderQueue) Remove(n *list.Node[*Order]) *Order {
 	oq.volumeMu.Lock()
-	oq.volume = oq.volume.Sub(n.Value.Volume())
+	oq.volume -= n.Value.Volume()
 	oq.volumeMu.Unlock()
 	oq.ordersMu.Lock()
 	defer oq.ordersMu.Unlock()
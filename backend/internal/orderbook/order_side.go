@@ -3,6 +3,7 @@ package orderbook
 import (
 	"fmt"
 	list "github/wry-0313/exchange/pkg/dsa/linkedlist"
+	"github/wry-0313/exchange/pkg/fixed"
 
 	// "github/wry-0313/exchange/internaltreemap"
 	"strings"
@@ -10,26 +11,26 @@ import (
 
 	rbtx "github.com/emirpasic/gods/examples/redblacktreeextended"
 	rbt "github.com/emirpasic/gods/trees/redblacktree"
-
-	"github.com/shopspring/decimal"
 )
 
 type OrderSide struct {
 	priceTree  *rbtx.RedBlackTreeExtended // price -> *OrderQueue, sorted by price
-	priceTable map[string]*OrderQueue     // price -> *OrderQueue for quick lookup
+	priceTable map[fixed.Num]*OrderQueue  // price -> *OrderQueue for quick lookup
 
-	volume   decimal.Decimal // total volume of all orders
-	volumeMu sync.RWMutex    // protect volume
+	volume   fixed.Num    // total volume of all orders
+	volumeMu sync.RWMutex // protect volume
 
 	depth   int          // number of active price levels
 	depthMu sync.RWMutex // protect depth
 
 	numOrders   int          // number of orders
 	numOrdersMu sync.RWMutex // protect numOrders
+
+	feed *l3Feed // reports orders joining and leaving the side, nil when not published
 }
 
-func keyComparator(a, b decimal.Decimal) bool {
-	return a.Cmp(b) == -1
+func keyComparator(a, b fixed.Num) bool {
+	return a < b
 }
 
 func NewOrderSide() *OrderSide {
@@ -37,15 +38,15 @@ func NewOrderSide() *OrderSide {
 		priceTree: &rbtx.RedBlackTreeExtended{
 			Tree: rbt.NewWith(rbtComparator),
 		},
-		priceTable: map[string]*OrderQueue{},
-		volume:     decimal.Zero,
+		priceTable: map[fixed.Num]*OrderQueue{},
+		volume:     fixed.Zero,
 		depth:      0,
 		numOrders:  0,
 	}
 }
 
 func rbtComparator(a, b interface{}) int {
-	return a.(decimal.Decimal).Cmp(b.(decimal.Decimal))
+	return fixed.Compare(a.(fixed.Num), b.(fixed.Num))
 }
 
 func (os *OrderSide) Len() int {
@@ -62,19 +63,18 @@ func (os *OrderSide) Depth() int {
 
 func (os *OrderSide) Append(o *Order) *list.Node[*Order] {
 	price := o.Price()
-	priceStr := price.String()
 
 	// os.priceTreeMu.Lock()
 	// defer os.priceTreeMu.Unlock()
 
 	// os.priceTableMu.RLock()
-	priceQueue, ok := os.priceTable[priceStr]
+	priceQueue, ok := os.priceTable[price]
 	// os.priceTableMu.RUnlock()
 	// if priceQueue at price level doesn't exit, create a new order queue at that order level
 	if !ok {
 		priceQueue = NewOrderQueue(o.Price())
 		// os.priceTableMu.Lock()
-		os.priceTable[priceStr] = priceQueue
+		os.priceTable[price] = priceQueue
 		// os.priceTableMu.Unlock()
 
 		os.priceTree.Put(price, priceQueue)
@@ -88,16 +88,19 @@ func (os *OrderSide) Append(o *Order) *list.Node[*Order] {
 	os.numOrdersMu.Unlock()
 	// os.volume = os.volume.Add(o.Volume())
 	// os.AddVolumeBy(o.Volume())
-	return priceQueue.Append(o)
+	n := priceQueue.Append(o)
+	if os.feed != nil {
+		os.feed.add(o)
+	}
+	return n
 }
 
 // Time Complexity: O(1) if don't remove price queue O(N) otherwise
 func (os *OrderSide) Remove(n *list.Node[*Order]) *Order {
 	price := n.Value.Price()
-	priceStr := price.String()
 
 	// os.priceTableMu.RLock()
-	priceQueue, found := os.priceTable[priceStr]
+	priceQueue, found := os.priceTable[price]
 	if !found {
 		// Log(fmt.Sprintf("already removed: %s\n", priceQueue))
 		return n.Value
@@ -110,18 +113,18 @@ func (os *OrderSide) Remove(n *list.Node[*Order]) *Order {
 	o := priceQueue.Remove(n)
 
 	if priceQueue.Len() == 0 {
-		// Log(fmt.Sprintf("Remove price queue at price level %s", priceStr))
+		// Log(fmt.Sprintf("Remove price queue at price level %s", price))
 		// os.priceTableMu.Lock()
-		delete(os.priceTable, priceStr)
+		delete(os.priceTable, price)
 		// os.priceTableMu.Unlock()
 
 		os.priceTree.Remove(price)
 		// if !removed {
-		// 	Log(fmt.Sprintf("Error: price level not removed from tree at price level %s", priceStr))
+		// 	Log(fmt.Sprintf("Error: price level not removed from tree at price level %s", price))
 		// 	panic("price level not removed from tree")
 		// }
 
-		// Log(fmt.Sprintf("price level removed from tree at price level %s", priceStr))
+		// Log(fmt.Sprintf("price level removed from tree at price level %s", price))
 
 		os.depthMu.Lock()
 		os.depth--
@@ -134,6 +137,11 @@ func (os *OrderSide) Remove(n *list.Node[*Order]) *Order {
 
 	// os.SubVolumeBy(o.Volume())
 
+	if os.feed != nil {
+		os.feed.emit(L3Delete, o, fixed.Zero)
+	}
+	o.bookID = 0
+
 	return o
 }
 
@@ -185,16 +193,16 @@ func (os *OrderSide) MinPriceQueue() (*OrderQueue, bool) {
 // 	os.volume = volume
 // }
 
-func (os *OrderSide) AddVolumeBy(volume decimal.Decimal) {
+func (os *OrderSide) AddVolumeBy(volume fixed.Num) {
 	os.volumeMu.Lock()
 	defer os.volumeMu.Unlock()
-	os.volume = os.volume.Add(volume)
+	os.volume += volume
 }
 
 func (os *OrderSide) ResetVolume() {
 	os.volumeMu.Lock()
 	defer os.volumeMu.Unlock()
-	os.volume = decimal.Zero
+	os.volume = fixed.Zero
 }
 
 // func (os *OrderSide) SubVolumeBy(volume decimal.Decimal) {
@@ -203,9 +211,7 @@ func (os *OrderSide) ResetVolume() {
 // 	os.volume = os.volume.Sub(volume)
 // }
 
-
-
-func (os *OrderSide) Volume() decimal.Decimal {
+func (os *OrderSide) Volume() fixed.Num {
 	os.volumeMu.RLock()
 	defer os.volumeMu.RUnlock()
 	return os.volume
@@ -214,7 +220,7 @@ func (os *OrderSide) Volume() decimal.Decimal {
 // LessThan returns nearest OrderQueue with price less than given
 // deprecate this and replace with iter()
 // TODO
-func (os *OrderSide) LessThan(price decimal.Decimal) *OrderQueue {
+func (os *OrderSide) LessThan(price fixed.Num) *OrderQueue {
 	tree := os.priceTree.Tree
 	node := tree.Root
 
@@ -3,12 +3,14 @@ package orderbook
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
 )
 
-var logService *LogService
+// logService discards the order book's log until InitializeLogService is called.
+var logService = &LogService{logger: log.New(io.Discard, "", 0)}
 
 type LogService struct {
 	mu     sync.Mutex
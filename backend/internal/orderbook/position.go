@@ -0,0 +1,51 @@
+package orderbook
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// positionCostPlaces is the precision average costs are kept at, finer than prices so that repeated fills don't
+// drift the cost basis.
+const positionCostPlaces = 6
+
+// Position is a user's position in a symbol, valued at average cost. Volume is negative for a short position.
+// RealizedPnL accumulates the profit of every fill that reduced the position and is kept when the position is
+// closed.
+type Position struct {
+	Volume      decimal.Decimal
+	AvgCost     decimal.Decimal
+	RealizedPnL decimal.Decimal
+}
+
+// Apply adds a fill to the position. A fill on the side of the position averages its price into the cost, a fill
+// against it realizes the difference to the average cost on the volume it closes. Volume beyond the position
+// opens a new one on the other side at the fill price.
+func (p *Position) Apply(side Side, volume, price decimal.Decimal) {
+	change := volume
+	if side == Sell {
+		change = volume.Neg()
+	}
+
+	if p.Volume.IsZero() || p.Volume.Sign() == change.Sign() {
+		held := p.Volume.Abs()
+		p.AvgCost = held.Mul(p.AvgCost).Add(volume.Mul(price)).DivRound(held.Add(volume), positionCostPlaces)
+		p.Volume = p.Volume.Add(change)
+		return
+	}
+
+	closed := decimal.Min(p.Volume.Abs(), volume)
+	profit := price.Sub(p.AvgCost).Mul(closed)
+	if p.Volume.IsNegative() {
+		profit = profit.Neg()
+	}
+	p.RealizedPnL = p.RealizedPnL.Add(profit)
+
+	wasLong := p.Volume.IsPositive()
+	p.Volume = p.Volume.Add(change)
+	switch {
+	case p.Volume.IsZero():
+		p.AvgCost = decimal.Zero
+	case p.Volume.IsPositive() != wasLong:
+		p.AvgCost = price
+	}
+}
@@ -0,0 +1,33 @@
+package orderbook
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPositionApply(t *testing.T) {
+	d := decimal.RequireFromString
+	var p Position
+	for _, step := range []struct {
+		side          Side
+		volume, price string
+		want          Position
+	}{
+		// Buying averages the price into the cost
+		{Buy, "10", "100", Position{Volume: d("10"), AvgCost: d("100"), RealizedPnL: d("0")}},
+		{Buy, "10", "110", Position{Volume: d("20"), AvgCost: d("105"), RealizedPnL: d("0")}},
+		// Selling part of it realizes the profit on that part and keeps the cost
+		{Sell, "5", "120", Position{Volume: d("15"), AvgCost: d("105"), RealizedPnL: d("75")}},
+		// Selling more than is held closes the position and opens a short at the fill price
+		{Sell, "20", "100", Position{Volume: d("-5"), AvgCost: d("100"), RealizedPnL: d("0")}},
+		// Covering the short below its cost is a profit
+		{Buy, "5", "90", Position{Volume: d("0"), AvgCost: d("0"), RealizedPnL: d("50")}},
+	} {
+		p.Apply(step.side, d(step.volume), d(step.price))
+		if !p.Volume.Equal(step.want.Volume) || !p.AvgCost.Equal(step.want.AvgCost) || !p.RealizedPnL.Equal(step.want.RealizedPnL) {
+			t.Fatalf("after %s %s at %s: position = %v/%v/%v, want %v/%v/%v", step.side, step.volume, step.price,
+				p.Volume, p.AvgCost, p.RealizedPnL, step.want.Volume, step.want.AvgCost, step.want.RealizedPnL)
+		}
+	}
+}
@@ -2,10 +2,17 @@ package orderbook
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/fixed"
+	"sort"
+	"strings"
+	"time"
 	// "log"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/oklog/ulid/v2"
 	"github.com/shopspring/decimal"
 )
 
@@ -15,14 +22,57 @@ type repository struct {
 
 type Repository interface {
 	CreateStock(stock models.Stock) error
-	CreateOrder(order *Order, symbol string) error
-	UpdateOrder(order *Order, newStatus OrderStatus, newVolume, totalProcessed, filledAt decimal.Decimal) error
-	CreateOrUpdateHolding(holding models.HoldingChange) error
-	UpdateUserBalance(userID string, newBalance decimal.Decimal) error
-	CreateMarketPriceHistory(symbol string, priceHistory models.StockPriceHistory) error
-	GetEntireMarketPriceHistory(symbol string) ([]models.StockPriceHistory, error)
+	GetStock(symbol string) (models.Stock, error)
+	SetStockHalted(symbol string, halted bool) error
+	PersistBatch(batch PersistBatch) error
+	GetOrderByClientOrderID(userID, clientOrderID string) (models.Order, error)
+	// GetUserOrder returns an order of the user, or ErrOrderNotExists.
+	GetUserOrder(userID, orderID string) (models.Order, error)
+	// GetUserOrders returns the user's orders matching filter, newest first.
+	GetUserOrders(userID string, filter OrderFilter) ([]models.Order, error)
+	// GetOrderFills returns the fills of an order, oldest first.
+	GetOrderFills(orderID string) ([]models.OrderFill, error)
+	CreateOrUpdateCandles(symbol string, candles []models.StockPriceHistory) error
+	GetCandles(symbol string, interval Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error)
+
+	// The page queries return the rows of a symbol within [from, to) in time order, up to limit rows after the
+	// cursor. They are used to export history in chunks.
+	GetCandlePage(symbol string, interval Interval, from, to time.Time, after PageCursor, limit int) ([]models.StockPriceHistory, error)
+	GetTradePage(symbol string, from, to time.Time, after PageCursor, limit int) ([]models.Trade, error)
+	GetOrderEventPage(symbol string, from, to time.Time, after PageCursor, limit int) ([]models.OrderEvent, error)
 }
 
+// PageCursor is the position of the last row of a page, the next page starts after it. The zero cursor starts at
+// the beginning of the range.
+type PageCursor struct {
+	At time.Time
+	ID string // breaks ties between rows with the same time, unused for candles
+}
+
+// OrderFilter narrows down a user's order history. Zero fields don't filter, OpenOnly keeps the open and partially
+// filled orders. Orders are listed newest first, Before is the ID of the last order of the previous page. From and
+// To bound the time the orders were created within [From, To).
+type OrderFilter struct {
+	Symbol   string
+	Side     string
+	Status   string
+	Type     string
+	OpenOnly bool
+	From     time.Time
+	To       time.Time
+	Before   string
+	Limit    int
+}
+
+// Order event types, see models.OrderEvent.
+const (
+	OrderEventCreated   = "Created"
+	OrderEventRejected  = "Rejected"
+	OrderEventFilled    = "Filled"
+	OrderEventCancelled = "Cancelled"
+	OrderEventAmended   = "Amended"
+)
+
 func NewRepository(db *sql.DB) Repository {
 	return &repository{
 		db: db,
@@ -49,112 +99,620 @@ func (r *repository) CreateStock(stock models.Stock) error {
 	return nil
 }
 
-func (r *repository) CreateOrder(order *Order, symbol string) error {
-
-	orderSide := order.side.String()
-	orderStatus := order.status.String()
+func (r *repository) GetStock(symbol string) (models.Stock, error) {
+	var stock models.Stock
+	err := r.db.QueryRow("SELECT symbol, halted FROM stocks WHERE symbol = ?", symbol).Scan(&stock.Symbol, &stock.Halted)
+	if err != nil {
+		return models.Stock{}, fmt.Errorf("repository: failed to get stock: %w", err)
+	}
+	return stock, nil
+}
 
-	sql := `INSERT INTO orders (user_id, order_id, order_side, order_status, order_type, volume, initial_volume, price, created_at, symbol) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+func (r *repository) SetStockHalted(symbol string, halted bool) error {
+	if _, err := r.db.Exec("UPDATE stocks SET halted = ? WHERE symbol = ?", halted, symbol); err != nil {
+		return fmt.Errorf("repository: failed to update stock: %w", err)
+	}
+	return nil
+}
 
-	_, err := r.db.Exec(sql, order.userID.String(), order.orderID.String(), orderSide, orderStatus, order.orderType.String(), order.volume, order.volume, order.price, order.createdAt, symbol)
+// PersistBatch applies a batch of order inserts and fills in one transaction. Orders are inserted with a single
+// multi-row statement before any fill is applied. Fills are folded per order, holding and user so that each row is
+// written once per batch no matter how many fills touched it.
+func (r *repository) PersistBatch(batch PersistBatch) error {
+	tx, err := r.db.Begin()
 	if err != nil {
+		return fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := insertOrders(tx, batch.Symbol, batch.Orders); err != nil {
+		return err
+	}
+	if err := applyFills(tx, batch.Symbol, batch.Fills); err != nil {
+		return err
+	}
+	if err := insertTrades(tx, batch.Symbol, batch.Trades); err != nil {
+		return err
+	}
+	if err := insertOrderEvents(tx, batch.Symbol, batch.Orders, batch.Fills); err != nil {
 		return err
 	}
 
-	// log.Printf("Order created successfully: %s\n", order.shortOrderID())
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("repository: failed to commit batch: %w", err)
+	}
+	return nil
+}
+
+// isConstraintErr reports whether MySQL refused a write because of the data itself, e.g. a duplicate key or a
+// missing foreign key, or the write was refused before reaching it because a value overflowed. Retrying such a
+// write fails the same way.
+func isConstraintErr(err error) bool {
+	if errors.Is(err, fixed.ErrOverflow) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1048, // column cannot be null
+		1062,       // duplicate entry
+		1264,       // value out of range
+		1265,       // data truncated
+		1366,       // incorrect value
+		1406,       // data too long
+		1451, 1452, // foreign key violated
+		3819: // check constraint violated
+		return true
+	}
+	return false
+}
+
+func insertOrders(tx *sql.Tx, symbol string, orders []OrderRecord) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO orders (user_id, order_id, client_order_id, order_side, order_status, reject_reason, order_type, volume, initial_volume, price, created_at, symbol) VALUES `)
+	args := make([]any, 0, len(orders)*12)
+	for i, order := range orders {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		// Orders without a client ID are stored as NULL so they never collide on the unique key
+		clientOrderID := sql.NullString{String: order.ClientOrderID, Valid: order.ClientOrderID != ""}
+		rejectReason := sql.NullString{String: order.RejectReason, Valid: order.RejectReason != ""}
+		args = append(args, order.UserID.String(), order.OrderID.String(), clientOrderID, order.Side.String(), order.Status.String(), rejectReason, order.OrderType.String(), order.Volume.Decimal(), order.Volume.Decimal(), order.Price.Decimal(), order.CreatedAt, symbol)
+	}
 
+	if _, err := tx.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to insert orders: %w", err)
+	}
 	return nil
 }
 
-func (r *repository) UpdateOrder(order *Order, newStatus OrderStatus, newVolume, totalProcessed, filledAt decimal.Decimal) error {
+func insertTrades(tx *sql.Tx, symbol string, trades []TradeRecord) error {
+	if len(trades) == 0 {
+		return nil
+	}
 
-	sql := `UPDATE orders SET order_status = ?, volume = ?, filled_at = ?, total_processed = total_processed + ? WHERE order_id = ?`
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO trades (trade_id, symbol, price, volume, aggressor_side, buy_order_id, sell_order_id, executed_at) VALUES `)
+	args := make([]any, 0, len(trades)*8)
+	for i, t := range trades {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, t.TradeID.String(), symbol, t.Price.Decimal(), t.Volume.Decimal(), t.Aggressor.String(), t.BuyOrderID.String(), t.SellOrderID.String(), t.ExecutedAt)
+	}
 
-	_, err := r.db.Exec(sql, newStatus.String(), newVolume, filledAt, totalProcessed, order.orderID.String())
-	if err != nil {
-		return fmt.Errorf("repository: failed to update order: %v", err)
+	if _, err := tx.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to insert trades: %w", err)
 	}
+	return nil
+}
 
-	// log.Printf("Order updated successfully: %s\n", order.shortOrderID())
+// insertOrderEvents records an event for every order created and every fill applied in the batch.
+func insertOrderEvents(tx *sql.Tx, symbol string, orders []OrderRecord, fills []FillRecord) error {
+	n := len(orders) + len(fills)
+	if n == 0 {
+		return nil
+	}
 
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO order_events (event_id, order_id, user_id, symbol, event_type, order_side, order_status, price, volume, filled_volume, occurred_at) VALUES `)
+	args := make([]any, 0, n*11)
+	add := func(orderID, userID ulid.ULID, eventType string, side Side, status OrderStatus, price, volume, filledVolume fixed.Num, at time.Time) {
+		if len(args) > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, ulid.Make().String(), orderID.String(), userID.String(), symbol, eventType, side.String(), status.String(), price.Decimal(), volume.Decimal(), filledVolume.Decimal(), at)
+	}
+	for _, o := range orders {
+		eventType := OrderEventCreated
+		if o.Status == Rejected {
+			eventType = OrderEventRejected
+		}
+		add(o.OrderID, o.UserID, eventType, o.Side, o.Status, o.Price, o.Volume, fixed.Zero, o.CreatedAt.Truncate(time.Microsecond))
+	}
+	for _, f := range fills {
+		eventType := OrderEventFilled
+		if f.Status == Cancelled {
+			eventType = OrderEventCancelled
+		} else if f.Amended {
+			eventType = OrderEventAmended
+		}
+		add(f.OrderID, f.UserID, eventType, f.Side, f.Status, f.FilledAt, f.Volume, f.FilledVolume, f.At)
+	}
+
+	if _, err := tx.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to insert order events: %w", err)
+	}
 	return nil
 }
 
-func (r *repository) CreateOrUpdateHolding(holding models.HoldingChange) error {
+type orderFill struct {
+	status         OrderStatus
+	volume         fixed.Num
+	filled         bool // false when the batch only changed the status, e.g. a cancellation
+	filledAt       fixed.Num
+	filledAtTime   time.Time
+	totalProcessed fixed.Num
+}
+
+func applyFills(tx *sql.Tx, symbol string, fills []FillRecord) error {
+	if len(fills) == 0 {
+		return nil
+	}
+
+	orderIDs := []string{}
+	orders := map[string]*orderFill{}
+	holdings := map[string]fixed.Num{}
+	balances := map[string]fixed.Num{}
+	userFills := map[string][]FillRecord{} // in the order they happened, for the positions
+	for _, f := range fills {
+		orderID := f.OrderID.String()
+		processedValue, err := f.FilledVolume.Mul(f.FilledAt)
+		if err != nil {
+			return fmt.Errorf("repository: failed to value fill of order %s: %w", orderID, err)
+		}
+
+		of, ok := orders[orderID]
+		if !ok {
+			of = &orderFill{}
+			orders[orderID] = of
+			orderIDs = append(orderIDs, orderID)
+		}
+		of.status = f.Status
+		of.volume = f.Volume
+		if f.FilledVolume.Sign() == 0 {
+			continue
+		}
+		of.filled = true
+		of.filledAt = f.FilledAt
+		of.filledAtTime = f.At
+		of.totalProcessed += processedValue
+
+		// order wants to buy stock so we need to add new holding to user and subtract user balance
+		userID := f.UserID.String()
+		if f.Side == Buy {
+			holdings[userID] += f.FilledVolume
+			balances[userID] -= processedValue
+		} else {
+			holdings[userID] -= f.FilledVolume
+			balances[userID] += processedValue
+		}
+		userFills[userID] = append(userFills[userID], f)
+	}
+
+	updateOrder, err := tx.Prepare(`UPDATE orders SET order_status = ?, volume = ?, filled_at = COALESCE(?, filled_at), last_filled_at = COALESCE(?, last_filled_at), total_processed = total_processed + ? WHERE order_id = ?`)
+	if err != nil {
+		return fmt.Errorf("repository: failed to prepare order update: %w", err)
+	}
+	defer updateOrder.Close()
+	for _, orderID := range orderIDs {
+		of := orders[orderID]
+		var filledAt, filledAtTime any
+		if of.filled {
+			filledAt = of.filledAt.Decimal()
+			filledAtTime = of.filledAtTime
+		}
+		if _, err := updateOrder.Exec(of.status.String(), of.volume.Decimal(), filledAt, filledAtTime, of.totalProcessed.Decimal(), orderID); err != nil {
+			return fmt.Errorf("repository: failed to update order: %w", err)
+		}
+	}
+
+	// Rows are always written in user ID order so that concurrent batches from different symbols lock them in the
+	// same order and cannot deadlock
+	userIDs := make([]string, 0, len(holdings))
+	for userID := range holdings {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	if len(userIDs) == 0 {
+		return nil
+	}
 
-	// log.Printf("holding: %+v\n", holding)
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO holdings (user_id, symbol, volume) VALUES `)
+	args := make([]any, 0, len(userIDs)*3)
+	for i, userID := range userIDs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?)")
+		args = append(args, userID, symbol, holdings[userID].Decimal())
+	}
+	sb.WriteString(` AS change_set ON DUPLICATE KEY UPDATE volume = holdings.volume + change_set.volume`)
+	if _, err := tx.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to create or update holdings: %w", err)
+	}
 
-	sql := `INSERT INTO holdings (user_id, symbol, volume) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE volume = volume + ?`
+	deleteArgs := []any{symbol}
+	for _, userID := range userIDs {
+		deleteArgs = append(deleteArgs, userID)
+	}
+	deleteSQL := `DELETE FROM holdings WHERE symbol = ? AND volume = 0 AND user_id IN (?` + strings.Repeat(", ?", len(userIDs)-1) + `)`
+	if _, err := tx.Exec(deleteSQL, deleteArgs...); err != nil {
+		return fmt.Errorf("repository: failed to delete empty holdings: %w", err)
+	}
 
-	_, err := r.db.Exec(sql, holding.UserID, holding.Symbol, holding.VolumeChange, holding.VolumeChange)
+	updateBalance, err := tx.Prepare(`UPDATE users SET cash_balance = cash_balance + ? WHERE user_id = ?`)
 	if err != nil {
-		return fmt.Errorf("repository: failed to create or update holding: %v", err)
+		return fmt.Errorf("repository: failed to prepare balance update: %w", err)
+	}
+	defer updateBalance.Close()
+	for _, userID := range userIDs {
+		if _, err := updateBalance.Exec(balances[userID].Decimal(), userID); err != nil {
+			return fmt.Errorf("repository: failed to update user balance: %w", err)
+		}
 	}
 
-	// log.Printf("Holding created or updated successfully: %s\n", holding.UserID[22:])
+	return updatePositions(tx, symbol, userIDs, userFills)
+}
+
+// updatePositions applies the fills of each user to their position in the symbol, see Position.Apply. userIDs must
+// be sorted, for the same reason as in applyFills.
+func updatePositions(tx *sql.Tx, symbol string, userIDs []string, userFills map[string][]FillRecord) error {
+	args := []any{symbol}
+	for _, userID := range userIDs {
+		args = append(args, userID)
+	}
+	rows, err := tx.Query(`SELECT user_id, volume, avg_cost, realized_pnl FROM positions WHERE symbol = ? AND user_id IN (?`+strings.Repeat(", ?", len(userIDs)-1)+`) ORDER BY user_id FOR UPDATE`, args...)
+	if err != nil {
+		return fmt.Errorf("repository: failed to get positions: %w", err)
+	}
+	positions := make(map[string]*Position, len(userIDs))
+	for rows.Next() {
+		var userID string
+		var p Position
+		if err := rows.Scan(&userID, &p.Volume, &p.AvgCost, &p.RealizedPnL); err != nil {
+			rows.Close()
+			return fmt.Errorf("repository: failed to scan position: %w", err)
+		}
+		positions[userID] = &p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("repository: failed to get positions: %w", err)
+	}
 
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO positions (user_id, symbol, volume, avg_cost, realized_pnl) VALUES `)
+	args = make([]any, 0, len(userIDs)*5)
+	for i, userID := range userIDs {
+		p, ok := positions[userID]
+		if !ok {
+			p = &Position{}
+		}
+		for _, f := range userFills[userID] {
+			p.Apply(f.Side, f.FilledVolume.Decimal(), f.FilledAt.Decimal())
+		}
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?)")
+		args = append(args, userID, symbol, p.Volume, p.AvgCost, p.RealizedPnL)
+	}
+	sb.WriteString(` AS change_set ON DUPLICATE KEY UPDATE volume = change_set.volume, avg_cost = change_set.avg_cost, realized_pnl = change_set.realized_pnl`)
+	if _, err := tx.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to create or update positions: %w", err)
+	}
 	return nil
 }
 
-func (r *repository) UpdateUserBalance(userID string, balanceChange decimal.Decimal) error {
+// orderColumns are the columns scanOrder reads.
+const orderColumns = `symbol, order_id, client_order_id, order_side, order_status, order_type, filled_at, last_filled_at, total_processed, volume, initial_volume, price, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
 
-	sql := `UPDATE users SET cash_balance = cash_balance + ? WHERE user_id = ?`
+func scanOrder(row scanner) (models.Order, error) {
+	var o models.Order
+	err := row.Scan(&o.Symbol, &o.OrderID, &o.ClientOrderID, &o.OrderSide, &o.OrderStatus, &o.OrderType, &o.FilledAt, &o.FilledAtTime, &o.TotalProcessed, &o.Volume, &o.InitialVolume, &o.Price, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
 
-	_, err := r.db.Exec(sql, balanceChange, userID)
+// GetOrderByClientOrderID returns the order a user placed with the given client order ID, or ErrOrderNotExists.
+func (r *repository) GetOrderByClientOrderID(userID, clientOrderID string) (models.Order, error) {
+	order, err := scanOrder(r.db.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE user_id = ? AND client_order_id = ?`, userID, clientOrderID))
 	if err != nil {
-		return fmt.Errorf("repository: failed to update user balance: %v", err)
+		if err == sql.ErrNoRows {
+			return models.Order{}, ErrOrderNotExists
+		}
+		return models.Order{}, fmt.Errorf("repository: failed to get order by client order ID: %w", err)
 	}
+	return order, nil
+}
 
-	// log.Printf("User balance updated successfully: %s\n", userID[22:])
-
-	return nil
+func (r *repository) GetUserOrder(userID, orderID string) (models.Order, error) {
+	order, err := scanOrder(r.db.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE user_id = ? AND order_id = ?`, userID, orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.Order{}, ErrOrderNotExists
+		}
+		return models.Order{}, fmt.Errorf("repository: failed to get order: %w", err)
+	}
+	return order, nil
 }
 
-func (r *repository) CreateMarketPriceHistory(symbol string, priceHistory models.StockPriceHistory) error {
+func (r *repository) GetUserOrders(userID string, filter OrderFilter) ([]models.Order, error) {
+	var sb strings.Builder
+	sb.WriteString(`SELECT ` + orderColumns + ` FROM orders WHERE user_id = ?`)
+	args := []any{userID}
+	where := func(cond string, arg any) {
+		sb.WriteString(" AND " + cond)
+		args = append(args, arg)
+	}
+	if filter.Symbol != "" {
+		where("symbol = ?", filter.Symbol)
+	}
+	if filter.Side != "" {
+		where("order_side = ?", filter.Side)
+	}
+	if filter.Status != "" {
+		where("order_status = ?", filter.Status)
+	}
+	if filter.OpenOnly {
+		sb.WriteString(" AND order_status IN ('Open', 'PartiallyFilled')")
+	}
+	if filter.Type != "" {
+		where("order_type = ?", filter.Type)
+	}
+	if !filter.From.IsZero() {
+		where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("created_at < ?", filter.To)
+	}
+	if filter.Before != "" {
+		where("order_id < ?", filter.Before)
+	}
+	sb.WriteString(" ORDER BY order_id DESC LIMIT ?")
+	args = append(args, filter.Limit)
 
-	sql := `INSERT INTO stock_history (symbol, open, high, low, close, recorded_at, bid_volume, ask_volume) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	rows, err := r.db.Query(sb.String(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get user orders: %w", err)
+	}
+	defer rows.Close()
 
-	_, err := r.db.Exec(sql, symbol, priceHistory.Open, priceHistory.High, priceHistory.Low, priceHistory.Close, priceHistory.RecordedAt, priceHistory.BidVolume, priceHistory.AskVolume)
+	orders := []models.Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository: failed to scan order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get user orders: %w", err)
+	}
+	return orders, nil
+}
 
+func (r *repository) GetOrderFills(orderID string) ([]models.OrderFill, error) {
+	rows, err := r.db.Query(`SELECT event_id, price, filled_volume, occurred_at FROM order_events
+	WHERE order_id = ? AND event_type = ? AND filled_volume > 0 ORDER BY occurred_at, event_id`, orderID, OrderEventFilled)
 	if err != nil {
-		return fmt.Errorf("repository: failed to create market price history: %v", err)
+		return nil, fmt.Errorf("repository: failed to get order fills: %w", err)
 	}
+	defer rows.Close()
 
+	fills := []models.OrderFill{}
+	for rows.Next() {
+		var f models.OrderFill
+		if err := rows.Scan(&f.EventID, &f.Price, &f.Volume, &f.FilledAt); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan order fill: %w", err)
+		}
+		fills = append(fills, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get order fills: %w", err)
+	}
+	return fills, nil
+}
+
+// CreateOrUpdateCandles stores closed base interval candles and rolls each of them up into the candle of every
+// larger interval it falls in. Candles must be passed in time order, a candle for a period that is already stored
+// is merged into it so that a partial candle flushed on shutdown is completed after a restart.
+func (r *repository) CreateOrUpdateCandles(symbol string, candles []models.StockPriceHistory) error {
+	if len(candles) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO stock_history (symbol, bar_interval, recorded_at, open, high, low, close, volume, trade_count, bid_volume, ask_volume) VALUES `)
+	args := make([]any, 0, len(candles)*len(Intervals)*11)
+	for i, c := range candles {
+		for j, interval := range Intervals {
+			if i > 0 || j > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, symbol, string(interval), interval.Start(c.RecordedAt), c.Open, c.High, c.Low, c.Close,
+				decimal.NewFromFloat(c.Volume).Round(2), c.TradeCount, decimal.NewFromFloat(c.BidVolume).Round(2), decimal.NewFromFloat(c.AskVolume).Round(2))
+		}
+	}
+	sb.WriteString(` AS bar ON DUPLICATE KEY UPDATE
+		high = GREATEST(stock_history.high, bar.high),
+		low = LEAST(stock_history.low, bar.low),
+		close = bar.close,
+		volume = stock_history.volume + bar.volume,
+		trade_count = stock_history.trade_count + bar.trade_count,
+		bid_volume = stock_history.bid_volume + bar.bid_volume,
+		ask_volume = stock_history.ask_volume + bar.ask_volume`)
+
+	if _, err := r.db.Exec(sb.String(), args...); err != nil {
+		return fmt.Errorf("repository: failed to create or update candles: %w", err)
+	}
 	return nil
 }
 
-func (r *repository) GetEntireMarketPriceHistory(symbol string) ([]models.StockPriceHistory, error) {
+// GetCandles returns up to limit of the most recent candles of an interval starting within [from, to), oldest
+// first. A zero from or to leaves that end of the range open.
+func (r *repository) GetCandles(symbol string, interval Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error) {
+	query := `SELECT open, high, low, close, volume, trade_count, recorded_at, bid_volume, ask_volume
+	FROM stock_history
+	WHERE symbol = ? AND bar_interval = ?`
+	args := []any{symbol, string(interval)}
+	if !from.IsZero() {
+		query += ` AND recorded_at >= ?`
+		args = append(args, from.UTC())
+	}
+	if !to.IsZero() {
+		query += ` AND recorded_at < ?`
+		args = append(args, to.UTC())
+	}
+	query += ` ORDER BY recorded_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get candles: %w", err)
+	}
+	defer rows.Close()
+
+	candles := []models.StockPriceHistory{}
+	for rows.Next() {
+		c := models.StockPriceHistory{Interval: string(interval)}
+		if err := rows.Scan(&c.Open, &c.High, &c.Low, &c.Close, &c.Volume, &c.TradeCount, &c.RecordedAt, &c.BidVolume, &c.AskVolume); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan candle: %w", err)
+		}
+		candles = append(candles, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: error iterating candles: %w", err)
+	}
 
-	sql := `SELECT open, high, low, close, recorded_at, bid_volume, ask_volume
-	FROM (
-		SELECT open, high, low, close, recorded_at, bid_volume, ask_volume
-		FROM stock_history 
-		WHERE symbol = ? 
-		ORDER BY recorded_at DESC 
-		LIMIT 25
-	) AS sub
-	ORDER BY recorded_at ASC;
-	`
+	// Rows are read newest first so that the limit keeps the most recent candles
+	for i, j := 0, len(candles)-1; i < j; i, j = i+1, j-1 {
+		candles[i], candles[j] = candles[j], candles[i]
+	}
+	return candles, nil
+}
+
+// GetCandlePage returns up to limit candles of an interval starting within [from, to) after the cursor, oldest first.
+func (r *repository) GetCandlePage(symbol string, interval Interval, from, to time.Time, after PageCursor, limit int) ([]models.StockPriceHistory, error) {
+	query := `SELECT open, high, low, close, volume, trade_count, recorded_at, bid_volume, ask_volume
+	FROM stock_history
+	WHERE symbol = ? AND bar_interval = ? AND recorded_at >= ? AND recorded_at < ?`
+	args := []any{symbol, string(interval), from.UTC(), to.UTC()}
+	if !after.At.IsZero() {
+		query += ` AND recorded_at > ?`
+		args = append(args, after.At.UTC())
+	}
+	query += ` ORDER BY recorded_at LIMIT ?`
+	args = append(args, limit)
 
-	rows, err := r.db.Query(sql, symbol)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("repository: failed to get market price history: %v", err)
+		return nil, fmt.Errorf("repository: failed to get candle page: %w", err)
 	}
 	defer rows.Close()
 
-	var priceData []models.StockPriceHistory
+	candles := []models.StockPriceHistory{}
 	for rows.Next() {
-		var history models.StockPriceHistory
-		if err := rows.Scan(&history.Open, &history.High, &history.Low, &history.Close, &history.RecordedAt, &history.BidVolume, &history.AskVolume); err != nil {
-			return nil, fmt.Errorf("repository: failed to scan row: %v", err)
+		c := models.StockPriceHistory{Interval: string(interval)}
+		if err := rows.Scan(&c.Open, &c.High, &c.Low, &c.Close, &c.Volume, &c.TradeCount, &c.RecordedAt, &c.BidVolume, &c.AskVolume); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan candle: %w", err)
 		}
-		priceData = append(priceData, history)
+		candles = append(candles, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: error iterating candles: %w", err)
 	}
+	return candles, nil
+}
+
+// GetTradePage returns up to limit trades executed within [from, to) after the cursor, oldest first.
+func (r *repository) GetTradePage(symbol string, from, to time.Time, after PageCursor, limit int) ([]models.Trade, error) {
+	query := `SELECT trade_id, symbol, price, volume, aggressor_side, buy_order_id, sell_order_id, executed_at
+	FROM trades
+	WHERE symbol = ? AND executed_at >= ? AND executed_at < ?`
+	args := []any{symbol, from.UTC(), to.UTC()}
+	if !after.At.IsZero() {
+		query += ` AND (executed_at, trade_id) > (?, ?)`
+		args = append(args, after.At.UTC(), after.ID)
+	}
+	query += ` ORDER BY executed_at, trade_id LIMIT ?`
+	args = append(args, limit)
 
-	// Check for errors from iterating over rows
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get trade page: %w", err)
+	}
+	defer rows.Close()
+
+	trades := []models.Trade{}
+	for rows.Next() {
+		var t models.Trade
+		if err := rows.Scan(&t.TradeID, &t.Symbol, &t.Price, &t.Volume, &t.AggressorSide, &t.BuyOrderID, &t.SellOrderID, &t.ExecutedAt); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan trade: %w", err)
+		}
+		trades = append(trades, t)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("repository: error iterating rows: %v", err)
+		return nil, fmt.Errorf("repository: error iterating trades: %w", err)
+	}
+	return trades, nil
+}
+
+// GetOrderEventPage returns up to limit order events that occurred within [from, to) after the cursor, oldest first.
+func (r *repository) GetOrderEventPage(symbol string, from, to time.Time, after PageCursor, limit int) ([]models.OrderEvent, error) {
+	query := `SELECT event_id, order_id, user_id, symbol, event_type, order_side, order_status, price, volume, filled_volume, occurred_at
+	FROM order_events
+	WHERE symbol = ? AND occurred_at >= ? AND occurred_at < ?`
+	args := []any{symbol, from.UTC(), to.UTC()}
+	if !after.At.IsZero() {
+		query += ` AND (occurred_at, event_id) > (?, ?)`
+		args = append(args, after.At.UTC(), after.ID)
+	}
+	query += ` ORDER BY occurred_at, event_id LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get order event page: %w", err)
 	}
+	defer rows.Close()
 
-	return priceData, nil
+	events := []models.OrderEvent{}
+	for rows.Next() {
+		var e models.OrderEvent
+		if err := rows.Scan(&e.EventID, &e.OrderID, &e.UserID, &e.Symbol, &e.EventType, &e.OrderSide, &e.OrderStatus, &e.Price, &e.Volume, &e.FilledVolume, &e.OccurredAt); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan order event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: error iterating order events: %w", err)
+	}
+	return events, nil
 }
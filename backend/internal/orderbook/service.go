@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"github/wry-0313/exchange/internal/models"
 	list "github/wry-0313/exchange/pkg/dsa/linkedlist"
+	"github/wry-0313/exchange/pkg/fixed"
 	"log"
 	"math"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -22,11 +24,46 @@ type Service interface {
 	PlaceMarketOrder(side Side, userID ulid.ULID, volume decimal.Decimal) (orderID ulid.ULID, err error)
 	PlaceLimitOrder(side Side, userID ulid.ULID, volume, price decimal.Decimal) (orderID ulid.ULID, err error)
 	Symbol() string
-	NewOrder(side Side, userID ulid.ULID, orderType OrderType, price, volume decimal.Decimal, partialAllowed bool) *Order
-	PersistMarketPrice(priceData models.StockPriceHistory) error
-	GetMarketPriceHistory() ([]models.StockPriceHistory, error)
-	SimulateMarketFluctuations(marketSimulationUlid ulid.ULID)
-	Run()
+	SubmitOrder(req OrderRequest) (OrderResult, error)
+	// RejectOrder records an order that could not be submitted, e.g. because its command was malformed, as
+	// rejected with cause as the reason.
+	RejectOrder(req OrderRequest, cause error) OrderResult
+	CancelOrder(orderID, userID ulid.ULID) (OrderResult, error)
+	// AmendOrder reduces the volume of a limit order of userID resting on the book, keeping its time priority.
+	AmendOrder(orderID, userID ulid.ULID, volume decimal.Decimal) (OrderResult, error)
+	NewOrder(side Side, userID ulid.ULID, orderType OrderType, price, volume fixed.Num, partialAllowed bool) *Order
+	// GetCandles returns up to limit of the most recent candles of an interval starting within [from, to), oldest
+	// first. A zero from or to leaves that end of the range open.
+	GetCandles(interval Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error)
+	// Ticker returns the symbol's statistics over the last 24 hours.
+	Ticker() Ticker
+	PersistenceStats() WriterStats
+	// OnFillsPersisted registers fn to be called once fills are persisted, see FillsPersistedFunc. It must be
+	// called before the book receives orders.
+	OnFillsPersisted(fn FillsPersistedFunc)
+	// MarketPrice returns the price of the last trade, zero before the first one.
+	MarketPrice() fixed.Num
+	// CommittedBuyValue returns the cash userID is going to spend that the database doesn't reflect yet: their
+	// limit buys on the book at their limit price, their market buys waiting for liquidity at the last traded price
+	// or the highest ask, whichever is higher, and their buy fills that are not persisted yet. It errs on the high
+	// side while a fill is being persisted.
+	CommittedBuyValue(userID ulid.ULID) decimal.Decimal
+	// CommittedSellVolume returns the volume userID's holding is going to shrink by that the database doesn't
+	// reflect yet: their sell orders on the book, including market sells waiting for liquidity, and their sell
+	// fills that are not persisted yet. It errs on the high side while a fill is being persisted.
+	CommittedSellVolume(userID ulid.ULID) decimal.Decimal
+	// SetHalted halts or resumes trading. A halted book rejects new orders, including the simulation's, while its
+	// resting orders can still be cancelled or reduced. The state is persisted and survives restarts.
+	SetHalted(halted bool) error
+	Halted() bool
+	Snapshot() Snapshot
+	L3Snapshot() L3Book
+	// SimulateMarketFluctuations and Run start background work that stops once ctx is done.
+	SimulateMarketFluctuations(ctx context.Context, marketSimulationUlid ulid.ULID)
+	Run(ctx context.Context)
+	// Shutdown waits for the background work to stop, snapshots the book and flushes pending writes. The context
+	// passed to Run and SimulateMarketFluctuations must be done before calling it.
+	Shutdown(ctx context.Context) error
 }
 
 type service struct {
@@ -34,7 +71,7 @@ type service struct {
 	activeOrders map[ulid.ULID]*list.Node[*Order] // orderID -> *Order for quick acctions such as update or cancel
 	ordersMu     sync.RWMutex
 
-	marketPrice   decimal.Decimal
+	marketPrice   fixed.Num
 	marketPriceMu sync.RWMutex
 
 	marketBuyOrders *list.List[*Order] // partially filled market buy orders
@@ -49,131 +86,136 @@ type service struct {
 	sortedOrdersMu sync.RWMutex
 
 	obRepo Repository
+	writer *writer // persists orders and fills in the background
+	l3     *l3Feed // publishes every change to the orders resting on the book
 
 	rdb *redis.Client
 
-	prices []decimal.Decimal
-}
+	candles candles // built from the book's trades, persisted and published by Run
+	stats   stats   // rolling 24 hour statistics of the book's trades
 
-func NewService(symbol string, obRepo Repository, rdb *redis.Client) Service {
-	err := InitializeLogService("orderbook_log.txt")
-	if err != nil {
-		log.Fatalf("Could not initialize log service: %v", err)
-	}
+	halted atomic.Bool
+
+	snapshotDir string         // where the book is saved on shutdown, snapshots are disabled when empty
+	wg          sync.WaitGroup // background goroutines started by Run and SimulateMarketFluctuations
+}
 
+// NewService creates the order book of a symbol. Writes the database refuses are appended to deadLetterFile, or
+// only logged when it is empty.
+func NewService(symbol string, obRepo Repository, rdb *redis.Client, snapshotDir, deadLetterFile string) Service {
 	stock := models.Stock{
 		Symbol: symbol,
 	}
 
-	err = obRepo.CreateStock(stock)
+	err := obRepo.CreateStock(stock)
 	if err != nil {
 		log.Fatalf("Could not create stock: %v", err)
 	}
 
-	return &service{
+	s := &service{
 		symbol:           symbol,
 		activeOrders:     map[ulid.ULID]*list.Node[*Order]{},
 		bids:             NewOrderSide(),
 		asks:             NewOrderSide(),
-		marketBuyOrders:  list.New[*Order](),
-		marketSellOrders: list.New[*Order](),
-		marketPrice:      decimal.Zero,
+		marketBuyOrders:  list.NewWithPool(nodePool),
+		marketSellOrders: list.NewWithPool(nodePool),
+		marketPrice:      fixed.Zero,
 		obRepo:           obRepo,
+		writer:           newWriter(symbol, obRepo, deadLetterFile),
+		l3:               newL3Feed(symbol, rdb),
 		rdb:              rdb,
-		prices:           []decimal.Decimal{},
+		snapshotDir:      snapshotDir,
+	}
+	s.bids.feed = s.l3
+	s.asks.feed = s.l3
+	if stock, err := obRepo.GetStock(symbol); err != nil {
+		log.Printf("Could not load the trading status of %s, trading is open: %v", symbol, err)
+	} else {
+		s.halted.Store(stock.Halted)
+	}
+	if err := s.restoreSnapshot(); err != nil {
+		log.Fatalf("Could not restore order book snapshot: %v", err)
+	}
+
+	now := time.Now()
+	candles, err := obRepo.GetCandles(symbol, Interval1m, now.Add(-statsWindow), time.Time{}, int(statsWindow/time.Minute)+1)
+	if err != nil {
+		log.Printf("Could not load the last 24 hours of %s, statistics start empty: %v", symbol, err)
 	}
+	s.stats.seed(candles, now)
+	return s
 }
 
-func (s *service) Run() {
-	loc, _ := time.LoadLocation("America/Chicago")
+// Run persists and publishes the symbol's candles every 500ms until ctx is done, then stores the candle still open.
+func (s *service) Run(ctx context.Context) {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		ticker := time.NewTicker(500 * time.Millisecond)
 		defer ticker.Stop()
 		for {
 			select {
+			case <-ctx.Done():
+				s.persistCandles(s.candles.flush())
+				return
 			case <-ticker.C:
+				closed, open := s.candles.tick(time.Now())
+				s.persistCandles(closed)
 
-				var priceData models.StockPriceHistory
-				var new bool // new means to create a new candle, otherwise update the last candle
-				s.prices = append(s.prices, s.MarketPrice())
-				if len(s.prices) >= 5 {
-					priceData = models.StockPriceHistory{
-						PriceData:  getPriceDataFromPriceSlice(s.prices),
-						BidVolume:  s.bids.Volume().InexactFloat64(),
-						AskVolume:  s.asks.Volume().InexactFloat64(),
-						RecordedAt: time.Now().In(loc),
-					}
-					new = true
-
-					err := s.PersistMarketPrice(priceData)
-					if err != nil {
-						log.Printf("Could not persist market price: %v", err)
-					}
-					s.prices = []decimal.Decimal{}
-					s.asks.ResetVolume()
-					s.bids.ResetVolume()
-				} else {
-					priceData = models.StockPriceHistory{
-						PriceData:  getPriceDataFromPriceSlice(s.prices),
-						BidVolume:  s.bids.Volume().InexactFloat64(),
-						AskVolume:  s.asks.Volume().InexactFloat64(),
-						RecordedAt: time.Now().In(loc),
-					}
-
-					new = false
+				// A closed candle is published as new so that the next update starts a new candle on the chart
+				for _, c := range closed {
+					s.publishPrice(c, true)
+				}
+				if open != nil {
+					s.publishPrice(*open, false)
 				}
-
-				s.publishPrice(priceData, new)
-
 			}
 		}
 	}()
 }
 
-func getPriceDataFromPriceSlice(prices []decimal.Decimal) models.PriceData {
-
-	return models.PriceData{
-		Open:  prices[0],
-		Close: prices[max(0, len(prices)-1)],
-		High:  getMax(prices),
-		Low:   getMin(prices),
+// recordTrades adds the fills an incoming order received to the candles and statistics.
+func (s *service) recordTrades(aggressor Side, fills []fill) {
+	if len(fills) == 0 {
+		return
 	}
-
+	now := time.Now()
+	s.candles.record(aggressor, fills, now)
+	s.stats.record(fills, now)
 }
 
-func getMin(prices []decimal.Decimal) decimal.Decimal {
-	min := prices[0]
-	for _, price := range prices {
-		if price.LessThan(min) {
-			min = price
-		}
+func (s *service) Ticker() Ticker {
+	t := s.stats.ticker(time.Now())
+	bid, ask := s.BestBid(), s.BestAsk()
+	t.Symbol = s.symbol
+	t.Halted = s.Halted()
+	t.BestBid, t.BestAsk = bid.Float64(), ask.Float64()
+	if bid.Sign() > 0 && ask.Sign() > 0 {
+		t.Spread = (ask - bid).Float64()
 	}
-	return min
+	return t
 }
 
-func getMax(prices []decimal.Decimal) decimal.Decimal {
-	max := prices[0]
-	for _, price := range prices {
-		if price.GreaterThan(max) {
-			max = price
-		}
+func (s *service) persistCandles(candles []models.StockPriceHistory) {
+	if err := s.obRepo.CreateOrUpdateCandles(s.symbol, candles); err != nil {
+		log.Printf("Could not persist candles of %s: %v", s.symbol, err)
 	}
-	return max
 }
 
 func (s *service) publishPrice(priceData models.StockPriceHistory, new bool) {
 
 	symbolMarketInfo := SymbolInfoResponse{
 		Symbol:  s.symbol,
-		Price:   s.MarketPrice().InexactFloat64(),
-		BestBid: s.BestBid().InexactFloat64(),
-		BestAsk: s.BestAsk().InexactFloat64(),
+		Price:   s.MarketPrice().Float64(),
+		BestBid: s.BestBid().Float64(),
+		BestAsk: s.BestAsk().Float64(),
 		// AskVolume: s.asks.Volume().InexactFloat64(),
 		// BidVolume: s.bids.Volume().InexactFloat64(),
 		CandleData: CandleData{
 			StockPriceHistory: priceData,
 			NewCandle:         new,
 		},
+		Ticker: s.Ticker(),
 	}
 	// log.Printf("Publishing market info: %v to redis channel %s\n", symbolMarketInfo, s.symbol)
 
@@ -216,7 +258,6 @@ var sineWaves = []SineWave{
 	{frequency: 0.7, amplitude: 0.5, phase: 0.2},
 }
 
-
 var sineWaves2 = []SineWave{
 
 	{frequency: 0.9, amplitude: 6, phase: -0.7},
@@ -231,7 +272,6 @@ var sineWaves2 = []SineWave{
 	{frequency: 0.7, amplitude: 0.5, phase: 0.2},
 }
 
-
 func calculateSuperimposedSine(sineWaves []SineWave, t float64) float64 {
 	totalValue := 0.0
 	for _, wave := range sineWaves {
@@ -241,8 +281,6 @@ func calculateSuperimposedSine(sineWaves []SineWave, t float64) float64 {
 	return totalValue / 10
 }
 
-
-
 func calculateSuperimposedCoSine(sineWaves []SineWave, t float64) float64 {
 	totalValue := 0.0
 	for _, wave := range sineWaves {
@@ -252,71 +290,277 @@ func calculateSuperimposedCoSine(sineWaves []SineWave, t float64) float64 {
 	return totalValue / 10
 }
 
-
-
-func (s *service) SimulateMarketFluctuations(marketSimulationUlid ulid.ULID) {
+func (s *service) SimulateMarketFluctuations(ctx context.Context, marketSimulationUlid ulid.ULID) {
 	t := 0.0
 
+	s.wg.Add(2)
 	go func() { // limit buy order
+		defer s.wg.Done()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
 		for {
 			// log.Printf("Best ask: %s", s.BestAsk())
 			fluctuation := calculateSuperimposedSine(sineWaves, t)
 			// log.Printf("Fluctuation: %f", fluctuation)
-			price := (s.BestAsk()).Add(decimal.NewFromFloat(3)).Sub(decimal.NewFromFloat(rand.Float64() * 5))
+			price := s.BestAsk().Decimal().Add(decimal.NewFromFloat(3)).Sub(decimal.NewFromFloat(rand.Float64() * 5))
 			volume := decimal.NewFromFloat(fluctuation).Mul(decimal.NewFromInt(60)).Abs().Add(decimal.NewFromInt(50))
-			_, err := s.PlaceLimitOrder(Buy, marketSimulationUlid, volume.Round(2), price.Round(2))
-			if err != nil {
-				// log.Printf("Failed to place limit order: %v", err)
+			if !s.Halted() {
+				_, err := s.PlaceLimitOrder(Buy, marketSimulationUlid, volume.Round(2), price.Round(2))
+				if err != nil {
+					// log.Printf("Failed to place limit order: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
-			time.Sleep(50 * time.Millisecond)
 			t += 0.03
 		}
 	}()
 
 	t1 := 0.0
 	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
 		for {
 			// log.Printf("Best bid: %s", s.BestBid())
 			fluctuation := calculateSuperimposedCoSine(sineWaves2, t1)
 			// log.Printf("Fluctuation2: %f", fluctuation)
-			price := (s.BestBid()).Sub(decimal.NewFromFloat(3)).Add(decimal.NewFromFloat(rand.Float64() * 5))
+			price := s.BestBid().Decimal().Sub(decimal.NewFromFloat(3)).Add(decimal.NewFromFloat(rand.Float64() * 5))
 			volume := decimal.NewFromFloat(fluctuation).Mul(decimal.NewFromInt(50)).Abs().Add(decimal.NewFromInt(50))
-			_, err := s.PlaceLimitOrder(Sell, marketSimulationUlid, volume.Round(2), price.Round(2))
-			if err != nil {
-				// log.Printf("Failed to place limit order: %v", err)
+			if !s.Halted() {
+				_, err := s.PlaceLimitOrder(Sell, marketSimulationUlid, volume.Round(2), price.Round(2))
+				if err != nil {
+					// log.Printf("Failed to place limit order: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
-			time.Sleep(50 * time.Millisecond)
 			t1 += 0.03
 		}
 	}()
 
 }
 
-func (s *service) GetMarketPriceHistory() ([]models.StockPriceHistory, error) {
-	return s.obRepo.GetEntireMarketPriceHistory(s.symbol)
+func (s *service) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.wg.Wait()
+		if err := s.writeSnapshot(); err != nil {
+			log.Printf("Could not snapshot order book %s: %v", s.symbol, err)
+		}
+		s.writer.close()
+		s.l3.close()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("orderbook: shutdown of %s did not finish: %w", s.symbol, ctx.Err())
+	}
+}
+
+func (s *service) GetCandles(interval Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error) {
+	return s.obRepo.GetCandles(s.symbol, interval, from, to, limit)
 }
 
 func (s *service) PlaceMarketOrder(side Side, userID ulid.ULID, volume decimal.Decimal) (orderID ulid.ULID, err error) {
-	if volume.Sign() <= 0 {
-		return ulid.ULID{}, ErrInvalidVolume
+	res, err := s.SubmitOrder(OrderRequest{Side: side, UserID: userID, Type: Market, Volume: volume})
+	return res.OrderID, err
+}
+
+func (s *service) PlaceLimitOrder(side Side, userID ulid.ULID, volume, price decimal.Decimal) (orderID ulid.ULID, err error) {
+	res, err := s.SubmitOrder(OrderRequest{Side: side, UserID: userID, Type: Limit, Volume: volume, Price: price})
+	return res.OrderID, err
+}
+
+// SubmitOrder validates and matches an order, returning the state the order was left in and the fills it received
+// while being matched.
+func (s *service) SubmitOrder(req OrderRequest) (OrderResult, error) {
+	orderID := req.OrderID
+	if orderID == (ulid.ULID{}) {
+		orderID = ulid.Make()
+	}
+
+	v, p, err := validateOrder(req)
+	if s.Halted() {
+		return s.rejectOrder(orderID, req, v, p, ErrTradingHalted), ErrTradingHalted
+	}
+	if err != nil {
+		return s.rejectOrder(orderID, req, v, p, err), err
+	}
+
+	switch req.Type {
+	case Market:
+		return s.placeMarketOrder(orderID, req.ClientOrderID, req.Side, req.UserID, v), nil
+	default:
+		return s.placeLimitOrder(orderID, req.ClientOrderID, req.Side, req.UserID, v, p), nil
+	}
+}
+
+// validateOrder checks an order request and converts its volume and price, which are left zero when they are out
+// of range.
+func validateOrder(req OrderRequest) (volume, price fixed.Num, err error) {
+	volume, volumeErr := fixed.FromDecimal(req.Volume)
+	price, priceErr := fixed.FromDecimal(req.Price)
+	switch {
+	case req.Side != Buy && req.Side != Sell:
+		err = ErrInvalidSide
+	case req.Type != Market && req.Type != Limit:
+		err = ErrInvalidOrderType
+	case volumeErr != nil || volume.Sign() <= 0:
+		err = ErrInvalidVolume
+	case priceErr != nil || (req.Type == Limit && price.Sign() <= 0):
+		err = ErrInvalidPrice
+	}
+	return volume, price, err
+}
+
+func (s *service) RejectOrder(req OrderRequest, cause error) OrderResult {
+	orderID := req.OrderID
+	if orderID == (ulid.ULID{}) {
+		orderID = ulid.Make()
+	}
+	v, p, _ := validateOrder(req)
+	return s.rejectOrder(orderID, req, v, p, cause)
+}
+
+// rejectOrder records an order that failed validation so that the user can see why it was not placed. An invalid
+// side or type is stored as the closest valid one, the reject reason tells what was wrong.
+func (s *service) rejectOrder(orderID ulid.ULID, req OrderRequest, volume, price fixed.Num, cause error) OrderResult {
+	s.writer.createOrder(OrderRecord{
+		OrderID:       orderID,
+		UserID:        req.UserID,
+		ClientOrderID: req.ClientOrderID,
+		Side:          req.Side,
+		OrderType:     req.Type,
+		Status:        Rejected,
+		RejectReason:  cause.Error(),
+		Price:         price,
+		Volume:        volume,
+		CreatedAt:     time.Now().In(chicago),
+	})
+	return OrderResult{OrderID: orderID, Status: Rejected, RemainingVolume: req.Volume}
+}
+
+// CancelOrder removes an order of userID that is still resting on the book, either as a limit order or as a
+// market order waiting for liquidity. Orders that were already filled, cancelled or belong to another user are
+// reported as ErrOrderNotExists.
+func (s *service) CancelOrder(orderID, userID ulid.ULID) (OrderResult, error) {
+	// Cancellations hold the book lock like matching does and look the order up under it, so the order can't be
+	// filled and released between the lookup and its removal.
+	s.sortedOrdersMu.Lock()
+	s.ordersMu.Lock()
+	n, ok := s.activeOrders[orderID]
+	ok = ok && n.Value.UserID() == userID
+	if ok {
+		delete(s.activeOrders, orderID)
+	}
+	s.ordersMu.Unlock()
+	if ok {
+		o := n.Value
+		if o.Side() == Buy {
+			s.bids.Remove(n)
+		} else {
+			s.asks.Remove(n)
+		}
+		s.sortedOrdersMu.Unlock()
+		return s.finishCancel(o), nil
+	}
+	s.sortedOrdersMu.Unlock()
+
+	if o := s.removeMarketOrder(s.marketBuyOrders, &s.marketBuyMu, orderID, userID); o != nil {
+		return s.finishCancel(o), nil
+	}
+	if o := s.removeMarketOrder(s.marketSellOrders, &s.marketSellMu, orderID, userID); o != nil {
+		return s.finishCancel(o), nil
+	}
+	return OrderResult{}, ErrOrderNotExists
+}
+
+// AmendOrder reduces a resting limit order to volume in place. Only reductions keep the order's place in the queue,
+// so a larger volume, like a new price, needs a cancel and a new order.
+func (s *service) AmendOrder(orderID, userID ulid.ULID, volume decimal.Decimal) (OrderResult, error) {
+	v, err := fixed.FromDecimal(volume)
+	if err != nil {
+		return OrderResult{}, ErrInvalidAmendment
+	}
+
+	// Amendments hold the book lock like matching does, so the order can't be filled and released meanwhile and
+	// the L3 feed reports the change in sequence.
+	s.sortedOrdersMu.Lock()
+	defer s.sortedOrdersMu.Unlock()
+
+	s.ordersMu.RLock()
+	n, ok := s.activeOrders[orderID]
+	s.ordersMu.RUnlock()
+	if !ok || n.Value.UserID() != userID {
+		return OrderResult{}, ErrOrderNotExists
+	}
+	o := n.Value
+	remaining := o.Volume()
+	if v.Sign() <= 0 || v >= remaining {
+		return o.result(nil), ErrInvalidAmendment
+	}
+
+	os := s.asks
+	if o.Side() == Buy {
+		os = s.bids
+	}
+	if oq, ok := os.priceTable[o.Price()]; ok {
+		oq.SetVolume(oq.Volume() - (remaining - v))
+	}
+	o.volumeMu.Lock()
+	o.volume = v
+	o.volumeMu.Unlock()
+	s.amendOrder(o)
+	if os.feed != nil {
+		os.feed.emit(L3Modify, o, fixed.Zero)
 	}
+	return o.result(nil), nil
+}
 
-	if side == Invalid {
-		return ulid.ULID{}, ErrInvalidSide
+// removeMarketOrder takes the resting market order with orderID off marketOrders.
+func (s *service) removeMarketOrder(marketOrders *list.List[*Order], mu *sync.Mutex, orderID, userID ulid.ULID) *Order {
+	mu.Lock()
+	defer mu.Unlock()
+	for n := marketOrders.Front(); n != nil; n = n.Next() {
+		if o := n.Value; o.OrderID() == orderID && o.UserID() == userID {
+			marketOrders.Remove(n)
+			return o
+		}
 	}
+	return nil
+}
 
-	o := s.NewOrder(side, userID, Market, decimal.Zero, volume, true)
+// finishCancel records the cancellation of an order that is no longer referenced by the book and releases it.
+func (s *service) finishCancel(o *Order) OrderResult {
+	s.cancelOrder(o)
+	res := o.result(nil)
+	releaseOrder(o)
+	return res
+}
+
+func (s *service) placeMarketOrder(orderID ulid.ULID, clientID string, side Side, userID ulid.ULID, volume fixed.Num) OrderResult {
+	o := s.newOrder(orderID, clientID, side, userID, Market, fixed.Zero, volume)
+	var fills []fill
+	defer func() { s.recordTrades(side, fills) }()
 
 	var (
 		os   *OrderSide
 		iter func() (*OrderQueue, bool)
 	)
 	if side == Buy {
-		s.bids.AddVolumeBy(volume)
 		iter = s.asks.MinPriceQueue
 		os = s.asks
 	} else {
-		s.asks.AddVolumeBy(volume)
 		iter = s.bids.MaxPriceQueue
 		os = s.bids
 	}
@@ -324,7 +568,7 @@ func (s *service) PlaceMarketOrder(side Side, userID ulid.ULID, volume decimal.D
 	if os.Len() == 0 {
 		// no limit orders in the opposite side, add the order to the market order list
 		s.addMarketOrder(o)
-		return o.orderID, nil
+		return o.result(fills)
 	}
 
 	var volumeLeft = o.Volume()
@@ -340,20 +584,22 @@ func (s *service) PlaceMarketOrder(side Side, userID ulid.ULID, volume decimal.D
 
 		// Log(fmt.Sprintf("os string: %v, oq: %v  volumeleft: %s\n", os, oq, volumeLeft))
 
-		volumeLeft = s.matchAtPriceLevel(oq, o)
+		volumeLeft = s.matchAtPriceLevel(oq, o, &fills)
 	}
 	s.sortedOrdersMu.Unlock()
 
+	res := o.result(fills)
 	if volumeLeft.Sign() > 0 {
 		// the order is not fully filled, add it to the market order list
 		s.addMarketOrder(o)
 	} else {
 		// the order is fully filled
+		releaseOrder(o)
 	}
-	return o.orderID, nil
+	return res
 }
 
-func (s *service) matchAtPriceLevel(oq *OrderQueue, o *Order) (volumeLeft decimal.Decimal) {
+func (s *service) matchAtPriceLevel(oq *OrderQueue, o *Order, fills *[]fill) (volumeLeft fixed.Num) {
 	volumeLeft = o.Volume()
 
 	logService.logger.Println(fmt.Sprintf("Matching %s at price level %s\n", o.shortOrderID(), oq.Price()))
@@ -369,11 +615,11 @@ func (s *service) matchAtPriceLevel(oq *OrderQueue, o *Order) (volumeLeft decima
 
 		logService.logger.Println(fmt.Sprintf("Matching %s with %s", o.shortOrderID(), bestOrder.shortOrderID()))
 
-		if volumeLeft.LessThan(bestOrderVolume) { // the best order will be partially filled
+		if volumeLeft < bestOrderVolume { // the best order will be partially filled
 
 			// Log(fmt.Sprintf("%s: %s -> %s | %s: %s -> %s\n", o.shortOrderID(), o.Volume(), o.Volume().Sub(volumeLeft), bestOrder.shortOrderID(), bestOrder.Volume(), bestOrder.Volume().Sub(volumeLeft)))
 			// matchedVolumeLeft := bestOrderVolume.Sub(volumeLeft) // update order status. This change should reflect in order queue
-			oq.SetVolume(oq.Volume().Sub(volumeLeft))
+			oq.SetVolume(oq.Volume() - volumeLeft)
 
 			// if o.Side() == Buy {
 			// 	s.asks.SubVolumeBy(volumeLeft)
@@ -382,14 +628,19 @@ func (s *service) matchAtPriceLevel(oq *OrderQueue, o *Order) (volumeLeft decima
 			// }
 			s.fillOrder(bestOrder, volumeLeft, oq.Price())
 			s.fillOrder(o, volumeLeft, oq.Price()) // completely filled
+			s.recordTrade(o, bestOrder, oq.Price(), volumeLeft)
+			*fills = append(*fills, fill{price: oq.Price(), volume: volumeLeft})
 
-			volumeLeft = decimal.Zero
+			volumeLeft = fixed.Zero
 
 		} else { // the best order will be completely filled
-			volumeLeft = volumeLeft.Sub(bestOrderVolume)
+			volumeLeft -= bestOrderVolume
+			oq.SetVolume(oq.Volume() - bestOrderVolume)
 			// Log(fmt.Sprintf("%s: %s -> %s | %s: %s -> %s\n", o.shortOrderID(), o.Volume(), o.Volume().Sub(bestOrder.Volume()), bestOrder.shortOrderID(), bestOrder.Volume(), decimal.Zero))
+			s.recordTrade(o, bestOrder, oq.Price(), bestOrderVolume) // before the best order is released
 			s.fillAndRemoveLimitOrder(bestOrderNode, bestOrderVolume, oq.Price())
 			s.fillOrder(o, bestOrderVolume, oq.Price())
+			*fills = append(*fills, fill{price: oq.Price(), volume: bestOrderVolume})
 		}
 	}
 	return
@@ -397,7 +648,7 @@ func (s *service) matchAtPriceLevel(oq *OrderQueue, o *Order) (volumeLeft decima
 
 // func (s *service) processTransaction()
 
-func (s *service) matchWithMarketOrders(marketOrders *list.List[*Order], order *Order) {
+func (s *service) matchWithMarketOrders(marketOrders *list.List[*Order], order *Order, fills *[]fill) {
 
 	for marketOrders.Len() > 0 {
 
@@ -408,12 +659,14 @@ func (s *service) matchWithMarketOrders(marketOrders *list.List[*Order], order *
 		marketOrderVolume := marketOrder.Volume()
 		orderVolume := order.Volume()
 
-		if orderVolume.LessThan(marketOrderVolume) { // the market order will be completely filled
+		if orderVolume < marketOrderVolume { // the market order will be completely filled
 
 			// Log(fmt.Sprintf("%s: %s -> %s | %s: %s -> %s\n", order.shortOrderID(), order.Volume(), decimal.Zero, marketOrder.shortOrderID(), marketOrder.Volume(), marketOrder.Volume().Sub(orderVolume)))
 
 			s.fillOrder(marketOrder, orderVolume, order.Price())
 			s.fillOrder(order, orderVolume, order.Price())
+			s.recordTrade(order, marketOrder, order.Price(), orderVolume)
+			*fills = append(*fills, fill{price: order.Price(), volume: orderVolume})
 
 			// if order.Side() == Buy {
 			// 	s.asks.SubVolumeBy(orderVolume)
@@ -436,122 +689,101 @@ func (s *service) matchWithMarketOrders(marketOrders *list.List[*Order], order *
 
 			s.fillOrder(order, marketOrderVolume, order.Price())
 			s.fillOrder(marketOrder, marketOrderVolume, order.Price())
+			s.recordTrade(order, marketOrder, order.Price(), marketOrderVolume)
+			*fills = append(*fills, fill{price: order.Price(), volume: marketOrderVolume})
+			releaseOrder(marketOrder)
 		}
 	}
 }
 
-func (s *service) fillAndRemoveLimitOrder(n *list.Node[*Order], filledVolume, filledAt decimal.Decimal) *Order {
+func (s *service) fillAndRemoveLimitOrder(n *list.Node[*Order], filledVolume, filledAt fixed.Num) {
 	o := n.Value
 
 	s.ordersMu.Lock()
 	delete(s.activeOrders, o.OrderID())
 	s.ordersMu.Unlock()
 
+	// Filled while still on the book so that the L3 feed reports the execution before the delete. The caller has
+	// already taken the filled volume off the price level.
+	s.fillOrder(o, filledVolume, filledAt)
 	if o.Side() == Buy {
 		s.bids.Remove(n)
 	} else {
 		s.asks.Remove(n)
 	}
-	s.fillOrder(o, filledVolume, filledAt)
-	return o
+	releaseOrder(o)
 }
 
-func (s *service) PlaceLimitOrder(side Side, userID ulid.ULID, volume, price decimal.Decimal) (orderID ulid.ULID, err error) {
-	if volume.Sign() <= 0 {
-		return ulid.ULID{}, ErrInvalidVolume
-	}
-
-	if price.Sign() <= 0 {
-		return ulid.ULID{}, ErrInvalidPrice
-	}
-
-	if side == Invalid {
-		return ulid.ULID{}, ErrInvalidSide
-	}
+func (s *service) placeLimitOrder(orderID ulid.ULID, clientID string, side Side, userID ulid.ULID, volume, price fixed.Num) OrderResult {
+	o := s.newOrder(orderID, clientID, side, userID, Limit, price, volume)
+	var fills []fill
+	defer func() { s.recordTrades(side, fills) }()
 
-	volumeLeft := volume
-
-	o := s.NewOrder(side, userID, Limit, price, volume, true)
-
-	
 	if side == Buy { // there are market orders waiting to be match
 
-		s.bids.AddVolumeBy(volume)
-
 		s.marketSellMu.Lock() // Lock the mutex
 		if s.marketSellOrders.Len() > 0 {
 			// Log(fmt.Sprintf("Limit order matching with market order: %s", o.shortOrderID()))
-			s.matchWithMarketOrders(s.marketSellOrders, o)
+			s.matchWithMarketOrders(s.marketSellOrders, o, &fills)
 		}
 		s.marketSellMu.Unlock() // Unlock the mutex
 
 	} else {
 
-		s.asks.AddVolumeBy(volume)
-
 		s.marketBuyMu.Lock() // Lock the mutex
 		if s.marketBuyOrders.Len() > 0 {
 			// Log(fmt.Sprintf("Limit order matching with market order: %s", o.shortOrderID()))
-			s.matchWithMarketOrders(s.marketBuyOrders, o)
+			s.matchWithMarketOrders(s.marketBuyOrders, o, &fills)
 		}
 		s.marketBuyMu.Unlock() // Unlock the mutex
 	}
 
 	if o.Status() == Filled {
-		return o.orderID, nil
+		res := o.result(fills)
+		releaseOrder(o)
+		return res
 	}
 
 	var (
 		os         *OrderSide
 		iter       func() (*OrderQueue, bool)
-		comparator func(decimal.Decimal) bool
+		comparator func(fixed.Num) bool
 	)
 
 	if side == Buy {
 		iter = s.asks.MinPriceQueue
-		comparator = price.GreaterThanOrEqual
+		comparator = func(best fixed.Num) bool { return price >= best }
 		os = s.asks
 	} else {
 		iter = s.bids.MaxPriceQueue
-		comparator = price.LessThanOrEqual
+		comparator = func(best fixed.Num) bool { return price <= best }
 		os = s.bids
 	}
 
 	s.sortedOrdersMu.Lock()
-	bestPrice, ok := iter()
+	defer s.sortedOrdersMu.Unlock()
 
-	if !ok || bestPrice == nil {
-		logService.logger.Println(fmt.Sprintf("No limit orders in the opposite side, initialize order: %s", o.shortOrderID()))
-		s.addLimitOrder(o)
-		s.sortedOrdersMu.Unlock()
-		return o.orderID, nil
-	}
-
-	for volumeLeft.Sign() > 0 && os.Len() > 0 && comparator(bestPrice.Price()) {
+	volumeLeft := o.Volume()
+	for volumeLeft.Sign() > 0 && os.Len() > 0 {
 		bestPrice, found := iter() // we don't dont have to check ok because we already checked it in the for loop condition with checking orderside size
-		if !found || bestPrice == nil {
-			continue
+		if !found || bestPrice == nil || !comparator(bestPrice.Price()) {
+			break
 		}
-		volumeLeft = s.matchAtPriceLevel(bestPrice, o)
+		volumeLeft = s.matchAtPriceLevel(bestPrice, o, &fills)
 	}
 
+	res := o.result(fills)
 	if volumeLeft.Sign() > 0 {
-		// the order is not fully filled or didn't find a match in price range, add it to the market order list
-		// Log(fmt.Sprintf("The order is not fully filled or matched in price range, add it: %s", o.shortOrderID()))
+		// the order is not fully filled or didn't find a match in price range, add it to the book
+		if len(fills) == 0 {
+			logService.logger.Println(fmt.Sprintf("No matching limit orders in the opposite side, initialize order: %s", o.shortOrderID()))
+		}
 		s.addLimitOrder(o)
+	} else {
+		releaseOrder(o)
 	}
-	s.sortedOrdersMu.Unlock()
 
-	return o.orderID, nil
-}
-
-func (s *service) PersistMarketPrice(priceData models.StockPriceHistory) error {
-	// log.Printf("Persisting market price: %v", priceData)
-	err := s.obRepo.CreateMarketPriceHistory(s.symbol, priceData)
-	if err != nil {
-		return fmt.Errorf("Service: failed to persist market price history: %w", err)
-	}
-	return nil
+	return res
 }
 
 func (s *service) addMarketOrder(o *Order) {
@@ -592,33 +824,79 @@ func (s *service) addLimitOrder(o *Order) {
 // 	return s.bids.Volume()
 // }
 
-func (s *service) BestBid() decimal.Decimal {
+func (s *service) BestBid() fixed.Num {
 	s.sortedOrdersMu.RLock()
 	defer s.sortedOrdersMu.RUnlock()
 	oq, found := s.bids.MaxPriceQueue()
 	if !found || oq == nil {
-		return decimal.Zero
+		return fixed.Zero
 	}
 	return oq.Price()
 }
 
-func (s *service) BestAsk() decimal.Decimal {
+func (s *service) BestAsk() fixed.Num {
 	s.sortedOrdersMu.RLock()
 	defer s.sortedOrdersMu.RUnlock()
 	oq, found := s.asks.MinPriceQueue()
 	if !found || oq == nil {
-		return decimal.Zero
+		return fixed.Zero
 	}
 	return oq.Price()
 }
 
-func (s *service) MarketPrice() decimal.Decimal {
+func (s *service) MarketPrice() fixed.Num {
 	s.marketPriceMu.RLock()
 	defer s.marketPriceMu.RUnlock()
 	return s.marketPrice
 }
 
-func (s *service) SetMarketPrice(price decimal.Decimal) {
+func (s *service) CommittedBuyValue(userID ulid.ULID) decimal.Decimal {
+	// Orders are read before the pending fills, since a fill is counted as pending before it leaves the order
+	value := decimal.Zero
+	marketPrice := s.MarketPrice()
+	s.sortedOrdersMu.RLock()
+	s.bids.each(true, func(o *Order) {
+		if o.userID == userID {
+			value = value.Add(o.Volume().Decimal().Mul(o.price.Decimal()))
+		}
+	})
+	if oq, found := s.asks.MaxPriceQueue(); found && oq != nil && oq.Price() > marketPrice {
+		marketPrice = oq.Price()
+	}
+	s.sortedOrdersMu.RUnlock()
+	marketVolume := fixed.Zero
+	s.marketBuyMu.Lock()
+	for n := s.marketBuyOrders.Front(); n != nil; n = n.Next() {
+		if o := n.Value; o.userID == userID {
+			marketVolume += o.Volume()
+		}
+	}
+	s.marketBuyMu.Unlock()
+	value = value.Add(marketVolume.Decimal().Mul(marketPrice.Decimal()))
+	return value.Add(s.writer.pendingFills(userID).buyValue)
+}
+
+func (s *service) CommittedSellVolume(userID ulid.ULID) decimal.Decimal {
+	// Orders are read before the pending fills, since a fill is counted as pending before it leaves the order
+	volume := fixed.Zero
+	s.sortedOrdersMu.RLock()
+	s.asks.each(false, func(o *Order) {
+		if o.userID == userID {
+			volume += o.Volume()
+		}
+	})
+	s.sortedOrdersMu.RUnlock()
+	s.marketSellMu.Lock()
+	for n := s.marketSellOrders.Front(); n != nil; n = n.Next() {
+		if o := n.Value; o.userID == userID {
+			volume += o.Volume()
+		}
+	}
+	s.marketSellMu.Unlock()
+	return (volume + s.writer.pendingFills(userID).sellVolume).Decimal()
+}
+
+func (s *service) SetMarketPrice(price fixed.Num) {
 	s.marketPriceMu.Lock()
 	logService.logger.Println(fmt.Sprintf("Set market price: %s", price))
 	s.marketPrice = price
@@ -627,6 +905,28 @@ func (s *service) SetMarketPrice(price decimal.Decimal) {
 	// release the stop orders that are triggered by the new market price
 }
 
+// PersistenceStats reports the state of the symbol's persistence queue.
+func (s *service) PersistenceStats() WriterStats {
+	return s.writer.stats()
+}
+
+func (s *service) OnFillsPersisted(fn FillsPersistedFunc) {
+	s.writer.onFillsPersisted = fn
+}
+
+func (s *service) SetHalted(halted bool) error {
+	if err := s.obRepo.SetStockHalted(s.symbol, halted); err != nil {
+		return err
+	}
+	s.halted.Store(halted)
+	log.Printf("Trading on %s halted: %v\n", s.symbol, halted)
+	return nil
+}
+
+func (s *service) Halted() bool {
+	return s.halted.Load()
+}
+
 func (s *service) Symbol() string {
 	return s.symbol
 }
@@ -0,0 +1,168 @@
+package orderbook
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/fixed"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+// nopRepository discards every write so the order book runs without a database.
+type nopRepository struct {
+	Repository
+}
+
+func (nopRepository) CreateStock(models.Stock) error { return nil }
+func (nopRepository) GetStock(string) (models.Stock, error) {
+	return models.Stock{}, nil
+}
+func (nopRepository) PersistBatch(PersistBatch) error { return nil }
+func (nopRepository) CreateOrUpdateCandles(string, []models.StockPriceHistory) error {
+	return nil
+}
+func (nopRepository) GetCandles(string, Interval, time.Time, time.Time, int) ([]models.StockPriceHistory, error) {
+	return nil, nil
+}
+
+// TestCancelRacingMatch cancels resting orders while market orders fill them. Each order must end up either
+// cancelled or filled, never both, which the race detector and the book's state check.
+func TestCancelRacingMatch(t *testing.T) {
+	s := NewService("RACE", nopRepository{}, nil, "", "").(*service)
+	seller, buyer := ulid.Make(), ulid.Make()
+	volume, price := decimal.NewFromInt(1), decimal.NewFromInt(100)
+
+	for i := 0; i < 5000; i++ {
+		res, err := s.SubmitOrder(OrderRequest{UserID: seller, Side: Sell, Type: Limit, Volume: volume, Price: price})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var cancelErr error
+		var buy OrderResult
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, cancelErr = s.CancelOrder(res.OrderID, seller)
+		}()
+		go func() {
+			defer wg.Done()
+			buy, _ = s.SubmitOrder(OrderRequest{UserID: buyer, Side: Buy, Type: Market, Volume: volume})
+		}()
+		wg.Wait()
+
+		filled := buy.Status == Filled
+		switch {
+		case cancelErr == nil && filled:
+			t.Fatalf("iteration %d: order was both cancelled and filled", i)
+		case errors.Is(cancelErr, ErrOrderNotExists) && !filled:
+			t.Fatalf("iteration %d: order was neither cancelled nor filled", i)
+		case cancelErr != nil && !errors.Is(cancelErr, ErrOrderNotExists):
+			t.Fatalf("iteration %d: %v", i, cancelErr)
+		}
+		if !filled {
+			// The buy is waiting for liquidity, take it off the book for the next iteration
+			if _, err := s.CancelOrder(buy.OrderID, buyer); err != nil {
+				t.Fatalf("iteration %d: cancelling the waiting buy: %v", i, err)
+			}
+		}
+
+		s.ordersMu.RLock()
+		active := len(s.activeOrders)
+		s.ordersMu.RUnlock()
+		if active != 0 || s.asks.Len() != 0 || s.bids.Len() != 0 {
+			t.Fatalf("iteration %d: book not empty: %d active orders, %d asks, %d bids", i, active, s.asks.Len(), s.bids.Len())
+		}
+	}
+}
+
+func TestSubmitOrderRejectsOutOfRangeValues(t *testing.T) {
+	s := NewService("RANGE", nopRepository{}, nil, "", "").(*service)
+	// One hundredth more than a Num holds would wrap around to a negative number
+	huge := decimal.New(math.MaxInt64, -fixed.Places).Add(decimal.New(1, -fixed.Places))
+
+	cases := []struct {
+		req  OrderRequest
+		want error
+	}{
+		{OrderRequest{UserID: ulid.Make(), Side: Buy, Type: Limit, Volume: huge, Price: decimal.NewFromInt(1)}, ErrInvalidVolume},
+		{OrderRequest{UserID: ulid.Make(), Side: Buy, Type: Limit, Volume: decimal.NewFromInt(1), Price: huge}, ErrInvalidPrice},
+	}
+	for _, c := range cases {
+		res, err := s.SubmitOrder(c.req)
+		if !errors.Is(err, c.want) || res.Status != Rejected {
+			t.Errorf("got %s, %v, want a rejection with %v", res.Status, err, c.want)
+		}
+	}
+	if s.bids.Len() != 0 {
+		t.Fatalf("%d orders entered the book", s.bids.Len())
+	}
+}
+
+// blockedRepository holds every write until release is closed, like a database that fell behind.
+type blockedRepository struct {
+	nopRepository
+	release chan struct{}
+}
+
+func (r blockedRepository) PersistBatch(PersistBatch) error {
+	<-r.release
+	return nil
+}
+
+func TestCommittedSellVolumeCountsUnpersistedFills(t *testing.T) {
+	repo := blockedRepository{release: make(chan struct{})}
+	s := NewService("COMMIT", repo, nil, "", "").(*service)
+	seller := ulid.Make()
+	if _, err := s.SubmitOrder(OrderRequest{UserID: seller, Side: Sell, Type: Limit, Volume: decimal.NewFromInt(10), Price: decimal.NewFromInt(100)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SubmitOrder(OrderRequest{UserID: ulid.Make(), Side: Buy, Type: Market, Volume: decimal.NewFromInt(4)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 6 are still offered and the 4 sold aren't deducted from the holding in the database yet
+	if got := s.CommittedSellVolume(seller); !got.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("got %s committed before the fills are persisted, want 10", got)
+	}
+	close(repo.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.CommittedSellVolume(seller).Equal(decimal.NewFromInt(6)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %s committed once the fills are persisted, want 6", s.CommittedSellVolume(seller))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommittedBuyValueCountsMarketBuysAndUnpersistedFills(t *testing.T) {
+	repo := blockedRepository{release: make(chan struct{})}
+	defer close(repo.release)
+	s := NewService("COMMIT", repo, nil, "", "").(*service)
+	s.SetMarketPrice(fixed.FromInt(100))
+	buyer := ulid.Make()
+	if _, err := s.SubmitOrder(OrderRequest{UserID: buyer, Side: Buy, Type: Limit, Volume: decimal.NewFromInt(2), Price: decimal.NewFromInt(90)}); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is offered, so the market buy waits and is valued at the last traded price
+	if _, err := s.SubmitOrder(OrderRequest{UserID: buyer, Side: Buy, Type: Market, Volume: decimal.NewFromInt(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.CommittedBuyValue(buyer); !got.Equal(decimal.NewFromInt(680)) {
+		t.Fatalf("got %s committed, want 680", got)
+	}
+
+	// Part of the market buy fills, but the fill isn't persisted yet
+	if _, err := s.SubmitOrder(OrderRequest{UserID: ulid.Make(), Side: Sell, Type: Limit, Volume: decimal.NewFromInt(2), Price: decimal.NewFromInt(100)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.CommittedBuyValue(buyer); !got.Equal(decimal.NewFromInt(680)) {
+		t.Fatalf("got %s committed after the fill, want 680", got)
+	}
+}
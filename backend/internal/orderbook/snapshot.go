@@ -0,0 +1,135 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/pkg/fixed"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is the resting state of a book. Orders are listed bids first and asks second, each from the best price
+// level to the worst and in time priority within a level, followed by the market orders waiting for liquidity.
+// Restoring them in that order rebuilds the same book.
+type Snapshot struct {
+	Symbol      string        `json:"symbol"`
+	MarketPrice fixed.Num     `json:"market_price"`
+	TakenAt     time.Time     `json:"taken_at"`
+	Orders      []OrderRecord `json:"orders"`
+}
+
+// Snapshot returns the resting state of the book. It must only be called while no orders are being matched.
+func (s *service) Snapshot() Snapshot {
+	snap := Snapshot{
+		Symbol:      s.symbol,
+		MarketPrice: s.MarketPrice(),
+		TakenAt:     time.Now(),
+	}
+	add := func(o *Order) { snap.Orders = append(snap.Orders, o.record()) }
+
+	s.sortedOrdersMu.RLock()
+	s.bids.each(true, add)
+	s.asks.each(false, add)
+	s.sortedOrdersMu.RUnlock()
+
+	s.marketBuyMu.Lock()
+	for n := s.marketBuyOrders.Front(); n != nil; n = n.Next() {
+		add(n.Value)
+	}
+	s.marketBuyMu.Unlock()
+	s.marketSellMu.Lock()
+	for n := s.marketSellOrders.Front(); n != nil; n = n.Next() {
+		add(n.Value)
+	}
+	s.marketSellMu.Unlock()
+
+	return snap
+}
+
+func snapshotPath(dir, symbol string) string {
+	return filepath.Join(dir, symbol+".json")
+}
+
+// writeSnapshot saves the book to the snapshot directory. The file is written next to its final name and renamed
+// so that a crash mid-write never leaves a truncated snapshot behind.
+func (s *service) writeSnapshot() error {
+	if s.snapshotDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		return fmt.Errorf("orderbook: failed to marshal snapshot: %w", err)
+	}
+	if err := os.MkdirAll(s.snapshotDir, 0755); err != nil {
+		return fmt.Errorf("orderbook: failed to create snapshot directory: %w", err)
+	}
+	path := snapshotPath(s.snapshotDir, s.symbol)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("orderbook: failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("orderbook: failed to save snapshot: %w", err)
+	}
+	return nil
+}
+
+// restoreSnapshot loads the book saved by the last shutdown, if any. The orders are already persisted so they are
+// put back on the book without being written again. The snapshot is removed once restored, since the book moves
+// on from it as soon as new orders arrive.
+func (s *service) restoreSnapshot() error {
+	if s.snapshotDir == "" {
+		return nil
+	}
+	path := snapshotPath(s.snapshotDir, s.symbol)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("orderbook: failed to read snapshot: %w", err)
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("orderbook: failed to parse snapshot: %w", err)
+	}
+	for _, record := range snap.Orders {
+		o := restoreOrder(record)
+		if o.OrderType() == Market {
+			s.addMarketOrder(o)
+		} else {
+			s.addLimitOrder(o)
+		}
+	}
+	s.SetMarketPrice(snap.MarketPrice)
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("orderbook: failed to remove restored snapshot: %w", err)
+	}
+	return nil
+}
+
+// each calls fn for every resting order, from the highest price level down when descending is set and from the
+// lowest up otherwise.
+func (os *OrderSide) each(descending bool, fn func(o *Order)) {
+	it := os.priceTree.Tree.Iterator()
+	step := it.Next
+	if descending {
+		it.End()
+		step = it.Prev
+	}
+	for step() {
+		it.Value().(*OrderQueue).each(fn)
+	}
+}
+
+// each calls fn for every order in the queue in time priority.
+func (oq *OrderQueue) each(fn func(o *Order)) {
+	oq.ordersMu.RLock()
+	defer oq.ordersMu.RUnlock()
+	for n := oq.orders.Front(); n != nil; n = n.Next() {
+		fn(n.Value)
+	}
+}
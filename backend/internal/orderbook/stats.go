@@ -0,0 +1,159 @@
+package orderbook
+
+import (
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/fixed"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	statsWindow       = 24 * time.Hour
+	statsBucketPeriod = time.Minute
+)
+
+// Ticker is a summary of a symbol's trading over the last 24 hours along with its current price and spread.
+type Ticker struct {
+	Symbol           string    `json:"symbol"`
+	LastPrice        float64   `json:"last_price"`
+	LastSize         float64   `json:"last_size"`
+	BestBid          float64   `json:"best_bid"`
+	BestAsk          float64   `json:"best_ask"`
+	Spread           float64   `json:"spread"` // zero unless both sides of the book have orders
+	Open24h          float64   `json:"open_24h"`
+	High24h          float64   `json:"high_24h"`
+	Low24h           float64   `json:"low_24h"`
+	Change24h        float64   `json:"change_24h"`
+	ChangePercent24h float64   `json:"change_percent_24h"`
+	Volume24h        float64   `json:"volume_24h"`
+	QuoteVolume24h   float64   `json:"quote_volume_24h"` // traded value, price times volume
+	TradeCount24h    int       `json:"trade_count_24h"`
+	VWAP24h          float64   `json:"vwap_24h"`
+	LastTradeAt      time.Time `json:"last_trade_at,omitempty"`
+	Halted           bool      `json:"halted"`
+}
+
+// statsBucket aggregates the trades of one minute.
+type statsBucket struct {
+	start    time.Time
+	open     fixed.Num
+	high     fixed.Num
+	low      fixed.Num
+	close    fixed.Num
+	volume   fixed.Num
+	notional float64
+	trades   int
+}
+
+// stats maintains a symbol's rolling 24 hour statistics from its trades. Trades are aggregated per minute, so the 24
+// hour window moves a minute at a time.
+type stats struct {
+	mu          sync.Mutex
+	buckets     []statsBucket // oldest first, only minutes with trades
+	lastPrice   fixed.Num
+	lastSize    fixed.Num
+	lastTradeAt time.Time
+}
+
+// record adds the fills an order received to the statistics.
+func (st *stats) record(fills []fill, at time.Time) {
+	if len(fills) == 0 {
+		return
+	}
+	start := at.Truncate(statsBucketPeriod)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(at)
+	if n := len(st.buckets); n == 0 || st.buckets[n-1].start.Before(start) {
+		st.buckets = append(st.buckets, statsBucket{start: start, open: fills[0].price, high: fills[0].price, low: fills[0].price})
+	}
+	b := &st.buckets[len(st.buckets)-1]
+	for _, f := range fills {
+		b.high = max(b.high, f.price)
+		b.low = min(b.low, f.price)
+		b.close = f.price
+		b.volume += f.volume
+		b.notional += f.price.Float64() * f.volume.Float64()
+		b.trades++
+	}
+	last := fills[len(fills)-1]
+	st.lastPrice, st.lastSize, st.lastTradeAt = last.price, last.volume, at
+}
+
+// seed fills the window from stored one minute candles after a restart. Candles do not keep the traded value, so it
+// is estimated from their typical price.
+func (st *stats) seed(candles []models.StockPriceHistory, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, c := range candles {
+		if c.TradeCount == 0 {
+			continue
+		}
+		// Candles are stored as DECIMAL(10, 2) and DECIMAL(20, 2), which always fit in a Num
+		b := statsBucket{start: c.RecordedAt, trades: c.TradeCount}
+		b.open, _ = fixed.FromDecimal(c.Open)
+		b.high, _ = fixed.FromDecimal(c.High)
+		b.low, _ = fixed.FromDecimal(c.Low)
+		b.close, _ = fixed.FromDecimal(c.Close)
+		b.volume, _ = fixed.FromFloat(c.Volume)
+		b.notional = (b.high.Float64() + b.low.Float64() + b.close.Float64()) / 3 * c.Volume
+		st.buckets = append(st.buckets, b)
+		st.lastPrice, st.lastTradeAt = b.close, c.RecordedAt
+	}
+	st.pruneLocked(now)
+}
+
+// pruneLocked drops the buckets that ended before the window starts.
+func (st *stats) pruneLocked(now time.Time) {
+	cutoff := now.Add(-statsWindow)
+	i := 0
+	for i < len(st.buckets) && !st.buckets[i].start.Add(statsBucketPeriod).After(cutoff) {
+		i++
+	}
+	st.buckets = st.buckets[i:]
+}
+
+// ticker summarises the window as of now. The book's prices are filled in by the caller.
+func (st *stats) ticker(now time.Time) Ticker {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(now)
+
+	t := Ticker{
+		LastPrice:   st.lastPrice.Float64(),
+		LastSize:    st.lastSize.Float64(),
+		LastTradeAt: st.lastTradeAt,
+	}
+	if len(st.buckets) == 0 {
+		return t
+	}
+
+	high, low := st.buckets[0].high, st.buckets[0].low
+	var volume fixed.Num
+	for _, b := range st.buckets {
+		high = max(high, b.high)
+		low = min(low, b.low)
+		volume += b.volume
+		t.QuoteVolume24h += b.notional
+		t.TradeCount24h += b.trades
+	}
+	open := st.buckets[0].open.Float64()
+	t.Open24h, t.High24h, t.Low24h = open, high.Float64(), low.Float64()
+	t.Volume24h = volume.Float64()
+	t.Change24h = round(t.LastPrice-open, 2)
+	if open != 0 {
+		t.ChangePercent24h = round(t.Change24h/open*100, 2)
+	}
+	if t.Volume24h != 0 {
+		t.VWAP24h = round(t.QuoteVolume24h/t.Volume24h, 4)
+	}
+	t.QuoteVolume24h = round(t.QuoteVolume24h, 2)
+	return t
+}
+
+func round(x float64, places int) float64 {
+	p := math.Pow10(places)
+	return math.Round(x*p) / p
+}
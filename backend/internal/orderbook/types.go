@@ -3,14 +3,15 @@ package orderbook
 import "github/wry-0313/exchange/internal/models"
 
 type SymbolInfoResponse struct {
-	Symbol     string     `json:"symbol"`
+	Symbol string `json:"symbol"`
 	// AskVolume  float64    `json:"ask_volume"`
 	// BidVolume  float64    `json:"bid_volume"`
-	BestBid    float64    `json:"best_bid"`
-	BestAsk    float64    `json:"best_ask"`
-	Price      float64    `json:"price"`
+	BestBid float64 `json:"best_bid"`
+	BestAsk float64 `json:"best_ask"`
+	Price   float64 `json:"price"`
 	CandleData
 	// models.StockPriceHistory
+	Ticker Ticker `json:"ticker"`
 }
 
 type CandleData struct {
@@ -0,0 +1,440 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"github/wry-0313/exchange/pkg/fixed"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	writerQueueSize     = 8192
+	writerBatchSize     = 512
+	writerFlushInterval = 50 * time.Millisecond
+	writerMaxRetries    = 5
+	writerRetryBackoff  = 100 * time.Millisecond
+)
+
+// FillRecord describes one fill of an order and the state the order was left in.
+type FillRecord struct {
+	OrderID      ulid.ULID
+	UserID       ulid.ULID
+	Side         Side
+	Status       OrderStatus
+	Volume       fixed.Num // volume left on the order after the fill
+	FilledVolume fixed.Num
+	FilledAt     fixed.Num
+	Amended      bool // the volume was reduced by an amendment rather than a fill
+	At           time.Time
+}
+
+// TradeRecord describes a match between an incoming order and an order that was resting on the book.
+type TradeRecord struct {
+	TradeID     ulid.ULID
+	Price       fixed.Num
+	Volume      fixed.Num
+	Aggressor   Side // side of the incoming order
+	BuyOrderID  ulid.ULID
+	SellOrderID ulid.ULID
+	ExecutedAt  time.Time
+}
+
+// PersistBatch is a group of writes for one symbol that the repository applies in a single transaction. Orders are
+// always inserted before fills are applied, so a fill never reaches the database ahead of its order.
+type PersistBatch struct {
+	Symbol string        `json:"symbol"`
+	Orders []OrderRecord `json:"orders,omitempty"`
+	Fills  []FillRecord  `json:"fills,omitempty"`
+	Trades []TradeRecord `json:"trades,omitempty"`
+}
+
+func (b *PersistBatch) len() int {
+	return len(b.Orders) + len(b.Fills) + len(b.Trades)
+}
+
+// newPersistBatch groups events for one symbol into a batch. An order is always queued before its fills, and the
+// repository inserts a batch's orders before applying its fills, so splitting the events into separate slices keeps
+// them in order.
+func newPersistBatch(symbol string, events []writeEvent) PersistBatch {
+	batch := PersistBatch{Symbol: symbol}
+	for _, e := range events {
+		switch e.kind {
+		case writeFill:
+			batch.Fills = append(batch.Fills, e.fill)
+		case writeTrade:
+			batch.Trades = append(batch.Trades, e.trade)
+		default:
+			batch.Orders = append(batch.Orders, e.order)
+		}
+	}
+	return batch
+}
+
+// WriterStats is a snapshot of a writer's counters.
+type WriterStats struct {
+	Symbol        string `json:"symbol"`
+	QueueLength   int    `json:"queue_length"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Enqueued      uint64 `json:"enqueued"`
+	Blocked       uint64 `json:"blocked"` // number of enqueues that had to wait for room in the queue
+	Written       uint64 `json:"written"`
+	Batches       uint64 `json:"batches"`
+	Retries       uint64 `json:"retries"`
+	DeadLettered  uint64 `json:"dead_lettered"`
+}
+
+type writeKind int
+
+const (
+	writeOrder writeKind = iota
+	writeFill
+	writeTrade
+)
+
+// writeEvent holds an order, a fill or a trade by value so that queueing a write does not allocate.
+type writeEvent struct {
+	kind  writeKind
+	order OrderRecord
+	fill  FillRecord
+	trade TradeRecord
+}
+
+// orderID returns the order the event belongs to, the buy order for a trade.
+func (e *writeEvent) orderID() ulid.ULID {
+	switch e.kind {
+	case writeFill:
+		return e.fill.OrderID
+	case writeTrade:
+		return e.trade.BuyOrderID
+	default:
+		return e.order.OrderID
+	}
+}
+
+// writer persists the order book's writes for one symbol. Writes are queued in the order the engine produced
+// them and applied by a single goroutine, batched into transactions. When the queue is full the engine blocks
+// until there is room, which is the backpressure the Blocked counter reports.
+type writer struct {
+	symbol string
+	repo   Repository
+	queue  chan writeEvent
+
+	deadLetterFile string
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	enqueued     atomic.Uint64
+	blocked      atomic.Uint64
+	written      atomic.Uint64
+	batches      atomic.Uint64
+	retries      atomic.Uint64
+	deadLettered atomic.Uint64
+
+	deadLetterMu sync.Mutex
+
+	// Fills queued or being written, by user, so the book can tell what isn't reflected by the database yet.
+	pendingMu sync.Mutex
+	pending   map[ulid.ULID]*pendingFills
+
+	// Called with the users whose orders were filled once a batch is persisted, see Service.OnFillsPersisted.
+	onFillsPersisted FillsPersistedFunc
+}
+
+// pendingFills sums a user's fills that are not persisted yet.
+type pendingFills struct {
+	sellVolume fixed.Num
+	buyValue   decimal.Decimal
+}
+
+func (p *pendingFills) empty() bool {
+	return p.sellVolume.Sign() <= 0 && !p.buyValue.IsPositive()
+}
+
+// FillsPersistedFunc is called with the symbol and the users whose orders were filled once a batch of fills is
+// persisted. It runs on the writer's goroutine and must not block.
+type FillsPersistedFunc func(symbol string, userIDs []string)
+
+// newWriter starts a writer that appends the batches the database refuses to deadLetterFile, or only logs them when
+// it is empty.
+func newWriter(symbol string, repo Repository, deadLetterFile string) *writer {
+	w := &writer{
+		symbol:         symbol,
+		repo:           repo,
+		queue:          make(chan writeEvent, writerQueueSize),
+		deadLetterFile: deadLetterFile,
+		done:           make(chan struct{}),
+		pending:        map[ulid.ULID]*pendingFills{},
+	}
+	go w.run()
+	return w
+}
+
+func (w *writer) createOrder(record OrderRecord) {
+	w.enqueue(writeEvent{order: record})
+}
+
+func (w *writer) fill(record FillRecord) {
+	w.enqueue(writeEvent{kind: writeFill, fill: record})
+}
+
+// addPending counts a fill as pending until the batch holding it is written. It must be called before the
+// order's volume is reduced, so a reader going from the book to the pending fills never misses the fill.
+func (w *writer) addPending(userID ulid.ULID, side Side, volume, price fixed.Num) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	p, ok := w.pending[userID]
+	if !ok {
+		p = &pendingFills{}
+		w.pending[userID] = p
+	}
+	if side == Sell {
+		p.sellVolume += volume
+	} else {
+		p.buyValue = p.buyValue.Add(volume.Decimal().Mul(price.Decimal()))
+	}
+}
+
+// settlePending stops counting the fills of a batch that was written or dead-lettered.
+func (w *writer) settlePending(batch PersistBatch) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	for _, f := range batch.Fills {
+		if f.FilledVolume.Sign() == 0 {
+			continue
+		}
+		p, ok := w.pending[f.UserID]
+		if !ok {
+			continue
+		}
+		if f.Side == Sell {
+			p.sellVolume -= f.FilledVolume
+		} else {
+			p.buyValue = p.buyValue.Sub(f.FilledVolume.Decimal().Mul(f.FilledAt.Decimal()))
+		}
+		if p.empty() {
+			delete(w.pending, f.UserID)
+		}
+	}
+}
+
+// pendingFills returns the sums of userID's fills that are not persisted yet.
+func (w *writer) pendingFills(userID ulid.ULID) pendingFills {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if p, ok := w.pending[userID]; ok {
+		return *p
+	}
+	return pendingFills{}
+}
+
+func (w *writer) trade(record TradeRecord) {
+	w.enqueue(writeEvent{kind: writeTrade, trade: record})
+}
+
+func (w *writer) enqueue(e writeEvent) {
+	w.enqueued.Add(1)
+	select {
+	case w.queue <- e:
+	default:
+		w.blocked.Add(1)
+		w.queue <- e
+	}
+}
+
+// close stops accepting writes and returns once everything queued has been flushed.
+func (w *writer) close() {
+	w.closeOnce.Do(func() {
+		close(w.queue)
+	})
+	<-w.done
+}
+
+func (w *writer) stats() WriterStats {
+	return WriterStats{
+		Symbol:        w.symbol,
+		QueueLength:   len(w.queue),
+		QueueCapacity: cap(w.queue),
+		Enqueued:      w.enqueued.Load(),
+		Blocked:       w.blocked.Load(),
+		Written:       w.written.Load(),
+		Batches:       w.batches.Load(),
+		Retries:       w.retries.Load(),
+		DeadLettered:  w.deadLettered.Load(),
+	}
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(writerFlushInterval)
+	defer ticker.Stop()
+
+	events := make([]writeEvent, 0, writerBatchSize)
+	flush := func() {
+		if len(events) == 0 {
+			return
+		}
+		w.write(events)
+		events = events[:0]
+	}
+
+	for {
+		select {
+		case e, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			events = append(events, e)
+			if len(events) >= writerBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write applies a batch of events, retrying with a linear backoff. A batch the database refuses because of its data
+// is not retried but split in halves, see splitEvents, which are written in order, until the events it refuses are
+// on their own. A batch that still fails is appended to the dead-letter file so it can be inspected and replayed by
+// hand.
+func (w *writer) write(events []writeEvent) {
+	batch := newPersistBatch(w.symbol, events)
+	var err error
+	for attempt := 0; attempt <= writerMaxRetries; attempt++ {
+		if attempt > 0 {
+			w.retries.Add(1)
+			time.Sleep(time.Duration(attempt) * writerRetryBackoff)
+		}
+		if err = w.repo.PersistBatch(batch); err == nil {
+			w.batches.Add(1)
+			w.written.Add(uint64(batch.len()))
+			w.settlePending(batch)
+			w.notifyFills(batch)
+			return
+		}
+		log.Printf("writer: failed to persist batch for %s (attempt %d): %v", w.symbol, attempt+1, err)
+		if isConstraintErr(err) {
+			if first, second, ok := splitEvents(events); ok {
+				w.write(first)
+				w.write(second)
+				return
+			}
+			break
+		}
+	}
+	w.deadLetter(batch, err)
+}
+
+// splitEvents splits events in two halves without separating the events of an order or the two orders of a
+// trade, so that neither half applies one side of a trade without the other. Both halves keep the events in the
+// order they were queued. It returns false when the events all belong together.
+func splitEvents(events []writeEvent) (first, second []writeEvent, ok bool) {
+	parent := map[ulid.ULID]ulid.ULID{}
+	var find func(id ulid.ULID) ulid.ULID
+	find = func(id ulid.ULID) ulid.ULID {
+		p, ok := parent[id]
+		if !ok || p == id {
+			parent[id] = id
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	for _, e := range events {
+		if e.kind == writeTrade {
+			parent[find(e.trade.BuyOrderID)] = find(e.trade.SellOrderID)
+		}
+	}
+
+	// Groups of events are numbered in the order their first event was queued
+	groups := make([]ulid.ULID, len(events))
+	var roots []ulid.ULID
+	seen := map[ulid.ULID]bool{}
+	for i, e := range events {
+		groups[i] = find(e.orderID())
+		if !seen[groups[i]] {
+			seen[groups[i]] = true
+			roots = append(roots, groups[i])
+		}
+	}
+	if len(roots) < 2 {
+		return nil, nil, false
+	}
+	inFirst := map[ulid.ULID]bool{}
+	for _, root := range roots[:len(roots)/2] {
+		inFirst[root] = true
+	}
+	for i, e := range events {
+		if inFirst[groups[i]] {
+			first = append(first, e)
+		} else {
+			second = append(second, e)
+		}
+	}
+	return first, second, true
+}
+
+// notifyFills passes the users whose orders a persisted batch filled to onFillsPersisted.
+func (w *writer) notifyFills(batch PersistBatch) {
+	if w.onFillsPersisted == nil {
+		return
+	}
+	seen := map[ulid.ULID]bool{}
+	var userIDs []string
+	for _, f := range batch.Fills {
+		if f.FilledVolume.Sign() != 0 && !seen[f.UserID] {
+			seen[f.UserID] = true
+			userIDs = append(userIDs, f.UserID.String())
+		}
+	}
+	if len(userIDs) > 0 {
+		w.onFillsPersisted(batch.Symbol, userIDs)
+	}
+}
+
+func (w *writer) deadLetter(batch PersistBatch, cause error) {
+	w.deadLettered.Add(uint64(batch.len()))
+	w.settlePending(batch)
+
+	entry := struct {
+		PersistBatch
+		Error      string    `json:"error"`
+		RecordedAt time.Time `json:"recorded_at"`
+	}{batch, cause.Error(), time.Now()}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("writer: failed to marshal dead-lettered batch for %s: %v", w.symbol, err)
+		return
+	}
+
+	if w.deadLetterFile == "" {
+		log.Printf("writer: dead-lettered batch for %s: %s", w.symbol, line)
+		return
+	}
+	w.deadLetterMu.Lock()
+	defer w.deadLetterMu.Unlock()
+	if err := appendLine(w.deadLetterFile, line); err != nil {
+		log.Printf("writer: failed to dead-letter batch for %s: %v, batch: %s", w.symbol, err, line)
+	}
+}
+
+func appendLine(filename string, line []byte) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,96 @@
+package orderbook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/oklog/ulid/v2"
+)
+
+// poisonRepository refuses every batch that contains the poison order, like a database refusing a duplicate key.
+type poisonRepository struct {
+	nopRepository
+	poison  ulid.ULID
+	orders  []ulid.ULID
+	fills   []ulid.ULID
+	batches int
+}
+
+func (r *poisonRepository) PersistBatch(batch PersistBatch) error {
+	r.batches++
+	for _, o := range batch.Orders {
+		if o.OrderID == r.poison {
+			return fmt.Errorf("repository: failed to insert orders: %w", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+		}
+	}
+	for _, o := range batch.Orders {
+		r.orders = append(r.orders, o.OrderID)
+	}
+	for _, f := range batch.Fills {
+		r.fills = append(r.fills, f.OrderID)
+	}
+	return nil
+}
+
+func TestWriterDeadLettersOnlyThePoisonEvent(t *testing.T) {
+	orders := make([]ulid.ULID, 10)
+	for i := range orders {
+		orders[i] = ulid.Make()
+	}
+	repo := &poisonRepository{poison: orders[6]}
+	w := newWriter("TEST", repo, filepath.Join(t.TempDir(), "persistence_deadletter.jsonl"))
+
+	for _, id := range orders {
+		w.createOrder(OrderRecord{OrderID: id})
+	}
+	w.fill(FillRecord{OrderID: orders[2]})
+	w.close()
+
+	if len(repo.orders) != len(orders)-1 || len(repo.fills) != 1 {
+		t.Fatalf("got %d orders and %d fills persisted, want %d and 1", len(repo.orders), len(repo.fills), len(orders)-1)
+	}
+	for _, id := range repo.orders {
+		if id == repo.poison {
+			t.Fatal("the poison order was persisted")
+		}
+	}
+	stats := w.stats()
+	if stats.DeadLettered != 1 || stats.Written != uint64(len(orders)) || stats.Retries != 0 {
+		t.Fatalf("got %d dead-lettered, %d written and %d retries, want 1, %d and 0", stats.DeadLettered, stats.Written, stats.Retries, len(orders))
+	}
+
+	data, err := os.ReadFile(w.deadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], repo.poison.String()) {
+		t.Fatalf("dead-letter file should hold the poison order alone, got %q", data)
+	}
+}
+
+func TestWriterKeepsBothSidesOfATradeTogether(t *testing.T) {
+	x, y, buy, sell := ulid.Make(), ulid.Make(), ulid.Make(), ulid.Make()
+	repo := &poisonRepository{poison: sell}
+	w := newWriter("TEST", repo, filepath.Join(t.TempDir(), "persistence_deadletter.jsonl"))
+
+	for _, id := range []ulid.ULID{x, y, buy, sell} {
+		w.createOrder(OrderRecord{OrderID: id})
+	}
+	w.fill(FillRecord{OrderID: buy, Side: Buy})
+	w.fill(FillRecord{OrderID: sell, Side: Sell})
+	w.trade(TradeRecord{BuyOrderID: buy, SellOrderID: sell})
+	w.close()
+
+	// The buy is only refused because it traded with the sell, applying its fill alone would leave the trade half done
+	if len(repo.orders) != 2 || repo.orders[0] != x || repo.orders[1] != y || len(repo.fills) != 0 {
+		t.Fatalf("got orders %v and fills %v persisted, want only the two unrelated orders", repo.orders, repo.fills)
+	}
+	if stats := w.stats(); stats.DeadLettered != 5 {
+		t.Fatalf("got %d events dead-lettered, want the 5 of the trade", stats.DeadLettered)
+	}
+}
@@ -0,0 +1,80 @@
+package portfolio
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/user"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// ErrMsgInternalServer is a message displayed when an unexpected error occurs
+	ErrMsgInternalServer = "Internal server error"
+
+	errMsgInvalidDays = "days must be an integer between 1 and 365"
+
+	defaultPnLDays = 30
+	maxPnLDays     = 365
+)
+
+type API struct {
+	portfolioService Service
+}
+
+// NewAPI creates a new intance of the API struct.
+func NewAPI(portfolioService Service) API {
+	return API{
+		portfolioService: portfolioService,
+	}
+}
+
+// HandleGetPortfolio returns the user's cash and open positions valued at the current market prices.
+func (api *API) HandleGetPortfolio(w http.ResponseWriter, r *http.Request) {
+	p, err := api.portfolioService.GetPortfolio(middleware.UserIDFromContext(r.Context()))
+	if err != nil {
+		writeErr(w, "HandleGetPortfolio", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, p)
+}
+
+// HandleGetPnL returns the user's realized and unrealized P&L, per symbol and in total, with their daily equity
+// over the last ?days= days, 30 by default.
+func (api *API) HandleGetPnL(w http.ResponseWriter, r *http.Request) {
+	days := defaultPnLDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 || n > maxPnLDays {
+			endpoint.WriteWithError(w, http.StatusBadRequest, errMsgInvalidDays)
+			return
+		}
+		days = n
+	}
+
+	pnl, err := api.portfolioService.GetPnL(middleware.UserIDFromContext(r.Context()), days)
+	if err != nil {
+		writeErr(w, "HandleGetPnL", err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, pnl)
+}
+
+func writeErr(w http.ResponseWriter, handler string, err error) {
+	if errors.Is(err, user.ErrUserNotFound) {
+		endpoint.WriteWithError(w, http.StatusNotFound, user.ErrUserNotFound.Error())
+		return
+	}
+	log.Printf("%s: Failed due to internal server error: %v", handler, err)
+	endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+}
+
+// RegisterHandlers registers the API's request handlers, which are behind apiKeyHandler.
+func (api *API) RegisterHandlers(r chi.Router, apiKeyHandler func(http.Handler) http.Handler) {
+	r.With(apiKeyHandler).Get("/users/me/portfolio", api.HandleGetPortfolio)
+	r.With(apiKeyHandler).Get("/users/me/pnl", api.HandleGetPnL)
+}
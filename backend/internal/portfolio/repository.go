@@ -0,0 +1,127 @@
+package portfolio
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/user"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// dateLayout is the format of snapshot dates.
+const dateLayout = "2006-01-02"
+
+type Repository interface {
+	GetCashBalance(userID string) (decimal.Decimal, error)
+	// GetPositions returns the user's positions ordered by symbol, including the closed ones.
+	GetPositions(userID string) ([]storedPosition, error)
+	// GetUserIDs returns up to limit user IDs in order, starting after the ID after.
+	GetUserIDs(after string, limit int) ([]string, error)
+
+	// SaveSnapshot stores the user's equity for a day, replacing a snapshot of the same day.
+	SaveSnapshot(userID string, snapshot EquitySnapshot) error
+	// GetSnapshots returns the user's snapshots from the day from on, oldest first.
+	GetSnapshots(userID string, from time.Time) ([]EquitySnapshot, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func (r *repository) GetCashBalance(userID string) (decimal.Decimal, error) {
+	var cash decimal.Decimal
+	err := r.db.QueryRow("SELECT cash_balance FROM users WHERE user_id = ?", userID).Scan(&cash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decimal.Decimal{}, user.ErrUserNotFound
+	}
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("repository: failed to get cash balance: %w", err)
+	}
+	return cash, nil
+}
+
+func (r *repository) GetPositions(userID string) ([]storedPosition, error) {
+	rows, err := r.db.Query("SELECT symbol, volume, avg_cost, realized_pnl FROM positions WHERE user_id = ? ORDER BY symbol", userID)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get positions: %w", err)
+	}
+	defer rows.Close()
+
+	var positions []storedPosition
+	for rows.Next() {
+		var p storedPosition
+		if err := rows.Scan(&p.Symbol, &p.Volume, &p.AvgCost, &p.RealizedPnL); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan position: %w", err)
+		}
+		positions = append(positions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get positions: %w", err)
+	}
+	return positions, nil
+}
+
+func (r *repository) GetUserIDs(after string, limit int) ([]string, error) {
+	rows, err := r.db.Query("SELECT user_id FROM users WHERE user_id > ? ORDER BY user_id LIMIT ?", after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan user: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get users: %w", err)
+	}
+	return userIDs, nil
+}
+
+func (r *repository) SaveSnapshot(userID string, s EquitySnapshot) error {
+	_, err := r.db.Exec(`INSERT INTO equity_snapshots (user_id, snapshot_date, cash_balance, market_value, equity, realized_pnl, unrealized_pnl)
+	VALUES (?, ?, ?, ?, ?, ?, ?) AS snapshot
+	ON DUPLICATE KEY UPDATE cash_balance = snapshot.cash_balance, market_value = snapshot.market_value, equity = snapshot.equity,
+		realized_pnl = snapshot.realized_pnl, unrealized_pnl = snapshot.unrealized_pnl`,
+		userID, s.Date, s.CashBalance, s.MarketValue, s.Equity, s.RealizedPnL, s.UnrealizedPnL)
+	if err != nil {
+		return fmt.Errorf("repository: failed to save equity snapshot: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetSnapshots(userID string, from time.Time) ([]EquitySnapshot, error) {
+	rows, err := r.db.Query(`SELECT snapshot_date, cash_balance, market_value, equity, realized_pnl, unrealized_pnl
+	FROM equity_snapshots WHERE user_id = ? AND snapshot_date >= ? ORDER BY snapshot_date`, userID, from.Format(dateLayout))
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get equity snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []EquitySnapshot{}
+	for rows.Next() {
+		var s EquitySnapshot
+		var date time.Time
+		if err := rows.Scan(&date, &s.CashBalance, &s.MarketValue, &s.Equity, &s.RealizedPnL, &s.UnrealizedPnL); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan equity snapshot: %w", err)
+		}
+		s.Date = date.Format(dateLayout)
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get equity snapshots: %w", err)
+	}
+	return snapshots, nil
+}
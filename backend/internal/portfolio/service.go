@@ -0,0 +1,249 @@
+package portfolio
+
+import (
+	"context"
+	"fmt"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/orderbook"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// pushInterval is how often the portfolios of users whose orders were filled are pushed, so that a user
+	// filled many times in a row gets one update.
+	pushInterval = time.Second
+
+	// snapshotPageSize is the number of users read at once when snapshotting everyone's equity.
+	snapshotPageSize = 500
+
+	// pricePlaces is the precision values and P&L are reported at.
+	pricePlaces = 2
+)
+
+// Service defines the portfolio service interface.
+type Service interface {
+	// GetPortfolio values the user's cash and open positions at the current market prices.
+	GetPortfolio(userID string) (Portfolio, error)
+	// GetPnL returns the user's profit and loss, with their equity snapshots of the last days.
+	GetPnL(userID string, days int) (PnL, error)
+	// SnapshotEquity stores the equity of every user as their snapshot of date.
+	SnapshotEquity(date time.Time) error
+
+	// NotifyFills schedules pushing the portfolios of users whose orders were filled, see
+	// orderbook.FillsPersistedFunc.
+	NotifyFills(symbol string, userIDs []string)
+	// Run pushes the scheduled portfolios and snapshots every user's equity at the end of each day (UTC) in the
+	// background until ctx is done.
+	Run(ctx context.Context)
+}
+
+type service struct {
+	repo       Repository
+	obServices map[string]orderbook.Service
+	rdb        *redis.Client
+
+	mu      sync.Mutex
+	pending map[string]bool // users whose portfolio is pushed next
+}
+
+func NewService(repo Repository, obServices map[string]orderbook.Service, rdb *redis.Client) Service {
+	return &service{
+		repo:       repo,
+		obServices: obServices,
+		rdb:        rdb,
+		pending:    map[string]bool{},
+	}
+}
+
+func (s *service) GetPortfolio(userID string) (Portfolio, error) {
+	p, _, err := s.value(userID)
+	return p, err
+}
+
+func (s *service) GetPnL(userID string, days int) (PnL, error) {
+	p, symbols, err := s.value(userID)
+	if err != nil {
+		return PnL{}, err
+	}
+	from := p.ValuedAt.Truncate(24*time.Hour).AddDate(0, 0, -days)
+	daily, err := s.repo.GetSnapshots(userID, from)
+	if err != nil {
+		return PnL{}, fmt.Errorf("service: failed getting equity snapshots: %w", err)
+	}
+	for i := 1; i < len(daily); i++ {
+		daily[i].EquityChange = daily[i].Equity.Sub(daily[i-1].Equity)
+	}
+	return PnL{
+		RealizedPnL:   p.RealizedPnL,
+		UnrealizedPnL: p.UnrealizedPnL,
+		TotalPnL:      p.RealizedPnL.Add(p.UnrealizedPnL),
+		Symbols:       symbols,
+		Daily:         daily,
+	}, nil
+}
+
+// value values the user's positions and returns the portfolio of the open ones along with the P&L of all of them.
+func (s *service) value(userID string) (Portfolio, []SymbolPnL, error) {
+	cash, err := s.repo.GetCashBalance(userID)
+	if err != nil {
+		return Portfolio{}, nil, fmt.Errorf("service: failed getting cash balance: %w", err)
+	}
+	stored, err := s.repo.GetPositions(userID)
+	if err != nil {
+		return Portfolio{}, nil, fmt.Errorf("service: failed getting positions: %w", err)
+	}
+
+	p := Portfolio{
+		CashBalance: cash,
+		Positions:   []Position{},
+		ValuedAt:    time.Now().UTC(),
+	}
+	symbols := make([]SymbolPnL, 0, len(stored))
+	for _, sp := range stored {
+		pos := Position{
+			Symbol:      sp.Symbol,
+			Volume:      sp.Volume,
+			AvgCost:     sp.AvgCost,
+			CostBasis:   sp.Volume.Mul(sp.AvgCost).Round(pricePlaces),
+			MarketPrice: s.marketPrice(sp.Symbol, sp.AvgCost),
+			RealizedPnL: sp.RealizedPnL.Round(pricePlaces),
+		}
+		pos.MarketValue = pos.Volume.Mul(pos.MarketPrice).Round(pricePlaces)
+		pos.UnrealizedPnL = pos.MarketValue.Sub(pos.CostBasis)
+
+		p.RealizedPnL = p.RealizedPnL.Add(pos.RealizedPnL)
+		symbols = append(symbols, SymbolPnL{
+			Symbol:        pos.Symbol,
+			RealizedPnL:   pos.RealizedPnL,
+			UnrealizedPnL: pos.UnrealizedPnL,
+			TotalPnL:      pos.RealizedPnL.Add(pos.UnrealizedPnL),
+		})
+		if pos.Volume.IsZero() {
+			continue
+		}
+		p.MarketValue = p.MarketValue.Add(pos.MarketValue)
+		p.UnrealizedPnL = p.UnrealizedPnL.Add(pos.UnrealizedPnL)
+		p.Positions = append(p.Positions, pos)
+	}
+	p.Equity = p.CashBalance.Add(p.MarketValue)
+	return p, symbols, nil
+}
+
+// marketPrice returns the price the symbol's book last traded at, or avgCost before its first trade.
+func (s *service) marketPrice(symbol string, avgCost decimal.Decimal) decimal.Decimal {
+	ob, ok := s.obServices[symbol]
+	if !ok {
+		return avgCost
+	}
+	price := ob.MarketPrice()
+	if price.Sign() <= 0 {
+		return avgCost
+	}
+	return price.Decimal()
+}
+
+func (s *service) SnapshotEquity(date time.Time) error {
+	day := date.Format(dateLayout)
+	after := ""
+	for {
+		userIDs, err := s.repo.GetUserIDs(after, snapshotPageSize)
+		if err != nil {
+			return fmt.Errorf("service: failed getting users: %w", err)
+		}
+		for _, userID := range userIDs {
+			p, _, err := s.value(userID)
+			if err != nil {
+				return err
+			}
+			snapshot := EquitySnapshot{
+				Date:          day,
+				CashBalance:   p.CashBalance,
+				MarketValue:   p.MarketValue,
+				Equity:        p.Equity,
+				RealizedPnL:   p.RealizedPnL,
+				UnrealizedPnL: p.UnrealizedPnL,
+			}
+			if err := s.repo.SaveSnapshot(userID, snapshot); err != nil {
+				return fmt.Errorf("service: failed saving equity snapshot: %w", err)
+			}
+		}
+		if len(userIDs) < snapshotPageSize {
+			return nil
+		}
+		after = userIDs[len(userIDs)-1]
+	}
+}
+
+func (s *service) NotifyFills(_ string, userIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, userID := range userIDs {
+		s.pending[userID] = true
+	}
+}
+
+func (s *service) Run(ctx context.Context) {
+	go s.pushPortfolios(ctx)
+	go s.snapshotDaily(ctx)
+}
+
+func (s *service) pushPortfolios(ctx context.Context) {
+	ticker := time.NewTicker(pushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = map[string]bool{}
+		s.mu.Unlock()
+		for userID := range pending {
+			s.pushPortfolio(userID)
+		}
+	}
+}
+
+// pushPortfolio publishes the user's portfolio on their channel, which their authenticated WebSocket connections
+// forward.
+func (s *service) pushPortfolio(userID string) {
+	if s.rdb == nil {
+		return
+	}
+	p, err := s.GetPortfolio(userID)
+	if err != nil {
+		log.Printf("Service: failed to value portfolio of user %s: %v", userID, err)
+		return
+	}
+	if err := exchange.NotifyUser(s.rdb, userID, EventPortfolio, p); err != nil {
+		log.Printf("Service: failed to push portfolio to user %s: %v", userID, err)
+	}
+}
+
+// snapshotDaily snapshots every user's equity at each midnight (UTC) as their snapshot of the day that ended.
+func (s *service) snapshotDaily(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		timer := time.NewTimer(midnight.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		day := midnight.AddDate(0, 0, -1)
+		if err := s.SnapshotEquity(day); err != nil {
+			log.Printf("Service: failed to snapshot equity of %s: %v", day.Format(dateLayout), err)
+		}
+	}
+}
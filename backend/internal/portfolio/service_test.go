@@ -0,0 +1,104 @@
+package portfolio
+
+import (
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/pkg/fixed"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type memRepository struct {
+	Repository
+	cash      decimal.Decimal
+	positions []storedPosition
+	snapshots []EquitySnapshot
+}
+
+func (r *memRepository) GetCashBalance(string) (decimal.Decimal, error) {
+	return r.cash, nil
+}
+
+func (r *memRepository) GetPositions(string) ([]storedPosition, error) {
+	return r.positions, nil
+}
+
+func (r *memRepository) GetUserIDs(after string, limit int) ([]string, error) {
+	if after != "" {
+		return nil, nil
+	}
+	return []string{"user1"}, nil
+}
+
+func (r *memRepository) SaveSnapshot(_ string, s EquitySnapshot) error {
+	r.snapshots = append(r.snapshots, s)
+	return nil
+}
+
+func (r *memRepository) GetSnapshots(string, time.Time) ([]EquitySnapshot, error) {
+	return append([]EquitySnapshot(nil), r.snapshots...), nil
+}
+
+// priceBook is an order book that only knows its market price.
+type priceBook struct {
+	orderbook.Service
+	price fixed.Num
+}
+
+func (b priceBook) MarketPrice() fixed.Num {
+	return b.price
+}
+
+func TestPortfolioValuation(t *testing.T) {
+	d := decimal.RequireFromString
+	repo := &memRepository{
+		cash: d("1000"),
+		positions: []storedPosition{
+			{Symbol: "AAPL", Volume: d("10"), AvgCost: d("100"), RealizedPnL: d("25")},
+			{Symbol: "MSFT", Volume: d("0"), AvgCost: d("0"), RealizedPnL: d("-10")},
+			{Symbol: "NEW", Volume: d("2"), AvgCost: d("50"), RealizedPnL: d("0")}, // not traded yet
+		},
+	}
+	books := map[string]orderbook.Service{
+		"AAPL": priceBook{price: fixed.FromInt(120)},
+		"NEW":  priceBook{},
+	}
+	s := NewService(repo, books, nil)
+
+	p, err := s.GetPortfolio("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Positions) != 2 {
+		t.Fatalf("got %d positions, want the 2 open ones", len(p.Positions))
+	}
+	if aapl := p.Positions[0]; !aapl.MarketValue.Equal(d("1200")) || !aapl.UnrealizedPnL.Equal(d("200")) {
+		t.Errorf("AAPL valued at %v with unrealized P&L %v, want 1200 and 200", aapl.MarketValue, aapl.UnrealizedPnL)
+	}
+	if n := p.Positions[1]; !n.MarketPrice.Equal(d("50")) || !n.UnrealizedPnL.IsZero() {
+		t.Errorf("untraded symbol priced at %v with unrealized P&L %v, want its cost and none", n.MarketPrice, n.UnrealizedPnL)
+	}
+	if !p.Equity.Equal(d("2300")) || !p.RealizedPnL.Equal(d("15")) {
+		t.Errorf("equity %v and realized P&L %v, want 2300 and 15", p.Equity, p.RealizedPnL)
+	}
+
+	// Snapshots keep the equity of the day, the P&L lists the change between them
+	if err := s.SnapshotEquity(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	books["AAPL"] = priceBook{price: fixed.FromInt(110)}
+	if err := s.SnapshotEquity(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	pnl, err := s.GetPnL("user1", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pnl.Symbols) != 3 || !pnl.TotalPnL.Equal(d("115")) {
+		t.Errorf("P&L of %d symbols totalling %v, want 3 and 115", len(pnl.Symbols), pnl.TotalPnL)
+	}
+	if len(pnl.Daily) != 2 || pnl.Daily[0].Date != "2024-03-01" || !pnl.Daily[1].EquityChange.Equal(d("-100")) {
+		t.Errorf("daily equity = %+v, want 2 days with a change of -100", pnl.Daily)
+	}
+}
@@ -0,0 +1,74 @@
+package portfolio
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// EventPortfolio is published on a user's channel with their Portfolio after their orders are filled.
+	EventPortfolio = "exchange.portfolio"
+)
+
+// Position is a holding valued at the market price of its symbol. Symbols that haven't traded yet are valued at
+// the average cost, so they have no unrealized P&L.
+type Position struct {
+	Symbol        string          `json:"symbol"`
+	Volume        decimal.Decimal `json:"volume"` // negative for a short position
+	AvgCost       decimal.Decimal `json:"avg_cost"`
+	CostBasis     decimal.Decimal `json:"cost_basis"`
+	MarketPrice   decimal.Decimal `json:"market_price"`
+	MarketValue   decimal.Decimal `json:"market_value"`
+	UnrealizedPnL decimal.Decimal `json:"unrealized_pnl"`
+	RealizedPnL   decimal.Decimal `json:"realized_pnl"`
+}
+
+// Portfolio is a user's cash and open positions, valued at the current market prices. Equity is the cash plus the
+// market value of the positions.
+type Portfolio struct {
+	CashBalance   decimal.Decimal `json:"cash_balance"`
+	MarketValue   decimal.Decimal `json:"market_value"`
+	Equity        decimal.Decimal `json:"equity"`
+	UnrealizedPnL decimal.Decimal `json:"unrealized_pnl"`
+	RealizedPnL   decimal.Decimal `json:"realized_pnl"` // including the positions that were closed
+	Positions     []Position      `json:"positions"`
+	ValuedAt      time.Time       `json:"valued_at"`
+}
+
+// SymbolPnL is the profit a user made trading a symbol. It's listed for closed positions too.
+type SymbolPnL struct {
+	Symbol        string          `json:"symbol"`
+	RealizedPnL   decimal.Decimal `json:"realized_pnl"`
+	UnrealizedPnL decimal.Decimal `json:"unrealized_pnl"`
+	TotalPnL      decimal.Decimal `json:"total_pnl"`
+}
+
+// EquitySnapshot is a user's equity at the end of a day (UTC). EquityChange is the difference to the previous
+// snapshot listed, deposits and withdrawals included.
+type EquitySnapshot struct {
+	Date          string          `json:"date"` // YYYY-MM-DD
+	CashBalance   decimal.Decimal `json:"cash_balance"`
+	MarketValue   decimal.Decimal `json:"market_value"`
+	Equity        decimal.Decimal `json:"equity"`
+	RealizedPnL   decimal.Decimal `json:"realized_pnl"`
+	UnrealizedPnL decimal.Decimal `json:"unrealized_pnl"`
+	EquityChange  decimal.Decimal `json:"equity_change"`
+}
+
+// PnL is a user's profit and loss now, per symbol, and over the last days.
+type PnL struct {
+	RealizedPnL   decimal.Decimal  `json:"realized_pnl"`
+	UnrealizedPnL decimal.Decimal  `json:"unrealized_pnl"`
+	TotalPnL      decimal.Decimal  `json:"total_pnl"`
+	Symbols       []SymbolPnL      `json:"symbols"`
+	Daily         []EquitySnapshot `json:"daily"` // oldest first
+}
+
+// storedPosition is a row of the positions table, see orderbook.Position.
+type storedPosition struct {
+	Symbol      string
+	Volume      decimal.Decimal
+	AvgCost     decimal.Decimal
+	RealizedPnL decimal.Decimal
+}
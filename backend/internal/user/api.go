@@ -59,7 +59,7 @@ func (api *API) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jwtToken, err := api.jwtService.GenerateToken(user.ID)
+	jwtToken, err := api.jwtService.GenerateToken(user.ID, user.Role, "")
 	if err != nil {
 		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
 	}
@@ -130,15 +130,91 @@ func (api *API) HandleGetUserPrivateInfo(w http.ResponseWriter, r *http.Request)
 	endpoint.WriteWithStatus(w, http.StatusOK, userPrivateInfo)
 }
 
-// RegisterHandlers is a function that registers all the handlers for the user endpoints
-func (api *API) RegisterHandlers(r chi.Router, authHandler func(http.Handler) http.Handler) {
+// HandleVerifyEmail verifies the user's email address with the token from the link mailed to them.
+func (api *API) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input VerifyEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if err := api.userService.VerifyEmail(input); err != nil {
+		writeVerificationErr(w, "HandleVerifyEmail", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: "Email verified"})
+}
+
+// HandleResendVerification mails the user a new verification link.
+func (api *API) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	if err := api.userService.ResendVerification(middleware.UserIDFromContext(r.Context())); err != nil {
+		writeVerificationErr(w, "HandleResendVerification", nil, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusAccepted, models.SuccessResponse{Message: "Verification email sent"})
+}
+
+// HandleRequestPasswordReset mails a password reset link. The response is the same whether or not an account
+// has the email.
+func (api *API) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var input RequestPasswordResetInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if err := api.userService.RequestPasswordReset(input); err != nil {
+		writeVerificationErr(w, "HandleRequestPasswordReset", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusAccepted, models.SuccessResponse{Message: "If an account uses this email, a password reset link was sent to it"})
+}
+
+// HandleResetPassword sets a new password with the token from the link mailed to the user.
+func (api *API) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input ResetPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		endpoint.HandleDecodeErr(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if err := api.userService.ResetPassword(input); err != nil {
+		writeVerificationErr(w, "HandleResetPassword", input, err)
+		return
+	}
+	endpoint.WriteWithStatus(w, http.StatusOK, models.SuccessResponse{Message: "Password reset"})
+}
+
+func writeVerificationErr(w http.ResponseWriter, handler string, input any, err error) {
+	switch {
+	case input != nil && validator.IsValidationError(err):
+		endpoint.WriteValidationErr(w, input, err)
+	case errors.Is(err, ErrVerificationNotFound):
+		endpoint.WriteWithError(w, http.StatusBadRequest, ErrVerificationNotFound.Error())
+	case errors.Is(err, ErrEmailAlreadyVerified):
+		endpoint.WriteWithError(w, http.StatusConflict, ErrEmailAlreadyVerified.Error())
+	case errors.Is(err, ErrUserNotFound):
+		endpoint.WriteWithError(w, http.StatusNotFound, ErrUserNotFound.Error())
+	default:
+		log.Printf("%s: Failed due to internal server error: %v", handler, err)
+		endpoint.WriteWithError(w, http.StatusInternalServerError, ErrMsgInternalServer)
+	}
+}
+
+// RegisterHandlers is a function that registers all the handlers for the user endpoints. The /me routes also
+// accept requests signed with an API key through apiKeyHandler.
+func (api *API) RegisterHandlers(r chi.Router, authHandler, apiKeyHandler func(http.Handler) http.Handler) {
 	r.Route("/users", func(r chi.Router) {
 		r.Post("/", api.HandleCreateUser)
-		r.Group(func(r chi.Router) {
-			r.Use(authHandler)
-			r.Post("/name", api.HandleUpdateUserName)
-			r.Get("/me", api.HandleGetUserFromJWT)
-			r.Get("/me/private", api.HandleGetUserPrivateInfo)
+		r.With(authHandler).Post("/name", api.HandleUpdateUserName)
+		r.Post("/verify-email", api.HandleVerifyEmail)
+		r.Post("/password-reset", api.HandleRequestPasswordReset)
+		r.Post("/password-reset/confirm", api.HandleResetPassword)
+		r.Route("/me", func(r chi.Router) {
+			r.Use(apiKeyHandler)
+			r.Get("/", api.HandleGetUserFromJWT)
+			r.Get("/private", api.HandleGetUserPrivateInfo)
+			r.Post("/verification", api.HandleResendVerification)
 		})
 	})
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github/wry-0313/exchange/internal/models"
 	"log"
+	"time"
 )
 
 var (
@@ -15,14 +16,31 @@ var (
 	ErrUserNameSame         = errors.New("User name is the same")
 )
 
+// privateInfoOrderLimit is the number of recent orders GetUserPrivateInfo returns, the full history is paginated
+// through GET /users/me/orders.
+const privateInfoOrderLimit = 100
+
 type Repository interface {
 	CreateUser(user models.User) error
 
 	GetUser(userID string) (models.User, error)
 	GetUserByEmail(email string) (models.User, error)
 	GetUserPrivateInfo(userID string) (UserPrivateInfo, error)
+	// GetUsers returns up to limit users ordered by ID, starting after the user with ID after.
+	GetUsers(after string, limit int) ([]models.User, error)
 
 	UpdateUserName(userID, name string) error
+	UpdateUserRole(userID string, role models.Role) error
+
+	// CreateVerification stores a verification, using up the user's earlier ones of the same purpose so only the
+	// latest link works.
+	CreateVerification(v Verification) error
+	// VerifyEmail uses up an email verification token and marks the user's email verified. Tokens that don't
+	// exist, expired or were used are reported as ErrVerificationNotFound.
+	VerifyEmail(tokenHash string, now time.Time) (userID string, err error)
+	// ResetPassword uses up a password reset token, see VerifyEmail, and sets the user's password. The user's
+	// refresh tokens are revoked, and their email counts as verified since the token was mailed to it.
+	ResetPassword(tokenHash, passwordHash string, now time.Time) (userID string, err error)
 }
 
 type repository struct {
@@ -45,7 +63,11 @@ func (r *repository) CreateUser(user models.User) error {
 		return ErrEmailExists // Email already exists
 	}
 
-	_, err = r.db.Exec("INSERT INTO users (user_id, name, email, password) VALUES (?, ?, ?, ?)", user.ID, user.Name, user.Email, user.Password)
+	role := user.Role
+	if role == "" {
+		role = models.RoleTrader
+	}
+	_, err = r.db.Exec("INSERT INTO users (user_id, name, email, password, role) VALUES (?, ?, ?, ?, ?)", user.ID, user.Name, user.Email, user.Password, role)
 	if err != nil {
 		return err
 	}
@@ -89,7 +111,8 @@ func (r *repository) GetUserPrivateInfo(userID string) (UserPrivateInfo, error)
 		userPrivateInfo.Holdings = append(userPrivateInfo.Holdings, holding)
 	}
 
-	rows, err = r.db.Query("SELECT symbol, order_id, order_side, order_status, order_type, filled_at, updated_at, total_processed, volume, initial_volume, price FROM orders WHERE user_id = ?", userID)
+	rows, err = r.db.Query(`SELECT symbol, order_id, client_order_id, order_side, order_status, order_type, filled_at, last_filled_at, total_processed, volume, initial_volume, price, created_at, updated_at
+	FROM orders WHERE user_id = ? ORDER BY order_id DESC LIMIT ?`, userID, privateInfoOrderLimit)
 	if err != nil {
 		return UserPrivateInfo{}, fmt.Errorf("repository: failed to get user orders: %w", err)
 	}
@@ -97,7 +120,7 @@ func (r *repository) GetUserPrivateInfo(userID string) (UserPrivateInfo, error)
 
 	for rows.Next() {
 		var order models.Order
-		err := rows.Scan(&order.Symbol, &order.OrderID, &order.OrderSide, &order.OrderStatus, &order.OrderType, &order.FilledAt, &order.FilledAtTime, &order.TotalProcessed, &order.Volume, &order.InitialVolume, &order.Price)
+		err := rows.Scan(&order.Symbol, &order.OrderID, &order.ClientOrderID, &order.OrderSide, &order.OrderStatus, &order.OrderType, &order.FilledAt, &order.FilledAtTime, &order.TotalProcessed, &order.Volume, &order.InitialVolume, &order.Price, &order.CreatedAt, &order.UpdatedAt)
 		if err != nil {
 			return UserPrivateInfo{}, fmt.Errorf("repository: failed to scan user orders: %w", err)
 		}
@@ -110,7 +133,7 @@ func (r *repository) GetUserPrivateInfo(userID string) (UserPrivateInfo, error)
 // GetUserByEmail returns a single user for a given email.
 func (r *repository) GetUserByEmail(email string) (models.User, error) {
 	var user models.User
-	err := r.db.QueryRow("SELECT user_id, name, email, password FROM users WHERE email = ?", email).Scan(&user.ID, &user.Name, &user.Email, &user.Password)
+	err := r.db.QueryRow("SELECT user_id, name, email, password, role, email_verified_at IS NOT NULL FROM users WHERE email = ?", email).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Role, &user.EmailVerified)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.User{}, ErrUserNotFound
@@ -138,7 +161,7 @@ func (r *repository) UpdateUserName(userID, name string) error {
 
 func (r *repository) GetUser(userID string) (models.User, error) {
 	var user models.User
-	err := r.db.QueryRow("SELECT user_id, name, email, password FROM users WHERE user_id = ?", userID).Scan(&user.ID, &user.Name, &user.Email, &user.Password)
+	err := r.db.QueryRow("SELECT user_id, name, email, password, role, email_verified_at IS NOT NULL FROM users WHERE user_id = ?", userID).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Role, &user.EmailVerified)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.User{}, ErrUserNotFound
@@ -147,3 +170,130 @@ func (r *repository) GetUser(userID string) (models.User, error) {
 	}
 	return user, nil
 }
+
+func (r *repository) GetUsers(after string, limit int) ([]models.User, error) {
+	rows, err := r.db.Query("SELECT user_id, name, email, role, email_verified_at IS NOT NULL FROM users WHERE user_id > ? ORDER BY user_id LIMIT ?", after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository: failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified); err != nil {
+			return nil, fmt.Errorf("repository: failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository: failed to get users: %w", err)
+	}
+	return users, nil
+}
+
+func (r *repository) UpdateUserRole(userID string, role models.Role) error {
+	res, err := r.db.Exec("UPDATE users SET role = ? WHERE user_id = ?", role, userID)
+	if err != nil {
+		return fmt.Errorf("repository: failed to update user role: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("repository: failed to update user role: %w", err)
+	}
+	if n == 0 {
+		// MySQL counts changed rows, so also check whether the user exists with the role already
+		if _, err := r.GetUser(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) CreateVerification(v Verification) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE verifications SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL", v.CreatedAt, v.UserID, v.Purpose); err != nil {
+			return fmt.Errorf("repository: failed to use up verifications: %w", err)
+		}
+		_, err := tx.Exec("INSERT INTO verifications (verification_id, user_id, purpose, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			v.ID, v.UserID, v.Purpose, v.TokenHash, v.ExpiresAt, v.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("repository: failed to create verification: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *repository) VerifyEmail(tokenHash string, now time.Time) (string, error) {
+	var userID string
+	err := r.inTx(func(tx *sql.Tx) error {
+		var err error
+		if userID, err = useVerification(tx, tokenHash, PurposeEmail, now); err != nil {
+			return err
+		}
+		return markEmailVerified(tx, userID, now)
+	})
+	return userID, err
+}
+
+func (r *repository) ResetPassword(tokenHash, passwordHash string, now time.Time) (string, error) {
+	var userID string
+	err := r.inTx(func(tx *sql.Tx) error {
+		var err error
+		if userID, err = useVerification(tx, tokenHash, PurposePasswordReset, now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE users SET password = ? WHERE user_id = ?", passwordHash, userID); err != nil {
+			return fmt.Errorf("repository: failed to update password: %w", err)
+		}
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID); err != nil {
+			return fmt.Errorf("repository: failed to revoke refresh tokens: %w", err)
+		}
+		return markEmailVerified(tx, userID, now)
+	})
+	return userID, err
+}
+
+// useVerification marks the verification with the token hash used and returns its user. The row is locked so
+// concurrent requests with the same token can't both use it.
+func useVerification(tx *sql.Tx, tokenHash string, purpose VerificationPurpose, now time.Time) (string, error) {
+	var v Verification
+	err := tx.QueryRow("SELECT verification_id, user_id, expires_at, used_at FROM verifications WHERE token_hash = ? AND purpose = ? FOR UPDATE", tokenHash, purpose).
+		Scan(&v.ID, &v.UserID, &v.ExpiresAt, &v.UsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrVerificationNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("repository: failed to get verification: %w", err)
+	}
+	if v.UsedAt != nil || !now.Before(v.ExpiresAt) {
+		return "", ErrVerificationNotFound
+	}
+	if _, err := tx.Exec("UPDATE verifications SET used_at = ? WHERE verification_id = ?", now, v.ID); err != nil {
+		return "", fmt.Errorf("repository: failed to use verification: %w", err)
+	}
+	return v.UserID, nil
+}
+
+func markEmailVerified(tx *sql.Tx, userID string, now time.Time) error {
+	if _, err := tx.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE user_id = ?", now, userID); err != nil {
+		return fmt.Errorf("repository: failed to mark email verified: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("repository: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("repository: failed to commit transaction: %w", err)
+	}
+	return nil
+}
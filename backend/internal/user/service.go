@@ -1,19 +1,46 @@
 package user
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github/wry-0313/exchange/internal/mail"
 	"github/wry-0313/exchange/internal/models"
 	"github/wry-0313/exchange/pkg/security"
 	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 )
 
+var ErrEmailAlreadyVerified = errors.New("Email is already verified")
+
+const (
+	// verificationTokenBytes is the amount of randomness in a verification token.
+	verificationTokenBytes = 32
+
+	emailVerificationExpiration = 48 * time.Hour
+	passwordResetExpiration     = time.Hour
+)
+
+// SessionRevoker ends a user's sessions by revoking every token issued to them before issuedBefore.
+type SessionRevoker interface {
+	RevokeUser(ctx context.Context, userID string, issuedBefore time.Time) error
+}
+
 type service struct {
 	userRepo  Repository
 	validator validator.Validate
+	mailer    mail.Mailer
+	revoker   SessionRevoker
+	// appURL is the address of the frontend, the mailed links open its verification pages.
+	appURL string
 }
 
 type Service interface {
@@ -21,16 +48,40 @@ type Service interface {
 	UpdateUserName(userID, name string) error
 	GetUser(userID string) (models.User, error)
 	GetUserPrivateInfo(userID string) (UserPrivateInfo, error)
+
+	// VerifyEmail verifies the email address the token was mailed to, a token is only good once.
+	VerifyEmail(input VerifyEmailInput) error
+	// ResendVerification mails the user a new verification link, the earlier ones stop working.
+	ResendVerification(userID string) error
+	// RequestPasswordReset mails a password reset link to the user with the email, if there is one. Unknown
+	// emails aren't reported so that the endpoint can't be used to find out who has an account.
+	RequestPasswordReset(input RequestPasswordResetInput) error
+	// ResetPassword sets the password of the user the token was mailed to and ends their sessions: refresh tokens
+	// are revoked, access tokens issued before are rejected and their WebSocket connections are closed.
+	ResetPassword(input ResetPasswordInput) error
 }
 
-func NewService(userRepo Repository, validator validator.Validate) Service {
+// NewService creates a new instance of the user service. Verification links point to the frontend at appURL.
+func NewService(userRepo Repository, validator validator.Validate, mailer mail.Mailer, revoker SessionRevoker, appURL string) Service {
 	return &service{
 		userRepo:  userRepo,
 		validator: validator,
+		mailer:    mailer,
+		revoker:   revoker,
+		appURL:    appURL,
 	}
 }
 
+// NormalizeEmail returns the form emails are stored and looked up in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (s *service) CreateUser(input CreateUserInput) (models.User, error) {
+	if input.Email != nil {
+		email := NormalizeEmail(*input.Email)
+		input.Email = &email
+	}
 	if err := s.validator.Struct(input); err != nil {
 		return models.User{}, fmt.Errorf("service: validation error: %w", err)
 	}
@@ -39,9 +90,10 @@ func (s *service) CreateUser(input CreateUserInput) (models.User, error) {
 	// id := ulid.Make()
 	name := toNameCase(input.Name)
 	user := models.User{
-		ID:        ulid.Make().String(),
-		Name:      name,
-		Email:     input.Email,
+		ID:    ulid.Make().String(),
+		Name:  name,
+		Email: input.Email,
+		Role:  models.RoleTrader,
 	}
 
 	// Hash the password
@@ -57,6 +109,11 @@ func (s *service) CreateUser(input CreateUserInput) (models.User, error) {
 		return models.User{}, fmt.Errorf("service: failed creating user: %w", err)
 	}
 
+	// A failed email isn't fatal, the user can have the link sent again
+	if err := s.sendVerification(user, PurposeEmail); err != nil {
+		log.Printf("Service: failed to send verification email to user %s: %v", user.ID, err)
+	}
+
 	// Hide password
 	user.Password = nil
 	return user, nil
@@ -109,4 +166,102 @@ func (s *service) GetUserPrivateInfo(userID string) (UserPrivateInfo, error) {
 	}
 
 	return userPrivateInfo, nil
-}
\ No newline at end of file
+}
+
+func (s *service) VerifyEmail(input VerifyEmailInput) error {
+	if err := s.validator.Struct(input); err != nil {
+		return fmt.Errorf("service: validation error: %w", err)
+	}
+	if _, err := s.userRepo.VerifyEmail(security.HashToken(input.Token), time.Now()); err != nil {
+		return fmt.Errorf("service: failed verifying email: %w", err)
+	}
+	return nil
+}
+
+func (s *service) ResendVerification(userID string) error {
+	user, err := s.userRepo.GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("service: failed getting user: %w", err)
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	return s.sendVerification(user, PurposeEmail)
+}
+
+func (s *service) RequestPasswordReset(input RequestPasswordResetInput) error {
+	input.Email = NormalizeEmail(input.Email)
+	if err := s.validator.Struct(input); err != nil {
+		return fmt.Errorf("service: validation error: %w", err)
+	}
+	user, err := s.userRepo.GetUserByEmail(input.Email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("service: failed getting user by email: %w", err)
+	}
+	return s.sendVerification(user, PurposePasswordReset)
+}
+
+func (s *service) ResetPassword(input ResetPasswordInput) error {
+	if err := s.validator.Struct(input); err != nil {
+		return fmt.Errorf("service: validation error: %w", err)
+	}
+	hashedPassword, err := security.HashPassword(input.Password)
+	if err != nil {
+		return fmt.Errorf("service: hashing password: %w", err)
+	}
+	now := time.Now()
+	userID, err := s.userRepo.ResetPassword(security.HashToken(input.Token), hashedPassword, now)
+	if err != nil {
+		return fmt.Errorf("service: failed resetting password: %w", err)
+	}
+	log.Printf("Password of user %s was reset", userID)
+	if err := s.revoker.RevokeUser(context.Background(), userID, now); err != nil {
+		return fmt.Errorf("service: failed ending sessions: %w", err)
+	}
+	return nil
+}
+
+// sendVerification stores a new verification token of purpose for the user and mails them the link to use it.
+func (s *service) sendVerification(user models.User, purpose VerificationPurpose) error {
+	if user.Email == nil {
+		return fmt.Errorf("service: user %s does not have an email", user.ID)
+	}
+	b := make([]byte, verificationTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("service: failed to generate verification token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	v := Verification{
+		ID:        ulid.Make().String(),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: security.HashToken(token),
+		CreatedAt: now,
+	}
+	msg := mail.Message{To: *user.Email}
+	switch purpose {
+	case PurposeEmail:
+		v.ExpiresAt = now.Add(emailVerificationExpiration)
+		msg.Subject = "Verify your email address"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nOpen this link to verify your email address, it expires in %d hours:\n\n%s/verify-email?token=%s\n",
+			user.Name, int(emailVerificationExpiration.Hours()), s.appURL, url.QueryEscape(token))
+	case PurposePasswordReset:
+		v.ExpiresAt = now.Add(passwordResetExpiration)
+		msg.Subject = "Reset your password"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nOpen this link to choose a new password, it expires in %d minutes:\n\n%s/reset-password?token=%s\n\nIf you didn't ask to reset your password, you can ignore this email.\n",
+			user.Name, int(passwordResetExpiration.Minutes()), s.appURL, url.QueryEscape(token))
+	}
+
+	if err := s.userRepo.CreateVerification(v); err != nil {
+		return fmt.Errorf("service: failed creating verification: %w", err)
+	}
+	if err := s.mailer.Send(context.Background(), msg); err != nil {
+		return fmt.Errorf("service: failed sending %s email: %w", purpose, err)
+	}
+	return nil
+}
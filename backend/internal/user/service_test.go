@@ -0,0 +1,192 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github/wry-0313/exchange/internal/mail"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/pkg/validator"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// memRepository keeps users and verifications in memory.
+type memRepository struct {
+	Repository
+	users         map[string]models.User
+	verifications map[string]Verification // by token hash
+}
+
+func newMemRepository() *memRepository {
+	return &memRepository{users: map[string]models.User{}, verifications: map[string]Verification{}}
+}
+
+func (r *memRepository) CreateUser(user models.User) error {
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *memRepository) GetUser(userID string) (models.User, error) {
+	u, ok := r.users[userID]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (r *memRepository) GetUserByEmail(email string) (models.User, error) {
+	for _, u := range r.users {
+		if *u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, ErrUserNotFound
+}
+
+func (r *memRepository) CreateVerification(v Verification) error {
+	for hash, other := range r.verifications {
+		if other.UserID == v.UserID && other.Purpose == v.Purpose && other.UsedAt == nil {
+			other.UsedAt = &v.CreatedAt
+			r.verifications[hash] = other
+		}
+	}
+	r.verifications[v.TokenHash] = v
+	return nil
+}
+
+func (r *memRepository) use(tokenHash string, purpose VerificationPurpose, now time.Time) (string, error) {
+	v, ok := r.verifications[tokenHash]
+	if !ok || v.Purpose != purpose || v.UsedAt != nil || !now.Before(v.ExpiresAt) {
+		return "", ErrVerificationNotFound
+	}
+	v.UsedAt = &now
+	r.verifications[tokenHash] = v
+	u := r.users[v.UserID]
+	u.EmailVerified = true
+	r.users[v.UserID] = u
+	return v.UserID, nil
+}
+
+func (r *memRepository) VerifyEmail(tokenHash string, now time.Time) (string, error) {
+	return r.use(tokenHash, PurposeEmail, now)
+}
+
+func (r *memRepository) ResetPassword(tokenHash, passwordHash string, now time.Time) (string, error) {
+	userID, err := r.use(tokenHash, PurposePasswordReset, now)
+	if err != nil {
+		return "", err
+	}
+	u := r.users[userID]
+	u.Password = &passwordHash
+	r.users[userID] = u
+	return userID, nil
+}
+
+// memRevoker records when each user's sessions were ended.
+type memRevoker map[string]time.Time
+
+func (m memRevoker) RevokeUser(ctx context.Context, userID string, issuedBefore time.Time) error {
+	m[userID] = issuedBefore
+	return nil
+}
+
+var tokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+// lastToken returns the token of the link in the last email sent.
+func lastToken(t *testing.T, mailer *mail.Memory) string {
+	t.Helper()
+	msgs := mailer.Messages()
+	if len(msgs) == 0 {
+		t.Fatal("no email was sent")
+	}
+	m := tokenPattern.FindStringSubmatch(msgs[len(msgs)-1].Body)
+	if m == nil {
+		t.Fatalf("email has no link with a token: %q", msgs[len(msgs)-1].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestEmailVerification(t *testing.T) {
+	repo, mailer := newMemRepository(), mail.NewMemory()
+	s := NewService(repo, validator.New(), mailer, memRevoker{}, "http://localhost:3000")
+
+	email, password := " Alice@Example.com", "password123"
+	u, err := s.CreateUser(CreateUserInput{Name: "alice", Email: &email, Password: &password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *u.Email != "alice@example.com" {
+		t.Errorf("email stored as %q, want it normalized", *u.Email)
+	}
+	if u.EmailVerified {
+		t.Error("new user is verified")
+	}
+	first := lastToken(t, mailer)
+
+	// Resending replaces the first link
+	if err := s.ResendVerification(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	second := lastToken(t, mailer)
+	if err := s.VerifyEmail(VerifyEmailInput{Token: first}); !errors.Is(err, ErrVerificationNotFound) {
+		t.Fatalf("replaced token: got %v, want ErrVerificationNotFound", err)
+	}
+	if err := s.VerifyEmail(VerifyEmailInput{Token: second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyEmail(VerifyEmailInput{Token: second}); !errors.Is(err, ErrVerificationNotFound) {
+		t.Fatalf("used token: got %v, want ErrVerificationNotFound", err)
+	}
+	if got, _ := s.GetUser(u.ID); !got.EmailVerified {
+		t.Error("user is not verified")
+	}
+	if err := s.ResendVerification(u.ID); !errors.Is(err, ErrEmailAlreadyVerified) {
+		t.Errorf("resend once verified: got %v, want ErrEmailAlreadyVerified", err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	repo, mailer, revoker := newMemRepository(), mail.NewMemory(), memRevoker{}
+	s := NewService(repo, validator.New(), mailer, revoker, "http://localhost:3000")
+
+	email, password := "bob@example.com", "password123"
+	u, err := s.CreateUser(CreateUserInput{Name: "bob", Email: &email, Password: &password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := *repo.users[u.ID].Password
+	sent := len(mailer.Messages())
+
+	if err := s.RequestPasswordReset(RequestPasswordResetInput{Email: "nobody@example.com"}); err != nil {
+		t.Fatalf("unknown email: got %v, want no error", err)
+	}
+	if len(mailer.Messages()) != sent {
+		t.Fatal("email sent for an unknown address")
+	}
+
+	if err := s.RequestPasswordReset(RequestPasswordResetInput{Email: "BOB@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	token := lastToken(t, mailer)
+	if err := s.VerifyEmail(VerifyEmailInput{Token: token}); !errors.Is(err, ErrVerificationNotFound) {
+		t.Fatalf("reset token used as email verification: got %v, want ErrVerificationNotFound", err)
+	}
+	if err := s.ResetPassword(ResetPasswordInput{Token: token, Password: "new-password"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetPassword(ResetPasswordInput{Token: token, Password: "other-password"}); !errors.Is(err, ErrVerificationNotFound) {
+		t.Fatalf("used token: got %v, want ErrVerificationNotFound", err)
+	}
+	if got := repo.users[u.ID]; *got.Password == before {
+		t.Error("password was not changed")
+	}
+	if _, ok := revoker[u.ID]; !ok {
+		t.Error("sessions were not ended")
+	}
+}
@@ -1,11 +1,14 @@
 package user
 
-import "github/wry-0313/exchange/internal/models"
+import (
+	"github/wry-0313/exchange/internal/models"
+	"time"
+)
 
 // CreateUserInput defines the structure for requests to create a new user.
 type CreateUserInput struct {
 	Name     string  `json:"name" validate:"required,min=2,max=24"`
-	Email    *string `json:"email" validate:"email,required"`
+	Email    *string `json:"email" validate:"required,email,max=255"`
 	Password *string `json:"password" validate:"min=8"`
 }
 
@@ -19,8 +22,44 @@ type CreateUserDTO struct {
 	JwtToken string      `json:"jwt_token"`
 }
 
+// UserPrivateInfo is a user's cash, holdings and most recent orders, newest first.
 type UserPrivateInfo struct {
 	CashBalance float64          `json:"cash_balance"`
 	Holdings    []models.Holding `json:"holdings"`
 	Orders      []models.Order   `json:"orders"`
 }
+
+// VerificationPurpose is what a verification token proves when it is used.
+type VerificationPurpose string
+
+const (
+	PurposeEmail         VerificationPurpose = "email"
+	PurposePasswordReset VerificationPurpose = "password_reset"
+)
+
+// Verification is a single-use token mailed to a user. Only the SHA-256 hash of the token is kept.
+type Verification struct {
+	ID        string
+	UserID    string
+	Purpose   VerificationPurpose
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+// VerifyEmailInput defines the structure for requests to verify an email address with the mailed token.
+type VerifyEmailInput struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// RequestPasswordResetInput defines the structure for requests to mail a password reset link.
+type RequestPasswordResetInput struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+// ResetPasswordInput defines the structure for requests to set a new password with the mailed token.
+type ResetPasswordInput struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
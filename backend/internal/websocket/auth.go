@@ -0,0 +1,181 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"github/wry-0313/exchange/internal/jwt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SubprotocolTokenPrefix lets browsers, which can't set headers on a WebSocket, send their token as a
+	// subprotocol, "exchange.token.<jwt>". It is never selected, so such clients must also offer SubprotocolJSON or
+	// SubprotocolBinary.
+	SubprotocolTokenPrefix = "exchange.token."
+
+	// queryToken is the query parameter a token can be passed in instead.
+	queryToken = "token"
+)
+
+var errTokenUserChanged = errors.New("ws: token belongs to another user")
+
+// ParamsAuth are the params of EventAuth.
+type ParamsAuth struct {
+	Token string `json:"token"`
+}
+
+// AuthResult acknowledges EventAuth.
+type AuthResult struct {
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AuthResponse struct {
+	ResponseBase
+	Result AuthResult `json:"result"`
+}
+
+// requestToken returns the token a handshake carries in the Authorization header, the token query parameter or a
+// token subprotocol, in that order.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if token := r.URL.Query().Get(queryToken); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, SubprotocolTokenPrefix); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// originChecker allows handshakes from the allowed origins, matched case insensitively, and handshakes without
+// an Origin header, which don't come from a browser.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	allowAll := false
+	origins := map[string]bool{}
+	for _, origin := range allowed {
+		if origin == "*" {
+			allowAll = true
+		}
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowAll {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+	}
+}
+
+// user returns the ID of the connection's user, empty while the connection is anonymous.
+func (c *Client) user() string {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.userID
+}
+
+// canTrade reports whether the connection's user may place, cancel and amend orders.
+func (c *Client) canTrade() bool {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.role.CanTrade()
+}
+
+// authenticate sets the connection's user from verified token claims and closes the connection once the token
+// expires, unless a later token extends the session. It returns true when the connection was anonymous before.
+// A token of another user than the connection's is refused.
+func (c *Client) authenticate(claims jwt.Claims) (bool, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.userID != "" && c.userID != claims.UserID {
+		return false, errTokenUserChanged
+	}
+
+	first := c.userID == ""
+	c.userID = claims.UserID
+	c.role = claims.Role
+	c.claims = claims
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.expiry = time.AfterFunc(time.Until(claims.ExpiresAt), func() {
+		closeConnection(c, websocket.ClosePolicyViolation, CloseReasonTokenExpired)
+		c.conn.Close()
+	})
+	return first, nil
+}
+
+// revokedBy reports whether the token the connection authenticated with was revoked by rev.
+func (c *Client) revokedBy(rev jwt.Revocation) bool {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.userID != "" && rev.Matches(c.claims)
+}
+
+// stopExpiry stops the token expiry timer once the connection is closed.
+func (c *Client) stopExpiry() {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+}
+
+// subscribeUser subscribes an authenticated connection to its user's notifications, such as rejected orders.
+func (c *Client) subscribeUser() {
+	sub := Subscription{Stream: EventStreamUserPrivateInfo, Encoding: EncodingJSON}
+	if err := c.subscribe(context.Background(), []Subscription{sub}); err != nil {
+		log.Printf("handler: failed to subscribe to user channel: %v", err)
+	}
+}
+
+// handleAuth authenticates the connection, or extends its session with a fresh token before the current one
+// expires. An invalid token closes the connection.
+func handleAuth(c *Client, msgReq Request) {
+	var params ParamsAuth
+	if err := UnmarshalParams(msgReq, &params, c); err != nil {
+		return
+	}
+
+	claims, err := c.ws.jwtService.VerifyTokenClaims(params.Token)
+	if err != nil {
+		log.Printf("handler: issue verifying jwt token: %v", err)
+		closeUnauthorized(c)
+		return
+	}
+	first, err := c.authenticate(claims)
+	if err != nil {
+		closeUnauthorized(c)
+		return
+	}
+	if first {
+		c.subscribeUser()
+	}
+
+	msgRes := AuthResponse{
+		ResponseBase: ResponseBase{ID: msgReq.ID, Event: msgReq.Event, Success: true},
+		Result:       AuthResult{UserID: claims.UserID, ExpiresAt: claims.ExpiresAt},
+	}
+	sendResponse(c, msgRes, "handleAuth")
+}
+
+// closeUnauthorized closes a connection that sent an invalid token or a private request without one.
+func closeUnauthorized(c *Client) {
+	closeConnection(c, websocket.ClosePolicyViolation, CloseReasonUnauthorized)
+	c.conn.Close()
+}
@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"errors"
+	"github/wry-0313/exchange/internal/jwt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginChecker(t *testing.T) {
+	check := originChecker([]string{"http://localhost:3000", "https://Exchange.example/"})
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:3000", true},
+		{"https://exchange.example", true},
+		{"http://exchange.example", false},
+		{"http://localhost:3001", false},
+		{"https://evil.example", false},
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := check(r); got != tc.want {
+			t.Errorf("origin %q: allowed = %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Origin", "https://anywhere.example")
+	if !originChecker([]string{"*"})(r) {
+		t.Error("* should allow any origin")
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer header-token")
+	if got := requestToken(r); got != "header-token" {
+		t.Errorf("header: token = %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "/ws?token=query-token", nil)
+	if got := requestToken(r); got != "query-token" {
+		t.Errorf("query: token = %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", SubprotocolJSON+", "+SubprotocolTokenPrefix+"a.b.c")
+	if got := requestToken(r); got != "a.b.c" {
+		t.Errorf("subprotocol: token = %q", got)
+	}
+
+	if got := requestToken(httptest.NewRequest("GET", "/ws", nil)); got != "" {
+		t.Errorf("none: token = %q", got)
+	}
+}
+
+func TestAuthenticateKeepsTheUser(t *testing.T) {
+	c := &Client{}
+	defer c.stopExpiry()
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, err := c.authenticate(jwt.Claims{UserID: "user-1", ExpiresAt: expiresAt})
+	if err != nil || !first {
+		t.Fatalf("authenticate = %v, %v, want true, nil", first, err)
+	}
+	first, err = c.authenticate(jwt.Claims{UserID: "user-1", ExpiresAt: expiresAt.Add(time.Hour)})
+	if err != nil || first {
+		t.Fatalf("refreshing: authenticate = %v, %v, want false, nil", first, err)
+	}
+	if _, err := c.authenticate(jwt.Claims{UserID: "user-2", ExpiresAt: expiresAt}); !errors.Is(err, errTokenUserChanged) {
+		t.Fatalf("other user: err = %v, want errTokenUserChanged", err)
+	}
+	if c.user() != "user-1" {
+		t.Fatalf("user = %q, want user-1", c.user())
+	}
+}
+
+func TestRevocationClosesTheUsersOlderSessions(t *testing.T) {
+	ws := &WebSocket{clients: map[*Client]struct{}{}}
+	now := time.Now()
+	connect := func(userID string, issuedAt time.Time) *Client {
+		c := &Client{ws: ws}
+		t.Cleanup(c.stopExpiry)
+		if _, err := c.authenticate(jwt.Claims{UserID: userID, IssuedAt: issuedAt, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		ws.clients[c] = struct{}{}
+		return c
+	}
+	old := connect("user-1", now.Add(-time.Minute))
+	connect("user-1", now.Add(time.Second)) // logged in again after the reset
+	connect("user-2", now.Add(-time.Minute))
+	ws.clients[&Client{ws: ws}] = struct{}{} // anonymous
+
+	revoked := ws.revokedClients(jwt.Revocation{UserID: "user-1", IssuedBefore: now})
+	if len(revoked) != 1 || revoked[0] != old {
+		t.Fatalf("revoked %d connections, want only the older one of user-1", len(revoked))
+	}
+}
+
+func TestLogoutClosesTheTokensSessions(t *testing.T) {
+	ws := &WebSocket{clients: map[*Client]struct{}{}}
+	connect := func(tokenID, sessionID string) *Client {
+		c := &Client{ws: ws}
+		t.Cleanup(c.stopExpiry)
+		if _, err := c.authenticate(jwt.Claims{ID: tokenID, UserID: "user-1", SessionID: sessionID, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		ws.clients[c] = struct{}{}
+		return c
+	}
+	loggedOut := connect("token-1", "session-1")
+	refreshed := connect("token-2", "session-1")
+	other := connect("token-3", "session-2")
+
+	if revoked := ws.revokedClients(jwt.Revocation{UserID: "user-1", TokenID: "token-1"}); len(revoked) != 1 || revoked[0] != loggedOut {
+		t.Fatalf("revoking a token closed %d connections, want only the one authenticated with it", len(revoked))
+	}
+	revoked := ws.revokedClients(jwt.Revocation{UserID: "user-1", SessionID: "session-1"})
+	if len(revoked) != 2 || (revoked[0] != refreshed && revoked[1] != refreshed) {
+		t.Fatalf("revoking a session closed %d connections, want the two of session-1", len(revoked))
+	}
+	for _, c := range revoked {
+		if c == other {
+			t.Fatal("revoking a session closed a connection of another session")
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/wry-0313/exchange/internal/orderbook"
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Binary market data encoding
+//
+// Market data can be streamed as binary frames instead of JSON, either for the whole connection by negotiating the
+// SubprotocolBinary subprotocol or per stream with "encoding": "binary" in the stream request. Every message starts
+// with a header of a uint16 template ID and a uint16 schema version, followed by the template's fields in order.
+// Integers are little endian. Strings are a uint8 length followed by the bytes. Decimals are an int64 mantissa
+// followed by an int8 base 10 exponent, so prices and sizes are carried exactly. Times are int64 unix nanoseconds,
+// zero when unset.
+//
+// TemplateSymbolInfo, an exchange.stream_info update:
+//
+//	symbol string, price decimal, best_bid decimal, best_ask decimal,
+//	candle: interval string, recorded_at time, open decimal, high decimal, low decimal, close decimal,
+//	        volume decimal, trade_count uint32, bid_volume decimal, ask_volume decimal, new_candle uint8,
+//	ticker: last_price decimal, last_size decimal, spread decimal, open_24h decimal, high_24h decimal,
+//	        low_24h decimal, change_24h decimal, change_percent_24h decimal, volume_24h decimal,
+//	        quote_volume_24h decimal, trade_count_24h uint32, vwap_24h decimal, last_trade_at time
+//
+// TemplateL3Events, a batch of exchange.stream_l3 events:
+//
+//	count uint16, then count times:
+//	sequence uint64, type uint8, order_id uint64, side uint8, price decimal, size decimal,
+//	executed_size decimal, timestamp int64
+//
+// Other messages, such as errors and user notifications, are always sent as JSON text frames.
+
+type Encoding string
+
+const (
+	EncodingJSON   Encoding = "json"
+	EncodingBinary Encoding = "binary"
+
+	// SubprotocolBinary selects the binary encoding for every stream of the connection.
+	SubprotocolBinary = "exchange.binary.v1"
+
+	// SubprotocolJSON selects JSON, the encoding of connections without a subprotocol.
+	SubprotocolJSON = "exchange.json.v1"
+
+	BinarySchemaVersion uint16 = 1
+
+	TemplateSymbolInfo uint16 = 1
+	TemplateL3Events   uint16 = 2
+)
+
+// L3 event types and sides as encoded in TemplateL3Events.
+var (
+	l3TypeCodes = map[string]uint8{orderbook.L3Add: 1, orderbook.L3Modify: 2, orderbook.L3Delete: 3, orderbook.L3Execute: 4}
+	l3SideCodes = map[string]uint8{"Buy": 1, "Sell": 2}
+)
+
+var ErrNotMarketData = errors.New("ws: message has no binary encoding")
+
+// encodeBinary transcodes a JSON market data message as published on Redis. It returns ErrNotMarketData for
+// messages that are sent as JSON in every encoding.
+func encodeBinary(payload []byte) ([]byte, error) {
+	var head orderbook.RedisPubMsgBase
+	if err := json.Unmarshal(payload, &head); err != nil {
+		return nil, fmt.Errorf("ws: failed to decode message: %w", err)
+	}
+	if !head.Success {
+		return nil, ErrNotMarketData
+	}
+
+	w := &binaryWriter{}
+	switch head.Event {
+	case orderbook.EventStreamSymbolInfo:
+		var msg orderbook.SymbolInfoPubMsg
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, fmt.Errorf("ws: failed to decode symbol info: %w", err)
+		}
+		w.header(TemplateSymbolInfo)
+		w.symbolInfo(msg.Result)
+	case orderbook.EventStreamL3:
+		var msg orderbook.L3PubMsg
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, fmt.Errorf("ws: failed to decode L3 events: %w", err)
+		}
+		if len(msg.Result) > math.MaxUint16 {
+			return nil, fmt.Errorf("ws: too many L3 events in one message: %d", len(msg.Result))
+		}
+		w.header(TemplateL3Events)
+		w.u16(uint16(len(msg.Result)))
+		for _, e := range msg.Result {
+			w.l3Event(e)
+		}
+	default:
+		return nil, ErrNotMarketData
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+type binaryWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (w *binaryWriter) header(template uint16) {
+	w.u16(template)
+	w.u16(BinarySchemaVersion)
+}
+
+func (w *binaryWriter) u8(v uint8) { w.buf.WriteByte(v) }
+
+func (w *binaryWriter) u16(v uint16) { w.buf.Write(binary.LittleEndian.AppendUint16(nil, v)) }
+
+func (w *binaryWriter) u32(v uint32) { w.buf.Write(binary.LittleEndian.AppendUint32(nil, v)) }
+
+func (w *binaryWriter) u64(v uint64) { w.buf.Write(binary.LittleEndian.AppendUint64(nil, v)) }
+
+func (w *binaryWriter) str(s string) {
+	if len(s) > math.MaxUint8 {
+		w.fail(fmt.Errorf("ws: string too long to encode: %d bytes", len(s)))
+		return
+	}
+	w.u8(uint8(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *binaryWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.u64(0)
+		return
+	}
+	w.u64(uint64(t.UnixNano()))
+}
+
+func (w *binaryWriter) decimal(d decimal.Decimal) {
+	coefficient, exponent := d.Coefficient(), d.Exponent()
+	if !coefficient.IsInt64() || exponent < math.MinInt8 || exponent > math.MaxInt8 {
+		w.fail(fmt.Errorf("ws: decimal out of range: %s", d))
+		return
+	}
+	w.u64(uint64(coefficient.Int64()))
+	w.u8(uint8(int8(exponent)))
+}
+
+// float encodes a float64 as the shortest decimal that parses back to it.
+func (w *binaryWriter) float(f float64) {
+	w.decimal(decimal.NewFromFloat(f))
+}
+
+func (w *binaryWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *binaryWriter) symbolInfo(info orderbook.SymbolInfoResponse) {
+	w.str(info.Symbol)
+	w.float(info.Price)
+	w.float(info.BestBid)
+	w.float(info.BestAsk)
+
+	c := info.CandleData
+	w.str(c.Interval)
+	w.time(c.RecordedAt)
+	w.decimal(c.Open)
+	w.decimal(c.High)
+	w.decimal(c.Low)
+	w.decimal(c.Close)
+	w.float(c.Volume)
+	w.u32(uint32(c.TradeCount))
+	w.float(c.BidVolume)
+	w.float(c.AskVolume)
+	if c.NewCandle {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+
+	t := info.Ticker
+	w.float(t.LastPrice)
+	w.float(t.LastSize)
+	w.float(t.Spread)
+	w.float(t.Open24h)
+	w.float(t.High24h)
+	w.float(t.Low24h)
+	w.float(t.Change24h)
+	w.float(t.ChangePercent24h)
+	w.float(t.Volume24h)
+	w.float(t.QuoteVolume24h)
+	w.u32(uint32(t.TradeCount24h))
+	w.float(t.VWAP24h)
+	w.time(t.LastTradeAt)
+}
+
+func (w *binaryWriter) l3Event(e orderbook.L3Event) {
+	w.u64(e.Sequence)
+	w.u8(l3TypeCodes[e.Type])
+	w.u64(e.OrderID)
+	w.u8(l3SideCodes[e.Side])
+	w.float(e.Price)
+	w.float(e.Size)
+	w.float(e.ExecutedSize)
+	w.u64(uint64(e.Timestamp))
+}
+
+// DecodeHeader returns the template ID and schema version of a binary message.
+func DecodeHeader(data []byte) (template, version uint16, err error) {
+	r := &binaryReader{data: data}
+	template, version = r.u16(), r.u16()
+	return template, version, r.err
+}
+
+// DecodeSymbolInfo decodes a TemplateSymbolInfo message. Values come back as the nearest float64, as in the JSON
+// encoding.
+func DecodeSymbolInfo(data []byte) (orderbook.SymbolInfoResponse, error) {
+	var info orderbook.SymbolInfoResponse
+	r := &binaryReader{data: data}
+	r.header(TemplateSymbolInfo)
+
+	info.Symbol = r.str()
+	info.Price = r.float()
+	info.BestBid = r.float()
+	info.BestAsk = r.float()
+
+	c := &info.CandleData
+	c.Interval = r.str()
+	c.RecordedAt = r.time()
+	c.Open = r.decimal()
+	c.High = r.decimal()
+	c.Low = r.decimal()
+	c.Close = r.decimal()
+	c.Volume = r.float()
+	c.TradeCount = int(r.u32())
+	c.BidVolume = r.float()
+	c.AskVolume = r.float()
+	c.NewCandle = r.u8() == 1
+
+	t := &info.Ticker
+	t.Symbol = info.Symbol
+	t.BestBid = info.BestBid
+	t.BestAsk = info.BestAsk
+	t.LastPrice = r.float()
+	t.LastSize = r.float()
+	t.Spread = r.float()
+	t.Open24h = r.float()
+	t.High24h = r.float()
+	t.Low24h = r.float()
+	t.Change24h = r.float()
+	t.ChangePercent24h = r.float()
+	t.Volume24h = r.float()
+	t.QuoteVolume24h = r.float()
+	t.TradeCount24h = int(r.u32())
+	t.VWAP24h = r.float()
+	t.LastTradeAt = r.time()
+
+	return info, r.done()
+}
+
+// DecodeL3Events decodes a TemplateL3Events message.
+func DecodeL3Events(data []byte) ([]orderbook.L3Event, error) {
+	r := &binaryReader{data: data}
+	r.header(TemplateL3Events)
+
+	n := int(r.u16())
+	events := make([]orderbook.L3Event, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		var e orderbook.L3Event
+		e.Sequence = r.u64()
+		e.Type = codeName(l3TypeCodes, r.u8())
+		e.OrderID = r.u64()
+		e.Side = codeName(l3SideCodes, r.u8())
+		e.Price = r.float()
+		e.Size = r.float()
+		e.ExecutedSize = r.float()
+		e.Timestamp = int64(r.u64())
+		events = append(events, e)
+	}
+	return events, r.done()
+}
+
+func codeName(codes map[string]uint8, code uint8) string {
+	for name, c := range codes {
+		if c == code {
+			return name
+		}
+	}
+	return ""
+}
+
+var errShortMessage = errors.New("ws: binary message is too short")
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errShortMessage
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) header(template uint16) {
+	got, version := r.u16(), r.u16()
+	if r.err != nil {
+		return
+	}
+	if got != template || version != BinarySchemaVersion {
+		r.err = fmt.Errorf("ws: unexpected template %d version %d", got, version)
+	}
+}
+
+// done reports the first decoding error, or an error if bytes are left over.
+func (r *binaryReader) done() error {
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("ws: %d trailing bytes in binary message", len(r.data))
+	}
+	return r.err
+}
+
+func (r *binaryReader) u8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *binaryReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) u64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) str() string {
+	return string(r.next(int(r.u8())))
+}
+
+func (r *binaryReader) time() time.Time {
+	ns := int64(r.u64())
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+func (r *binaryReader) decimal() decimal.Decimal {
+	mantissa := int64(r.u64())
+	exponent := int8(r.u8())
+	return decimal.New(mantissa, int32(exponent))
+}
+
+func (r *binaryReader) float() float64 {
+	return r.decimal().InexactFloat64()
+}
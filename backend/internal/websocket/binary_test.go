@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestBinarySymbolInfoRoundTrip(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	info := orderbook.SymbolInfoResponse{
+		Symbol:  "AAPL",
+		BestBid: 101.25,
+		BestAsk: 101.3,
+		Price:   101.27,
+		CandleData: orderbook.CandleData{
+			StockPriceHistory: models.StockPriceHistory{
+				PriceData: models.PriceData{
+					Open:  decimal.RequireFromString("100.1"),
+					Close: decimal.RequireFromString("101.27"),
+					High:  decimal.RequireFromString("102"),
+					Low:   decimal.RequireFromString("99.99"),
+				},
+				Interval:   "1s",
+				Volume:     12.5,
+				TradeCount: 3,
+				BidVolume:  10,
+				AskVolume:  2.5,
+				RecordedAt: at,
+			},
+			NewCandle: true,
+		},
+		Ticker: orderbook.Ticker{
+			Symbol:           "AAPL",
+			LastPrice:        101.27,
+			LastSize:         0.01,
+			BestBid:          101.25,
+			BestAsk:          101.3,
+			Spread:           0.05,
+			Open24h:          95,
+			High24h:          102,
+			Low24h:           94.5,
+			Change24h:        6.27,
+			ChangePercent24h: 6.6,
+			Volume24h:        1234.56,
+			QuoteVolume24h:   123456.78,
+			TradeCount24h:    42,
+			VWAP24h:          100.01,
+			LastTradeAt:      at,
+		},
+	}
+	payload, err := json.Marshal(orderbook.SymbolInfoPubMsg{
+		RedisPubMsgBase: orderbook.RedisPubMsgBase{Event: orderbook.EventStreamSymbolInfo, Success: true},
+		Result:          info,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeBinary(payload)
+	if err != nil {
+		t.Fatalf("encodeBinary: %v", err)
+	}
+	if template, _, _ := DecodeHeader(data); template != TemplateSymbolInfo {
+		t.Fatalf("template = %d, want %d", template, TemplateSymbolInfo)
+	}
+	got, err := DecodeSymbolInfo(data)
+	if err != nil {
+		t.Fatalf("DecodeSymbolInfo: %v", err)
+	}
+	// Decimals compare by value, the JSON round trip in between changes their representation
+	for _, pair := range [][2]decimal.Decimal{{got.Open, info.Open}, {got.Close, info.Close}, {got.High, info.High}, {got.Low, info.Low}} {
+		if !pair[0].Equal(pair[1]) {
+			t.Errorf("decimal = %s, want %s", pair[0], pair[1])
+		}
+	}
+	got.PriceData, info.PriceData = models.PriceData{}, models.PriceData{}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("DecodeSymbolInfo = %+v, want %+v", got, info)
+	}
+}
+
+func TestBinaryL3RoundTrip(t *testing.T) {
+	events := []orderbook.L3Event{
+		{Sequence: 7, Type: orderbook.L3Add, OrderID: 3, Side: "Buy", Price: 100.05, Size: 1.5, Timestamp: 1700000000000000001},
+		{Sequence: 8, Type: orderbook.L3Execute, OrderID: 3, Side: "Buy", Price: 100.05, Size: 0.5, ExecutedSize: 1, Timestamp: 1700000000000000002},
+	}
+	payload, err := json.Marshal(orderbook.L3PubMsg{
+		RedisPubMsgBase: orderbook.RedisPubMsgBase{Event: orderbook.EventStreamL3, Success: true},
+		Result:          events,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeBinary(payload)
+	if err != nil {
+		t.Fatalf("encodeBinary: %v", err)
+	}
+	got, err := DecodeL3Events(data)
+	if err != nil {
+		t.Fatalf("DecodeL3Events: %v", err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("DecodeL3Events = %+v, want %+v", got, events)
+	}
+}
+
+func TestBinaryLeavesOtherMessagesAsJSON(t *testing.T) {
+	_, err := encodeBinary([]byte(`{"event":"exchange.order_rejected","success":true}`))
+	if !errors.Is(err, ErrNotMarketData) {
+		t.Errorf("encodeBinary error = %v, want ErrNotMarketData", err)
+	}
+}
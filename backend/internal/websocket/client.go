@@ -3,9 +3,14 @@ package ws
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	// "github/wry-0313/exchange/internal/models"
+	"errors"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/jwt"
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -25,16 +30,41 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Large enough for a subscribe request with a few hundred symbols.
+	maxMessageSize = 8192
+
+	// Maximum number of order requests of a connection waiting for the engine at once.
+	maxPendingOrders = 16
 )
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
+	// Guards userID, role, claims and expiry, which change when the client authenticates.
+	authMu sync.Mutex
+
+	// The connection's user, empty while it is anonymous.
 	userID string
 
-	// A map of subscriptions that the client has. Each value is a cancel channel to close the subscription.
-	subscriptions map[string]chan bool
+	// The role of the connection's user, from their token.
+	role models.Role
+
+	// The claims of the token the connection last authenticated with, checked against revocations.
+	claims jwt.Claims
+
+	// Closes the connection once the user's token expires.
+	expiry *time.Timer
+
+	// Guards subscriptions and closed.
+	subsMu sync.Mutex
+
+	// The client's subscriptions keyed by Redis channel. The hub delivers the channels' messages.
+	subscriptions map[string]Subscription
+
+	// Set once the connection is closed, later subscribes fail.
+	closed bool
+
+	// Disconnects the client once its send buffer is full.
+	slowOnce sync.Once
 
 	// Websocket dependencies.
 	ws *WebSocket
@@ -43,7 +73,20 @@ type Client struct {
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outbound
+
+	// Holds a slot for every order request waiting for the engine, bounding the goroutines a connection starts.
+	orderSlots chan struct{}
+
+	// The encoding of market data streams that don't ask for one, set from the negotiated subprotocol.
+	encoding Encoding
+}
+
+// outbound is a message queued for the client. Text messages are batched into one frame, each binary message is
+// sent as its own frame.
+type outbound struct {
+	data   []byte
+	binary bool
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -53,6 +96,8 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
+		c.ws.unregister(c)
+		c.stopExpiry()
 		c.closeSubscriptions()
 		c.conn.Close()
 	}()
@@ -103,26 +148,13 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			if _, err := w.Write(message); err != nil {
-				log.Printf("Failed to set write message: %v", err)
-			}
-
-			// Add queued messages to the current websocket message.
+			// Write queued messages along with this one.
+			messages := []outbound{message}
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				if _, err := w.Write(newline); err != nil {
-					log.Printf("Failed to set write message: %v", err)
-				}
-				if _, err := w.Write(<-c.send); err != nil {
-					log.Printf("Failed to set write message: %v", err)
-				}
+				messages = append(messages, <-c.send)
 			}
-
-			if err := w.Close(); err != nil {
+			if err := c.writeMessages(messages); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -136,33 +168,162 @@ func (c *Client) writePump() {
 	}
 }
 
-// subscribe subscribes a client to a Redis symbol channel
-func (c *Client) subscribe(symbol string) {
-	rdb := c.ws.rdb
-	pubsub := rdb.Subscribe(context.Background(), symbol)
-	defer pubsub.Close()
+// writeMessages writes consecutive text messages as one frame separated by newlines, and binary messages as
+// separate frames.
+func (c *Client) writeMessages(messages []outbound) error {
+	for len(messages) > 0 {
+		if messages[0].binary {
+			if err := c.conn.WriteMessage(websocket.BinaryMessage, messages[0].data); err != nil {
+				return err
+			}
+			messages = messages[1:]
+			continue
+		}
+
+		w, err := c.conn.NextWriter(websocket.TextMessage)
+		if err != nil {
+			return err
+		}
+		for i := 0; len(messages) > 0 && !messages[0].binary; i++ {
+			if i > 0 {
+				if _, err := w.Write(newline); err != nil {
+					log.Printf("Failed to set write message: %v", err)
+				}
+			}
+			if _, err := w.Write(messages[0].data); err != nil {
+				log.Printf("Failed to set write message: %v", err)
+			}
+			messages = messages[1:]
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	errClientClosed     = errors.New("ws: client is closed")
+	errNotAuthenticated = errors.New("ws: client is not authenticated")
+)
+
+// channel returns the Redis channel a subscription is published on. The user stream is always the channel of the
+// connection's own user, there is none before the connection is authenticated.
+func (c *Client) channel(sub Subscription) (string, error) {
+	switch sub.Stream {
+	case EventStreamL3:
+		return orderbook.L3Channel(sub.Symbol), nil
+	case EventStreamUserPrivateInfo:
+		userID := c.user()
+		if userID == "" {
+			return "", errNotAuthenticated
+		}
+		return exchange.UserChannel(userID), nil
+	default:
+		return sub.Symbol, nil
+	}
+}
 
-	cancel := make(chan bool)
-	c.subscriptions[symbol] = cancel
+// subscribe adds subscriptions through the hub. Subscribing to a stream the client already has only updates its
+// encoding.
+func (c *Client) subscribe(ctx context.Context, subs []Subscription) error {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
 
-	ch := pubsub.Channel()
-	// fmt.Printf("Channel created for symbol %v\n", symbol)
-	for {
-		select {
-		case msg := <-ch:
-			// log.Printf("Received message from channel %v: %v", symbol, msg.Payload)
-			// Forward messages received from pubsub channel to client
-			c.send <- []byte(msg.Payload)
-		case <-cancel:
-			fmt.Printf("Cancelling subscription %v\n", symbol)
-			return
+	channels := make(map[string]Encoding, len(subs))
+	byChannel := make(map[string]Subscription, len(subs))
+	for _, sub := range subs {
+		channel, err := c.channel(sub)
+		if err != nil {
+			return err
+		}
+		channels[channel] = sub.Encoding
+		byChannel[channel] = sub
+	}
+	if err := c.ws.hub.subscribe(ctx, c, channels); err != nil {
+		return err
+	}
+	for channel, sub := range byChannel {
+		c.subscriptions[channel] = sub
+	}
+	return nil
+}
+
+// unsubscribe removes the client's subscriptions matching match and returns them.
+func (c *Client) unsubscribe(ctx context.Context, match func(Subscription) bool) ([]Subscription, error) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	var channels []string
+	var removed []Subscription
+	for channel, sub := range c.subscriptions {
+		if match(sub) {
+			channels = append(channels, channel)
+			removed = append(removed, sub)
+		}
+	}
+	if len(channels) == 0 {
+		return nil, nil
+	}
+	if err := c.ws.hub.unsubscribe(ctx, c, channels); err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		delete(c.subscriptions, channel)
+	}
+	sortSubscriptions(removed)
+	return removed, nil
+}
+
+// listSubscriptions returns the client's subscriptions ordered by stream and symbol.
+func (c *Client) listSubscriptions() []Subscription {
+	c.subsMu.Lock()
+	subs := make([]Subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub)
+	}
+	c.subsMu.Unlock()
+	sortSubscriptions(subs)
+	return subs
+}
+
+func sortSubscriptions(subs []Subscription) {
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Stream != subs[j].Stream {
+			return subs[i].Stream < subs[j].Stream
 		}
+		return subs[i].Symbol < subs[j].Symbol
+	})
+}
+
+// queue queues a message for the client without blocking. A client whose send buffer is full is not reading fast
+// enough and is disconnected, the message is dropped.
+func (c *Client) queue(m outbound) {
+	select {
+	case c.send <- m:
+	default:
+		c.slowOnce.Do(func() {
+			c.ws.hub.disconnected.Add(1)
+			closeSlowConsumer(c)
+		})
 	}
 }
 
+// closeSubscriptions removes the client from the hub.
 func (c *Client) closeSubscriptions() {
-	for _, cancel := range c.subscriptions {
-		cancel <- true
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	c.closed = true
+	channels := make([]string, 0, len(c.subscriptions))
+	for channel := range c.subscriptions {
+		channels = append(channels, channel)
+	}
+	c.subscriptions = map[string]Subscription{}
+	if err := c.ws.hub.unsubscribe(context.Background(), c, channels); err != nil {
+		log.Printf("Failed to close subscriptions: %v", err)
 	}
 }
 
@@ -179,9 +340,22 @@ func handleMessage(c *Client, msg []byte) {
 	case "":
 		closeConnection(c, websocket.CloseInvalidFramePayloadData, CloseReasonBadEvent)
 		return
-	case EventStreamSymbolInfo:
-		handleStreamSymbolInfo(c, msgReq)
-	
+	case EventAuth:
+		handleAuth(c, msgReq)
+	case EventStreamSymbolInfo, EventStreamL3:
+		handleStream(c, msgReq)
+	case EventSubscribe:
+		handleSubscribe(c, msgReq)
+	case EventUnsubscribe:
+		handleUnsubscribe(c, msgReq)
+	case EventListSubscriptions:
+		handleListSubscriptions(c, msgReq)
+	case EventPlaceOrder:
+		handlePlaceOrder(c, msgReq)
+	case EventCancelOrder:
+		handleCancelOrder(c, msgReq)
+	case EventAmendOrder:
+		handleAmendOrder(c, msgReq)
 	default:
 		closeConnection(c, websocket.CloseInvalidFramePayloadData, CloseReasonUnsupportedEvent)
 		return
@@ -9,6 +9,7 @@ import (
 
 func buildErrorResponse(msg Request, errMsg string) ResponseBase {
 	return ResponseBase{
+		ID:           msg.ID,
 		Event:        msg.Event,
 		Success:      false,
 		ErrorMessage: errMsg,
@@ -22,5 +23,5 @@ func sendErrorMessage(c *Client, msgRes interface{}) {
 		closeConnection(c, websocket.CloseProtocolError, CloseReasonInternalServer)
 		return
 	}
-	c.send <- msgResBytes
+	c.queue(outbound{data: msgResBytes})
 }
\ No newline at end of file
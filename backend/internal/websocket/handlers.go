@@ -1,9 +1,10 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"github/wry-0313/exchange/internal/middleware"
+	"github/wry-0313/exchange/internal/endpoint"
+	"github/wry-0313/exchange/internal/jwt"
 	"log"
 	"net/http"
 
@@ -11,20 +12,22 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var (
-	Upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			// Allow all origins
-			return true
-		},
+// HandleConnection upgrades a request to a WebSocket connection. Connections are anonymous unless the handshake
+// carries a token, see requestToken, or the client authenticates later with EventAuth. Anonymous connections can
+// stream market data, order entry and the user's notifications need a user.
+func (ws *WebSocket) HandleConnection(w http.ResponseWriter, r *http.Request) {
+	var claims jwt.Claims
+	if token := requestToken(r); token != "" {
+		var err error
+		if claims, err = ws.jwtService.VerifyTokenClaims(token); err != nil {
+			log.Printf("handler: issue verifying jwt token: %v", err)
+			endpoint.WriteWithError(w, http.StatusUnauthorized, errMsgInvalidToken)
+			return
+		}
 	}
-)
 
-func (ws *WebSocket) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	// Upgrade connection to WebSocket
-	conn, err := Upgrader.Upgrade(w, r, nil)
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("handler: failed to upgrade connection: %v", err)
 		// logger.Errorf("handler: failed to upgrade connection: %v", err)
@@ -32,16 +35,29 @@ func (ws *WebSocket) HandleConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := middleware.UserIDFromContext(r.Context())
-	fmt.Printf("userID: %v\n", userID);
-
 	client := Client{
 		// symbols:       make(map[string]Symbol),
-		userID:        userID,
-		subscriptions: make(map[string]chan bool),
+		subscriptions: make(map[string]Subscription),
 		conn:          conn,
-		send:          make(chan []byte, 256),
+		send:          make(chan outbound, 256),
+		orderSlots:    make(chan struct{}, maxPendingOrders),
 		ws:            ws,
+		encoding:      EncodingJSON,
+	}
+	if conn.Subprotocol() == SubprotocolBinary {
+		client.encoding = EncodingBinary
+	}
+
+	if !ws.register(&client) {
+		closeConnection(&client, websocket.CloseGoingAway, CloseReasonServerShutdown)
+		conn.Close()
+		return
+	}
+
+	if claims.UserID != "" {
+		if _, err := client.authenticate(claims); err == nil {
+			client.subscribeUser()
+		}
 	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -49,17 +65,156 @@ func (ws *WebSocket) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	go client.writePump()
 	go client.readPump()
 }
-	
-
-func handleStreamSymbolInfo(c *Client, msgReq Request) {
 
+// handleStream subscribes the client to a stream for one or more symbols, the event names the stream. For
+// exchange.stream_l3, clients fetch GET /l3/{symbol} after subscribing and apply the events with a later sequence
+// number on top of it.
+func handleStream(c *Client, msgReq Request) {
 	var params ParamsSymbol
 	if err := UnmarshalParams(msgReq, &params, c); err != nil {
 		return
 	}
-	symbol := params.Symbol
 
-	go c.subscribe(symbol)
+	subscribeStreams(c, msgReq, []ParamsStream{{Stream: msgReq.Event, ParamsSymbol: params}})
+}
+
+// handleSubscribe subscribes the client to several streams in one request.
+func handleSubscribe(c *Client, msgReq Request) {
+	var params ParamsStreams
+	if err := UnmarshalParams(msgReq, &params, c); err != nil {
+		return
+	}
+
+	subscribeStreams(c, msgReq, params.Streams)
+}
+
+// subscribeStreams validates the streams of a request, subscribes to all of them and acknowledges the request
+// with the resulting subscriptions. Nothing is subscribed when any stream or symbol is invalid.
+func subscribeStreams(c *Client, msgReq Request, streams []ParamsStream) {
+	var subs []Subscription
+	for _, stream := range streams {
+		if !isMarketDataStream(stream.Stream) {
+			sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgUnsupportedStream))
+			return
+		}
+		encoding, ok := streamEncoding(c, msgReq, stream.Encoding)
+		if !ok {
+			return
+		}
+		for _, symbol := range stream.symbols() {
+			// Symbols name Redis channels, anything but a listed symbol could reach another channel
+			if !c.ws.exchangeService.HasSymbol(symbol) {
+				sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgUnknownSymbol))
+				return
+			}
+			subs = append(subs, Subscription{Stream: stream.Stream, Symbol: symbol, Encoding: encoding})
+		}
+	}
+	if len(subs) == 0 {
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgSymbolRequired))
+		return
+	}
+
+	if err := c.subscribe(context.Background(), subs); err != nil {
+		log.Printf("handler: %v", err)
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgInternalServer))
+		return
+	}
+	sortSubscriptions(subs)
+	sendSubscriptions(c, msgReq, EventSubscribe, subs)
+}
+
+// handleUnsubscribe removes the client's subscriptions to the requested streams.
+func handleUnsubscribe(c *Client, msgReq Request) {
+	var params ParamsStreams
+	if len(msgReq.Params) > 0 {
+		if err := UnmarshalParams(msgReq, &params, c); err != nil {
+			return
+		}
+	}
+	for _, stream := range params.Streams {
+		if !isMarketDataStream(stream.Stream) {
+			sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgUnsupportedStream))
+			return
+		}
+	}
+
+	removed, err := c.unsubscribe(context.Background(), func(sub Subscription) bool {
+		if !isMarketDataStream(sub.Stream) {
+			return false
+		}
+		if len(params.Streams) == 0 {
+			return true
+		}
+		for _, stream := range params.Streams {
+			if stream.Stream != sub.Stream {
+				continue
+			}
+			symbols := stream.symbols()
+			if len(symbols) == 0 {
+				return true
+			}
+			for _, symbol := range symbols {
+				if symbol == sub.Symbol {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err != nil {
+		log.Printf("handler: %v", err)
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgInternalServer))
+		return
+	}
+	sendSubscriptions(c, msgReq, EventUnsubscribe, removed)
+}
+
+// handleListSubscriptions sends the client its subscriptions.
+func handleListSubscriptions(c *Client, msgReq Request) {
+	sendSubscriptions(c, msgReq, EventListSubscriptions, c.listSubscriptions())
+}
+
+// isMarketDataStream reports whether clients can subscribe to and unsubscribe from a stream. The user's private
+// stream is managed by the server.
+func isMarketDataStream(stream string) bool {
+	return stream == EventStreamSymbolInfo || stream == EventStreamL3
+}
+
+// sendSubscriptions acknowledges a request. Subscribing with a stream event is acknowledged as EventSubscribe, so
+// that stream messages and acknowledgements can be told apart by their event.
+func sendSubscriptions(c *Client, msgReq Request, event string, subs []Subscription) {
+	if subs == nil {
+		subs = []Subscription{}
+	}
+	msgRes := SubscriptionsResponse{
+		ResponseBase: ResponseBase{ID: msgReq.ID, Event: event, Success: true},
+		Result:       subs,
+	}
+	sendResponse(c, msgRes, "sendSubscriptions")
+}
+
+// sendResponse marshals a response and queues it for the client.
+func sendResponse(c *Client, msgRes any, handlerName string) {
+	msgResBytes, err := json.Marshal(msgRes)
+	if err := handleMarshalError(err, handlerName, c); err != nil {
+		return
+	}
+	c.queue(outbound{data: msgResBytes})
+}
+
+// streamEncoding returns the encoding a stream request asked for, falling back to the connection's. An unknown
+// encoding is answered with an error message.
+func streamEncoding(c *Client, msgReq Request, requested Encoding) (Encoding, bool) {
+	switch requested {
+	case "":
+		return c.encoding, true
+	case EncodingJSON, EncodingBinary:
+		return requested, true
+	default:
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgUnsupportedEncoding))
+		return "", false
+	}
 }
 
 // unmarshalParams is a helper function that unmarshals a message request's params and sends
@@ -84,6 +239,15 @@ func handleMarshalError(err error, handlerName string, c *Client) error {
 	return nil
 }
 
-func (ws *WebSocket) RegisterHandlers(r chi.Router) {
+// HandleStats responds with the WebSocket connection and subscription counts.
+func (ws *WebSocket) HandleStats(w http.ResponseWriter, r *http.Request) {
+	endpoint.WriteWithStatus(w, http.StatusOK, ws.Stats())
+}
+
+func (ws *WebSocket) RegisterHandlers(r chi.Router, adminHandler func(http.Handler) http.Handler) {
 	r.HandleFunc("/ws", ws.HandleConnection)
+	r.Route("/admin/ws", func(r chi.Router) {
+		r.Use(adminHandler)
+		r.Get("/stats", ws.HandleStats)
+	})
 }
@@ -0,0 +1,80 @@
+package ws
+
+import (
+	"encoding/json"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/jwt"
+	"testing"
+	"time"
+)
+
+// listedSymbols is an exchange that lists a fixed set of symbols.
+type listedSymbols struct {
+	exchange.Service
+	symbols map[string]bool
+}
+
+func (l listedSymbols) HasSymbol(symbol string) bool {
+	return l.symbols[symbol]
+}
+
+// readResponse returns the next response queued for the client.
+func readResponse(t *testing.T, c *Client) ResponseBase {
+	t.Helper()
+	if len(c.send) == 0 {
+		t.Fatal("no response was queued")
+	}
+	var res ResponseBase
+	if err := json.Unmarshal((<-c.send).data, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestSubscribeRejectsUnlistedSymbols(t *testing.T) {
+	h := newHub(nil)
+	ws := &WebSocket{hub: h, exchangeService: listedSymbols{symbols: map[string]bool{"AAPL": true}}}
+	c := &Client{ws: ws, send: make(chan outbound, 4), subscriptions: map[string]Subscription{}}
+	// Another client already streams AAPL, so subscribing to it doesn't reach Redis
+	h.channels["AAPL"] = map[*Client]Encoding{{}: EncodingJSON}
+
+	// A symbol naming another user's channel would forward their notifications
+	handleSubscribe(c, Request{Event: EventSubscribe, Params: json.RawMessage(`{"streams":[{"stream":"` + EventStreamSymbolInfo + `","symbols":["AAPL","` + exchange.UserChannel("victim") + `"]}]}`)})
+	if res := readResponse(t, c); res.Success || res.ErrorMessage != ErrMsgUnknownSymbol {
+		t.Fatalf("got %+v, want ErrMsgUnknownSymbol", res)
+	}
+	if len(c.subscriptions) != 0 || h.channels[exchange.UserChannel("victim")] != nil {
+		t.Fatalf("subscribed to %v", c.subscriptions)
+	}
+
+	handleSubscribe(c, Request{Event: EventSubscribe, Params: json.RawMessage(`{"streams":[{"stream":"` + EventStreamSymbolInfo + `","symbol":"AAPL"}]}`)})
+	if res := readResponse(t, c); !res.Success {
+		t.Fatalf("got %+v, want AAPL to be subscribed", res)
+	}
+	if _, ok := c.subscriptions["AAPL"]; !ok {
+		t.Fatalf("subscriptions = %v, want AAPL", c.subscriptions)
+	}
+}
+
+func TestUserStreamIsTheOwnUsersChannel(t *testing.T) {
+	h := newHub(nil)
+	ws := &WebSocket{hub: h}
+	c := &Client{ws: ws, send: make(chan outbound, 4), subscriptions: map[string]Subscription{}}
+	defer c.stopExpiry()
+
+	// An anonymous connection has no user channel to subscribe to
+	c.subscribeUser()
+	if len(c.subscriptions) != 0 || h.channels[exchange.UserChannel("")] != nil {
+		t.Fatalf("anonymous connection subscribed to %v", c.subscriptions)
+	}
+
+	if _, err := c.authenticate(jwt.Claims{UserID: "user-1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	// Another connection of the user already streams the channel, so subscribing doesn't reach Redis
+	h.channels[exchange.UserChannel("user-1")] = map[*Client]Encoding{{}: EncodingJSON}
+	c.subscribeUser()
+	if _, ok := c.subscriptions[exchange.UserChannel("user-1")]; !ok || len(c.subscriptions) != 1 {
+		t.Fatalf("subscriptions = %v, want only the channel of user-1", c.subscriptions)
+	}
+}
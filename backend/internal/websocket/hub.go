@@ -0,0 +1,182 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// hub holds one Redis subscription per channel, however many clients are subscribed to it, and fans the
+// channel's messages out to them. Clients that don't keep up are disconnected rather than allowed to block the
+// fan-out, a gap in a stream such as the L3 feed is worse than a reconnect.
+type hub struct {
+	rdb *redis.Client
+
+	// Serializes Redis subscribe and unsubscribe calls, so that they are applied in the order the clients map
+	// changed. Acquired before mu.
+	redisMu sync.Mutex
+	pubsub  *redis.PubSub // created on the first subscribe
+
+	mu       sync.RWMutex
+	channels map[string]map[*Client]Encoding // subscribed clients per Redis channel
+
+	disconnected atomic.Int64 // slow consumers disconnected
+}
+
+// HubStats are the hub's connection and subscription counts.
+type HubStats struct {
+	Connections         int            `json:"connections"`
+	Channels            int            `json:"channels"`      // Redis channels subscribed to
+	Subscriptions       int            `json:"subscriptions"` // client subscriptions over all channels
+	ChannelSubscribers  map[string]int `json:"channel_subscribers"`
+	SlowConsumersClosed int64          `json:"slow_consumers_closed"`
+}
+
+func newHub(rdb *redis.Client) *hub {
+	return &hub{
+		rdb:      rdb,
+		channels: map[string]map[*Client]Encoding{},
+	}
+}
+
+// subscribe adds c to the channels, subscribing the hub to those no other client was subscribed to. A client
+// that already is subscribed to a channel only has its encoding updated.
+func (h *hub) subscribe(ctx context.Context, c *Client, channels map[string]Encoding) error {
+	h.redisMu.Lock()
+	defer h.redisMu.Unlock()
+
+	var added []string
+	h.mu.Lock()
+	for channel, encoding := range channels {
+		clients, ok := h.channels[channel]
+		if !ok {
+			clients = map[*Client]Encoding{}
+			h.channels[channel] = clients
+			added = append(added, channel)
+		}
+		clients[c] = encoding
+	}
+	h.mu.Unlock()
+	if len(added) == 0 {
+		return nil
+	}
+
+	if h.pubsub == nil {
+		h.pubsub = h.rdb.Subscribe(ctx)
+		go h.run(h.pubsub.Channel())
+	}
+	if err := h.pubsub.Subscribe(ctx, added...); err != nil {
+		h.mu.Lock()
+		for _, channel := range added {
+			delete(h.channels, channel)
+		}
+		h.mu.Unlock()
+		return fmt.Errorf("ws: failed to subscribe to %v: %w", added, err)
+	}
+	return nil
+}
+
+// unsubscribe removes c from the channels, unsubscribing the hub from those without clients left.
+func (h *hub) unsubscribe(ctx context.Context, c *Client, channels []string) error {
+	h.redisMu.Lock()
+	defer h.redisMu.Unlock()
+
+	var removed []string
+	h.mu.Lock()
+	for _, channel := range channels {
+		clients, ok := h.channels[channel]
+		if !ok {
+			continue
+		}
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(h.channels, channel)
+			removed = append(removed, channel)
+		}
+	}
+	h.mu.Unlock()
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err := h.pubsub.Unsubscribe(ctx, removed...); err != nil {
+		return fmt.Errorf("ws: failed to unsubscribe from %v: %w", removed, err)
+	}
+	return nil
+}
+
+// run fans the messages of the Redis subscription out until it is closed. Each message is transcoded to binary
+// at most once, however many clients receive it.
+func (h *hub) run(ch <-chan *redis.Message) {
+	for msg := range ch {
+		text := outbound{data: []byte(msg.Payload)}
+		var binary *outbound
+
+		h.mu.RLock()
+		for c, encoding := range h.channels[msg.Channel] {
+			m := text
+			if encoding == EncodingBinary {
+				if binary == nil {
+					binary = encodeOutbound(text.data)
+				}
+				m = *binary
+			}
+			c.queue(m)
+		}
+		h.mu.RUnlock()
+	}
+}
+
+// encodeOutbound transcodes a Redis payload to binary, falling back to the JSON text for messages that have no
+// binary encoding.
+func encodeOutbound(payload []byte) *outbound {
+	data, err := encodeBinary(payload)
+	if err != nil {
+		if !errors.Is(err, ErrNotMarketData) {
+			log.Printf("Failed to encode message as binary: %v", err)
+		}
+		return &outbound{data: payload}
+	}
+	return &outbound{data: data, binary: true}
+}
+
+func (h *hub) stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := HubStats{
+		Channels:            len(h.channels),
+		ChannelSubscribers:  make(map[string]int, len(h.channels)),
+		SlowConsumersClosed: h.disconnected.Load(),
+	}
+	for channel, clients := range h.channels {
+		stats.ChannelSubscribers[channel] = len(clients)
+		stats.Subscriptions += len(clients)
+	}
+	return stats
+}
+
+// close closes the Redis subscription, which stops run.
+func (h *hub) close() error {
+	h.redisMu.Lock()
+	defer h.redisMu.Unlock()
+	if h.pubsub == nil {
+		return nil
+	}
+	return h.pubsub.Close()
+}
+
+// closeSlowConsumer disconnects a client whose send buffer is full. The connection is closed in its own goroutine
+// so the fan-out doesn't wait on the client's socket.
+func closeSlowConsumer(c *Client) {
+	go func() {
+		closeConnection(c, websocket.CloseTryAgainLater, CloseReasonSlowConsumer)
+		c.conn.Close()
+	}()
+}
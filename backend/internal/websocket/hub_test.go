@@ -0,0 +1,48 @@
+package ws
+
+import (
+	"encoding/json"
+	"github/wry-0313/exchange/internal/orderbook"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHubFansOutByChannelAndEncoding(t *testing.T) {
+	h := newHub(nil)
+	ws := &WebSocket{hub: h}
+	jsonClient := &Client{ws: ws, send: make(chan outbound, 4)}
+	binaryClient := &Client{ws: ws, send: make(chan outbound, 4)}
+	otherClient := &Client{ws: ws, send: make(chan outbound, 4)}
+	h.channels["AAPL.l3"] = map[*Client]Encoding{jsonClient: EncodingJSON, binaryClient: EncodingBinary}
+	h.channels["MSFT.l3"] = map[*Client]Encoding{otherClient: EncodingJSON}
+
+	payload, err := json.Marshal(orderbook.L3PubMsg{
+		RedisPubMsgBase: orderbook.RedisPubMsgBase{Event: orderbook.EventStreamL3, Success: true},
+		Result:          []orderbook.L3Event{{Sequence: 1, Type: orderbook.L3Add, OrderID: 1, Side: "Buy", Price: 10, Size: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *redis.Message, 1)
+	ch <- &redis.Message{Channel: "AAPL.l3", Payload: string(payload)}
+	close(ch)
+	h.run(ch)
+
+	if m := <-jsonClient.send; m.binary || string(m.data) != string(payload) {
+		t.Errorf("JSON client got %+v, want the payload as text", m)
+	}
+	if m := <-binaryClient.send; !m.binary {
+		t.Errorf("binary client got a text message")
+	} else if _, err := DecodeL3Events(m.data); err != nil {
+		t.Errorf("DecodeL3Events: %v", err)
+	}
+	if len(otherClient.send) != 0 {
+		t.Errorf("client of another channel got %d messages", len(otherClient.send))
+	}
+
+	stats := h.stats()
+	if stats.Channels != 2 || stats.Subscriptions != 3 || stats.ChannelSubscribers["AAPL.l3"] != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
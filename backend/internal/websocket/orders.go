@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/pkg/validator"
+	"log"
+	"time"
+)
+
+const (
+	defaultOrderAckTimeout = 5 * time.Second
+	maxOrderAckTimeout     = 30 * time.Second
+)
+
+// ParamsOrderWait controls whether an order request is acknowledged once the engine processed it, which is the
+// default, or as soon as it was queued. A rejection is then only reported on the user's private stream.
+type ParamsOrderWait struct {
+	Wait      *bool `json:"wait,omitempty"`
+	TimeoutMs int   `json:"timeout_ms,omitempty"`
+}
+
+func (p ParamsOrderWait) wait() (bool, time.Duration) {
+	timeout := defaultOrderAckTimeout
+	if p.TimeoutMs > 0 {
+		timeout = min(time.Duration(p.TimeoutMs)*time.Millisecond, maxOrderAckTimeout)
+	}
+	return p.Wait == nil || *p.Wait, timeout
+}
+
+// ParamsPlaceOrder are the params of EventPlaceOrder, the same fields as the body of POST /orders.
+type ParamsPlaceOrder struct {
+	exchange.PlaceOrderInput
+	ParamsOrderWait
+}
+
+// ParamsCancelOrder are the params of EventCancelOrder.
+type ParamsCancelOrder struct {
+	ClientOrderID string `json:"client_order_id"`
+	ParamsOrderWait
+}
+
+// ParamsAmendOrder are the params of EventAmendOrder, Volume is what the order is reduced to.
+type ParamsAmendOrder struct {
+	ClientOrderID string  `json:"client_order_id"`
+	Volume        float64 `json:"volume"`
+	ParamsOrderWait
+}
+
+// OrderResponse acknowledges an order request. A request the engine rejected has Success unset, the reason in
+// ErrorMessage and the order's state in Result.
+type OrderResponse struct {
+	ResponseBase
+	Result *exchange.OrderAck `json:"result,omitempty"`
+}
+
+// handlePlaceOrder places an order for the connection's user.
+func handlePlaceOrder(c *Client, msgReq Request) {
+	if !authorizeOrderRequest(c, msgReq) {
+		return
+	}
+	var params ParamsPlaceOrder
+	if err := UnmarshalParams(msgReq, &params, c); err != nil {
+		return
+	}
+
+	input := params.PlaceOrderInput
+	input.UserID = c.user()
+	wait, timeout := params.wait()
+	c.startOrderRequest(msgReq, func(ctx context.Context) (exchange.OrderAck, error) {
+		return c.ws.exchangeService.PlaceOrder(ctx, input, wait)
+	}, timeout)
+}
+
+// handleCancelOrder cancels an order of the connection's user by its client order ID.
+func handleCancelOrder(c *Client, msgReq Request) {
+	if !authorizeOrderRequest(c, msgReq) {
+		return
+	}
+	var params ParamsCancelOrder
+	if err := UnmarshalParams(msgReq, &params, c); err != nil {
+		return
+	}
+
+	userID := c.user()
+	wait, timeout := params.wait()
+	c.startOrderRequest(msgReq, func(ctx context.Context) (exchange.OrderAck, error) {
+		return c.ws.exchangeService.CancelClientOrder(ctx, userID, params.ClientOrderID, wait)
+	}, timeout)
+}
+
+// handleAmendOrder reduces the volume of an order of the connection's user by its client order ID.
+func handleAmendOrder(c *Client, msgReq Request) {
+	if !authorizeOrderRequest(c, msgReq) {
+		return
+	}
+	var params ParamsAmendOrder
+	if err := UnmarshalParams(msgReq, &params, c); err != nil {
+		return
+	}
+
+	userID := c.user()
+	wait, timeout := params.wait()
+	c.startOrderRequest(msgReq, func(ctx context.Context) (exchange.OrderAck, error) {
+		return c.ws.exchangeService.AmendClientOrder(ctx, userID, params.ClientOrderID, params.Volume, wait)
+	}, timeout)
+}
+
+// authorizeOrderRequest closes anonymous connections that send an order request and refuses order requests of
+// users whose role doesn't allow trading.
+func authorizeOrderRequest(c *Client, msgReq Request) bool {
+	if c.user() == "" {
+		closeUnauthorized(c)
+		return false
+	}
+	if !c.canTrade() {
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgForbiddenRole))
+		return false
+	}
+	return true
+}
+
+// startOrderRequest runs an order request in its own goroutine so that waiting for the engine doesn't hold up the
+// connection's other requests. The request is refused while maxPendingOrders requests of the connection are still
+// waiting.
+func (c *Client) startOrderRequest(msgReq Request, do func(ctx context.Context) (exchange.OrderAck, error), timeout time.Duration) {
+	select {
+	case c.orderSlots <- struct{}{}:
+	default:
+		sendErrorMessage(c, buildErrorResponse(msgReq, ErrMsgTooManyPendingOrders))
+		return
+	}
+	// The slot is released before the acknowledgement is sent, so a client may send another request once it has one
+	go c.sendOrderResult(msgReq, func(ctx context.Context) (exchange.OrderAck, error) {
+		defer func() { <-c.orderSlots }()
+		return do(ctx)
+	}, timeout)
+}
+
+// sendOrderResult runs an order request and sends its acknowledgement.
+func (c *Client) sendOrderResult(msgReq Request, do func(ctx context.Context) (exchange.OrderAck, error), timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ack, err := do(ctx)
+	if err != nil {
+		sendErrorMessage(c, buildErrorResponse(msgReq, orderErrorMessage(msgReq, err)))
+		return
+	}
+
+	msgRes := OrderResponse{
+		ResponseBase: ResponseBase{ID: msgReq.ID, Event: msgReq.Event, Success: true},
+		Result:       &ack,
+	}
+	if ack.Status == orderbook.Rejected.String() {
+		msgRes.Success = false
+		msgRes.ErrorMessage = ack.RejectReason
+	}
+	sendResponse(c, msgRes, "sendOrderResult")
+}
+
+// orderErrorMessage describes a failed order request the way the HTTP API does.
+func orderErrorMessage(msgReq Request, err error) string {
+	switch {
+	case validator.IsValidationError(err):
+		var input exchange.PlaceOrderInput
+		if msg := validator.GetValidationErrMsg(input, err); msg != "" {
+			return msg
+		}
+		return ErrMsgInvalidRequest
+	case errors.Is(err, exchange.ErrInvalidSymbol), errors.Is(err, exchange.ErrOrderNotFound), errors.Is(err, exchange.ErrInvalidVolume),
+		errors.Is(err, exchange.ErrTradingHalted), errors.Is(err, exchange.ErrOrderRejected):
+		return err.Error()
+	default:
+		log.Printf("%s: %v", msgReq.Event, err)
+		return ErrMsgInternalServer
+	}
+}
@@ -0,0 +1,65 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/jwt"
+	"github/wry-0313/exchange/internal/models"
+	"testing"
+	"time"
+)
+
+// stalledExchange holds every order until release is closed, like an engine that stopped applying commands.
+type stalledExchange struct {
+	exchange.Service
+	release chan struct{}
+}
+
+func (e stalledExchange) PlaceOrder(ctx context.Context, input exchange.PlaceOrderInput, wait bool) (exchange.OrderAck, error) {
+	select {
+	case <-e.release:
+		return exchange.OrderAck{OrderID: "order"}, nil
+	case <-ctx.Done():
+		return exchange.OrderAck{}, ctx.Err()
+	}
+}
+
+func TestPendingOrderRequestsAreBounded(t *testing.T) {
+	release := make(chan struct{})
+	ws := &WebSocket{hub: newHub(nil), exchangeService: stalledExchange{release: release}}
+	c := &Client{ws: ws, send: make(chan outbound, maxPendingOrders+4), orderSlots: make(chan struct{}, maxPendingOrders)}
+	defer c.stopExpiry()
+	if _, err := c.authenticate(jwt.Claims{UserID: "user-1", Role: models.RoleTrader, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := Request{Event: EventPlaceOrder, Params: json.RawMessage(`{"symbol":"AAPL","order_type":"market","order_side":"buy","volume":1}`)}
+	for i := 0; i < maxPendingOrders; i++ {
+		handlePlaceOrder(c, req)
+	}
+	handlePlaceOrder(c, req)
+	if res := readResponse(t, c); res.Success || res.ErrorMessage != ErrMsgTooManyPendingOrders {
+		t.Fatalf("got %+v, want ErrMsgTooManyPendingOrders", res)
+	}
+
+	// Once the engine catches up, the slots are released and the connection can place orders again
+	close(release)
+	for i := 0; i < maxPendingOrders; i++ {
+		select {
+		case <-c.send:
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending orders were not acknowledged")
+		}
+	}
+	handlePlaceOrder(c, req)
+	select {
+	case out := <-c.send:
+		var res ResponseBase
+		if err := json.Unmarshal(out.data, &res); err != nil || !res.Success {
+			t.Fatalf("got %s, want the order acknowledged", out.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the order was not acknowledged")
+	}
+}
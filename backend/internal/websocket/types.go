@@ -2,6 +2,7 @@ package ws
 
 import (
 	"encoding/json"
+	"github/wry-0313/exchange/internal/orderbook"
 )
 
 const (
@@ -10,8 +11,29 @@ const (
 
 	EventStreamSymbolInfo = "exchange.stream_info"
 
+	// EventStreamL3 streams every change to the orders resting on a symbol's book, see orderbook.L3Event.
+	EventStreamL3 = orderbook.EventStreamL3
+
 	EventStreamUserPrivateInfo = "exchange.stream_user_private_info"
 
+	// EventAuth authenticates the connection with a token, see ParamsAuth. Sending it again with a fresh token
+	// before the current one expires keeps the connection open.
+	EventAuth = "exchange.auth"
+
+	// EventSubscribe subscribes to several streams at once, see ParamsStreams.
+	EventSubscribe = "exchange.subscribe"
+
+	// EventUnsubscribe removes subscriptions, see ParamsStreams.
+	EventUnsubscribe = "exchange.unsubscribe"
+
+	// EventListSubscriptions lists the connection's subscriptions.
+	EventListSubscriptions = "exchange.list_subscriptions"
+
+	// Order entry for authenticated connections, see ParamsPlaceOrder, ParamsCancelOrder and ParamsAmendOrder.
+	EventPlaceOrder  = "exchange.place_order"
+	EventCancelOrder = "exchange.cancel_order"
+	EventAmendOrder  = "exchange.amend_order"
+
 	// CloseReasonBadEvent indicates that the event field has an incorrect type.
 	CloseReasonBadEvent = "The event field is an incorrect type."
 
@@ -27,24 +49,107 @@ const (
 	// CloseReasonUnauthorized indicates an unauthorized request.
 	CloseReasonUnauthorized = "Unauthorized."
 
+	// CloseReasonTokenExpired indicates that the token the connection authenticated with expired.
+	CloseReasonTokenExpired = "The token expired."
+
+	// CloseReasonTokenRevoked indicates that the token the connection authenticated with was revoked.
+	CloseReasonTokenRevoked = "The token was revoked."
+
+	// CloseReasonServerShutdown indicates that the server is shutting down.
+	CloseReasonServerShutdown = "The server is shutting down."
+
+	// CloseReasonSlowConsumer indicates that the client did not read its messages fast enough.
+	CloseReasonSlowConsumer = "The client is not reading messages fast enough."
+
 	// ErrMsgInternalServer indicates an internal server error.
 	ErrMsgInternalServer = "Internal server error."
+
+	// errMsgInvalidToken is the handshake's response to an invalid token.
+	errMsgInvalidToken = "Token is invalid."
+
+	// ErrMsgUnsupportedEncoding indicates that the requested encoding is neither json nor binary.
+	ErrMsgUnsupportedEncoding = "The encoding is unsupported."
+
+	// ErrMsgUnsupportedStream indicates that a subscribe or unsubscribe request names a stream clients can't manage.
+	ErrMsgUnsupportedStream = "The stream is unsupported."
+
+	// ErrMsgSymbolRequired indicates that a subscribe request has no symbols.
+	ErrMsgSymbolRequired = "At least one symbol is required."
+
+	// ErrMsgUnknownSymbol indicates that a subscribe request names a symbol the exchange doesn't list.
+	ErrMsgUnknownSymbol = "The symbol is not listed."
+
+	// ErrMsgInvalidRequest indicates that the request's params failed validation.
+	ErrMsgInvalidRequest = "Invalid request."
+
+	// ErrMsgForbiddenRole indicates that the user's role doesn't allow trading.
+	ErrMsgForbiddenRole = "Your role does not allow this action."
+
+	// ErrMsgTooManyPendingOrders indicates that the connection already has maxPendingOrders order requests waiting
+	// for the engine.
+	ErrMsgTooManyPendingOrders = "Too many order requests are pending, wait for their acknowledgements."
 )
 
-// Request is a struct that describes the shape of every message request.
+// Request is a struct that describes the shape of every message request. ID is optional and echoed in the
+// response, so clients can match acknowledgements to requests.
 type Request struct {
+	ID     string          `json:"id,omitempty"`
 	Event  string          `json:"event"`
 	Params json.RawMessage `json:"params"`
 }
 
 // ResponseBase represents the base response structure.
 type ResponseBase struct {
+	ID           string `json:"id,omitempty"`
 	Event        string `json:"event"`
 	Success      bool   `json:"success"`
 	ErrorMessage string `json:"error_message,omitempty"`
 }
 
-// ParamsSymbol contains the parameter symbol and is used for handlers that only needs the symbol
+// ParamsSymbol contains the symbols of a stream request. Symbol and Symbols can be combined.
 type ParamsSymbol struct {
-	Symbol string `json:"symbol" validate:"required"`
-}
\ No newline at end of file
+	Symbol  string   `json:"symbol"`
+	Symbols []string `json:"symbols,omitempty"`
+
+	// Encoding optionally overrides the connection's encoding for this stream, "json" or "binary".
+	Encoding Encoding `json:"encoding,omitempty"`
+}
+
+// symbols returns Symbol and Symbols without duplicates.
+func (p ParamsSymbol) symbols() []string {
+	seen := map[string]bool{}
+	var symbols []string
+	for _, symbol := range append([]string{p.Symbol}, p.Symbols...) {
+		if symbol != "" && !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+	return symbols
+}
+
+// ParamsStream names a stream and its symbols in a subscribe or unsubscribe request.
+type ParamsStream struct {
+	Stream string `json:"stream"`
+	ParamsSymbol
+}
+
+// ParamsStreams are the params of EventSubscribe and EventUnsubscribe. Unsubscribing from a stream without
+// symbols removes all of its symbols, and an unsubscribe without streams removes every market data subscription.
+type ParamsStreams struct {
+	Streams []ParamsStream `json:"streams"`
+}
+
+// Subscription is a stream the client is subscribed to.
+type Subscription struct {
+	Stream   string   `json:"stream"`
+	Symbol   string   `json:"symbol,omitempty"`
+	Encoding Encoding `json:"encoding"`
+}
+
+// SubscriptionsResponse acknowledges a subscribe or unsubscribe request with the subscriptions it added or
+// removed, and answers a list request with all of them.
+type SubscriptionsResponse struct {
+	ResponseBase
+	Result []Subscription `json:"result"`
+}
@@ -1,19 +1,132 @@
 package ws
 
 import (
+	"context"
+	"encoding/json"
 	"github/wry-0313/exchange/internal/exchange"
+	"github/wry-0313/exchange/internal/jwt"
+	"log"
+	"sync"
 
+	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 )
 
 type WebSocket struct {
 	exchangeService exchange.Service
 	rdb             *redis.Client
+	jwtService      jwt.Service
+	hub             *hub
+	upgrader        websocket.Upgrader
+
+	clientsMu sync.Mutex
+	clients   map[*Client]struct{} // open connections, closed on shutdown
+	closing   bool
 }
 
-func NewWebSocket(exchangeService exchange.Service, rdb *redis.Client) *WebSocket {
+// NewWebSocket creates the WebSocket server. Browsers may only connect from allowedOrigins, see
+// config.Config.WSAllowedOrigins.
+func NewWebSocket(exchangeService exchange.Service, rdb *redis.Client, jwtService jwt.Service, allowedOrigins []string) *WebSocket {
 	return &WebSocket{
 		exchangeService: exchangeService,
 		rdb:             rdb,
+		jwtService:      jwtService,
+		hub:             newHub(rdb),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			// Clients that don't ask for a subprotocol get JSON.
+			Subprotocols: []string{SubprotocolBinary, SubprotocolJSON},
+			CheckOrigin:  originChecker(allowedOrigins),
+		},
+		clients: map[*Client]struct{}{},
+	}
+}
+
+// register tracks a new connection. It returns false once the server is shutting down.
+func (ws *WebSocket) register(c *Client) bool {
+	ws.clientsMu.Lock()
+	defer ws.clientsMu.Unlock()
+	if ws.closing {
+		return false
+	}
+	ws.clients[c] = struct{}{}
+	return true
+}
+
+func (ws *WebSocket) unregister(c *Client) {
+	ws.clientsMu.Lock()
+	delete(ws.clients, c)
+	ws.clientsMu.Unlock()
+}
+
+// Shutdown refuses new connections and closes the open ones with a going away close message, so clients know to
+// reconnect elsewhere. http.Server.Shutdown does not wait for hijacked connections, which is why this is separate.
+func (ws *WebSocket) Shutdown(ctx context.Context) error {
+	ws.clientsMu.Lock()
+	ws.closing = true
+	clients := make([]*Client, 0, len(ws.clients))
+	for c := range ws.clients {
+		clients = append(clients, c)
 	}
+	ws.clientsMu.Unlock()
+
+	for _, c := range clients {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		closeConnection(c, websocket.CloseGoingAway, CloseReasonServerShutdown)
+		c.conn.Close()
+	}
+	return ws.hub.close()
+}
+
+// Run closes the connections whose token is revoked, as announced on jwt.RevocationsChannel, until ctx is done.
+func (ws *WebSocket) Run(ctx context.Context) {
+	pubsub := ws.rdb.Subscribe(ctx, jwt.RevocationsChannel)
+	go func() {
+		defer pubsub.Close()
+		ch := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var rev jwt.Revocation
+				if err := json.Unmarshal([]byte(msg.Payload), &rev); err != nil {
+					log.Printf("ws: failed to unmarshal revocation: %v, message: %s", err, msg.Payload)
+					continue
+				}
+				for _, c := range ws.revokedClients(rev) {
+					closeConnection(c, websocket.ClosePolicyViolation, CloseReasonTokenRevoked)
+					c.conn.Close()
+				}
+			}
+		}
+	}()
+}
+
+// revokedClients returns the open connections authenticated with a token rev revokes.
+func (ws *WebSocket) revokedClients(rev jwt.Revocation) []*Client {
+	ws.clientsMu.Lock()
+	defer ws.clientsMu.Unlock()
+	var revoked []*Client
+	for c := range ws.clients {
+		if c.revokedBy(rev) {
+			revoked = append(revoked, c)
+		}
+	}
+	return revoked
+}
+
+// Stats returns the number of open connections and the hub's subscription counts.
+func (ws *WebSocket) Stats() HubStats {
+	stats := ws.hub.stats()
+	ws.clientsMu.Lock()
+	stats.Connections = len(ws.clients)
+	ws.clientsMu.Unlock()
+	return stats
 }
@@ -3,11 +3,13 @@ package list
 import (
 	"fmt"
 	"strings"
+	"sync"
 )
 
 type List[Value any] struct {
 	root *Node[Value]
 	len  int
+	pool *NodePool[Value] // optional, recycles nodes on insert and remove
 }
 
 type Node[Value any] struct {
@@ -18,6 +20,40 @@ type Node[Value any] struct {
 
 func New[Value any]() *List[Value] { return new(List[Value]).init() }
 
+// NewWithPool creates a list that takes its nodes from p and gives them back to p once removed. Callers must not
+// hold on to a node after removing it from a pooled list.
+func NewWithPool[Value any](p *NodePool[Value]) *List[Value] {
+	l := new(List[Value]).init()
+	l.pool = p
+	return l
+}
+
+// NodePool recycles list nodes so that lists with a high insert and remove rate do not allocate a node per insert.
+// A pool can be shared by any number of lists holding the same value type.
+type NodePool[Value any] struct {
+	pool sync.Pool
+}
+
+func NewNodePool[Value any]() *NodePool[Value] {
+	return &NodePool[Value]{
+		pool: sync.Pool{
+			New: func() any { return new(Node[Value]) },
+		},
+	}
+}
+
+func (p *NodePool[Value]) get(v Value) *Node[Value] {
+	n := p.pool.Get().(*Node[Value])
+	n.Value = v
+	return n
+}
+
+func (p *NodePool[Value]) put(n *Node[Value]) {
+	var zero Value
+	n.Value = zero // drop the reference so the value can be collected
+	p.pool.Put(n)
+}
+
 // Init is a convient helper function that initializes the sentinel root and len
 func (l *List[Value]) init() *List[Value] {
 	l.root = &Node[Value]{}
@@ -70,6 +106,9 @@ func (l *List[Value]) insert(n, at *Node[Value]) *Node[Value] {
 
 // insertValue is a wrapper for calling insert
 func (l *List[Value]) insertValue(v Value, at *Node[Value]) *Node[Value] {
+	if l.pool != nil {
+		return l.insert(l.pool.get(v), at)
+	}
 	return l.insert(&Node[Value]{Value: v}, at)
 }
 
@@ -83,12 +122,17 @@ func (l *List[Value]) remove(n *Node[Value]) {
 	l.len--
 }
 
-// Remove removes n from l if n is an element and returns the value e.Value
+// Remove removes n from l if n is an element and returns the value e.Value. If l is pooled the node is recycled
+// and must not be used afterwards.
 func (l *List[Value]) Remove(n *Node[Value]) Value {
+	v := n.Value
 	if n.list == l {
 		l.remove(n)
+		if l.pool != nil {
+			l.pool.put(n)
+		}
 	}
-	return n.Value
+	return v
 }
 
 // move moves
@@ -20,3 +20,35 @@ func Test(t *testing.T) {
 	}
 }
 
+func TestPooled(t *testing.T) {
+	pool := NewNodePool[int]()
+	list := NewWithPool(pool)
+	for i := 0; i < 1000; i++ {
+		list.PushBack(i)
+	}
+	for i := 0; list.Len() != 0; i++ {
+		if v := list.Remove(list.Front()); v != i {
+			t.Fatalf("expected %d, got %d", i, v)
+		}
+	}
+	n := list.PushBack(7)
+	if n.Value != 7 || list.Front() != n {
+		t.Fatalf("recycled node not reinitialized: %v", list)
+	}
+}
+
+func BenchmarkPushRemove(b *testing.B) {
+	list := New[int]()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		list.Remove(list.PushBack(i))
+	}
+}
+
+func BenchmarkPushRemovePooled(b *testing.B) {
+	list := NewWithPool(NewNodePool[int]())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		list.Remove(list.PushBack(i))
+	}
+}
@@ -0,0 +1,149 @@
+// Package fixed implements an integer fixed-point number with two fractional digits. It is used inside the
+// matching engine so that prices and volumes can be compared and added without allocating, and is converted
+// to decimal.Decimal only at the API and persistence boundary.
+package fixed
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"github.com/shopspring/decimal"
+)
+
+// Num is a fixed-point number stored as an integer count of hundredths.
+type Num int64
+
+const (
+	// Places is the number of fractional digits a Num carries. It matches the DECIMAL(10, 2) columns in the database.
+	Places = 2
+
+	// Scale is the integer value of 1 in Num units.
+	Scale = 100
+
+	Zero Num = 0
+)
+
+var ErrOverflow = errors.New("fixed: overflow")
+
+// The range of a Num in hundredths.
+var (
+	minNum = decimal.NewFromInt(math.MinInt64)
+	maxNum = decimal.NewFromInt(math.MaxInt64)
+)
+
+// FromDecimal converts a decimal to a Num, rounding half away from zero to two places. It returns ErrOverflow if
+// the decimal is out of a Num's range.
+func FromDecimal(d decimal.Decimal) (Num, error) {
+	n := d.Shift(Places).Round(0)
+	if n.LessThan(minNum) || n.GreaterThan(maxNum) {
+		return 0, ErrOverflow
+	}
+	return Num(n.IntPart()), nil
+}
+
+// FromFloat converts a float to a Num, rounding half away from zero to two places. It returns ErrOverflow if the
+// float is out of a Num's range.
+func FromFloat(f float64) (Num, error) {
+	return FromDecimal(decimal.NewFromFloat(f))
+}
+
+// FromInt converts a whole number to a Num.
+func FromInt(i int64) Num {
+	return Num(i * Scale)
+}
+
+// Decimal converts n back to a decimal.Decimal.
+func (n Num) Decimal() decimal.Decimal {
+	return decimal.New(int64(n), -Places)
+}
+
+// Float64 returns the nearest float64 value for n.
+func (n Num) Float64() float64 {
+	return float64(n) / Scale
+}
+
+// Mul returns n * m rounded half away from zero to two places. It returns ErrOverflow if the product doesn't fit
+// in a Num.
+func (n Num) Mul(m Num) (Num, error) {
+	// The product is computed on the magnitudes in 128 bits, so only the rounded result has to fit
+	hi, lo := bits.Mul64(magnitude(n), magnitude(m))
+	lo, carry := bits.Add64(lo, Scale/2, 0)
+	hi += carry
+	if hi >= Scale {
+		return 0, ErrOverflow
+	}
+	q, _ := bits.Div64(hi, lo, Scale)
+	if q > math.MaxInt64 {
+		return 0, ErrOverflow
+	}
+	if (n < 0) != (m < 0) {
+		return -Num(q), nil
+	}
+	return Num(q), nil
+}
+
+func magnitude(n Num) uint64 {
+	if n < 0 {
+		return uint64(-n)
+	}
+	return uint64(n)
+}
+
+// Sign returns -1, 0 or 1 depending on the sign of n.
+func (n Num) Sign() int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Abs returns the absolute value of n.
+func (n Num) Abs() Num {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// String implements fmt.Stringer interface
+func (n Num) String() string {
+	neg := n < 0
+	u := uint64(n)
+	if neg {
+		u = uint64(-n)
+	}
+	frac := u % Scale
+	s := strconv.FormatUint(u/Scale, 10)
+	if frac != 0 {
+		fs := strconv.FormatUint(frac, 10)
+		if frac < 10 {
+			fs = "0" + fs
+		}
+		if fs[len(fs)-1] == '0' {
+			fs = fs[:len(fs)-1]
+		}
+		s += "." + fs
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 depending on whether a is less than, equal to or greater than b.
+func Compare(a, b Num) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,79 @@
+package fixed
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{"0", "1", "0.01", "0.1", "12.34", "-5.5", "99999999.99"} {
+		d := decimal.RequireFromString(s)
+		n, err := FromDecimal(d)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if !n.Decimal().Equal(d) {
+			t.Errorf("%s: got %s", s, n.Decimal())
+		}
+		if n.String() != d.String() {
+			t.Errorf("%s: String() = %s", s, n.String())
+		}
+	}
+}
+
+func TestFromDecimalRounds(t *testing.T) {
+	if got, _ := FromDecimal(decimal.RequireFromString("1.005")); got != 101 {
+		t.Errorf("expected 101, got %d", got)
+	}
+	if got, _ := FromFloat(2.344); got != 234 {
+		t.Errorf("expected 234, got %d", got)
+	}
+}
+
+func TestFromDecimalOverflow(t *testing.T) {
+	max, min := decimal.New(math.MaxInt64, -Places), decimal.New(math.MinInt64, -Places)
+	if n, err := FromDecimal(max); err != nil || n != math.MaxInt64 {
+		t.Errorf("largest Num: got %d, %v", n, err)
+	}
+	if n, err := FromDecimal(min); err != nil || n != math.MinInt64 {
+		t.Errorf("smallest Num: got %d, %v", n, err)
+	}
+	for _, d := range []decimal.Decimal{max.Add(decimal.New(1, -Places)), min.Sub(decimal.New(1, -Places)), decimal.RequireFromString("1e30")} {
+		if n, err := FromDecimal(d); !errors.Is(err, ErrOverflow) {
+			t.Errorf("%s: got %d, %v, want ErrOverflow", d, n, err)
+		}
+	}
+}
+
+func TestMul(t *testing.T) {
+	cases := []struct{ a, b, want string }{
+		{"10", "2.5", "25"},
+		{"0.33", "0.33", "0.11"},
+		{"1.5", "-1.5", "-2.25"},
+		{"0.05", "0.1", "0.01"},
+	}
+	for _, c := range cases {
+		a, _ := FromDecimal(decimal.RequireFromString(c.a))
+		b, _ := FromDecimal(decimal.RequireFromString(c.b))
+		want := decimal.RequireFromString(c.a).Mul(decimal.RequireFromString(c.b)).Round(Places)
+		if got, err := a.Mul(b); err != nil || !got.Decimal().Equal(want) || got.String() != c.want {
+			t.Errorf("%s * %s = %s, %v, want %s", c.a, c.b, got, err, c.want)
+		}
+	}
+}
+
+func TestMulOverflow(t *testing.T) {
+	// The product of the raw values overflows int64 even though the result fits
+	big := FromInt(100_000_000)
+	if got, err := big.Mul(FromInt(-10_000_000)); err != nil || got != FromInt(-1_000_000_000_000_000) {
+		t.Errorf("got %s, %v, want -1000000000000000", got, err)
+	}
+	for _, m := range []Num{FromInt(1_000_000_000_000), FromInt(-1_000_000_000_000), math.MinInt64} {
+		if got, err := big.Mul(m); !errors.Is(err, ErrOverflow) {
+			t.Errorf("%s * %s = %s, %v, want ErrOverflow", big, m, got, err)
+		}
+	}
+}
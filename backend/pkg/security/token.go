@@ -0,0 +1,13 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashToken returns the hex encoded SHA-256 hash of a token, such as a refresh token or a verification token.
+// Tokens are random, so unlike passwords they don't need a slow, salted hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"github/wry-0313/exchange/internal/models"
+	"github/wry-0313/exchange/internal/orderbook"
+	"github/wry-0313/exchange/pkg/fixed"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/shopspring/decimal"
+)
+
+// nopRepository discards every write so that benchmarks only measure the matching engine.
+type nopRepository struct{}
+
+func (nopRepository) CreateStock(stock models.Stock) error { return nil }
+func (nopRepository) GetStock(symbol string) (models.Stock, error) {
+	return models.Stock{Symbol: symbol}, nil
+}
+func (nopRepository) SetStockHalted(symbol string, halted bool) error { return nil }
+func (nopRepository) PersistBatch(batch orderbook.PersistBatch) error { return nil }
+func (nopRepository) GetOrderByClientOrderID(userID, clientOrderID string) (models.Order, error) {
+	return models.Order{}, orderbook.ErrOrderNotExists
+}
+func (nopRepository) GetUserOrder(userID, orderID string) (models.Order, error) {
+	return models.Order{}, orderbook.ErrOrderNotExists
+}
+func (nopRepository) GetUserOrders(userID string, filter orderbook.OrderFilter) ([]models.Order, error) {
+	return nil, nil
+}
+func (nopRepository) GetOrderFills(orderID string) ([]models.OrderFill, error) {
+	return nil, nil
+}
+func (nopRepository) CreateOrUpdateCandles(symbol string, candles []models.StockPriceHistory) error {
+	return nil
+}
+func (nopRepository) GetCandles(symbol string, interval orderbook.Interval, from, to time.Time, limit int) ([]models.StockPriceHistory, error) {
+	return nil, nil
+}
+func (nopRepository) GetCandlePage(symbol string, interval orderbook.Interval, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.StockPriceHistory, error) {
+	return nil, nil
+}
+func (nopRepository) GetTradePage(symbol string, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.Trade, error) {
+	return nil, nil
+}
+func (nopRepository) GetOrderEventPage(symbol string, from, to time.Time, after orderbook.PageCursor, limit int) ([]models.OrderEvent, error) {
+	return nil, nil
+}
+
+// BenchmarkPlaceRestingLimitOrder measures an order that rests on the book without matching.
+func BenchmarkPlaceRestingLimitOrder(b *testing.B) {
+	ob := orderbook.NewService("BNCH", nopRepository{}, nil, "", "")
+	userID := ulid.Make()
+	volume := decimal.NewFromInt(10)
+	prices := make([]decimal.Decimal, 100)
+	for i := range prices {
+		prices[i] = decimal.NewFromInt(int64(i + 1))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ob.PlaceLimitOrder(orderbook.Buy, userID, volume, prices[i%len(prices)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMatchLimitOrders measures a resting sell followed by a buy that fully fills it, so every iteration
+// creates and releases two orders and one list node.
+func BenchmarkMatchLimitOrders(b *testing.B) {
+	ob := orderbook.NewService("BNCH", nopRepository{}, nil, "", "")
+	userID := ulid.Make()
+	volume := decimal.NewFromInt(10)
+	price := decimal.NewFromInt(100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ob.PlaceLimitOrder(orderbook.Sell, userID, volume, price); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ob.PlaceLimitOrder(orderbook.Buy, userID, volume, price); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMatchMarketOrders measures market orders sweeping resting limit orders.
+func BenchmarkMatchMarketOrders(b *testing.B) {
+	ob := orderbook.NewService("BNCH", nopRepository{}, nil, "", "")
+	userID := ulid.Make()
+	volume := decimal.NewFromInt(10)
+	price := decimal.NewFromInt(100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ob.PlaceLimitOrder(orderbook.Sell, userID, volume, price); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ob.PlaceMarketOrder(orderbook.Buy, userID, volume); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPriceArithmeticDecimal and BenchmarkPriceArithmeticFixed compare the per order price work the engine
+// did with decimal.Decimal against the fixed-point representation it uses now.
+func BenchmarkPriceArithmeticDecimal(b *testing.B) {
+	price := decimal.NewFromFloat(101.25)
+	volume := decimal.NewFromFloat(12.5)
+	left := decimal.NewFromInt(1000)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = price.GreaterThanOrEqual(price)
+		left = left.Sub(volume).Add(volume)
+		_ = volume.Mul(price).Round(2)
+		_ = price.String()
+	}
+}
+
+func BenchmarkPriceArithmeticFixed(b *testing.B) {
+	price, _ := fixed.FromFloat(101.25)
+	volume, _ := fixed.FromFloat(12.5)
+	left := fixed.FromInt(1000)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = price >= price
+		left = left - volume + volume
+		_, _ = volume.Mul(price)
+		_ = fixed.Compare(price, left)
+	}
+}
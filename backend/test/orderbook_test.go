@@ -220,7 +220,7 @@ func TestSimulateStockMarketFluctuations(t *testing.T) {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
 	obRepo := orderbook.NewRepository(db.DB)
-	ob := orderbook.NewService("AAPL", obRepo, rdb)
+	ob := orderbook.NewService("AAPL", obRepo, rdb, "", "")
 	var wg sync.WaitGroup
 
 	wg.Add(1)
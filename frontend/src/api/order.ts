@@ -1,4 +1,4 @@
-import { MsgResponse, sendPostRequest } from ".";
+import { sendPostRequest } from ".";
 import { BASE_URL } from "../constants";
 
 export type OrderType = "limit" | "market";
@@ -10,6 +10,23 @@ export type PlaceOrderParams = {
   order_type: OrderType;
   order_side: OrderSide;
   symbol: string;
+  // optional ID, a retried submission with the same ID returns the original order
+  client_order_id?: string;
+}
+
+export type OrderFill = {
+  price: number;
+  volume: number;
+}
+
+export type OrderAck = {
+  order_id: string;
+  client_order_id?: string;
+  duplicate?: boolean;
+  status: string;
+  reject_reason?: string;
+  remaining_volume?: string;
+  fills?: OrderFill[];
 }
 
 export async function placeOrder(
@@ -17,6 +34,6 @@ export async function placeOrder(
   token: string
 )  {
   const url = `http://${BASE_URL}/orders`;
-  return sendPostRequest<MsgResponse>(url, params, token);
+  return sendPostRequest<OrderAck>(url, params, token);
 }
 
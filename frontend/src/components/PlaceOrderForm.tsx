@@ -43,7 +43,7 @@ export default function PlaceOrderForm({ className }: { className?: string }) {
       console.log("Order submitted:", o);
       placeOrder(order(), t)
         .then((res) => {
-          toast.success(res.message);
+          toast.success(`Order ${res.order_id.slice(-4)} ${res.status.toLowerCase()}`);
         })
         .catch((err) => {
           if (err instanceof APIError) {
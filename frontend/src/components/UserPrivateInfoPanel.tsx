@@ -113,7 +113,11 @@ const UserPrivateInfoPanel = () => {
                       : "N/A"}
                   </td>
 
-                  <td>{new Date(order.filled_at_time).toLocaleTimeString()}</td>
+                  <td>
+                    {order.filled_at_time
+                      ? new Date(order.filled_at_time).toLocaleTimeString()
+                      : "N/A"}
+                  </td>
                   <td>{order.volume}</td>
                   <td>{order.initial_volume}</td>
                 </tr>
@@ -50,14 +50,14 @@ const Price: Component = () => {
   ): ApexGraphVolumeData => {
     return [
       {
-        name: "Ask Volume",
+        name: "Sell Volume",
         data: d.map((cd) => ({
           x: cd.recorded_at,
           y: cd.ask_volume,
         })),
       },
       {
-        name: "Bid Volume",
+        name: "Buy Volume",
         data: d.map((cd) => ({
           x: cd.recorded_at,
           y: cd.bid_volume,
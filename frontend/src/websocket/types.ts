@@ -26,7 +26,11 @@ type CandleDataPoint = {
   high: number;
   low: number;
   close: number;
+  interval: string;
   volume: number;
+  trade_count: number;
+  bid_volume: number;
+  ask_volume: number;
 }
 
 type GraphPriceDataPoint = {
@@ -52,11 +56,28 @@ type ApexGraphVolumeData = {
 type SymbolInfo = CandleDataUpdate & {
   symbol: string;
   price: number;
-  ask_volume: number;
-  bid_volume: number;
   best_bid: number;
   best_ask: number;
-  
+  ticker: Ticker;
+};
+
+type Ticker = {
+  symbol: string;
+  last_price: number;
+  last_size: number;
+  best_bid: number;
+  best_ask: number;
+  spread: number;
+  open_24h: number;
+  high_24h: number;
+  low_24h: number;
+  change_24h: number;
+  change_percent_24h: number;
+  volume_24h: number;
+  quote_volume_24h: number;
+  trade_count_24h: number;
+  vwap_24h: number;
+  last_trade_at?: string;
 };
 
 type CandleDataUpdate = CandleDataPoint & {
@@ -108,10 +129,12 @@ type UserPrivateInfo = {
     order_status: string;
     order_type: string;
     filled_at: number;
-    filled_at_time: string;
+    filled_at_time: string | null;
     total_processed: number;
     volume: number;
     initial_volume: number;
     price: number;
+    created_at: string;
+    updated_at: string;
   }[];
 }
\ No newline at end of file